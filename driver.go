@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/patrickmn/go-cache"
 )
 
 var (
@@ -18,11 +25,17 @@ var (
 	db              = NewDatabase("db.json")
 	processedAlerts = db.GetProcessedAlerts()
 	maxWazersOnline = db.GetMaxWazersOnline()
+	// Mesmo cache e TTLs do modo servidor (waze.go), para que os dois modos
+	// consultem o Waze na mesma frequência.
+	c = cache.New(5*time.Minute, 10*time.Minute)
 
 	options = struct {
 		areaBounds       map[string]float64
 		requestURL       string
 		broadcastFeedURL string
+		// proxyURL vazio usa HTTP_PROXY/HTTPS_PROXY do ambiente.
+		proxyURL  string
+		userAgent string
 	}{
 		areaBounds: map[string]float64{
 			"left":   -49.640,
@@ -32,12 +45,23 @@ var (
 		},
 		requestURL:       "https://www.waze.com/row-rtserver/web/TGeoRSS?tk=community&format=JSON",
 		broadcastFeedURL: "https://www.waze.com/row-rtserver/broadcast/BroadcastRSS?buid=xxxxxxxxxxxxxxxxxxxxxxx&format=JSON",
+		userAgent:        "InformaWaze/console",
 	}
 
+	// httpClient é criado em main com o proxy de options, como no modo
+	// servidor.
+	httpClient = http.DefaultClient
+
 	wg sync.WaitGroup
 )
 
 func main() {
+	client, err := newHTTPClient(options.proxyURL)
+	if err != nil {
+		log.Fatalf("Proxy inválido %q: %v", options.proxyURL, err)
+	}
+	httpClient = client
+
 	wg.Add(1)
 	go scheduleJob("*/30 * * * * *", getUpdates)
 	go scheduleJob("*/20 * * * * *", countWazers)
@@ -64,9 +88,19 @@ func scheduleJob(cron string, job func()) {
 func getUpdates() {
 	logger("getting updates")
 
-	url := addBoundsToURL(options.areaBounds, options.requestURL)
+	// Verifica se os dados estão no cache
+	if data, found := c.Get("wazeData"); found {
+		processAlerts(data.([]interface{}))
+		return
+	}
+
+	url, err := addBoundsToURL(options.areaBounds, options.requestURL)
+	if err != nil {
+		logger("ERROR: invalid request URL")
+		return
+	}
 
-	resp, err := http.Get(url)
+	resp, err := wazeGet(url)
 	if err != nil {
 		logger("ERROR: can't get updates")
 		return
@@ -84,6 +118,9 @@ func getUpdates() {
 		return
 	}
 
+	// Adiciona os dados ao cache
+	c.Set("wazeData", data["alerts"].([]interface{}), cache.DefaultExpiration)
+
 	processAlerts(data["alerts"].([]interface{}))
 }
 
@@ -162,50 +199,90 @@ func handleUnknownAlert(alert map[string]interface{}) {
 func countWazers() {
 	logger("counting wazers")
 
-	resp, err := http.Get(options.broadcastFeedURL)
-	if err != nil {
-		logger("ERROR: can't count wazers")
-		return
-	}
-	defer resp.Body.Close()
+	var usersOnJams []interface{}
 
-	var data map[string]interface{}
-	err = json.NewDecoder(resp.Body).Decode(&data)
-	if err != nil {
-		logger("ERROR: can't decode response")
-		return
+	// Verifica se os dados estão no cache
+	if data, found := c.Get("broadcastData"); found {
+		usersOnJams = data.([]interface{})
+	} else {
+		resp, err := wazeGet(options.broadcastFeedURL)
+		if err != nil {
+			logger("ERROR: can't count wazers")
+			return
+		}
+		defer resp.Body.Close()
+
+		var data map[string]interface{}
+		err = json.NewDecoder(resp.Body).Decode(&data)
+		if err != nil {
+			logger("ERROR: can't decode response")
+			return
+		}
+
+		usersOnJams = data["usersOnJams"].([]interface{})
+		c.Set("broadcastData", usersOnJams, 1*time.Minute)
 	}
 
-	usersOnJams := data["usersOnJams"].([]interface{})
 	actualWazersOnline := 0
 	for _, jam := range usersOnJams {
 		wazersCount := jam.(map[string]interface{})["wazersCount"].(float64)
 		actualWazersOnline += int(wazersCount)
 	}
 
-	if actualWazersOnline > maxWazersOnline.Get() {
-		maxWazersOnline.Set(actualWazersOnline)
+	maxWazersOnline.SetIfGreater(actualWazersOnline)
+}
+
+// newHTTPClient cria o cliente usado nas requisições ao Waze. Um proxyURL
+// explícito tem prioridade sobre HTTP_PROXY/HTTPS_PROXY do ambiente.
+func newHTTPClient(proxyURL string) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(u)
 	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	return &http.Client{Transport: transport}, nil
+}
+
+// wazeGet faz um GET aos feeds do Waze pelo httpClient, com o User-Agent de
+// options.
+func wazeGet(targetURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, targetURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", options.userAgent)
+	return httpClient.Do(req)
 }
 
 func sendWazersReport() {
-	maxWazers := maxWazersOnline.Get()
+	maxWazers := maxWazersOnline.GetAndReset()
 	if maxWazers > 0 {
 		message := fmt.Sprintf("%d wazers conectados 🚙 🚕 🚚", maxWazers)
 		sendMessage(message)
-		maxWazersOnline.Set(0)
 	}
 }
 
-func addBoundsToURL(bounds map[string]float64, sourceURL string) string {
-	var sb strings.Builder
-	sb.WriteString(sourceURL)
+// addBoundsToURL adiciona os limites da área à query de sourceURL. As chaves
+// saem em ordem alfabética, então a URL é estável entre chamadas.
+func addBoundsToURL(bounds map[string]float64, sourceURL string) (string, error) {
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		return "", err
+	}
 
+	query := u.Query()
 	for key, val := range bounds {
-		sb.WriteString(fmt.Sprintf("&%s=%.4f", key, val))
+		query.Set(key, strconv.FormatFloat(val, 'f', 4, 64))
 	}
+	u.RawQuery = query.Encode()
 
-	return sb.String()
+	return u.String(), nil
 }
 
 func sendMessage(text string) {
@@ -252,19 +329,42 @@ func (db *Database) load() {
 	}
 }
 
+// save grava em um arquivo temporário no mesmo diretório e o renomeia sobre
+// o original, então uma falha no meio da escrita preserva o último db válido.
 func (db *Database) save() {
-	file, err := os.Create(db.filename)
+	file, err := os.CreateTemp(filepath.Dir(db.filename), filepath.Base(db.filename)+".tmp-*")
 	if err != nil {
 		log.Println("ERROR: can't create database file")
 		return
 	}
-	defer file.Close()
+	defer os.Remove(file.Name())
 
 	err = json.NewEncoder(file).Encode(&db.data)
 	if err != nil {
+		file.Close()
 		log.Println("ERROR: can't encode database file")
 		return
 	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		log.Println("ERROR: can't sync database file")
+		return
+	}
+	if err := file.Close(); err != nil {
+		log.Println("ERROR: can't close database file")
+		return
+	}
+
+	if err := os.Rename(file.Name(), db.filename); err != nil {
+		log.Println("ERROR: can't replace database file")
+		return
+	}
+
+	if dir, err := os.Open(filepath.Dir(db.filename)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
 }
 
 func (db *Database) GetProcessedAlerts() *Set {
@@ -336,17 +436,55 @@ func (s *Set) Has(item string) bool {
 	return ok
 }
 
+func (s *Set) AddAll(items []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, item := range items {
+		s.data[item] = struct{}{}
+	}
+}
+
+// Slice retorna os itens ordenados; um conjunto vazio resulta em []string{},
+// nunca nil, para serializar como [] em JSON.
 func (s *Set) Slice() []string {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	var items []string
+	items := make([]string, 0, len(s.data))
 	for item := range s.data {
 		items = append(items, item)
 	}
+	sort.Strings(items)
 	return items
 }
 
+// Union, Intersect e Diff trabalham sobre uma cópia de other, então nunca
+// seguram os dois locks ao mesmo tempo.
+func (s *Set) Union(other *Set) *Set {
+	result := NewSet(s.Slice())
+	result.AddAll(other.Slice())
+	return result
+}
+
+func (s *Set) Intersect(other *Set) *Set {
+	result := NewSet(nil)
+	for _, item := range other.Slice() {
+		if s.Has(item) {
+			result.Add(item)
+		}
+	}
+	return result
+}
+
+func (s *Set) Diff(other *Set) *Set {
+	result := NewSet(s.Slice())
+	for _, item := range other.Slice() {
+		result.Remove(item)
+	}
+	return result
+}
+
 type Counter struct {
 	count int
 	mu    sync.Mutex
@@ -369,3 +507,38 @@ func (c *Counter) Set(count int) {
 
 	c.count = count
 }
+
+func (c *Counter) Add(delta int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.count += delta
+	return c.count
+}
+
+// GetAndReset lê e zera o contador em uma única operação.
+func (c *Counter) GetAndReset() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count := c.count
+	c.count = 0
+	return count
+}
+
+func (c *Counter) Inc() int {
+	return c.Add(1)
+}
+
+// SetIfGreater atualiza o contador apenas se n for maior que o valor atual,
+// informando se houve atualização.
+func (c *Counter) SetIfGreater(n int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if n <= c.count {
+		return false
+	}
+	c.count = n
+	return true
+}
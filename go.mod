@@ -2,6 +2,8 @@ module selenium-scraper
 
 go 1.22.2
 
+require github.com/patrickmn/go-cache v2.1.0+incompatible
+
 require (
 	github.com/blang/semver v3.5.1+incompatible // indirect
 	github.com/evzpav/telegram-go v0.0.0-20200524173333-3fceb76ec226 // indirect
@@ -0,0 +1,1266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// recordingNotifier guarda o que seria enviado aos destinos.
+type recordingNotifier struct {
+	mu     sync.Mutex
+	alerts []string
+	texts  []string
+}
+
+func (n *recordingNotifier) Name() string { return "recording" }
+
+func (n *recordingNotifier) SendAlert(alert map[string]interface{}, message string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.alerts = append(n.alerts, message)
+	return nil
+}
+
+func (n *recordingNotifier) SendText(text string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.texts = append(n.texts, text)
+	return nil
+}
+
+// fakeWaze serve respostas fixas nos caminhos do TGeoRSS e do BroadcastRSS.
+func fakeWaze(t *testing.T, alerts, broadcast string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/row-rtserver/web/TGeoRSS":
+			fmt.Fprint(w, alerts)
+		case "/row-rtserver/broadcast/BroadcastRSS":
+			fmt.Fprint(w, broadcast)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// withPipeline isola o estado global usado por getUpdates/countWazers e
+// aponta os feeds para server.
+func withPipeline(t *testing.T, server *httptest.Server, notifier Notifier) {
+	t.Helper()
+	inTempDir(t)
+
+	previousLive := liveConfig.Get()
+	previousNotifiers, previousFilters := notifiers, filters
+	previousCache, previousCh, previousMessages := c, alertsCh, messagesCh
+	previousProcessed, previousMax, previousOnline := processedAlerts, maxWazersOnline, wazersOnline
+	previousAlertsBreaker, previousBroadcastBreaker := alertsBreaker, broadcastBreaker
+	previousDedupTTL, previousDB := options.dedupTTL, db
+	previousReport, previousPeak, previousPeakAt := lastWazersReport, previousWazersPeak, maxWazersOnlineAt
+	previousSpeeds, previousSuppressions, previousDailyPeak := jamSpeeds, suppressions, dailyWazersPeak
+	t.Cleanup(func() {
+		liveConfig.Set(previousLive)
+		notifiers, filters = previousNotifiers, previousFilters
+		c, alertsCh, messagesCh = previousCache, previousCh, previousMessages
+		processedAlerts, maxWazersOnline, wazersOnline = previousProcessed, previousMax, previousOnline
+		alertsBreaker, broadcastBreaker = previousAlertsBreaker, previousBroadcastBreaker
+		options.dedupTTL, db = previousDedupTTL, previousDB
+		lastWazersReport, previousWazersPeak, maxWazersOnlineAt = previousReport, previousPeak, previousPeakAt
+		jamSpeeds, suppressions, dailyWazersPeak = previousSpeeds, previousSuppressions, previousDailyPeak
+	})
+
+	live := defaultLiveConfig()
+	live.RequestURL = server.URL + "/row-rtserver/web/TGeoRSS?tk=community&format=JSON"
+	live.BroadcastFeedURL = server.URL + "/row-rtserver/broadcast/BroadcastRSS?buid=teste&format=JSON"
+	liveConfig.Set(live)
+	withHTTPClient(t, server.Client().Transport)
+
+	notifiers = []Notifier{notifier}
+	filters = &Filters{Jam: true, Accident: true}
+	c = cache.New(time.Minute, time.Minute)
+	alertsCh = make(chan map[string]interface{}, 10)
+	messagesCh = make(chan string, 10)
+	db = NewDatabase("db.json")
+	processedAlerts = NewSet(nil)
+	maxWazersOnline = NewCounter(0)
+	wazersOnline = NewCounter(0)
+	dailyWazersPeak = &DailyPeak{}
+	lastWazersReport, previousWazersPeak, maxWazersOnlineAt = clock.Now().Add(-time.Hour), 0, time.Time{}
+	jamSpeeds = &Average{}
+	suppressions = NewStatsCounter(time.Hour)
+	alertsBreaker = NewCircuitBreaker("alerts", 5, time.Minute)
+	broadcastBreaker = NewCircuitBreaker("broadcast", 5, time.Minute)
+	options.dedupTTL = map[string]time.Duration{"ACCIDENT": time.Hour}
+}
+
+// drainAlerts faz o papel do laço de main para o que já está na fila.
+func drainAlerts() {
+	for len(alertsCh) > 0 {
+		publishAlert(<-alertsCh)
+	}
+	for len(messagesCh) > 0 {
+		sendMessage(<-messagesCh)
+	}
+}
+
+func TestPollCycle(t *testing.T) {
+	now := time.Date(2024, 3, 11, 8, 0, 0, 0, time.Local)
+	withClock(t, newFakeClock(now))
+
+	pub := now.Add(-5 * time.Minute).UnixMilli()
+	old := now.Add(-2 * time.Hour).UnixMilli()
+	alerts := fmt.Sprintf(`{"alerts": [
+		{"uuid": "jam-1", "type": "JAM", "street": "SC-401", "pubMillis": %d, "location": {"x": -48.5, "y": -27.6}},
+		{"uuid": "acc-1", "type": "ACCIDENT", "street": "BR-101", "pubMillis": %d, "location": {"x": -48.6, "y": -27.5}},
+		{"uuid": "acc-2", "type": "ACCIDENT", "street": "BR-101", "pubMillis": %d, "location": {"x": -48.6, "y": -27.5}},
+		{"uuid": "old-1", "type": "JAM", "street": "SC-405", "pubMillis": %d, "location": {"x": -48.5, "y": -27.7}}
+	]}`, pub, pub, pub, old)
+	broadcast := `{"usersOnJams": [{"wazersCount": 7}, {"wazersCount": 5}]}`
+
+	notifier := &recordingNotifier{}
+	withPipeline(t, fakeWaze(t, alerts, broadcast), notifier)
+
+	getUpdates()
+	drainAlerts()
+	countWazers()
+	sendWazersReport()
+
+	if len(notifier.alerts) != 2 {
+		t.Fatalf("alerts sent = %d, want 2: %q", len(notifier.alerts), notifier.alerts)
+	}
+	if !strings.Contains(notifier.alerts[0], "Congestionamento") || !strings.Contains(notifier.alerts[1], "Acidente") {
+		t.Errorf("unexpected messages: %q", notifier.alerts)
+	}
+	if !strings.Contains(notifier.alerts[1], "severity: 70") {
+		t.Errorf("severity missing from message: %q", notifier.alerts[1])
+	}
+	if len(notifier.texts) != 1 || notifier.texts[0] != "12 wazers conectados 🚙 🚕 🚚\n🕐 07:00–08:00, pico às 08:00" {
+		t.Errorf("texts = %q", notifier.texts)
+	}
+
+	// O acidente repetido e o congestionamento antigo também ficam gravados,
+	// para não serem reavaliados após um reinício.
+	saved := NewDatabase("db.json").GetProcessedAlerts()
+	for _, alertID := range []string{"jam-1", "acc-1", "acc-2", "old-1"} {
+		if !saved.Has(alertID) {
+			t.Errorf("%s not persisted", alertID)
+		}
+	}
+
+	// Um novo ciclo com o mesmo feed (vindo do cache) não reenvia nada.
+	getUpdates()
+	drainAlerts()
+	if len(notifier.alerts) != 2 {
+		t.Errorf("alerts sent after second poll = %d, want 2", len(notifier.alerts))
+	}
+}
+
+func TestConcurrentPollsShareOneRequest(t *testing.T) {
+	now := time.Date(2024, 3, 11, 8, 0, 0, 0, time.Local)
+	withClock(t, newFakeClock(now))
+
+	pub := now.Add(-5 * time.Minute).UnixMilli()
+	feed := fmt.Sprintf(`{"alerts": [
+		{"uuid": "acc-1", "type": "ACCIDENT", "street": "BR-101", "pubMillis": %d, "location": {"x": -48.6, "y": -27.5}}
+	]}`, pub)
+
+	var mu sync.Mutex
+	requests := 0
+	started, release := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		first := requests == 1
+		mu.Unlock()
+		if first {
+			close(started)
+		}
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, feed)
+	}))
+	t.Cleanup(server.Close)
+
+	notifier := &recordingNotifier{}
+	withPipeline(t, server, notifier)
+
+	const callers = 5
+	var wg sync.WaitGroup
+	wg.Add(callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			defer wg.Done()
+			getUpdates()
+		}()
+	}
+
+	// Segura a resposta para os outros chegarem com ela em andamento. Quem
+	// se atrasar encontra o cache preenchido, então também não consulta.
+	<-started
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	drainAlerts()
+
+	if requests != 1 {
+		t.Errorf("requests = %d, want 1", requests)
+	}
+	if len(notifier.alerts) != 1 {
+		t.Errorf("alerts sent = %d, want 1: %q", len(notifier.alerts), notifier.alerts)
+	}
+}
+
+func TestWazersReportWithJamSpeed(t *testing.T) {
+	now := time.Date(2024, 3, 11, 8, 0, 0, 0, time.Local)
+	withClock(t, newFakeClock(now))
+
+	// Um em km/h, um em m/s (5 m/s = 18 km/h) e um sem velocidade.
+	broadcast := `{"usersOnJams": [
+		{"wazersCount": 4, "speedKMH": 12},
+		{"wazersCount": 3, "speed": 5, "line": [{"x": -48.5, "y": -27.6}]},
+		{"wazersCount": 2}
+	]}`
+	notifier := &recordingNotifier{}
+	withPipeline(t, fakeWaze(t, `{"alerts": []}`, broadcast), notifier)
+
+	countWazers()
+	sendWazersReport()
+
+	want := "9 wazers conectados 🚙 🚕 🚚\n🕐 07:00–08:00, pico às 08:00\n🏎️ velocidade média 15 km/h nos congestionamentos"
+	if len(notifier.texts) != 1 || notifier.texts[0] != want {
+		t.Errorf("texts = %q", notifier.texts)
+	}
+	if _, ok := jamSpeeds.GetAndReset(); ok {
+		t.Error("speeds not reset after the report")
+	}
+}
+
+func TestPollCycleWithJams(t *testing.T) {
+	now := time.Date(2024, 3, 11, 8, 0, 0, 0, time.Local)
+	withClock(t, newFakeClock(now))
+	previous := options.consumeJams
+	t.Cleanup(func() { options.consumeJams = previous })
+	options.consumeJams = true
+
+	pub := now.Add(-5 * time.Minute).UnixMilli()
+	jams := fmt.Sprintf(`"jams": [
+		{"uuid": 1234, "street": "Via Expressa", "pubMillis": %d, "delay": 250, "length": 850, "speedKMH": 8.5,
+		 "line": [{"x": -48.6, "y": -27.59}, {"x": -48.61, "y": -27.6}]},
+		{"street": "sem id", "delay": 60, "length": 100}
+	]`, pub)
+
+	// Sem a chave "alerts", o feed só com congestionamentos vale do mesmo
+	// jeito.
+	for name, alerts := range map[string]string{"with alerts": `{"alerts": [], ` + jams + `}`, "jams only": `{` + jams + `}`} {
+		t.Run(name, func(t *testing.T) {
+			notifier := &recordingNotifier{}
+			withPipeline(t, fakeWaze(t, alerts, `{"usersOnJams": []}`), notifier)
+
+			getUpdates()
+			drainAlerts()
+
+			if len(notifier.alerts) != 1 {
+				t.Fatalf("alerts sent = %d, want 1: %q", len(notifier.alerts), notifier.alerts)
+			}
+			if !strings.Contains(notifier.alerts[0], "⏳ 4 min de atraso em 850 m") {
+				t.Errorf("message = %q", notifier.alerts[0])
+			}
+			if !processedAlerts.Has("jam-1234") {
+				t.Error("jam uuid not marked as processed")
+			}
+			if state := alertsBreaker.State(); state != breakerClosed {
+				t.Errorf("breaker = %s, want %s", state, breakerClosed)
+			}
+		})
+	}
+
+	if got := jamAlerts(nil); len(got) != 0 {
+		t.Errorf("jamAlerts(nil) = %v", got)
+	}
+}
+
+func TestPollCycleDedupsJamsAcrossSources(t *testing.T) {
+	now := time.Date(2024, 3, 11, 8, 0, 0, 0, time.Local)
+	pub := now.Add(-5 * time.Minute).UnixMilli()
+	// O mesmo congestionamento na Via Expressa vem nas duas listas, com grafia
+	// e ponto um pouco diferentes; o da SC-401 só vem em "alerts".
+	feed := fmt.Sprintf(`{"alerts": [
+		{"uuid": "jam-a", "type": "JAM", "street": "Via Expressa", "pubMillis": %d, "location": {"x": -48.6001, "y": -27.5901}},
+		{"uuid": "jam-b", "type": "JAM", "street": "SC-401", "pubMillis": %d, "location": {"x": -48.5, "y": -27.6}}
+	], "jams": [
+		{"uuid": 1234, "street": "VIA EXPRESSA", "pubMillis": %d, "delay": 250, "length": 850,
+		 "line": [{"x": -48.6, "y": -27.59}, {"x": -48.61, "y": -27.6}]}
+	]}`, pub, pub, pub)
+
+	previousOptions := options
+	t.Cleanup(func() { options = previousOptions })
+
+	for _, tc := range []struct {
+		prefer string
+		want   []string
+	}{
+		{jamSourceJams, []string{"⏳ 4 min de atraso em 850 m", "SC-401"}},
+		{jamSourceAlerts, []string{"Via Expressa", "SC-401"}},
+		{"off", []string{"Via Expressa", "SC-401", "⏳ 4 min de atraso em 850 m"}},
+	} {
+		t.Run(tc.prefer, func(t *testing.T) {
+			withClock(t, newFakeClock(now))
+			options.consumeJams, options.jamDedup, options.jamDedupBucket = true, tc.prefer, 300
+
+			notifier := &recordingNotifier{}
+			withPipeline(t, fakeWaze(t, feed, `{"usersOnJams": []}`), notifier)
+			getUpdates()
+			drainAlerts()
+
+			if len(notifier.alerts) != len(tc.want) {
+				t.Fatalf("alerts sent = %d, want %d: %q", len(notifier.alerts), len(tc.want), notifier.alerts)
+			}
+			for i, want := range tc.want {
+				if !strings.Contains(notifier.alerts[i], want) {
+					t.Errorf("alert %d = %q, want %q", i, notifier.alerts[i], want)
+				}
+			}
+			// O descartado fica como processado e não volta no próximo ciclo.
+			if !processedAlerts.Has("jam-a") || !processedAlerts.Has("jam-1234") {
+				t.Error("jams not marked as processed")
+			}
+		})
+	}
+
+	// Um congestionamento que os filtros descartam não esconde o mesmo
+	// trecho vindo da outra fonte: o de "jams" tem nível 1, abaixo do
+	// mínimo, e o de "alerts", sem nível, é enviado.
+	t.Run("filtered", func(t *testing.T) {
+		withClock(t, newFakeClock(now))
+		options.consumeJams, options.jamDedup, options.jamDedupBucket = true, jamSourceJams, 300
+		feed := fmt.Sprintf(`{"alerts": [
+			{"uuid": "jam-a", "type": "JAM", "street": "Via Expressa", "pubMillis": %d, "location": {"x": -48.6001, "y": -27.5901}}
+		], "jams": [
+			{"uuid": 1234, "street": "VIA EXPRESSA", "pubMillis": %d, "level": 1, "delay": 250, "length": 850,
+			 "line": [{"x": -48.6, "y": -27.59}, {"x": -48.61, "y": -27.6}]}
+		]}`, pub, pub)
+
+		notifier := &recordingNotifier{}
+		withPipeline(t, fakeWaze(t, feed, `{"usersOnJams": []}`), notifier)
+		filters = &Filters{Jam: true, MinJamLevel: 3}
+		getUpdates()
+		drainAlerts()
+
+		if len(notifier.alerts) != 1 || !strings.Contains(notifier.alerts[0], "Via Expressa") {
+			t.Errorf("alerts sent = %q, want the one from \"alerts\"", notifier.alerts)
+		}
+	})
+}
+
+func TestPollCycleDropsSmallJams(t *testing.T) {
+	now := time.Date(2024, 3, 11, 8, 0, 0, 0, time.Local)
+	pub := now.Add(-5 * time.Minute).UnixMilli()
+	feed := fmt.Sprintf(`{"alerts": [
+		{"uuid": "sem-dados", "type": "JAM", "street": "SC-405", "pubMillis": %d, "location": {"x": -48.5, "y": -27.7}}
+	], "jams": [
+		{"uuid": 1, "street": "Curta", "pubMillis": %d, "delay": 300, "length": 50, "line": [{"x": -48.1, "y": -27.1}]},
+		{"uuid": 2, "street": "Rápida", "pubMillis": %d, "delay": 30, "length": 900, "line": [{"x": -48.2, "y": -27.2}]},
+		{"uuid": 3, "street": "Longa", "pubMillis": %d, "delay": 300, "length": 900, "line": [{"x": -48.3, "y": -27.3}]},
+		{"uuid": 4, "street": "Bloqueada", "pubMillis": %d, "delay": -1, "length": 40, "level": 5, "line": [{"x": -48.4, "y": -27.4}]}
+	]}`, pub, pub, pub, pub, pub)
+
+	previousOptions := options
+	t.Cleanup(func() { options = previousOptions })
+
+	for _, tc := range []struct {
+		dropWithoutData bool
+		want            []string
+	}{
+		{false, []string{"Longa", "Bloqueada", "SC-405"}},
+		{true, []string{"Longa", "Bloqueada"}},
+	} {
+		t.Run(fmt.Sprint(tc.dropWithoutData), func(t *testing.T) {
+			withClock(t, newFakeClock(now))
+			options.consumeJams, options.jamDedup = true, jamSourceJams
+			options.minJamLength, options.minJamDelay, options.dropJamsWithoutData = 200, 120, tc.dropWithoutData
+
+			notifier := &recordingNotifier{}
+			withPipeline(t, fakeWaze(t, feed, `{"usersOnJams": []}`), notifier)
+			getUpdates()
+			drainAlerts()
+
+			if len(notifier.alerts) != len(tc.want) {
+				t.Fatalf("alerts sent = %d, want %d: %q", len(notifier.alerts), len(tc.want), notifier.alerts)
+			}
+			for i, want := range tc.want {
+				if !strings.Contains(notifier.alerts[i], want) {
+					t.Errorf("alert %d = %q, want %q", i, notifier.alerts[i], want)
+				}
+			}
+			// Os pequenos ficam de fora para serem reavaliados se crescerem.
+			if processedAlerts.Has("jam-1") || processedAlerts.Has("jam-2") {
+				t.Error("small jams marked as processed")
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	handleStats(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if !strings.Contains(rec.Body.String(), `"jamThresholds":{"dropWithoutData":true,"minDelaySeconds":120,"minLengthMeters":200}`) {
+		t.Errorf("/stats = %s", rec.Body.String())
+	}
+}
+
+func TestPollCycleSkipsUnchangedFeed(t *testing.T) {
+	now := time.Date(2024, 3, 11, 8, 0, 0, 0, time.Local)
+	withClock(t, newFakeClock(now))
+
+	feed := fmt.Sprintf(`{"alerts": [
+		{"uuid": "acc-1", "type": "ACCIDENT", "street": "BR-101", "pubMillis": %d, "location": {"x": -48.6, "y": -27.5}}
+	]}`, now.Add(-time.Minute).UnixMilli())
+	const etag, lastModified = `"v1"`, "Mon, 11 Mar 2024 10:59:00 GMT"
+
+	var requests []http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Header.Clone())
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", lastModified)
+		fmt.Fprint(w, feed)
+	}))
+	t.Cleanup(server.Close)
+
+	notifier := &recordingNotifier{}
+	withPipeline(t, server, notifier)
+	t.Cleanup(func() {
+		urlValidatorsLock.Lock()
+		urlValidators = make(map[string]validators)
+		urlValidatorsLock.Unlock()
+	})
+
+	getUpdates()
+	drainAlerts()
+	// Com o cache vencido, a segunda consulta leva os validadores e o 304
+	// não reprocessa nem reenvia nada.
+	c.Delete("wazeData")
+	getUpdates()
+	drainAlerts()
+
+	if len(requests) != 2 {
+		t.Fatalf("requests = %d, want 2", len(requests))
+	}
+	if requests[0].Get("If-None-Match") != "" || requests[0].Get("If-Modified-Since") != "" {
+		t.Errorf("first request sent validators: %v", requests[0])
+	}
+	if requests[1].Get("If-None-Match") != etag || requests[1].Get("If-Modified-Since") != lastModified {
+		t.Errorf("second request headers = %v", requests[1])
+	}
+	if len(notifier.alerts) != 1 {
+		t.Errorf("alerts sent = %d, want 1", len(notifier.alerts))
+	}
+	if _, found := c.Get("wazeData"); found {
+		t.Error("304 response was cached")
+	}
+	if state := alertsBreaker.State(); state != breakerClosed {
+		t.Errorf("breaker = %s after 304, want %s", state, breakerClosed)
+	}
+}
+
+func TestCountWazersWithUnchangedFeed(t *testing.T) {
+	withClock(t, newFakeClock(time.Date(2024, 3, 11, 8, 0, 0, 0, time.Local)))
+
+	const etag = `"v1"`
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", etag)
+		fmt.Fprint(w, `{"usersOnJams": [{"wazersCount": 120}, {"wazersCount": 30}]}`)
+	}))
+	t.Cleanup(server.Close)
+
+	withPipeline(t, server, &recordingNotifier{})
+	t.Cleanup(func() {
+		urlValidatorsLock.Lock()
+		urlValidators = make(map[string]validators)
+		urlValidatorsLock.Unlock()
+		lastUsersOnJamsLock.Lock()
+		lastUsersOnJams = make(map[string][]interface{})
+		lastUsersOnJamsLock.Unlock()
+	})
+
+	countWazers()
+	// O relatório de hora em hora zera o máximo; com o feed parado, o 304
+	// ainda precisa repor a contagem.
+	maxWazersOnline.GetAndReset()
+	wazersOnline.Set(0)
+	c.Delete("broadcastData")
+	countWazers()
+
+	if requests != 2 {
+		t.Fatalf("requests = %d, want 2", requests)
+	}
+	if got := maxWazersOnline.Get(); got != 150 {
+		t.Errorf("maxWazersOnline = %d after 304, want 150", got)
+	}
+	if got := wazersOnline.Get(); got != 150 {
+		t.Errorf("wazersOnline = %d after 304, want 150", got)
+	}
+}
+
+func TestPollCycleWithHTMLErrorPage(t *testing.T) {
+	withClock(t, newFakeClock(time.Date(2024, 3, 11, 8, 0, 0, 0, time.Local)))
+
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("ETag", `"erro"`)
+		fmt.Fprint(w, "<html>\n  <body>Too many requests, please slow down</body>\n</html>")
+	}))
+	t.Cleanup(server.Close)
+
+	notifier := &recordingNotifier{}
+	withPipeline(t, server, notifier)
+	alertsBreaker = NewCircuitBreaker("alerts", 2, time.Minute)
+
+	getUpdates()
+	countWazers()
+	if len(notifier.alerts) != 0 || maxWazersOnline.Get() != 0 {
+		t.Fatalf("alerts = %q, wazers = %d", notifier.alerts, maxWazersOnline.Get())
+	}
+	if _, found := c.Get("wazeData"); found {
+		t.Error("error page was cached")
+	}
+
+	// A página de erro conta como falha: na segunda, o circuito abre e a
+	// terceira consulta nem chega ao servidor.
+	getUpdates()
+	if state := alertsBreaker.State(); state != breakerOpen {
+		t.Errorf("breaker = %s, want %s", state, breakerOpen)
+	}
+	getUpdates()
+	if requests != 3 {
+		t.Errorf("requests = %d, want 3", requests)
+	}
+
+	resp := &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/html"}},
+		Body:       io.NopCloser(strings.NewReader("<html>\n  <body>Too many requests</body>\n</html>")),
+	}
+	err := checkJSONResponse(resp)
+	if err == nil || !strings.Contains(err.Error(), `"<html> <body>Too many requests</body> </html>"`) {
+		t.Errorf("checkJSONResponse = %v", err)
+	}
+}
+
+func TestPollCycleWithUnexpectedShape(t *testing.T) {
+	withClock(t, newFakeClock(time.Date(2024, 3, 11, 8, 0, 0, 0, time.Local)))
+
+	for _, body := range []string{`{"alerts": null, "usersOnJams": null}`, `{}`} {
+		t.Run(body, func(t *testing.T) {
+			notifier := &recordingNotifier{}
+			withPipeline(t, fakeWaze(t, body, body), notifier)
+			alertsBreaker = NewCircuitBreaker("alerts", 1, time.Minute)
+			broadcastBreaker = NewCircuitBreaker("broadcast", 1, time.Minute)
+
+			getUpdates()
+			countWazers()
+			drainAlerts()
+
+			if len(notifier.alerts) != 0 || maxWazersOnline.Get() != 0 {
+				t.Errorf("alerts = %q, wazers = %d", notifier.alerts, maxWazersOnline.Get())
+			}
+			if _, found := c.Get("wazeData"); found {
+				t.Error("alerts were cached")
+			}
+			if _, found := c.Get("broadcastData"); found {
+				t.Error("broadcast was cached")
+			}
+			for _, breaker := range []*CircuitBreaker{alertsBreaker, broadcastBreaker} {
+				if state := breaker.State(); state != breakerOpen {
+					t.Errorf("%s breaker = %s, want %s", breaker.name, state, breakerOpen)
+				}
+			}
+		})
+	}
+}
+
+// failingNotifier recusa todas as mensagens.
+type failingNotifier struct{}
+
+func (failingNotifier) Name() string { return "falho" }
+
+func (failingNotifier) SendAlert(map[string]interface{}, string) error {
+	return fmt.Errorf("token inválido")
+}
+
+func (failingNotifier) SendText(string) error { return fmt.Errorf("token inválido") }
+
+func TestRunCheck(t *testing.T) {
+	alerts := `{"alerts": [{"uuid": "a"}, {"uuid": "b"}], "jams": [{"uuid": 1}]}`
+	notifier := &recordingNotifier{}
+	withPipeline(t, fakeWaze(t, alerts, `{"usersOnJams": [{"wazersCount": 7}, {"wazersCount": 5}]}`), notifier)
+
+	var out strings.Builder
+	if code := runCheck(&out); code != 0 {
+		t.Fatalf("code = %d, output:\n%s", code, out.String())
+	}
+	for _, want := range []string{
+		"✔ feed de alertas: 2 alertas, 1 congestionamentos",
+		"✔ feed de broadcast: 12 wazers",
+		"✔ destino recording: mensagem de teste enviada",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, out.String())
+		}
+	}
+	if len(notifier.texts) != 1 {
+		t.Errorf("test messages = %q", notifier.texts)
+	}
+
+	// Um destino com erro ou um feed fora do ar fazem o check falhar.
+	notifiers = append(notifiers, failingNotifier{})
+	live := *liveConfig.Get()
+	live.BroadcastFeedURL = live.RequestURL[:strings.Index(live.RequestURL, "/row-rtserver")] + "/fora-do-ar"
+	liveConfig.Set(&live)
+
+	out.Reset()
+	if code := runCheck(&out); code != 1 {
+		t.Errorf("code = %d, want 1", code)
+	}
+	for _, want := range []string{"✘ feed de broadcast: resposta inesperada: 404", "✘ destino falho: token inválido"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestReannouncementGoesThroughQueue(t *testing.T) {
+	now := time.Date(2024, 3, 11, 8, 0, 0, 0, time.Local)
+	fake := newFakeClock(now)
+	withClock(t, fake)
+
+	feed := fmt.Sprintf(`{"alerts": [
+		{"uuid": "acc-1", "type": "ACCIDENT", "street": "BR-101", "pubMillis": %d, "location": {"x": -48.6, "y": -27.5}}
+	]}`, now.Add(-time.Minute).UnixMilli())
+	const etag = `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", etag)
+		fmt.Fprint(w, feed)
+	}))
+	t.Cleanup(server.Close)
+	notifier := &recordingNotifier{}
+	withPipeline(t, server, notifier)
+
+	previousInterval, previousMax, previousAlerts := options.reannounceInterval, options.reannounceMax, alerts
+	t.Cleanup(func() {
+		options.reannounceInterval, options.reannounceMax = previousInterval, previousMax
+		forgetAnnouncements(map[string]bool{})
+		urlValidatorsLock.Lock()
+		urlValidators = make(map[string]validators)
+		urlValidatorsLock.Unlock()
+		alertsLock.Lock()
+		alerts = previousAlerts
+		alertsLock.Unlock()
+	})
+	options.reannounceInterval = map[string]time.Duration{"ACCIDENT": 30 * time.Minute}
+	options.reannounceMax = 1
+	alertsLock.Lock()
+	alerts = nil
+	alertsLock.Unlock()
+
+	getUpdates()
+	drainAlerts()
+	// Com o feed parado, a consulta recebe 304 e não processa nada; a
+	// repetição vem do seu próprio ciclo.
+	fake.Advance(31 * time.Minute)
+	c.Delete("wazeData")
+	getUpdates()
+	if len(alertsCh) != 0 {
+		t.Fatalf("304 queued %d alerts", len(alertsCh))
+	}
+	activeAlertsLock.Lock()
+	_, active := activeAlerts["acc-1"]
+	activeAlertsLock.Unlock()
+	if !active {
+		t.Fatal("304 resolved the alert")
+	}
+	reannounce()
+
+	// A repetição fica na fila, sem ser enviada na hora.
+	if len(notifier.alerts) != 1 || len(alertsCh) != 1 {
+		t.Fatalf("before draining: sent %d, queued %d", len(notifier.alerts), len(alertsCh))
+	}
+	drainAlerts()
+	if len(notifier.alerts) != 2 || !strings.Contains(notifier.alerts[1], tr("alert.stillActive")) {
+		t.Errorf("alerts sent = %q", notifier.alerts)
+	}
+	alertsLock.Lock()
+	stored := len(alerts)
+	alertsLock.Unlock()
+	if stored != 2 {
+		t.Errorf("stored alerts = %d, want 2 (original and repetition)", stored)
+	}
+}
+
+func TestHealthzReportsMQTT(t *testing.T) {
+	withPipeline(t, fakeWaze(t, `{"alerts": []}`, `{"usersOnJams": []}`), &recordingNotifier{})
+	mqtt := &MQTTNotifier{}
+	notifiers = append(notifiers, mqtt)
+
+	health := func() map[string]interface{} {
+		rec := httptest.NewRecorder()
+		handleHealthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		var got map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	if got := health(); got["mqtt"] != false || got["status"] != "degraded" {
+		t.Errorf("broker down: /healthz = %v", got)
+	}
+	mqtt.online.Store(true)
+	if got := health(); got["mqtt"] != true || got["status"] != "ok" {
+		t.Errorf("broker up: /healthz = %v", got)
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	notifier := &recordingNotifier{}
+	withPipeline(t, fakeWaze(t, `{"alerts": []}`, `{"usersOnJams": []}`), notifier)
+	previousToken, previousAlerts := adminToken, alerts
+	t.Cleanup(func() {
+		adminToken = previousToken
+		notificationsPaused.Store(false)
+		alertsLock.Lock()
+		alerts = previousAlerts
+		alertsLock.Unlock()
+	})
+	adminToken = "segredo"
+
+	post := func(path, token string) int {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handlePause(path == "/pause")(rec, req)
+		return rec.Code
+	}
+	if code := post("/pause", "errado"); code != http.StatusUnauthorized || notificationsPaused.Load() {
+		t.Fatalf("wrong token: status %d, paused %t", code, notificationsPaused.Load())
+	}
+	if code := post("/pause", "segredo"); code != http.StatusOK {
+		t.Fatalf("pause: status %d", code)
+	}
+
+	rec := httptest.NewRecorder()
+	handleHealthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if !strings.Contains(rec.Body.String(), `"paused":true`) {
+		t.Errorf("/healthz = %s", rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), `"mqtt"`) {
+		t.Errorf("/healthz reports mqtt without the notifier: %s", rec.Body.String())
+	}
+
+	// Pausado, o alerta fica guardado para /alerts e /events, mas não sai.
+	publishAlert(map[string]interface{}{"uuid": "pausado", "type": "ACCIDENT", "street": "BR-101"})
+	sendMessage("relatório")
+	if len(notifier.alerts) != 0 || len(notifier.texts) != 0 {
+		t.Errorf("sent while paused: %q %q", notifier.alerts, notifier.texts)
+	}
+	if alert, _ := findAlert("pausado"); alert == nil {
+		t.Error("paused alert not stored")
+	}
+
+	if code := post("/resume", "segredo"); code != http.StatusOK {
+		t.Fatalf("resume: status %d", code)
+	}
+	publishAlert(map[string]interface{}{"uuid": "retomado", "type": "ACCIDENT", "street": "BR-101"})
+	if len(notifier.alerts) != 1 || !strings.Contains(notifier.alerts[0], "retomado") {
+		t.Errorf("alerts after resume = %q", notifier.alerts)
+	}
+}
+
+func TestWazeRequestsIdentifyTheBot(t *testing.T) {
+	var agents, froms []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents = append(agents, r.UserAgent())
+		froms = append(froms, r.Header.Get("From"))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"alerts": [], "usersOnJams": []}`)
+	}))
+	t.Cleanup(server.Close)
+
+	withPipeline(t, server, &recordingNotifier{})
+	previousOptions := options
+	t.Cleanup(func() { options = previousOptions })
+
+	options.userAgent, options.requestHeaders = "", nil
+	getUpdates()
+	options.userAgent = "MeuBot/2.0"
+	options.requestHeaders = map[string]string{"From": "contato@exemplo.com", "User-Agent": "ignorado"}
+	countWazers()
+	var out strings.Builder
+	runCheck(&out)
+
+	want := []string{"InformaWaze/" + version, "MeuBot/2.0", "MeuBot/2.0", "MeuBot/2.0"}
+	if strings.Join(agents, ",") != strings.Join(want, ",") {
+		t.Errorf("User-Agent = %q, want %q", agents, want)
+	}
+	if froms[0] != "" || froms[1] != "contato@exemplo.com" {
+		t.Errorf("From = %q", froms)
+	}
+}
+
+func TestDebugDedup(t *testing.T) {
+	now := time.Date(2024, 3, 11, 8, 0, 0, 0, time.Local)
+	clock := newFakeClock(now)
+	withClock(t, clock)
+
+	pub := now.Add(-5 * time.Minute).UnixMilli()
+	old := now.Add(-2 * time.Hour).UnixMilli()
+	feed := fmt.Sprintf(`{"alerts": [
+		{"uuid": "jam-1", "type": "JAM", "street": "SC-401", "pubMillis": %d, "location": {"x": -48.5, "y": -27.6}},
+		{"uuid": "acc-1", "type": "ACCIDENT", "street": "BR-101", "pubMillis": %d, "location": {"x": -48.6, "y": -27.5}},
+		{"uuid": "acc-2", "type": "ACCIDENT", "street": "BR-101", "pubMillis": %d, "location": {"x": -48.6, "y": -27.5}},
+		{"uuid": "old-1", "type": "JAM", "street": "SC-405", "pubMillis": %d, "location": {"x": -48.5, "y": -27.7}}
+	]}`, pub, pub, pub, old)
+
+	notifier := &recordingNotifier{}
+	withPipeline(t, fakeWaze(t, feed, `{"usersOnJams": []}`), notifier)
+	previousToken, previousAlerts, previousEventID := adminToken, alerts, lastEventID
+	t.Cleanup(func() {
+		adminToken = previousToken
+		alertsLock.Lock()
+		alerts, lastEventID = previousAlerts, previousEventID
+		alertsLock.Unlock()
+	})
+	adminToken = "segredo"
+	filters = &Filters{Accident: true}
+
+	processedAlerts.Add("antigo")
+	clock.Advance(time.Second)
+	getUpdates()
+	drainAlerts()
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handleDebugDedup(rec, req)
+		return rec
+	}
+	if rec := get("/debug/dedup", "errado"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token: status %d", rec.Code)
+	}
+	if rec := get("/debug/dedup?limit=x", "segredo"); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid limit: status %d", rec.Code)
+	}
+
+	rec := get("/debug/dedup?limit=4", "segredo")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var body struct {
+		Processed int `json:"processed"`
+		Recent    []struct {
+			UUID string    `json:"uuid"`
+			Seen time.Time `json:"seen"`
+		} `json:"recent"`
+		Suppressed map[string]int `json:"suppressedLastHour"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	// jam-1 passa pela coleta e é barrado pelos filtros na entrega.
+	if body.Processed != 5 || len(body.Recent) != 4 || body.Recent[3].UUID == "antigo" || !body.Recent[0].Seen.Equal(now.Add(time.Second)) {
+		t.Errorf("processed = %d, recent = %v", body.Processed, body.Recent)
+	}
+	want := map[string]int{suppressedDedup: 1, suppressedMaxAge: 1, suppressedFilters: 1}
+	if !reflect.DeepEqual(body.Suppressed, want) {
+		t.Errorf("suppressed = %v, want %v", body.Suppressed, want)
+	}
+
+	// As contagens têm resolução de um minuto.
+	clock.Advance(time.Hour + time.Minute)
+	body.Suppressed = nil
+	json.NewDecoder(get("/debug/dedup", "segredo").Body).Decode(&body)
+	if len(body.Suppressed) != 0 || len(body.Recent) != 5 {
+		t.Errorf("after an hour: suppressed = %v, recent = %d", body.Suppressed, len(body.Recent))
+	}
+}
+
+func TestDebugDedupCountsOtherDrops(t *testing.T) {
+	now := time.Date(2024, 3, 11, 8, 0, 0, 0, time.Local)
+	withClock(t, newFakeClock(now))
+	pub := now.Add(-5 * time.Minute).UnixMilli()
+	// Com espaço para um só alerta na fila, o primeiro comentário ocupa a
+	// vaga, o segundo passa do limite de chitChatLimit e o acidente encontra
+	// a fila cheia.
+	feed := fmt.Sprintf(`{"alerts": [
+		{"uuid": "jam-1", "type": "JAM", "street": "SC-401", "pubMillis": %[1]d, "lengthMeters": 50, "location": {"x": -48.5, "y": -27.6}},
+		{"uuid": "chat-1", "type": "CHIT_CHAT", "reportBy": "fulano", "pubMillis": %[1]d, "location": {"x": -48.4, "y": -27.6}},
+		{"uuid": "chat-2", "type": "CHIT_CHAT", "reportBy": "fulano", "pubMillis": %[1]d, "location": {"x": -48.3, "y": -27.6}},
+		{"uuid": "acc-1", "type": "ACCIDENT", "street": "BR-101", "pubMillis": %[1]d, "location": {"x": -48.6, "y": -27.5}}
+	]}`, pub)
+
+	withPipeline(t, fakeWaze(t, feed, `{"usersOnJams": []}`), &recordingNotifier{})
+	previousOptions, previousThrottle := options, chitChatThrottle
+	t.Cleanup(func() { options, chitChatThrottle = previousOptions, previousThrottle })
+	options.minJamLength = 200
+	chitChatThrottle = NewChatThrottle(1, time.Hour)
+	alertsCh = make(chan map[string]interface{}, 1)
+	t.Cleanup(func() { forgetSmallJams(nil) })
+
+	getUpdates()
+
+	want := map[string]int{suppressedJamSize: 1, suppressedChitChat: 1, suppressedQueueFull: 1}
+	if got := suppressions.Counts(now.Add(-time.Hour)); !reflect.DeepEqual(got, want) {
+		t.Errorf("suppressed = %v, want %v", got, want)
+	}
+
+	// O congestionamento pequeno continua no feed: não é contado de novo.
+	drainAlerts()
+	c.Delete("wazeData")
+	getUpdates()
+	if got := suppressions.Counts(now.Add(-time.Hour))[suppressedJamSize]; got != 1 {
+		t.Errorf("jamSize = %d after the second poll, want 1", got)
+	}
+}
+
+func TestFeed(t *testing.T) {
+	fake := newFakeClock(time.Date(2024, 3, 11, 8, 0, 0, 0, time.UTC))
+	withClock(t, fake)
+	withPipeline(t, fakeWaze(t, `{"alerts": []}`, `{"usersOnJams": [{"wazersCount": 7}, {"wazersCount": 5}]}`), &recordingNotifier{})
+	previousAlerts, previousEventID := alerts, lastEventID
+	t.Cleanup(func() {
+		alertsLock.Lock()
+		alerts, lastEventID = previousAlerts, previousEventID
+		alertsLock.Unlock()
+	})
+	alerts = nil
+
+	// Um pico anterior no mesmo dia, já zerado em maxWazersOnline pelo
+	// relatório de hora em hora.
+	dailyWazersPeak.Record(20, fake.Now().Add(-2*time.Hour))
+	maxWazersOnline.Set(0)
+	countWazers()
+	publishAlert(map[string]interface{}{"uuid": "a", "type": "ACCIDENT", "street": "BR-101"})
+	publishAlert(map[string]interface{}{"uuid": "b", "type": "ACCIDENT", "street": "SC-401"})
+	publishAlert(map[string]interface{}{"uuid": "a", "type": "ACCIDENT", "street": "BR-101", "nThumbsUp": 2.0})
+
+	rec := httptest.NewRecorder()
+	handleFeed(rec, httptest.NewRequest(http.MethodGet, "/feed?format=raw", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var body struct {
+		WazersOnline   int                      `json:"wazersOnline"`
+		MaxWazersToday int                      `json:"maxWazersToday"`
+		Alerts         []map[string]interface{} `json:"alerts"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.WazersOnline != 12 || body.MaxWazersToday != 20 {
+		t.Errorf("wazersOnline = %d, maxWazersToday = %d, want 12 and 20", body.WazersOnline, body.MaxWazersToday)
+	}
+	if len(body.Alerts) != 2 || body.Alerts[0]["uuid"] != "b" || body.Alerts[1]["nThumbsUp"] != 2.0 {
+		t.Errorf("alerts = %v", body.Alerts)
+	}
+
+	rec = httptest.NewRecorder()
+	handleFeed(rec, httptest.NewRequest(http.MethodGet, "/feed?format=xml", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid format: status %d", rec.Code)
+	}
+
+	// No dia seguinte, o pico recomeça pela primeira contagem.
+	fake.Advance(24 * time.Hour)
+	c.Delete("broadcastData")
+	countWazers()
+	rec = httptest.NewRecorder()
+	handleFeed(rec, httptest.NewRequest(http.MethodGet, "/feed", nil))
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.MaxWazersToday != 12 {
+		t.Errorf("next day: maxWazersToday = %d, want 12", body.MaxWazersToday)
+	}
+	if got := NewDatabase("db.json").GetDailyWazersPeak().Get(fake.Now()); got != 12 {
+		t.Errorf("saved daily peak = %d, want 12", got)
+	}
+}
+
+func TestResolvedEvents(t *testing.T) {
+	withClock(t, newFakeClock(time.Date(2024, 3, 11, 8, 0, 0, 0, time.UTC)))
+	notifier := &recordingNotifier{}
+	withPipeline(t, fakeWaze(t, `{"alerts": []}`, `{"usersOnJams": []}`), notifier)
+	previousOptions, previousResolved, previousResolvedID := options, resolvedEvents, lastResolvedID
+	previousAlerts, previousEventID := alerts, lastEventID
+	t.Cleanup(func() {
+		options = previousOptions
+		alertsLock.Lock()
+		resolvedEvents, lastResolvedID = previousResolved, previousResolvedID
+		alerts, lastEventID = previousAlerts, previousEventID
+		alertsLock.Unlock()
+		activeAlertsLock.Lock()
+		activeAlerts = make(map[string]map[string]interface{})
+		activeAlertsLock.Unlock()
+	})
+	alertsLock.Lock()
+	alerts, lastEventID = nil, 0
+	alertsLock.Unlock()
+	options.allClearTypes = map[string]bool{"ACCIDENT": true}
+
+	processAlerts([]interface{}{
+		map[string]interface{}{"uuid": "acc-1", "type": "ACCIDENT", "street": "BR-101"},
+		map[string]interface{}{"uuid": "jam-1", "type": "JAM", "street": "SC-401"},
+	})
+	drainAlerts()
+	alertsLock.Lock()
+	before := lastResolvedID
+	alertsLock.Unlock()
+
+	processAlerts([]interface{}{map[string]interface{}{"uuid": "jam-1", "type": "JAM", "street": "SC-401"}})
+	processAlerts(nil)
+	drainAlerts()
+
+	rec := httptest.NewRecorder()
+	last, err := writeResolvedEvents(rec, rec, before)
+	if err != nil || last != before+2 {
+		t.Fatalf("writeResolvedEvents = %d, %v, want %d", last, err, before+2)
+	}
+	body := rec.Body.String()
+	if strings.Count(body, "event: resolved\n") != 2 || !strings.Contains(body, `"uuid":"acc-1"`) || !strings.Contains(body, `"uuid":"jam-1"`) {
+		t.Errorf("events = %q", body)
+	}
+	if strings.Index(body, "acc-1") > strings.Index(body, "jam-1") {
+		t.Errorf("events out of order: %q", body)
+	}
+
+	// Só os tipos de allClearTypes viram mensagem.
+	if len(notifier.texts) != 1 || !strings.Contains(notifier.texts[0], "✅") || !strings.Contains(notifier.texts[0], "BR-101") {
+		t.Errorf("texts = %q", notifier.texts)
+	}
+
+	// Um cliente em dia não recebe nada.
+	rec = httptest.NewRecorder()
+	if last, _ := writeResolvedEvents(rec, rec, last); last != before+2 || rec.Body.Len() != 0 {
+		t.Errorf("up-to-date client got %q", rec.Body)
+	}
+
+	// Em /alerts os dois aparecem como liberados; o histórico de /events
+	// não os reenvia.
+	rec = httptest.NewRecorder()
+	handleAlerts(rec, httptest.NewRequest(http.MethodGet, "/alerts?format=raw", nil))
+	var listed []map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 || listed[0]["resolvedAt"] == nil || listed[1]["resolvedAt"] == nil {
+		t.Errorf("/alerts = %v", listed)
+	}
+	rec = httptest.NewRecorder()
+	if last, _ := writeEvents(rec, rec, 0); last != 2 || rec.Body.Len() != 0 {
+		t.Errorf("backlog = %d, %q", last, rec.Body)
+	}
+}
+
+func TestAllClearOnDisappearanceIsThrottled(t *testing.T) {
+	withClock(t, newFakeClock(time.Date(2024, 3, 11, 8, 0, 0, 0, time.UTC)))
+	notifier := &recordingNotifier{}
+	withPipeline(t, fakeWaze(t, `{"alerts": []}`, `{"usersOnJams": []}`), notifier)
+	previousOptions := options
+	t.Cleanup(func() {
+		options = previousOptions
+		activeAlertsLock.Lock()
+		activeAlerts = make(map[string]map[string]interface{})
+		activeAlertsLock.Unlock()
+	})
+	options.allClearTypes = map[string]bool{"ACCIDENT": true}
+	options.allClearThrottle = 100 * time.Millisecond
+
+	accident := func(id, street string, x float64) map[string]interface{} {
+		return map[string]interface{}{"uuid": id, "type": "ACCIDENT", "street": street, "location": map[string]interface{}{"x": x, "y": -27.5}}
+	}
+	// appearAndVanish passa o alerta por um ciclo e some com ele no seguinte.
+	appearAndVanish := func(alert map[string]interface{}) {
+		processAlerts([]interface{}{alert})
+		for len(alertsCh) > 0 {
+			<-alertsCh
+		}
+		processAlerts(nil)
+		drainAlerts()
+	}
+
+	// Enquanto o alerta continua no feed, nada é anunciado.
+	first := accident("acc-1", "BR-101", -48.61)
+	processAlerts([]interface{}{first})
+	for len(alertsCh) > 0 {
+		<-alertsCh
+	}
+	processAlerts([]interface{}{first})
+	drainAlerts()
+	if len(notifier.texts) != 0 {
+		t.Fatalf("all-clear while the alert is still in the feed: %q", notifier.texts)
+	}
+	processAlerts(nil)
+	if len(notifier.texts) != 0 || len(messagesCh) != 1 {
+		t.Fatalf("all-clear sent during the poll: texts %q, queued %d", notifier.texts, len(messagesCh))
+	}
+	drainAlerts()
+	if len(notifier.texts) != 1 || !strings.Contains(notifier.texts[0], "BR-101") {
+		t.Fatalf("texts after it vanished = %q", notifier.texts)
+	}
+
+	// Outro acidente na mesma rua, dentro de allClearThrottle, fica sem
+	// aviso; em outra rua, não.
+	appearAndVanish(accident("acc-2", "BR-101", -48.62))
+	appearAndVanish(accident("acc-3", "SC-401", -48.63))
+	if len(notifier.texts) != 2 || !strings.Contains(notifier.texts[1], "SC-401") {
+		t.Fatalf("texts within the throttle = %q", notifier.texts)
+	}
+
+	// Passado o intervalo, a mesma rua volta a ser anunciada.
+	time.Sleep(2 * options.allClearThrottle)
+	appearAndVanish(accident("acc-4", "BR-101", -48.64))
+	if len(notifier.texts) != 3 || !strings.Contains(notifier.texts[2], "BR-101") {
+		t.Errorf("texts after the throttle = %q", notifier.texts)
+	}
+}
+
+func TestShutdownFlushesPending(t *testing.T) {
+	notifier := &recordingNotifier{}
+	withPipeline(t, fakeWaze(t, `{"alerts": []}`, `{"usersOnJams": []}`), notifier)
+	previousOptions, previousStop, previousClusterer := options, stopJobs, clusterer
+	previousDrained, previousMessagesDrained := alertsDrained, messagesDrained
+	t.Cleanup(func() {
+		options, stopJobs, clusterer = previousOptions, previousStop, previousClusterer
+		alertsDrained, messagesDrained = previousDrained, previousMessagesDrained
+		digestLock.Lock()
+		digest = nil
+		digestLock.Unlock()
+	})
+	// As filas já estão vazias.
+	stopJobs, alertsDrained, messagesDrained = make(chan struct{}), make(chan struct{}), make(chan struct{})
+	close(alertsDrained)
+	close(messagesDrained)
+
+	options.digestInterval = time.Hour
+	digestLock.Lock()
+	digest = []map[string]interface{}{{"uuid": "resumo-1", "type": "JAM", "street": "SC-401"}}
+	digestLock.Unlock()
+
+	// Um grupo aberto há pouco, longe do fim da janela.
+	clusterer = NewClusterer(500, time.Hour)
+	for _, id := range []string{"grupo-1", "grupo-2"} {
+		clusterer.Add(map[string]interface{}{"uuid": id, "type": "ACCIDENT", "street": "BR-101",
+			"location": map[string]interface{}{"x": -48.6, "y": -27.5}})
+	}
+
+	stopAndSave()
+
+	if len(notifier.texts) != 1 || !strings.Contains(notifier.texts[0], "SC-401") {
+		t.Errorf("texts = %q, want the pending digest", notifier.texts)
+	}
+	if len(notifier.alerts) != 1 || !strings.Contains(notifier.alerts[0], "BR-101") {
+		t.Errorf("alerts = %q, want the open cluster", notifier.alerts)
+	}
+	if open := clusterer.Flush(); len(open) != 0 {
+		t.Errorf("%d clusters left open", len(open))
+	}
+}
+
+func TestShutdownDrainsQueuedAlerts(t *testing.T) {
+	notifier := &recordingNotifier{}
+	withPipeline(t, fakeWaze(t, `{"alerts": []}`, `{"usersOnJams": []}`), notifier)
+	previousOptions, previousStop := options, stopJobs
+	previousDrained, previousMessagesDrained := alertsDrained, messagesDrained
+	previousAlerts, previousEventID := alerts, lastEventID
+	t.Cleanup(func() {
+		options, stopJobs = previousOptions, previousStop
+		alertsDrained, messagesDrained = previousDrained, previousMessagesDrained
+		alertsLock.Lock()
+		alerts, lastEventID = previousAlerts, previousEventID
+		alertsLock.Unlock()
+	})
+	options.alertsFile = "alerts.json"
+	options.lifecycleNotices = true
+	stopJobs, alertsDrained, messagesDrained = make(chan struct{}), make(chan struct{}), make(chan struct{})
+
+	// Um job em andamento no encerramento termina antes de alertsCh fechar.
+	started, release := make(chan struct{}), make(chan struct{})
+	live := *liveConfig.Get()
+	live.Schedules = map[string]string{"teste": "* * * * * *"}
+	liveConfig.Set(&live)
+	wg.Add(1)
+	go scheduleJob("teste", func() {
+		select {
+		case started <- struct{}{}:
+			<-release
+			enqueueAlert(map[string]interface{}{"uuid": "tardio", "type": "JAM", "street": "SC-405"})
+		default:
+		}
+	})
+	go closeAlertsAfterJobs()
+
+	enqueueAlert(map[string]interface{}{"uuid": "fila-1", "type": "JAM", "street": "SC-401"})
+	enqueueAlert(map[string]interface{}{"uuid": "fila-2", "type": "ACCIDENT", "street": "BR-101"})
+	<-started
+
+	done := make(chan struct{})
+	go func() {
+		stopAndSave()
+		close(done)
+	}()
+	close(release)
+	go sendQueuedMessages()
+	go publishQueued()
+	<-done
+
+	notifier.mu.Lock()
+	sent := len(notifier.alerts)
+	notifier.mu.Unlock()
+	if sent != 3 {
+		t.Errorf("notified %d alerts, want 3", sent)
+	}
+	// O aviso de encerramento, com a versão, sai depois da fila.
+	if want := tr("lifecycle.stopping", version, gitCommit); len(notifier.texts) != 1 || notifier.texts[0] != want {
+		t.Errorf("texts = %q, want %q", notifier.texts, want)
+	}
+	data, err := os.ReadFile("alerts.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"fila-1", "fila-2", "tardio"} {
+		if !strings.Contains(string(data), id) {
+			t.Errorf("alerts.json without %s: %s", id, data)
+		}
+	}
+}
@@ -3,13 +3,40 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"html"
+	"io"
 	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/patrickmn/go-cache"
@@ -21,536 +48,7843 @@ type Filters struct {
 	Jam      bool `json:"jam"`
 	Accident bool `json:"accident"`
 	Unknown  bool `json:"unknown"`
+	// Zones restringe os alertas às zonas listadas; vazio aceita todas.
+	Zones []string `json:"zones"`
+	// ReportSource aceita "official" (prefeituras/parceiros), "community"
+	// ou "" para ambos. A origem vem do campo reportByMunicipalityUser do
+	// Waze; veja isOfficialReport.
+	ReportSource string `json:"reportSource" enum:"official,community,"`
+	// Windows limita, por tipo, os horários em que os alertas são enviados,
+	// no mesmo formato de activeWindows do config.json. Vale junto com
+	// activeWindows: o alerta precisa estar dentro das duas.
+	Windows map[string][]ActiveWindow `json:"windows"`
+	// Streets aceita só alertas cuja rua contenha um dos trechos e
+	// ExcludeStreets descarta os que contenham algum, sem diferenciar
+	// maiúsculas nem acentos. Alertas sem rua passam.
+	Streets        []string `json:"streets"`
+	ExcludeStreets []string `json:"excludeStreets"`
+	// Subtypes e ExcludeSubtypes refinam os tipos ligados pelo código do
+	// subtipo no Waze (ex.: "HAZARD_WEATHER_FLOOD"). Subtypes só restringe os
+	// tipos com algum subtipo na lista, então ["HAZARD_WEATHER_FLOOD"] não
+	// afeta os acidentes. Alertas sem subtipo passam; veja subtypeAllowed.
+	Subtypes        []string `json:"subtypes"`
+	ExcludeSubtypes []string `json:"excludeSubtypes"`
+	// ExcludeReportBy descarta os alertas dos usuários listados no campo
+	// reportBy do Waze (ex.: a própria conta do operador ou um bot), sem
+	// diferenciar maiúsculas. ReportByWhitelist, se não vazia, aceita só os
+	// alertas dos usuários listados; aí os alertas sem reportBy (anônimos)
+	// também caem, exceto os congestionamentos da lista "jams", que não são
+	// relatos de ninguém. Sem ela, alertas sem reportBy passam.
+	ExcludeReportBy   []string `json:"excludeReportBy"`
+	ReportByWhitelist []string `json:"reportByWhitelist"`
+	// MinJamLevel descarta os JAM abaixo do nível, na escala do Waze: 0 livre,
+	// 1 leve, 2 moderado, 3 intenso, 4 parado e 5 bloqueado. MinJamSpeedDrop
+	// descarta os que reduzem a velocidade em menos km/h que isso. 0 desliga
+	// cada limite, e JAM sem a informação passam; veja jamThresholdAllowed.
+	MinJamLevel     int     `json:"minJamLevel"`
+	MinJamSpeedDrop float64 `json:"minJamSpeedDrop"`
+
+	// windows é Windows já interpretado por validateFilters.
+	windows map[string][]activeWindow
 }
 
 func loadFilters(filename string) *Filters {
-	file, err := os.Open(filename)
+	filters, err := readFilters(filename)
 	if err != nil {
-		log.Printf("Erro ao abrir arquivo JSON de filtros: %v", err)
+		log.Printf("Erro ao abrir o arquivo JSON de filtros: %v", err)
 		return &Filters{}
 	}
+	return filters
+}
+
+func readFilters(filename string) (*Filters, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
 	defer file.Close()
 
 	var filters Filters
 	if err := json.NewDecoder(file).Decode(&filters); err != nil {
-		log.Printf("Erro ao abrir o arquivo JSON de filtros: %v", err)
-		return &Filters{}
+		return nil, err
 	}
+	if err := validateFilters(&filters); err != nil {
+		return nil, err
+	}
+	return &filters, nil
+}
 
-	return &filters
+type Config struct {
+	ProxyURL string `json:"proxyUrl"`
+	// UserAgent identifica o bot nas requisições ao Waze (padrão
+	// "InformaWaze/<versão>"); RequestHeaders acrescenta outros cabeçalhos a
+	// elas, como {"From": "contato@exemplo.com"}.
+	UserAgent      string            `json:"userAgent"`
+	RequestHeaders map[string]string `json:"requestHeaders"`
+	// DigestInterval (ex.: "15m") agrupa os alertas em um resumo periódico;
+	// os tipos em DigestImmediate continuam sendo enviados na hora.
+	DigestInterval  string   `json:"digestInterval"`
+	DigestImmediate []string `json:"digestImmediate"`
+	Zones           []Zone   `json:"zones"`
+	MaxAlertAge     string   `json:"maxAlertAge"`
+	// Durações do cache: dados de alertas, feed de broadcast e limpeza.
+	CacheTTL             string `json:"cacheTTL"`
+	BroadcastCacheTTL    string `json:"broadcastCacheTTL"`
+	CacheCleanupInterval string `json:"cacheCleanupInterval"`
+	// TelegramRoutes envia cada tipo de alerta para outro chat/tópico.
+	TelegramRoutes map[string]TelegramRoute `json:"telegramRoutes"`
+	// StaticMapURL é o modelo da URL de uma imagem estática do mapa, com
+	// {lat}, {lon} e {key} (ex.: o Static Maps do Google ou do Geoapify).
+	// Os alertas dos tipos em StaticMapTypes vão ao Telegram como foto, com o
+	// texto na legenda. A chave pode vir de STATIC_MAP_KEY, que tem prioridade.
+	StaticMapURL   string   `json:"staticMapUrl"`
+	StaticMapKey   string   `json:"staticMapKey"`
+	StaticMapTypes []string `json:"staticMapTypes"`
+	// DedupTTL define, por tipo, por quanto tempo alertas repetidos no mesmo
+	// trecho são suprimidos (ex.: {"JAM": "2m", "ACCIDENT": "1h"}).
+	DedupTTL map[string]string `json:"dedupTTL"`
+	// DedupWindow limita por quanto tempo um uuid é lembrado; depois disso o
+	// alerta volta a ser notificado se reaparecer. Vazio lembra para sempre.
+	DedupWindow string `json:"dedupWindow"`
+	// Após BreakerThreshold falhas seguidas, as chamadas a um endpoint do
+	// Waze são suspensas por BreakerCooldown.
+	BreakerThreshold int    `json:"breakerThreshold"`
+	BreakerCooldown  string `json:"breakerCooldown"`
+	// Limite de CHIT_CHAT por usuário em ChitChatWindow; ChitChatNote avisa
+	// uma vez quando um usuário passa a ser silenciado.
+	ChitChatLimit  int    `json:"chitChatLimit"`
+	ChitChatWindow string `json:"chitChatWindow"`
+	ChitChatNote   bool   `json:"chitChatNote"`
+	// CoordinatePrecision define as casas decimais usadas ao arredondar
+	// coordenadas (padrão 4).
+	CoordinatePrecision *int `json:"coordinatePrecision"`
+	// SeverityScores troca ou acrescenta entradas na tabela de severidade
+	// (0–100) por subtipo ou tipo (ex.: {"ACCIDENT_MAJOR": 95}). Alertas
+	// com severidade abaixo de MinSeverity não são notificados, mas continuam
+	// em /alerts e /events; -min-severity tem prioridade.
+	SeverityScores map[string]int `json:"severityScores"`
+	MinSeverity    int            `json:"minSeverity"`
+	// WazersThresholds avisa quando a contagem instantânea de motoristas
+	// passa de cada limite (ex.: [100, 200]); o aviso volta depois que ela
+	// cai 10% abaixo do limite.
+	WazersThresholds []int `json:"wazersThresholds"`
+	// Timezone é o fuso (nome IANA, ex.: "America/Sao_Paulo") dos horários
+	// mostrados nas mensagens; vazio usa o do servidor.
+	Timezone string `json:"timezone"`
+	// ArchivePath é o diretório onde os alertas são arquivados em JSONL.
+	ArchivePath string `json:"archivePath"`
+	// AllClearTypes lista os tipos que recebem um aviso "✅" quando somem do
+	// feed; AllClearThrottle limita esses avisos por tipo e rua.
+	AllClearTypes    []string `json:"allClearTypes"`
+	AllClearThrottle string   `json:"allClearThrottle"`
+	// DedupMaxSize limita quantos uuids processados são lembrados, descartando
+	// os usados há mais tempo; 0 não limita.
+	DedupMaxSize int `json:"dedupMaxSize"`
+	// DedupKeys é a ordem dos campos usados para identificar um alerta; vale
+	// o primeiro presente. "fingerprint" usa tipo, subtipo, rua e posição.
+	// Padrão: ["uuid", "id", "fingerprint"].
+	DedupKeys []string `json:"dedupKeys"`
+	// DedupSaveInterval agrupa as gravações dos uuids processados no
+	// db.json: com "30s", os ciclos com alertas novos nesse intervalo viram
+	// uma gravação só. Vazio ou "0" grava a cada ciclo.
+	DedupSaveInterval string `json:"dedupSaveInterval"`
+	// Notifiers escolhe os destinos ("telegram", "discord", "webhook", "matrix"). Sem a lista,
+	// são usados todos os que estiverem configurados.
+	Notifiers         []string `json:"notifiers"`
+	DiscordWebhookURL string   `json:"discordWebhookUrl"`
+	// DryRun liga o modo -dry-run pelo config.json: as mensagens só vão
+	// para o log, sem chegar a nenhum destino.
+	DryRun bool `json:"dryRun"`
+	// LifecycleNotices avisa nos destinos quando o bot inicia e encerra,
+	// com a versão e o commit em execução.
+	LifecycleNotices bool `json:"lifecycleNotices"`
+	// AccessLog liga o log de acesso do servidor HTTP (padrão true);
+	// AccessLogSkip lista caminhos omitidos, por padrão o stream /events.
+	AccessLog     *bool    `json:"accessLog"`
+	AccessLogSkip []string `json:"accessLogSkip"`
+	// Webhook genérico; com WebhookSecret o corpo é assinado com HMAC-SHA256.
+	WebhookURL     string `json:"webhookUrl"`
+	WebhookSecret  string `json:"webhookSecret"`
+	WebhookTimeout string `json:"webhookTimeout"`
+	// Matrix publica numa sala pelo client-server API. O token pode vir de
+	// MATRIX_ACCESS_TOKEN, que tem prioridade. webhookTimeout também vale
+	// para cada tentativa de envio ao Matrix.
+	MatrixHomeserver  string `json:"matrixHomeserver"`
+	MatrixRoomID      string `json:"matrixRoomId"`
+	MatrixAccessToken string `json:"matrixAccessToken"`
+	// MQTT publica cada alerta em JSON no broker mqttBroker ("host:porta"),
+	// no tópico mqttTopic, onde {type} vira o tipo do alerta e {region} a
+	// zona (padrão "waze/alerts/{type}"). Só QoS 0 e 1 são suportados. A senha pode vir
+	// de MQTT_PASSWORD, que tem prioridade.
+	MqttBroker   string `json:"mqttBroker"`
+	MqttTopic    string `json:"mqttTopic"`
+	MqttQoS      int    `json:"mqttQos"`
+	MqttRetain   bool   `json:"mqttRetain"`
+	MqttClientID string `json:"mqttClientId"`
+	MqttUsername string `json:"mqttUsername"`
+	MqttPassword string `json:"mqttPassword"`
+	// Área consultada, feeds do Waze e agendas cron dos jobs ("updates",
+	// "wazers", "wazersReport"). Estas opções são recarregadas sem reiniciar.
+	AreaBounds       map[string]float64 `json:"areaBounds"`
+	RequestURL       string             `json:"requestUrl"`
+	BroadcastFeedURL string             `json:"broadcastFeedUrl"`
+	Schedules        map[string]string  `json:"schedules"`
+	// AreaName ("Florianópolis, SC") troca areaBounds pelo retângulo que o
+	// geocodificador devolver; se a consulta falhar, vale areaBounds.
+	// GeocoderProvider é "nominatim" (padrão) ou "opencage"; GeocoderURL
+	// substitui o endereço do provedor, com {query} e {key}.
+	AreaName         string `json:"areaName"`
+	GeocoderProvider string `json:"geocoderProvider"`
+	GeocoderURL      string `json:"geocoderUrl"`
+	GeocoderKey      string `json:"geocoderKey"`
+	// ConfigReloadInterval é o intervalo de verificação de config.json e
+	// filters.json (padrão "5s"); "0s" desliga a recarga.
+	ConfigReloadInterval string `json:"configReloadInterval"`
+	// ActiveWindows limita, por tipo, os horários em que os alertas são
+	// enviados (ex.: JAM só de 06:00 a 10:00 e de 16:00 a 20:00). Tipos sem
+	// janelas são sempre enviados.
+	ActiveWindows map[string][]ActiveWindow `json:"activeWindows"`
+	// ReannounceInterval repete, por tipo, os alertas que continuam ativos
+	// (ex.: {"ROAD_CLOSED": "30m"}), no máximo ReannounceMax vezes por alerta
+	// (padrão 3).
+	ReannounceInterval map[string]string `json:"reannounceInterval"`
+	ReannounceMax      *int              `json:"reannounceMax"`
+	// AlertsBuffer é o tamanho da fila entre a consulta ao Waze e o envio
+	// (padrão 10). Com a fila cheia, novos alertas são descartados.
+	AlertsBuffer int `json:"alertsBuffer"`
+	// StoredAlerts limita quantos alertas publicados ficam em memória para
+	// /alerts e /events (padrão 500). Com AlertsFile, eles são gravados a cada
+	// AlertsSaveInterval (padrão "1m") e no encerramento, e recarregados na
+	// inicialização, descartando os mais velhos que maxAlertAge.
+	StoredAlerts       int    `json:"storedAlerts"`
+	AlertsFile         string `json:"alertsFile"`
+	AlertsSaveInterval string `json:"alertsSaveInterval"`
+	// AlertDisplays personaliza emoji e nomes por tipo ou subtipo (ex.:
+	// {"ACCIDENT_MAJOR": {"label": "Acidente grave"}}); campos omitidos
+	// mantêm o padrão.
+	AlertDisplays map[string]AlertDisplay `json:"alertDisplays"`
+	// AlertFields escolhe, em ordem, os campos do alerta mostrados no bloco
+	// de código das mensagens (padrão em defaultAlertFields). Um "*" acrescenta
+	// os demais em ordem alfabética, menos os internos do bot.
+	AlertFields []string `json:"alertFields"`
+	// MessagePrefix e MessageSuffix envolvem toda mensagem enviada (ex.:
+	// "🚨 Trânsito Floripa |"); cada zona pode definir os seus.
+	MessagePrefix string `json:"messagePrefix"`
+	MessageSuffix string `json:"messageSuffix"`
+	// ConsumeJams gera alertas JAM também a partir da lista "jams" do
+	// TGeoRSS, com atraso e extensão do congestionamento.
+	ConsumeJams bool `json:"consumeJams"`
+	// JamDedup evita notificar duas vezes o mesmo congestionamento quando ele
+	// vem em "alerts" e em "jams": "jams" (padrão) ou "alerts" diz qual fonte
+	// prevalece; "off" desliga. Dois JAM são o mesmo quando têm a mesma rua e
+	// caem no mesmo quadrado de JamDedupBucket metros (padrão 300).
+	JamDedup       string  `json:"jamDedup" enum:"jams,alerts,off,"`
+	JamDedupBucket float64 `json:"jamDedupBucket"`
+	// MinJamLengthMeters e MinJamDelaySeconds descartam, antes de qualquer
+	// notificação, os JAM mais curtos ou com menos atraso que isso (0 desliga).
+	// Os JAM sem extensão ou atraso (como os da lista "alerts") passam, a não
+	// ser que DropJamsWithoutData esteja ligado. Vias bloqueadas sempre passam.
+	MinJamLengthMeters  float64 `json:"minJamLengthMeters"`
+	MinJamDelaySeconds  float64 `json:"minJamDelaySeconds"`
+	DropJamsWithoutData bool    `json:"dropJamsWithoutData"`
+	// ClusterTypes junta numa só notificação os alertas desses tipos que
+	// chegam a até ClusterRadius metros um do outro (padrão 500) dentro de
+	// ClusterWindow (padrão "2m").
+	ClusterTypes  []string `json:"clusterTypes"`
+	ClusterRadius float64  `json:"clusterRadius"`
+	ClusterWindow string   `json:"clusterWindow"`
+	// MaxClients limita as conexões simultâneas em /events; acima disso as
+	// novas recebem 503. 0 não limita.
+	MaxClients int `json:"maxClients"`
+	// ReplayInterval é a pausa entre os alertas reenviados por /replay
+	// (padrão "2s").
+	ReplayInterval string `json:"replayInterval"`
+	// Lang escolhe o idioma das mensagens enviadas ("pt" ou "en"; padrão
+	// "pt"). Textos sem tradução saem em português.
+	Lang string `json:"lang"`
+	// Bot e chats do Telegram, usados quando TELEGRAM_BOT_TOKEN e
+	// TELEGRAM_CHAT_ID não estão definidos. Os alertas sem rota e as
+	// mensagens avulsas vão para todos os chats.
+	TelegramBotToken string   `json:"telegramBotToken"`
+	TelegramChatIDs  []string `json:"telegramChatIds"`
+	// Com AnomalyFactor > 0, avisa quando os alertas de um tipo em
+	// AnomalyWindow (padrão "1h") passam de AnomalyFactor vezes o esperado
+	// pela média de AnomalyBaseline (padrão "24h", no máximo 24h) e de
+	// AnomalyMinCount (padrão 5). Cada tipo avisa no máximo uma vez por janela.
+	AnomalyFactor   float64 `json:"anomalyFactor"`
+	AnomalyWindow   string  `json:"anomalyWindow"`
+	AnomalyBaseline string  `json:"anomalyBaseline"`
+	AnomalyMinCount int     `json:"anomalyMinCount"`
 }
 
-func saveFilters(filename string, filters *Filters) {
-	file, err := os.Create(filename)
-	if err != nil {
-		log.Printf("Erro ao criar arquivo JSON de filtros: %v", err)
-		return
+// ActiveWindow é um intervalo "HH:MM" no horário local. Se To for menor que
+// From, a janela atravessa a meia-noite; Weekdays restringe os dias em que a
+// janela começa ("seg", "ter", ... ou "mon", "tue", ...).
+type ActiveWindow struct {
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Weekdays []string `json:"weekdays"`
+}
+
+// activeWindow é a ActiveWindow já interpretada: minutos desde a meia-noite
+// e uma máscara de dias da semana (0 aceita todos).
+type activeWindow struct {
+	from, to int
+	weekdays uint8
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"dom": time.Sunday, "seg": time.Monday, "ter": time.Tuesday, "qua": time.Wednesday,
+	"qui": time.Thursday, "sex": time.Friday, "sab": time.Saturday,
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseActiveWindow(w ActiveWindow) (activeWindow, error) {
+	var parsed activeWindow
+	for _, bound := range []struct {
+		value string
+		dest  *int
+	}{{w.From, &parsed.from}, {w.To, &parsed.to}} {
+		t, err := time.Parse("15:04", bound.value)
+		if err != nil {
+			return parsed, fmt.Errorf("horário inválido %q (use HH:MM)", bound.value)
+		}
+		*bound.dest = t.Hour()*60 + t.Minute()
 	}
-	defer file.Close()
+	for _, name := range w.Weekdays {
+		day, ok := weekdayNames[strings.ToLower(name)]
+		if !ok {
+			return parsed, fmt.Errorf("dia da semana inválido %q", name)
+		}
+		parsed.weekdays |= 1 << uint(day)
+	}
+	return parsed, nil
+}
 
-	if err := json.NewEncoder(file).Encode(filters); err != nil {
-		log.Printf("Erro ao codificar arquivo JSON de filtros: %v", err)
-		return
+// contains diz se t cai na janela. Numa janela que atravessa a meia-noite,
+// a madrugada conta como parte do dia em que a janela começou; From igual a
+// To cobre o dia inteiro.
+func (w activeWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	startDay := t.Weekday()
+
+	switch {
+	case w.from < w.to:
+		if minute < w.from || minute >= w.to {
+			return false
+		}
+	case minute < w.from:
+		if w.from > w.to && minute >= w.to {
+			return false
+		}
+		startDay = (startDay + 6) % 7
 	}
+
+	return w.weekdays == 0 || w.weekdays&(1<<uint(startDay)) != 0
 }
 
-var (
-	telegramBotToken = os.Getenv("TELEGRAM_BOT_TOKEN")
-	telegramChatID   = os.Getenv("TELEGRAM_CHAT_ID")
+// withinActiveWindow diz se um alerta do tipo pode ser enviado em t, pelas
+// janelas do config.json e pelas dos filtros.
+func withinActiveWindow(alertType string, t time.Time) bool {
+	filtersLock.Lock()
+	filterWindows, filtered := filters.windows[alertType]
+	filtersLock.Unlock()
+	if filtered && !windowsContain(filterWindows, t) {
+		return false
+	}
 
-	db              = NewDatabase("db.json")
-	processedAlerts = db.GetProcessedAlerts()
-	maxWazersOnline = db.GetMaxWazersOnline()
-	c               *cache.Cache
+	windows, ok := options.activeWindows[alertType]
+	return !ok || windowsContain(windows, t)
+}
 
-	options = struct {
-		areaBounds       map[string]float64
-		requestURL       string
-		broadcastFeedURL string
-	}{
-		areaBounds: map[string]float64{
+// windowsContain compara os horários das janelas no fuso de options.timezone,
+// e não no do servidor.
+func windowsContain(windows []activeWindow, t time.Time) bool {
+	t = localTime(t)
+	for _, w := range windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// LiveConfig reúne as opções recarregadas sem reiniciar o processo. Uma
+// recarga troca a configuração inteira, então quem lê sempre vê um conjunto
+// consistente.
+type LiveConfig struct {
+	AreaBounds       map[string]float64 `json:"areaBounds"`
+	RequestURL       string             `json:"requestUrl"`
+	BroadcastFeedURL string             `json:"broadcastFeedUrl"`
+	Schedules        map[string]string  `json:"schedules"`
+}
+
+func defaultLiveConfig() *LiveConfig {
+	return &LiveConfig{
+		AreaBounds: map[string]float64{
 			"left":   -52.2100,
 			"right":  -48.5400,
 			"top":    -26.5000,
 			"bottom": -27.5000,
 		},
-		requestURL:       "https://www.waze.com/row-rtserver/web/TGeoRSS?tk=community&format=JSON",
-		broadcastFeedURL: "https://www.waze.com/row-rtserver/broadcast/BroadcastRSS?buid=xxxxxxxxxxxxx&format=JSON",
+		RequestURL:       "https://www.waze.com/row-rtserver/web/TGeoRSS?tk=community&format=JSON",
+		BroadcastFeedURL: "https://www.waze.com/row-rtserver/broadcast/BroadcastRSS?buid=xxxxxxxxxxxxx&format=JSON",
+		Schedules: map[string]string{
+			"updates":      "*/30 * * * * *",
+			"wazers":       "*/20 * * * * *",
+			"wazersReport": "0 * * * *",
+		},
 	}
+}
 
-	alerts       []map[string]interface{}
-	alertsLock   sync.Mutex
-	alertsCh     = make(chan map[string]interface{}, 10)
-	clients      = make(map[chan struct{}]struct{})
-	clientsLock  sync.Mutex
-	wg           sync.WaitGroup
-	shutdownOnce sync.Once
-	filters      *Filters
-	filtersLock  sync.Mutex
-)
+// buildLiveConfig aplica sobre os padrões o que estiver definido em config;
+// uma chave removida do arquivo volta ao valor padrão.
+func buildLiveConfig(config *Config) *LiveConfig {
+	live := defaultLiveConfig()
+	if config.AreaBounds != nil {
+		live.AreaBounds = config.AreaBounds
+	}
+	if config.AreaName != "" {
+		if bounds, err := geocodeArea(config); err != nil {
+			logger(fmt.Sprintf("WARNING: can't geocode areaName %q, usando areaBounds: %v", config.AreaName, err))
+		} else {
+			live.AreaBounds = bounds
+		}
+	}
+	if config.RequestURL != "" {
+		live.RequestURL = config.RequestURL
+	}
+	if config.BroadcastFeedURL != "" {
+		live.BroadcastFeedURL = config.BroadcastFeedURL
+	}
+	for job, expr := range config.Schedules {
+		live.Schedules[job] = expr
+	}
+	cli.apply(live)
+	return live
+}
 
-func main() {
-	c = cache.New(5*time.Minute, 10*time.Minute)
-	filters = loadFilters("filters.json")
-	wg.Add(1)
-	go startWebServer()
-	go scheduleJob("*/30 * * * * *", getUpdates)
-	go scheduleJob("*/20 * * * * *", countWazers)
-	go scheduleJob("0 * * * *", sendWazersReport)
+// geocoderURLs são os endereços padrão dos provedores de geocodificação.
+var geocoderURLs = map[string]string{
+	"nominatim": "https://nominatim.openstreetmap.org/search?q={query}&format=json&limit=1",
+	"opencage":  "https://api.opencagedata.com/geocode/v1/json?q={query}&key={key}&limit=1",
+}
 
-	go func() {
-		wg.Wait()
-		close(alertsCh)
-	}()
+const geocoderTimeout = 10 * time.Second
 
-	for alert := range alertsCh {
-		alertsLock.Lock()
-		alerts = append(alerts, alert)
-		alertsLock.Unlock()
+// geocodeArea resolve o retângulo de config.AreaName. O resultado fica no
+// db.json, então recargas e reinícios não repetem a consulta.
+func geocodeArea(config *Config) (map[string]float64, error) {
+	provider := config.GeocoderProvider
+	if provider == "" {
+		provider = "nominatim"
+	}
+	template := config.GeocoderURL
+	if template == "" {
+		template = geocoderURLs[provider]
+	}
+	if template == "" {
+		return nil, fmt.Errorf("geocoderProvider desconhecido: %q", provider)
+	}
 
-		clientsLock.Lock()
-		for client := range clients {
-			client <- struct{}{}
+	// A URL entra na chave para que trocar geocoderUrl refaça a consulta; é o
+	// modelo, sem a chave de API.
+	cacheKey := provider + " " + template + " " + strings.ToLower(strings.TrimSpace(config.AreaName))
+	if bounds := db.GetGeocodedArea(cacheKey); bounds != nil {
+		logAreaBounds(config.AreaName, bounds, "db.json")
+		return bounds, nil
+	}
+
+	// As variáveis de ambiente têm prioridade sobre o config.json.
+	key := os.Getenv("GEOCODER_KEY")
+	if key == "" {
+		key = config.GeocoderKey
+	}
+	target := strings.NewReplacer("{query}", url.QueryEscape(config.AreaName), "{key}", url.QueryEscape(key)).Replace(template)
+
+	ctx, cancel := context.WithTimeout(context.Background(), geocoderTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", wazeUserAgent())
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkJSONResponse(resp); err != nil {
+		return nil, err
+	}
+
+	bounds, err := parseGeocoderBounds(provider, resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	db.SetGeocodedArea(cacheKey, bounds)
+	logAreaBounds(config.AreaName, bounds, provider)
+	return bounds, nil
+}
+
+// parseGeocoderBounds lê o primeiro resultado da resposta do provedor no
+// formato de areaBounds.
+func parseGeocoderBounds(provider string, body io.Reader) (map[string]float64, error) {
+	switch provider {
+	case "opencage":
+		var response struct {
+			Results []struct {
+				Bounds struct {
+					Northeast struct{ Lat, Lng float64 } `json:"northeast"`
+					Southwest struct{ Lat, Lng float64 } `json:"southwest"`
+				} `json:"bounds"`
+			} `json:"results"`
 		}
-		clientsLock.Unlock()
+		if err := json.NewDecoder(body).Decode(&response); err != nil {
+			return nil, fmt.Errorf("JSON inválido: %v", err)
+		}
+		if len(response.Results) == 0 {
+			return nil, errors.New("nenhum resultado")
+		}
+		b := response.Results[0].Bounds
+		return map[string]float64{"left": b.Southwest.Lng, "right": b.Northeast.Lng, "top": b.Northeast.Lat, "bottom": b.Southwest.Lat}, nil
+	default:
+		// boundingbox vem como ["sul", "norte", "oeste", "leste"], em texto.
+		var results []struct {
+			BoundingBox []string `json:"boundingbox"`
+		}
+		if err := json.NewDecoder(body).Decode(&results); err != nil {
+			return nil, fmt.Errorf("JSON inválido: %v", err)
+		}
+		if len(results) == 0 || len(results[0].BoundingBox) != 4 {
+			return nil, errors.New("nenhum resultado")
+		}
+		var box [4]float64
+		for i, value := range results[0].BoundingBox {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("boundingbox inválido: %v", results[0].BoundingBox)
+			}
+			box[i] = parsed
+		}
+		return map[string]float64{"left": box[2], "right": box[3], "top": box[1], "bottom": box[0]}, nil
 	}
 }
 
-func startWebServer() {
-	http.HandleFunc("/", handleIndex)
-	http.HandleFunc("/alerts", handleAlerts)
-	http.HandleFunc("/events", handleEvents)
-	http.HandleFunc("/filters", handleFilters)
-	http.HandleFunc("/updateFilters", handleUpdateFilters)
-	log.Fatal(http.ListenAndServe(":9091", nil))
+func logAreaBounds(name string, bounds map[string]float64, source string) {
+	logger(fmt.Sprintf("área %q (%s): left=%.4f right=%.4f top=%.4f bottom=%.4f",
+		name, source, bounds["left"], bounds["right"], bounds["top"], bounds["bottom"]))
 }
 
-func handleUpdateFilters(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
-		return
+// ConfigHolder guarda a LiveConfig atual. Quem precisa reagir a uma troca
+// (como os jobs agendados) espera no canal devolvido por Watch.
+type ConfigHolder struct {
+	mu      sync.RWMutex
+	config  *LiveConfig
+	changed chan struct{}
+}
+
+func NewConfigHolder(config *LiveConfig) *ConfigHolder {
+	return &ConfigHolder{config: config, changed: make(chan struct{})}
+}
+
+func (h *ConfigHolder) Get() *LiveConfig {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.config
+}
+
+// Watch devolve a configuração atual e um canal fechado na próxima troca.
+func (h *ConfigHolder) Watch() (*LiveConfig, <-chan struct{}) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.config, h.changed
+}
+
+func (h *ConfigHolder) Set(config *LiveConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.config = config
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+// Zone é uma sub-região nomeada (bairro), definida por um polígono de pontos
+// [x, y] (longitude, latitude) ou por um retângulo no formato de areaBounds.
+type Zone struct {
+	Name    string             `json:"name"`
+	Polygon [][2]float64       `json:"polygon"`
+	Bounds  map[string]float64 `json:"bounds"`
+	// Substituem messagePrefix/messageSuffix nos alertas desta zona.
+	MessagePrefix string `json:"messagePrefix"`
+	MessageSuffix string `json:"messageSuffix"`
+}
+
+const zoneOutside = "outside"
+
+// points retorna o polígono da zona, convertendo Bounds quando necessário.
+func (z Zone) points() [][2]float64 {
+	if len(z.Polygon) > 0 || z.Bounds == nil {
+		return z.Polygon
 	}
+	left, right := z.Bounds["left"], z.Bounds["right"]
+	top, bottom := z.Bounds["top"], z.Bounds["bottom"]
+	return [][2]float64{{left, top}, {right, top}, {right, bottom}, {left, bottom}}
+}
 
-	var newFilters Filters
-	if err := json.NewDecoder(r.Body).Decode(&newFilters); err != nil {
-		http.Error(w, "Erro ao decodificar filtros", http.StatusBadRequest)
-		return
+// brandMessage envolve a mensagem com o prefixo (na mesma linha) e o sufixo
+// (numa linha própria) da zona, ou com os globais quando a zona não os define.
+func brandMessage(message, zoneName string) string {
+	prefix, suffix := options.messagePrefix, options.messageSuffix
+	for _, zone := range options.zones {
+		if zone.Name != zoneName {
+			continue
+		}
+		if zone.MessagePrefix != "" {
+			prefix = zone.MessagePrefix
+		}
+		if zone.MessageSuffix != "" {
+			suffix = zone.MessageSuffix
+		}
+		break
 	}
 
-	filtersLock.Lock()
-	filters = &newFilters
-	saveFilters("filters.json", filters)
-	filtersLock.Unlock()
+	if prefix != "" {
+		message = prefix + " " + message
+	}
+	if suffix != "" {
+		message += "\n" + suffix
+	}
+	return message
+}
 
-	w.WriteHeader(http.StatusNoContent)
+// zoneFor retorna o nome da primeira zona que contém o ponto, ou zoneOutside.
+func zoneFor(zones []Zone, x, y float64) string {
+	for _, zone := range zones {
+		if pointInPolygon(zone.points(), x, y) {
+			return zone.Name
+		}
+	}
+	return zoneOutside
 }
 
-func handleIndex(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	fmt.Fprintf(w, "Bem-vindo ao servidor de alertas do Waze\n\n")
-	fmt.Fprintf(w, "Para ver os alertas, acesse /alerts\n")
-	fmt.Fprintf(w, "Para receber os alertas em tempo real, acesse /events\n")
-	fmt.Fprintf(w, "Para configurar os filtros, acesse /filters\n")
+// pointInPolygon usa ray casting; pontos sobre as arestas contam como dentro.
+func pointInPolygon(polygon [][2]float64, x, y float64) bool {
+	if len(polygon) < 3 {
+		return false
+	}
+
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		xi, yi := polygon[i][0], polygon[i][1]
+		xj, yj := polygon[j][0], polygon[j][1]
+
+		if onSegment(xi, yi, xj, yj, x, y) {
+			return true
+		}
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
 }
 
-func handleAlerts(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	alertsLock.Lock()
-	defer alertsLock.Unlock()
-	json.NewEncoder(w).Encode(alerts)
+func onSegment(x1, y1, x2, y2, x, y float64) bool {
+	const epsilon = 1e-9
+
+	cross := (x2-x1)*(y-y1) - (y2-y1)*(x-x1)
+	if math.Abs(cross) > epsilon {
+		return false
+	}
+	return x >= math.Min(x1, x2)-epsilon && x <= math.Max(x1, x2)+epsilon &&
+		y >= math.Min(y1, y2)-epsilon && y <= math.Max(y1, y2)+epsilon
 }
 
-func handleEvents(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+func loadConfig(filename string) *Config {
+	config, err := readConfig(filename)
+	if err != nil {
+		log.Printf("Erro ao ler arquivo JSON de configuração: %v", err)
+		return &Config{}
+	}
+	return config
+}
 
-	notify := r.Context().Done()
-	client := make(chan struct{}, 1)
+func readConfig(filename string) (*Config, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
 
-	clientsLock.Lock()
-	clients[client] = struct{}{}
-	clientsLock.Unlock()
+	var config Config
+	if err := json.NewDecoder(file).Decode(&config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func applyConfig(config *Config) {
+	// O cliente e a identificação vêm antes da área, que geocodeArea já
+	// consulta com eles.
+	if config.ProxyURL != "" {
+		options.proxyURL = config.ProxyURL
+	}
+	options.userAgent = config.UserAgent
+	options.requestHeaders = config.RequestHeaders
+	client, err := newHTTPClient(options.proxyURL)
+	if err != nil {
+		log.Fatalf("Proxy inválido %q: %v", options.proxyURL, err)
+	}
+	httpClient = client
+
+	liveConfig.Set(buildLiveConfig(config))
+
+	// As variáveis de ambiente têm prioridade sobre o config.json.
+	if os.Getenv("TELEGRAM_BOT_TOKEN") == "" {
+		telegramBotToken = config.TelegramBotToken
+	}
+	if os.Getenv("TELEGRAM_CHAT_ID") == "" {
+		telegramChatIDs = config.TelegramChatIDs
+	}
+
+	if config.DigestInterval != "" {
+		interval, err := time.ParseDuration(config.DigestInterval)
+		if err != nil {
+			log.Fatalf("digestInterval inválido %q: %v", config.DigestInterval, err)
+		}
+		options.digestInterval = interval
+	}
+	options.zones = config.Zones
+	if config.BreakerThreshold > 0 {
+		options.breakerThreshold = config.BreakerThreshold
+	}
+	options.chitChatLimit = config.ChitChatLimit
+	options.archivePath = config.ArchivePath
+	options.dedupMaxSize = config.DedupMaxSize
+	if len(config.DedupKeys) > 0 {
+		options.dedupKeys = config.DedupKeys
+	}
+	options.maxClients = config.MaxClients
+	options.anomalyFactor = config.AnomalyFactor
+	if config.AnomalyMinCount > 0 {
+		options.anomalyMinCount = config.AnomalyMinCount
+	}
+	if config.AlertsBuffer > 0 {
+		options.alertsBuffer = config.AlertsBuffer
+	}
+	if config.StoredAlerts > 0 {
+		options.storedAlerts = config.StoredAlerts
+	}
+	options.alertsFile = config.AlertsFile
+
+	if config.AccessLog != nil {
+		options.accessLog = *config.AccessLog
+	}
+	if config.AccessLogSkip != nil {
+		options.accessLogSkip = make(map[string]bool)
+		for _, path := range config.AccessLogSkip {
+			options.accessLogSkip[path] = true
+		}
+	}
+
+	options.discordWebhookURL = config.DiscordWebhookURL
+	options.webhookURL = config.WebhookURL
+	options.webhookSecret = config.WebhookSecret
+	options.matrixHomeserver = strings.TrimRight(config.MatrixHomeserver, "/")
+	options.matrixRoomID = config.MatrixRoomID
+	if os.Getenv("MATRIX_ACCESS_TOKEN") == "" {
+		matrixAccessToken = config.MatrixAccessToken
+	}
+	options.mqttBroker = mqttAddress(config.MqttBroker)
+	if config.MqttTopic != "" {
+		options.mqttTopic = config.MqttTopic
+	}
+	options.mqttQoS = config.MqttQoS
+	options.mqttRetain = config.MqttRetain
+	if config.MqttClientID != "" {
+		options.mqttClientID = config.MqttClientID
+	}
+	options.mqttUsername = config.MqttUsername
+	if os.Getenv("MQTT_PASSWORD") == "" {
+		mqttPassword = config.MqttPassword
+	}
+	options.dryRun = config.DryRun
+	options.lifecycleNotices = config.LifecycleNotices
+	options.notifiers = config.Notifiers
+	if options.notifiers == nil {
+		if telegramEnabled() {
+			options.notifiers = append(options.notifiers, notifierTelegram)
+		}
+		if options.discordWebhookURL != "" {
+			options.notifiers = append(options.notifiers, notifierDiscord)
+		}
+		if options.webhookURL != "" {
+			options.notifiers = append(options.notifiers, notifierWebhook)
+		}
+		if matrixEnabled() {
+			options.notifiers = append(options.notifiers, notifierMatrix)
+		}
+		if mqttEnabled() {
+			options.notifiers = append(options.notifiers, notifierMQTT)
+		}
+	}
+
+	options.allClearTypes = make(map[string]bool)
+	for _, alertType := range config.AllClearTypes {
+		options.allClearTypes[alertType] = true
+	}
+	if config.CoordinatePrecision != nil {
+		if *config.CoordinatePrecision < 0 || *config.CoordinatePrecision > 8 {
+			log.Fatalf("coordinatePrecision inválido: %d (use de 0 a 8)", *config.CoordinatePrecision)
+		}
+		options.coordinatePrecision = *config.CoordinatePrecision
+	}
+	options.chitChatNote = config.ChitChatNote
+	if config.Timezone != "" {
+		location, err := time.LoadLocation(config.Timezone)
+		if err != nil {
+			log.Fatalf("timezone inválido %q: %v", config.Timezone, err)
+		}
+		options.timezone = location
+	}
+	options.severityScores = make(map[string]int, len(defaultSeverityScores))
+	for key, score := range defaultSeverityScores {
+		options.severityScores[key] = score
+	}
+	for key, score := range config.SeverityScores {
+		options.severityScores[key] = score
+	}
+	options.minSeverity = config.MinSeverity
+	options.wazersThresholds = config.WazersThresholds
+	if cli.minSeverity >= 0 {
+		options.minSeverity = cli.minSeverity
+	}
+	options.telegramRoutes = config.TelegramRoutes
+	options.staticMapURL = config.StaticMapURL
+	if os.Getenv("STATIC_MAP_KEY") == "" {
+		staticMapKey = config.StaticMapKey
+	}
+	options.staticMapTypes = make(map[string]bool)
+	for _, alertType := range config.StaticMapTypes {
+		options.staticMapTypes[alertType] = true
+	}
+
+	if config.MaxAlertAge != "" {
+		maxAge, err := time.ParseDuration(config.MaxAlertAge)
+		if err != nil {
+			log.Fatalf("maxAlertAge inválido %q: %v", config.MaxAlertAge, err)
+		}
+		options.maxAlertAge = maxAge
+	}
+
+	for _, d := range []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"cacheTTL", config.CacheTTL, &options.cacheTTL},
+		{"broadcastCacheTTL", config.BroadcastCacheTTL, &options.broadcastCacheTTL},
+		{"cacheCleanupInterval", config.CacheCleanupInterval, &options.cacheCleanup},
+		{"dedupWindow", config.DedupWindow, &options.dedupWindow},
+		{"breakerCooldown", config.BreakerCooldown, &options.breakerCooldown},
+		{"chitChatWindow", config.ChitChatWindow, &options.chitChatWindow},
+		{"allClearThrottle", config.AllClearThrottle, &options.allClearThrottle},
+		{"webhookTimeout", config.WebhookTimeout, &options.webhookTimeout},
+		{"configReloadInterval", config.ConfigReloadInterval, &options.configReloadInterval},
+		{"clusterWindow", config.ClusterWindow, &options.clusterWindow},
+		{"replayInterval", config.ReplayInterval, &options.replayInterval},
+		{"anomalyWindow", config.AnomalyWindow, &options.anomalyWindow},
+		{"anomalyBaseline", config.AnomalyBaseline, &options.anomalyBaseline},
+		{"alertsSaveInterval", config.AlertsSaveInterval, &options.alertsSaveInterval},
+		{"dedupSaveInterval", config.DedupSaveInterval, &options.dedupSaveInterval},
+	} {
+		if d.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil {
+			log.Fatalf("%s inválido %q: %v", d.name, d.value, err)
+		}
+		*d.dest = duration
+	}
+
+	if config.DedupTTL != nil {
+		options.dedupTTL = make(map[string]time.Duration)
+		for alertType, value := range config.DedupTTL {
+			ttl, err := time.ParseDuration(value)
+			if err != nil {
+				log.Fatalf("dedupTTL inválido para %s %q: %v", alertType, value, err)
+			}
+			options.dedupTTL[alertType] = ttl
+		}
+	}
+
+	if config.Lang != "" {
+		options.lang = config.Lang
+	}
+	options.alertDisplays = buildAlertDisplays(options.lang, config.AlertDisplays)
+	if config.AlertFields != nil {
+		options.alertFields = config.AlertFields
+	}
+	options.messagePrefix = config.MessagePrefix
+	options.messageSuffix = config.MessageSuffix
+	options.consumeJams = config.ConsumeJams
+	if config.JamDedup != "" {
+		options.jamDedup = config.JamDedup
+	}
+	if config.JamDedupBucket > 0 {
+		options.jamDedupBucket = config.JamDedupBucket
+	}
+	options.minJamLength = config.MinJamLengthMeters
+	options.minJamDelay = config.MinJamDelaySeconds
+	options.dropJamsWithoutData = config.DropJamsWithoutData
+	options.clusterTypes = make(map[string]bool)
+	for _, alertType := range config.ClusterTypes {
+		options.clusterTypes[alertType] = true
+	}
+	if config.ClusterRadius > 0 {
+		options.clusterRadius = config.ClusterRadius
+	}
+
+	options.reannounceInterval = make(map[string]time.Duration)
+	for alertType, value := range config.ReannounceInterval {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			log.Fatalf("reannounceInterval inválido para %s %q", alertType, value)
+		}
+		options.reannounceInterval[alertType] = interval
+	}
+	if config.ReannounceMax != nil {
+		options.reannounceMax = *config.ReannounceMax
+	}
+
+	options.activeWindows = make(map[string][]activeWindow)
+	for alertType, windows := range config.ActiveWindows {
+		for _, w := range windows {
+			parsed, err := parseActiveWindow(w)
+			if err != nil {
+				log.Fatalf("activeWindows inválido para %s: %v", alertType, err)
+			}
+			options.activeWindows[alertType] = append(options.activeWindows[alertType], parsed)
+		}
+	}
+
+	if config.DigestImmediate != nil {
+		options.digestImmediate = make(map[string]bool)
+		for _, alertType := range config.DigestImmediate {
+			options.digestImmediate[alertType] = true
+		}
+	}
+}
+
+// validateConfig verifica a configuração já resolvida (config.json + env) e
+// falha com uma mensagem clara quando algo essencial está errado.
+func validateConfig() error {
+	// Sem chats configurados, o bot usa os que se registrarem com /start.
+	if telegramBotToken == "" && len(telegramChatIDs) > 0 {
+		return fmt.Errorf("chats do Telegram definidos sem token: defina TELEGRAM_BOT_TOKEN ou telegramBotToken")
+	}
+	for alertType, route := range options.telegramRoutes {
+		if route.ChatID == "" {
+			return fmt.Errorf("telegramRoutes.%s sem chatId", alertType)
+		}
+	}
+	for _, key := range options.dedupKeys {
+		if strings.TrimSpace(key) == "" {
+			return fmt.Errorf("dedupKeys com campo vazio")
+		}
+	}
+	for alertType := range options.alertDisplays {
+		if !slices.Contains(knownAlertTypes, alertType) {
+			return fmt.Errorf("alertDisplays.%s: tipo ou subtipo desconhecido", alertType)
+		}
+	}
+
+	for _, name := range options.notifiers {
+		switch name {
+		case notifierTelegram:
+			if !telegramEnabled() {
+				return fmt.Errorf("notificador telegram sem TELEGRAM_BOT_TOKEN")
+			}
+		case notifierDiscord:
+			if options.discordWebhookURL == "" {
+				return fmt.Errorf("notificador discord sem discordWebhookUrl")
+			}
+		case notifierWebhook:
+			if options.webhookURL == "" {
+				return fmt.Errorf("notificador webhook sem webhookUrl")
+			}
+		case notifierMatrix:
+			if !matrixEnabled() {
+				return fmt.Errorf("notificador matrix sem matrixHomeserver, matrixRoomId e MATRIX_ACCESS_TOKEN/matrixAccessToken")
+			}
+		case notifierMQTT:
+			if !mqttEnabled() {
+				return fmt.Errorf("notificador mqtt sem mqttBroker")
+			}
+		default:
+			return fmt.Errorf("notificador desconhecido: %q", name)
+		}
+	}
+
+	if options.anomalyFactor > 0 {
+		if options.anomalyWindow <= 0 || options.anomalyBaseline <= options.anomalyWindow {
+			return fmt.Errorf("anomalyBaseline (%s) deve ser maior que anomalyWindow (%s)", options.anomalyBaseline, options.anomalyWindow)
+		}
+		if options.anomalyBaseline > statsRetention {
+			return fmt.Errorf("anomalyBaseline (%s) deve ser de no máximo %s", options.anomalyBaseline, statsRetention)
+		}
+	}
+
+	switch options.jamDedup {
+	case jamSourceJams, jamSourceAlerts, "off":
+	default:
+		return fmt.Errorf("jamDedup desconhecido: %q (use jams, alerts ou off)", options.jamDedup)
+	}
+	for _, threshold := range options.wazersThresholds {
+		if threshold <= 0 {
+			return fmt.Errorf("wazersThresholds inválido: %d (use números positivos)", threshold)
+		}
+	}
+	if options.minSeverity < 0 || options.minSeverity > 100 {
+		return fmt.Errorf("minSeverity inválido: %d (use de 0 a 100)", options.minSeverity)
+	}
+	for key, score := range options.severityScores {
+		if score < 0 || score > 100 {
+			return fmt.Errorf("severityScores.%s inválido: %d (use de 0 a 100)", key, score)
+		}
+	}
+	if options.mqttQoS != 0 && options.mqttQoS != 1 {
+		return fmt.Errorf("mqttQos inválido: %d (use 0 ou 1)", options.mqttQoS)
+	}
+	if strings.ContainsAny(options.mqttTopic, "+#") {
+		return fmt.Errorf("mqttTopic não pode ter curingas: %q", options.mqttTopic)
+	}
+
+	if _, ok := messageCatalogs[options.lang]; !ok {
+		return fmt.Errorf("idioma desconhecido: %q (use pt ou en)", options.lang)
+	}
+
+	if err := validateLiveConfig(liveConfig.Get()); err != nil {
+		return err
+	}
+
+	if options.chitChatLimit > 0 && options.chitChatWindow <= 0 {
+		return fmt.Errorf("chitChatWindow deve ser positivo quando chitChatLimit está definido")
+	}
+	return nil
+}
+
+// validateLiveConfig verifica as opções recarregáveis; é usada na
+// inicialização e antes de aceitar uma recarga.
+func validateLiveConfig(live *LiveConfig) error {
+	bounds := live.AreaBounds
+	for _, key := range []string{"left", "right", "top", "bottom"} {
+		if _, ok := bounds[key]; !ok {
+			return fmt.Errorf("areaBounds sem %q", key)
+		}
+	}
+	if bounds["left"] >= bounds["right"] || bounds["bottom"] >= bounds["top"] {
+		return fmt.Errorf("areaBounds degenerado: left=%.4f right=%.4f top=%.4f bottom=%.4f",
+			bounds["left"], bounds["right"], bounds["top"], bounds["bottom"])
+	}
+
+	for name, rawURL := range map[string]string{
+		"requestUrl":       live.RequestURL,
+		"broadcastFeedUrl": live.BroadcastFeedURL,
+	} {
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("%s inválida: %q", name, rawURL)
+		}
+	}
+
+	for job, expr := range live.Schedules {
+		if _, ok := scheduledJobs[job]; !ok {
+			return fmt.Errorf("schedules: job desconhecido %q", job)
+		}
+		if _, err := parseCron(expr); err != nil {
+			return fmt.Errorf("schedules.%s: %v", job, err)
+		}
+	}
+	return nil
+}
+
+// watchConfigFiles verifica a data de modificação dos arquivos a cada
+// interval e chama reload para os que mudaram. A consulta periódica fica no
+// lugar do fsnotify, que não está vendorizado; ela também pega os editores
+// que gravam num arquivo novo e o renomeiam, caso em que o fsnotify perde o
+// arquivo observado.
+func watchConfigFiles(interval time.Duration, files map[string]func(string)) {
+	modTimes := make(map[string]time.Time)
+	for filename := range files {
+		modTimes[filename] = modTime(filename)
+	}
+
+	for {
+		<-clock.After(interval)
+		for filename, reload := range files {
+			mtime := modTime(filename)
+			if mtime.Equal(modTimes[filename]) {
+				continue
+			}
+			modTimes[filename] = mtime
+			reload(filename)
+		}
+	}
+}
+
+func modTime(filename string) time.Time {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reloadConfig relê a configuração e troca área, feeds e agendas. Uma
+// configuração inválida é descartada e a anterior continua valendo; as
+// demais opções só mudam ao reiniciar.
+func reloadConfig(filename string) {
+	config, err := readConfig(filename)
+	if err != nil {
+		logger(fmt.Sprintf("ERROR: %s ignorado, mantendo a configuração anterior: %v", filename, err))
+		return
+	}
+
+	next := buildLiveConfig(config)
+	if err := validateLiveConfig(next); err != nil {
+		logger(fmt.Sprintf("ERROR: %s ignorado, mantendo a configuração anterior: %v", filename, err))
+		return
+	}
+
+	changes := diffFields(liveConfig.Get(), next)
+	if len(changes) == 0 {
+		logger(filename + " alterado, mas nenhuma opção recarregável mudou (as demais exigem reinício)")
+		return
+	}
+
+	liveConfig.Set(next)
+	// Os dados em cache foram obtidos com a área e os feeds anteriores.
+	c.Delete("wazeData")
+	c.Delete("broadcastData")
+	logger(filename + " recarregado: " + strings.Join(changes, "; "))
+}
+
+// reloadFilters relê os filtros, inclusive os gravados pelo próprio servidor
+// em /updateFilters, que não produzem mudanças.
+func reloadFilters(filename string) {
+	newFilters, err := readFilters(filename)
+	if err != nil {
+		logger(fmt.Sprintf("ERROR: %s ignorado, mantendo os filtros anteriores: %v", filename, err))
+		return
+	}
+
+	filtersLock.Lock()
+	changes := diffFields(filters, newFilters)
+	if len(changes) > 0 {
+		filters = newFilters
+	}
+	filtersLock.Unlock()
+
+	if len(changes) > 0 {
+		logger(filename + " recarregado: " + strings.Join(changes, "; "))
+	}
+}
+
+// diffFields compara dois valores pela forma JSON e descreve cada campo
+// alterado como "campo: antes → depois".
+func diffFields(before, after interface{}) []string {
+	var oldFields, newFields map[string]json.RawMessage
+	for _, v := range []struct {
+		value interface{}
+		dest  *map[string]json.RawMessage
+	}{{before, &oldFields}, {after, &newFields}} {
+		data, _ := json.Marshal(v.value)
+		json.Unmarshal(data, v.dest)
+	}
+
+	keys := make(map[string]bool)
+	for key := range oldFields {
+		keys[key] = true
+	}
+	for key := range newFields {
+		keys[key] = true
+	}
+
+	var changes []string
+	for key := range keys {
+		if !bytes.Equal(oldFields[key], newFields[key]) {
+			changes = append(changes, fmt.Sprintf("%s: %s → %s", key, orNull(oldFields[key]), orNull(newFields[key])))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+func orNull(value json.RawMessage) string {
+	if value == nil {
+		return "null"
+	}
+	return string(value)
+}
+
+// logStartupSummary registra a configuração efetiva, sem expor segredos.
+func logStartupSummary() {
+	live := liveConfig.Get()
+	b := live.AreaBounds
+	logger(fmt.Sprintf("área: left=%.4f right=%.4f top=%.4f bottom=%.4f", b["left"], b["right"], b["top"], b["bottom"]))
+	logger("feed de alertas: " + live.RequestURL)
+	logger("feed de broadcast: " + live.BroadcastFeedURL)
+	logger(fmt.Sprintf("cache: alertas %s, broadcast %s; idade máxima %s; janela de dedup %s",
+		options.cacheTTL, options.broadcastCacheTTL, options.maxAlertAge, orNone(options.dedupWindow)))
+
+	sinks := []string{"console", "/events"}
+	for _, name := range options.notifiers {
+		switch name {
+		case notifierTelegram:
+			chats := strings.Join(telegramChatIDs, ", ")
+			if chats == "" {
+				chats = fmt.Sprintf("%d registrados via /start", telegramChats.Len())
+			}
+			sinks = append(sinks, fmt.Sprintf("telegram (token %s, chat %s, %d rotas)",
+				redactSecret(telegramBotToken), chats, len(options.telegramRoutes)))
+		case notifierDiscord:
+			// A URL do webhook contém o token, então não é registrada.
+			sinks = append(sinks, "discord")
+		case notifierWebhook:
+			sinks = append(sinks, fmt.Sprintf("webhook %s (assinado: %t)", redactURL(options.webhookURL), options.webhookSecret != ""))
+		case notifierMatrix:
+			sinks = append(sinks, fmt.Sprintf("matrix %s, sala %s (token %s)",
+				options.matrixHomeserver, options.matrixRoomID, redactSecret(matrixAccessToken)))
+		case notifierMQTT:
+			sinks = append(sinks, fmt.Sprintf("mqtt %s, tópico %s (qos %d, retain %t)",
+				options.mqttBroker, options.mqttTopic, options.mqttQoS, options.mqttRetain))
+		}
+	}
+	if options.alertsFile != "" {
+		sinks = append(sinks, fmt.Sprintf("últimos %d alertas em %s", options.storedAlerts, options.alertsFile))
+	}
+	if options.archivePath != "" {
+		sinks = append(sinks, "arquivo "+options.archivePath)
+	}
+	logger("destinos: " + strings.Join(sinks, ", "))
+	if options.digestInterval > 0 {
+		logger(fmt.Sprintf("resumo a cada %s", options.digestInterval))
+	}
+
+	filtersLock.Lock()
+	f := *filters
+	filtersLock.Unlock()
+	logger(fmt.Sprintf("filtros: comentários=%t polícia=%t congestionamento=%t acidente=%t outros=%t zonas=%v origem=%q",
+		f.ChitChat, f.Police, f.Jam, f.Accident, f.Unknown, f.Zones, f.ReportSource))
+}
+
+func orNone(d time.Duration) string {
+	if d <= 0 {
+		return "nenhuma"
+	}
+	return d.String()
+}
+
+// redactSecret mantém apenas os quatro últimos caracteres do segredo.
+func redactSecret(secret string) string {
+	if len(secret) <= 4 {
+		return "****"
+	}
+	return "****" + secret[len(secret)-4:]
+}
+
+func saveFilters(filename string, filters *Filters) {
+	file, err := os.Create(filename)
+	if err != nil {
+		log.Printf("Erro ao criar arquivo JSON de filtros: %v", err)
+		return
+	}
+	defer file.Close()
+
+	if err := json.NewEncoder(file).Encode(filters); err != nil {
+		log.Printf("Erro ao codificar arquivo JSON de filtros: %v", err)
+		return
+	}
+}
+
+// CLI guarda as opções de linha de comando. Cada flag tem como padrão uma
+// variável de ambiente; área e agendas, quando informadas, têm prioridade
+// sobre o config.json, inclusive nas recargas.
+type CLI struct {
+	listenAddr      string
+	configFile      string
+	logLevel        string
+	dryRun          bool
+	check           bool
+	updatesSchedule string
+	wazersSchedule  string
+	areaBounds      map[string]float64
+	// minSeverity negativo deixa valer o minSeverity do config.json.
+	minSeverity int
+	// logFile troca a saída padrão por um arquivo, rotacionado ao passar de
+	// logMaxSize MB e com até logMaxBackups cópias antigas.
+	logFile       string
+	logMaxSize    int
+	logMaxBackups int
+}
+
+var cli = CLI{listenAddr: ":9091", configFile: "config.json", logLevel: "info", minSeverity: -1, logMaxSize: 10, logMaxBackups: 3}
+
+var logLevels = map[string]int{"info": 0, "warn": 1, "error": 2}
+
+// parseFlags lê os argumentos em cli. Com -h, imprime o uso e retorna
+// flag.ErrHelp.
+func parseFlags(args []string) error {
+	fs := flag.NewFlagSet("informa-waze", flag.ContinueOnError)
+	fs.StringVar(&cli.listenAddr, "listen", envOr("LISTEN_ADDR", cli.listenAddr), "endereço do servidor HTTP (LISTEN_ADDR)")
+	fs.StringVar(&cli.configFile, "config", envOr("CONFIG_FILE", cli.configFile), "arquivo de configuração (CONFIG_FILE)")
+	fs.StringVar(&cli.logLevel, "log-level", envOr("LOG_LEVEL", cli.logLevel), "nível de log: info, warn ou error (LOG_LEVEL)")
+	fs.BoolVar(&cli.dryRun, "dry-run", os.Getenv("DRY_RUN") == "true", "consulta o Waze mas só registra as mensagens, sem enviá-las (DRY_RUN=true)")
+	fs.BoolVar(&cli.check, "check", false, "verifica a configuração, os feeds do Waze e os destinos (com uma mensagem de teste) e sai; código 1 se algo falhar")
+	fs.StringVar(&cli.updatesSchedule, "updates-schedule", os.Getenv("UPDATES_SCHEDULE"), "agenda cron da consulta de alertas (UPDATES_SCHEDULE)")
+	fs.StringVar(&cli.wazersSchedule, "wazers-schedule", os.Getenv("WAZERS_SCHEDULE"), "agenda cron da contagem de motoristas (WAZERS_SCHEDULE)")
+	bounds := fs.String("bounds", os.Getenv("AREA_BOUNDS"), "área consultada como left,right,top,bottom (AREA_BOUNDS)")
+	minSeverity := fs.String("min-severity", os.Getenv("MIN_SEVERITY"), "severidade mínima (0 a 100) para notificar um alerta (MIN_SEVERITY)")
+	fs.StringVar(&cli.logFile, "log-file", os.Getenv("LOG_FILE"), "grava o log neste arquivo em vez da saída padrão (LOG_FILE)")
+	logMaxSize := fs.String("log-max-size", envOr("LOG_MAX_SIZE", strconv.Itoa(cli.logMaxSize)), "tamanho em MB que faz o arquivo de log ser rotacionado (LOG_MAX_SIZE)")
+	logMaxBackups := fs.String("log-max-backups", envOr("LOG_MAX_BACKUPS", strconv.Itoa(cli.logMaxBackups)), "quantos arquivos de log antigos manter (LOG_MAX_BACKUPS)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Uso: %s [opções]\n\nOpções (entre parênteses, a variável de ambiente usada como padrão):\n", fs.Name())
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if _, ok := logLevels[cli.logLevel]; !ok {
+		return flagError(fs, fmt.Errorf("nível de log inválido: %q", cli.logLevel))
+	}
+	for name, expr := range map[string]string{"updates-schedule": cli.updatesSchedule, "wazers-schedule": cli.wazersSchedule} {
+		if expr == "" {
+			continue
+		}
+		if _, err := parseCron(expr); err != nil {
+			return flagError(fs, fmt.Errorf("-%s: %v", name, err))
+		}
+	}
+	cli.areaBounds = nil
+	if *bounds != "" {
+		parsed, err := parseBounds(*bounds)
+		if err != nil {
+			return flagError(fs, fmt.Errorf("-bounds: %v", err))
+		}
+		cli.areaBounds = parsed
+	}
+	cli.minSeverity = -1
+	if *minSeverity != "" {
+		n, err := strconv.Atoi(*minSeverity)
+		if err != nil || n < 0 || n > 100 {
+			return flagError(fs, fmt.Errorf("-min-severity: use um número de 0 a 100: %q", *minSeverity))
+		}
+		cli.minSeverity = n
+	}
+	size, err := strconv.Atoi(*logMaxSize)
+	if err != nil || size < 1 {
+		return flagError(fs, fmt.Errorf("-log-max-size: use um número de MB maior que zero: %q", *logMaxSize))
+	}
+	cli.logMaxSize = size
+	backups, err := strconv.Atoi(*logMaxBackups)
+	if err != nil || backups < 0 {
+		return flagError(fs, fmt.Errorf("-log-max-backups: use um número maior ou igual a zero: %q", *logMaxBackups))
+	}
+	cli.logMaxBackups = backups
+	return nil
+}
+
+// runCheck faz uma consulta a cada feed do Waze e envia uma mensagem de
+// teste a cada destino, escrevendo o resultado em w. Retorna o código de
+// saída: 0 se tudo funcionou, 1 caso contrário.
+func runCheck(w io.Writer) int {
+	failed := false
+	report := func(name string, err error, detail string) {
+		if err != nil {
+			failed = true
+			fmt.Fprintf(w, "✘ %s: %v\n", name, err)
+			return
+		}
+		fmt.Fprintf(w, "✔ %s: %s\n", name, detail)
+	}
+
+	live := liveConfig.Get()
+	alertsURL, err := addBoundsToURL(live.AreaBounds, live.RequestURL)
+	if err == nil {
+		var data map[string]interface{}
+		if data, err = fetchJSON(alertsURL); err == nil {
+			alerts, _ := data["alerts"].([]interface{})
+			jams, _ := data["jams"].([]interface{})
+			report("feed de alertas", nil, fmt.Sprintf("%d alertas, %d congestionamentos", len(alerts), len(jams)))
+		}
+	}
+	if err != nil {
+		report("feed de alertas", err, "")
+	}
+
+	if data, err := fetchJSON(live.BroadcastFeedURL); err != nil {
+		report("feed de broadcast", err, "")
+	} else {
+		usersOnJams, _ := data["usersOnJams"].([]interface{})
+		wazers := 0
+		for _, item := range usersOnJams {
+			jam, _ := item.(map[string]interface{})
+			count, _ := jam["wazersCount"].(float64)
+			wazers += int(count)
+		}
+		report("feed de broadcast", nil, fmt.Sprintf("%d wazers", wazers))
+	}
+
+	if len(notifiers) == 0 {
+		fmt.Fprintln(w, "- nenhum destino configurado")
+	}
+	for _, notifier := range notifiers {
+		err := notifier.SendText(brandMessage(tr("check.message"), ""))
+		report("destino "+notifier.Name(), err, "mensagem de teste enviada")
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// fetchJSON faz um GET sem cache nem validadores e decodifica o JSON.
+func fetchJSON(targetURL string) (map[string]interface{}, error) {
+	req, err := newWazeRequest(context.Background(), targetURL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkJSONResponse(resp); err != nil {
+		return nil, err
+	}
+	var data map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("JSON inválido: %v", err)
+	}
+	return data, nil
+}
+
+func flagError(fs *flag.FlagSet, err error) error {
+	fmt.Fprintln(fs.Output(), err)
+	fs.Usage()
+	return err
+}
+
+// apply sobrepõe à configuração dinâmica o que veio da linha de comando.
+func (c *CLI) apply(live *LiveConfig) {
+	if c.areaBounds != nil {
+		live.AreaBounds = c.areaBounds
+	}
+	if c.updatesSchedule != "" {
+		live.Schedules["updates"] = c.updatesSchedule
+	}
+	if c.wazersSchedule != "" {
+		live.Schedules["wazers"] = c.wazersSchedule
+	}
+}
+
+func parseBounds(value string) (map[string]float64, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("use left,right,top,bottom: %q", value)
+	}
+
+	bounds := make(map[string]float64, 4)
+	for i, key := range []string{"left", "right", "top", "bottom"} {
+		n, err := strconv.ParseFloat(strings.TrimSpace(parts[i]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s inválido: %q", key, parts[i])
+		}
+		bounds[key] = n
+	}
+	return bounds, nil
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// logLevelAllows filtra as mensagens pelo prefixo: em "warn" só passam
+// WARNING e ERROR; em "error", só ERROR.
+func logLevelAllows(msg string) bool {
+	level := 0
+	switch {
+	case strings.HasPrefix(msg, "ERROR:"):
+		level = 2
+	case strings.HasPrefix(msg, "WARNING:"):
+		level = 1
+	}
+	return level >= logLevels[cli.logLevel]
+}
+
+// dryRunNotifier substitui os destinos no modo -dry-run, só registrando o que
+// seria enviado.
+type dryRunNotifier struct{}
+
+func (dryRunNotifier) Name() string { return "dry-run" }
+
+func (dryRunNotifier) SendAlert(alert map[string]interface{}, message string) error {
+	dryRunSent.Inc()
+	logger("[DRY-RUN] alerta:\n" + message)
+	return nil
+}
+
+// SendText só conta: sendMessage já registra o texto no log.
+func (dryRunNotifier) SendText(text string) error {
+	dryRunSent.Inc()
+	return nil
+}
+
+func (dryRunNotifier) Reply(chatID, text string) error {
+	dryRunSent.Inc()
+	logger(fmt.Sprintf("[DRY-RUN] resposta ao chat %s:\n%s", chatID, text))
+	return nil
+}
+
+// Preenchidas no build, por exemplo:
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.gitCommit=$(git rev-parse --short HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Sem -ldflags, commit e data vêm das informações de VCS que o go build
+// embute no binário (veja fillBuildInfo).
+var (
+	version   = "dev"
+	gitCommit = "unknown"
+	buildTime = "unknown"
+)
+
+func init() {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		fillBuildInfo(info.Settings)
+	}
+}
+
+// fillBuildInfo completa gitCommit e buildTime com vcs.revision e vcs.time
+// quando não foram definidos por -ldflags. Um checkout com alterações não
+// commitadas ganha o sufixo "-dirty".
+func fillBuildInfo(settings []debug.BuildSetting) {
+	values := make(map[string]string, len(settings))
+	for _, setting := range settings {
+		values[setting.Key] = setting.Value
+	}
+
+	if revision := values["vcs.revision"]; gitCommit == "unknown" && revision != "" {
+		if len(revision) > 7 {
+			revision = revision[:7]
+		}
+		if values["vcs.modified"] == "true" {
+			revision += "-dirty"
+		}
+		gitCommit = revision
+	}
+	if vcsTime := values["vcs.time"]; buildTime == "unknown" && vcsTime != "" {
+		buildTime = vcsTime
+	}
+}
+
+// sendLifecycleNotice manda o aviso de início ou encerramento, com a versão,
+// quando lifecycleNotices está ligado.
+func sendLifecycleNotice(key string) {
+	if options.lifecycleNotices {
+		sendMessage(tr(key, version, gitCommit))
+	}
+}
+
+func versionString() string {
+	return fmt.Sprintf("versão %s (commit %s, build %s, %s)", version, gitCommit, buildTime, runtime.Version())
+}
+
+var (
+	telegramBotToken = os.Getenv("TELEGRAM_BOT_TOKEN")
+	// TELEGRAM_CHAT_ID aceita vários chats separados por vírgula.
+	telegramChatIDs = splitList(os.Getenv("TELEGRAM_CHAT_ID"))
+	// TELEGRAM_WEBHOOK_SECRET deve ser o mesmo secret_token usado no setWebhook.
+	telegramWebhookSecret = os.Getenv("TELEGRAM_WEBHOOK_SECRET")
+	matrixAccessToken     = os.Getenv("MATRIX_ACCESS_TOKEN")
+	mqttPassword          = os.Getenv("MQTT_PASSWORD")
+	staticMapKey          = os.Getenv("STATIC_MAP_KEY")
+	// ADMIN_TOKEN libera os endpoints /admin/, /replay, /pause e /resume
+	// (Authorization: Bearer <token>); sem ele, ficam desativados.
+	adminToken = os.Getenv("ADMIN_TOKEN")
+
+	db              = NewDatabase("db.json")
+	processedAlerts = db.GetProcessedAlerts()
+	maxWazersOnline = db.GetMaxWazersOnline()
+	// dailyWazersPeak é o pico do dia, exposto em /feed; ao contrário de
+	// maxWazersOnline, não é zerado pelo relatório de wazers.
+	dailyWazersPeak = db.GetDailyWazersPeak()
+	// wazersOnline é a última contagem de countWazers, sem acumular pico.
+	wazersOnline = NewCounter(0)
+	// wazersThresholdLevel é o maior limite de wazersThresholds já avisado.
+	wazersThresholdLevel = NewCounter(0)
+	// Chats que mandaram /start ao bot; usados quando TELEGRAM_CHAT_ID e
+	// telegramChatIds estão vazios.
+	telegramChats = db.GetTelegramChats()
+	// O cache é criado na inicialização do pacote e recriado em main, com os
+	// TTLs da configuração, antes de qualquer job. Nenhum dos dois tem a
+	// limpeza própria do go-cache, que fica numa goroutine sem parada;
+	// runCacheCleanup faz a limpeza e termina com stopJobs.
+	c          = cache.New(5*time.Minute, 0)
+	httpClient = http.DefaultClient
+
+	options = struct {
+		proxyURL        string
+		userAgent       string
+		requestHeaders  map[string]string
+		digestInterval  time.Duration
+		digestImmediate map[string]bool
+		zones           []Zone
+		maxAlertAge     time.Duration
+		cacheTTL        time.Duration
+		// O feed de broadcast muda mais rápido, então expira antes.
+		broadcastCacheTTL    time.Duration
+		cacheCleanup         time.Duration
+		telegramRoutes       map[string]TelegramRoute
+		staticMapURL         string
+		staticMapTypes       map[string]bool
+		dedupTTL             map[string]time.Duration
+		dedupWindow          time.Duration
+		breakerThreshold     int
+		breakerCooldown      time.Duration
+		chitChatLimit        int
+		chitChatWindow       time.Duration
+		chitChatNote         bool
+		coordinatePrecision  int
+		timezone             *time.Location
+		severityScores       map[string]int
+		minSeverity          int
+		wazersThresholds     []int
+		archivePath          string
+		allClearTypes        map[string]bool
+		allClearThrottle     time.Duration
+		dedupMaxSize         int
+		dedupKeys            []string
+		dedupSaveInterval    time.Duration
+		notifiers            []string
+		dryRun               bool
+		lifecycleNotices     bool
+		discordWebhookURL    string
+		accessLog            bool
+		accessLogSkip        map[string]bool
+		webhookURL           string
+		webhookSecret        string
+		webhookTimeout       time.Duration
+		matrixHomeserver     string
+		matrixRoomID         string
+		mqttBroker           string
+		mqttTopic            string
+		mqttQoS              int
+		mqttRetain           bool
+		mqttClientID         string
+		mqttUsername         string
+		configReloadInterval time.Duration
+		activeWindows        map[string][]activeWindow
+		reannounceInterval   map[string]time.Duration
+		reannounceMax        int
+		alertsBuffer         int
+		storedAlerts         int
+		alertsFile           string
+		alertsSaveInterval   time.Duration
+		alertDisplays        map[string]AlertDisplay
+		alertFields          []string
+		messagePrefix        string
+		messageSuffix        string
+		consumeJams          bool
+		jamDedup             string
+		jamDedupBucket       float64
+		minJamLength         float64
+		minJamDelay          float64
+		dropJamsWithoutData  bool
+		clusterTypes         map[string]bool
+		clusterRadius        float64
+		clusterWindow        time.Duration
+		maxClients           int
+		replayInterval       time.Duration
+		lang                 string
+		anomalyFactor        float64
+		anomalyWindow        time.Duration
+		anomalyBaseline      time.Duration
+		anomalyMinCount      int
+	}{
+		digestImmediate:      map[string]bool{"ACCIDENT": true},
+		maxAlertAge:          30 * time.Minute,
+		cacheTTL:             5 * time.Minute,
+		broadcastCacheTTL:    1 * time.Minute,
+		cacheCleanup:         10 * time.Minute,
+		breakerThreshold:     5,
+		breakerCooldown:      5 * time.Minute,
+		chitChatWindow:       10 * time.Minute,
+		coordinatePrecision:  4,
+		timezone:             time.Local,
+		severityScores:       defaultSeverityScores,
+		allClearThrottle:     10 * time.Minute,
+		accessLog:            true,
+		accessLogSkip:        map[string]bool{"/events": true},
+		webhookTimeout:       10 * time.Second,
+		mqttTopic:            "waze/alerts/{type}",
+		mqttClientID:         "informawaze",
+		configReloadInterval: 5 * time.Second,
+		reannounceMax:        3,
+		alertsBuffer:         10,
+		storedAlerts:         500,
+		alertsSaveInterval:   time.Minute,
+		alertDisplays:        defaultAlertDisplays,
+		alertFields:          defaultAlertFields,
+		jamDedup:             jamSourceJams,
+		jamDedupBucket:       300,
+		clusterRadius:        500,
+		clusterWindow:        2 * time.Minute,
+		replayInterval:       2 * time.Second,
+		lang:                 defaultLang,
+		anomalyWindow:        time.Hour,
+		anomalyBaseline:      24 * time.Hour,
+		anomalyMinCount:      5,
+		dedupKeys:            defaultDedupKeys,
+	}
+
+	// liveConfig guarda área, feeds e agendas, recarregados de config.json.
+	liveConfig = NewConfigHolder(defaultLiveConfig())
+
+	alerts     []map[string]interface{}
+	alertsLock sync.Mutex
+	// lastEventID é o id de /events do último alerta publicado. Os ids são
+	// consecutivos, então o de alerts[i] é lastEventID-len(alerts)+1+i.
+	lastEventID int
+	// resolvedEvents guarda os últimos alertas que sumiram do feed, enviados
+	// em /events como "event: resolved"; lastResolvedID segue a mesma conta
+	// de lastEventID, mas só vale para os clientes já conectados.
+	resolvedEvents []map[string]interface{}
+	lastResolvedID int
+
+	alertsCh = make(chan map[string]interface{}, 10)
+	// messagesCh leva os avisos de texto (liberações e anomalias) a
+	// sendQueuedMessages, para que um destino lento não segure a consulta nem
+	// a publicação dos alertas.
+	messagesCh   = make(chan string, 10)
+	clients      = make(map[chan struct{}]struct{})
+	clientsLock  sync.Mutex
+	wg           sync.WaitGroup
+	shutdownOnce sync.Once
+	// stopJobs é fechado no encerramento: os jobs agendados terminam a
+	// execução em curso e param; sem eles, ninguém mais envia a alertsCh.
+	stopJobs = make(chan struct{})
+	// alertsDrained é fechado quando o último alerta de alertsCh foi
+	// publicado.
+	alertsDrained = make(chan struct{})
+	// messagesDrained é fechado quando o último aviso de messagesCh foi
+	// enviado.
+	messagesDrained = make(chan struct{})
+	filters         *Filters
+	filtersLock     sync.Mutex
+	digest          []map[string]interface{}
+	digestLock      sync.Mutex
+
+	// lastWazersReport marca o último relatório enviado (ou o início do
+	// processo), base do "tempo desde o último relatório" em /wazers.
+	// maxWazersOnlineAt é quando o pico atual foi atingido e
+	// previousWazersPeak, o pico do relatório anterior. Os três são gravados
+	// no db.json e protegidos por lastWazersReportLock.
+	maxWazersOnlineAt, lastWazersReport, previousWazersPeak = db.GetWazersHistory()
+
+	lastWazersReportLock sync.Mutex
+
+	alertStats = NewStatsCounter(statsRetention)
+	// suppressions conta, por motivo, os alertas barrados antes do envio na
+	// última hora; aparece em /debug/dedup.
+	suppressions = NewStatsCounter(time.Hour)
+
+	activeAlerts     = make(map[string]map[string]interface{})
+	activeAlertsLock sync.Mutex
+
+	// announcements guarda, por uuid, os anúncios dos tipos com
+	// reannounceInterval; a entrada some quando o alerta sai do feed.
+	announcements     = make(map[string]*announcement)
+	announcementsLock sync.Mutex
+
+	// smallJams guarda os congestionamentos barrados por jamSizeAllowed, que
+	// são registrados uma vez só; a entrada some quando o alerta sai do feed.
+	smallJams     = make(map[string]bool)
+	smallJamsLock sync.Mutex
+
+	// jamSpeeds acumula as velocidades de usersOnJams até o próximo
+	// relatório de wazers.
+	jamSpeeds = &Average{}
+	// droppedAlerts conta os alertas descartados com alertsCh cheio.
+	droppedAlerts = NewCounter(0)
+	// dryRunSent conta as mensagens que o modo dry-run teria enviado.
+	dryRunSent = NewCounter(0)
+
+	notifiers []Notifier
+
+	// archive é nil quando archivePath não está configurado.
+	archive *Archive
+
+	// chitChatThrottle é nil quando chitChatLimit não está configurado.
+	chitChatThrottle *ChatThrottle
+
+	// clusterer é nil quando clusterTypes não está configurado.
+	clusterer *Clusterer
+
+	// anomalies é nil quando anomalyFactor não está configurado.
+	anomalies *AnomalyDetector
+
+	alertsBreaker    = NewCircuitBreaker("alerts", 5, 5*time.Minute)
+	broadcastBreaker = NewCircuitBreaker("broadcast", 5, 5*time.Minute)
+)
+
+func main() {
+	if err := parseFlags(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		os.Exit(2)
+	}
+
+	if cli.logFile != "" {
+		file, err := OpenRotatingFile(cli.logFile, int64(cli.logMaxSize)<<20, cli.logMaxBackups)
+		if err != nil {
+			log.Fatalf("Arquivo de log %q: %v", cli.logFile, err)
+		}
+		logOutput = file
+		log.SetOutput(file)
+	}
+
+	logger("iniciando " + versionString())
+
+	filters = loadFilters("filters.json")
+
+	applyConfig(loadConfig(cli.configFile))
+	if err := validateConfig(); err != nil {
+		log.Fatalf("Configuração inválida: %v", err)
+	}
+	logStartupSummary()
+	// Em dry-run os destinos reais nem são criados: o MQTT, por exemplo,
+	// conectaria ao broker ao ser construído.
+	if cli.dryRun || options.dryRun {
+		logger("[DRY-RUN] modo dry-run: nenhuma mensagem será enviada")
+		notifiers = []Notifier{dryRunNotifier{}}
+	} else {
+		notifiers = buildNotifiers()
+	}
+
+	c = cache.New(options.cacheTTL, 0)
+	if options.cacheCleanup > 0 {
+		go runCacheCleanup(options.cacheCleanup, stopJobs)
+	}
+	alertsCh = make(chan map[string]interface{}, options.alertsBuffer)
+	messagesCh = make(chan string, options.alertsBuffer)
+	processedAlerts.SetWindow(options.dedupWindow)
+	processedAlerts.SetCapacity(options.dedupMaxSize)
+	alertsBreaker = NewCircuitBreaker("alerts", options.breakerThreshold, options.breakerCooldown)
+	broadcastBreaker = NewCircuitBreaker("broadcast", options.breakerThreshold, options.breakerCooldown)
+
+	logProxy(options.proxyURL, liveConfig.Get().RequestURL)
+
+	if cli.check {
+		os.Exit(runCheck(os.Stdout))
+	}
+	// Só depois do proxy e fora do -check, que não é uma execução do bot.
+	sendLifecycleNotice("lifecycle.started")
+
+	if options.digestInterval > 0 {
+		go runDigest(options.digestInterval)
+	}
+
+	if options.archivePath != "" {
+		archive = NewArchive(options.archivePath)
+		go runArchiveFlush(archive, time.Minute)
+	}
+
+	if options.alertsFile != "" {
+		restored, lastID := loadAlerts(options.alertsFile)
+		alertsLock.Lock()
+		alerts = restored
+		lastEventID = lastID
+		alertsLock.Unlock()
+		logger(fmt.Sprintf("%d alertas restaurados de %s", len(restored), options.alertsFile))
+		go runAlertsSave(options.alertsFile, options.alertsSaveInterval)
+	}
+	if options.dedupSaveInterval > 0 {
+		go runProcessedSave(options.dedupSaveInterval)
+	}
+	if len(options.reannounceInterval) > 0 {
+		go runReannouncements(time.Minute)
+	}
+
+	go handleSignals()
+
+	if options.chitChatLimit > 0 {
+		chitChatThrottle = NewChatThrottle(options.chitChatLimit, options.chitChatWindow)
+		go runChatThrottleCleanup(chitChatThrottle, options.chitChatWindow)
+	}
+
+	if len(options.clusterTypes) > 0 {
+		clusterer = NewClusterer(options.clusterRadius, options.clusterWindow)
+		go runClusterFlush(clusterer)
+	}
+
+	if options.anomalyFactor > 0 {
+		anomalies = NewAnomalyDetector(alertStats, options.anomalyWindow, options.anomalyBaseline,
+			options.anomalyFactor, options.anomalyMinCount)
+	}
+
+	go startWebServer()
+	for name, job := range scheduledJobs {
+		wg.Add(1)
+		go scheduleJob(name, job)
+	}
+
+	if options.configReloadInterval > 0 {
+		go watchConfigFiles(options.configReloadInterval, map[string]func(string){
+			cli.configFile: reloadConfig,
+			"filters.json": reloadFilters,
+		})
+	}
+
+	go closeAlertsAfterJobs()
+	go sendQueuedMessages()
+	publishQueued()
+
+	// shutdown grava o estado e encerra o processo.
+	select {}
+}
+
+// closeAlertsAfterJobs fecha alertsCh quando todos os jobs pararam, o que
+// garante que nenhum envio acontece num canal fechado.
+func closeAlertsAfterJobs() {
+	wg.Wait()
+	close(alertsCh)
+}
+
+// publishQueued publica os alertas de alertsCh até o canal ser fechado e
+// esvaziado. Depois dele ninguém mais envia a messagesCh, que é fechado
+// também.
+func publishQueued() {
+	for alert := range alertsCh {
+		publishAlert(alert)
+	}
+	close(messagesCh)
+	close(alertsDrained)
+}
+
+// sendQueuedMessages envia os avisos de messagesCh até o canal ser fechado
+// e esvaziado.
+func sendQueuedMessages() {
+	for text := range messagesCh {
+		sendMessage(text)
+	}
+	close(messagesDrained)
+}
+
+// enqueueMessage põe um aviso de texto na fila sem bloquear; com a fila
+// cheia, o aviso é descartado.
+func enqueueMessage(text string) bool {
+	select {
+	case messagesCh <- text:
+		return true
+	default:
+		suppressions.Record(suppressedQueueFull, clock.Now())
+		logger(fmt.Sprintf("WARNING: fila de mensagens cheia (%d), descartando: %s", cap(messagesCh), text))
+		return false
+	}
+}
+
+func publishAlert(alert map[string]interface{}) {
+	alertsLock.Lock()
+	alerts = append(alerts, alert)
+	if excess := len(alerts) - options.storedAlerts; options.storedAlerts > 0 && excess > 0 {
+		alerts = append([]map[string]interface{}(nil), alerts[excess:]...)
+	}
+	lastEventID++
+	alertsLock.Unlock()
+
+	alertType, _ := alert["type"].(string)
+	now := clock.Now()
+	alertStats.Record(alertType, now)
+	if anomalies != nil {
+		if count, expected, ok := anomalies.Check(alertType, now); ok {
+			enqueueMessage(formatAnomaly(alertType, count, expected, options.anomalyWindow))
+		}
+	}
+
+	if archive != nil {
+		if err := archive.Write(alert); err != nil {
+			logger(fmt.Sprintf("ERROR: can't archive alert: %v", err))
+		}
+	}
+
+	notifyAlert(alert)
+	wakeClients()
+}
+
+// publishResolved guarda o aviso de um alerta que sumiu do feed para os
+// clientes de /events e marca o alerta com resolvedAt no buffer, para que
+// /alerts e quem conectar depois saibam que ele já foi liberado. O alerta
+// fica no buffer porque os ids de /events dependem da posição.
+func publishResolved(alert map[string]interface{}) {
+	resolvedAt := clock.Now().UnixMilli()
+	event := map[string]interface{}{"resolvedAt": resolvedAt}
+	for _, key := range []string{"uuid", "type", "subtype", "street"} {
+		if value, ok := alert[key]; ok {
+			event[key] = value
+		}
+	}
+
+	alertsLock.Lock()
+	for i, stored := range alerts {
+		if stored["uuid"] != event["uuid"] {
+			continue
+		}
+		// Uma cópia, porque o mesmo mapa pode estar no cache do feed.
+		marked := make(map[string]interface{}, len(stored)+1)
+		for key, value := range stored {
+			marked[key] = value
+		}
+		marked["resolvedAt"] = resolvedAt
+		alerts[i] = marked
+	}
+	resolvedEvents = append(resolvedEvents, event)
+	if excess := len(resolvedEvents) - options.storedAlerts; options.storedAlerts > 0 && excess > 0 {
+		resolvedEvents = append([]map[string]interface{}(nil), resolvedEvents[excess:]...)
+	}
+	lastResolvedID++
+	alertsLock.Unlock()
+
+	wakeClients()
+}
+
+// wakeClients avisa os clientes de /events que há algo novo.
+func wakeClients() {
+	// O canal só acorda o cliente, que envia todos os alertas; se já houver
+	// um aviso pendente, não é preciso outro, e um cliente lento não trava a
+	// fila.
+	clientsLock.Lock()
+	for client := range clients {
+		select {
+		case client <- struct{}{}:
+		default:
+		}
+	}
+	clientsLock.Unlock()
+}
+
+// handleSignals encerra o processo em SIGINT/SIGTERM, gravando antes o que
+// ainda estiver em buffer.
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	shutdown()
+}
+
+func shutdown() {
+	shutdownOnce.Do(func() {
+		stopAndSave()
+		os.Exit(0)
+	})
+}
+
+// shutdownTimeout limita a espera pelos jobs e pela fila no encerramento.
+const shutdownTimeout = 30 * time.Second
+
+// stopAndSave para os jobs, espera a fila de alertas ser publicada e só
+// então grava o estado e fecha arquivo e destinos.
+func stopAndSave() {
+	logger("encerrando")
+	close(stopJobs)
+	deadline := clock.After(shutdownTimeout)
+	select {
+	case <-alertsDrained:
+		select {
+		case <-messagesDrained:
+		case <-deadline:
+			logger(fmt.Sprintf("WARNING: fila de mensagens não esvaziou em %s, %d mensagens perdidas", shutdownTimeout, len(messagesCh)))
+		}
+	case <-deadline:
+		logger(fmt.Sprintf("WARNING: fila de alertas não esvaziou em %s, %d alertas perdidos", shutdownTimeout, len(alertsCh)))
+	}
+
+	// O resumo e os grupos em andamento saem agora, para não se perderem no
+	// encerramento.
+	if options.digestInterval > 0 {
+		flushDigest(options.digestInterval)
+	}
+	if clusterer != nil {
+		sendClusters(clusterer.Flush())
+	}
+
+	sendLifecycleNotice("lifecycle.stopping")
+
+	if processedDirty.Swap(false) {
+		saveProcessedAlerts()
+	}
+	if options.alertsFile != "" {
+		if err := saveAlerts(options.alertsFile); err != nil {
+			logger(fmt.Sprintf("ERROR: can't save alerts: %v", err))
+		}
+	}
+	if archive != nil {
+		if err := archive.Close(); err != nil {
+			logger(fmt.Sprintf("ERROR: can't close archive: %v", err))
+		}
+	}
+	for _, notifier := range notifiers {
+		if closer, ok := notifier.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+func startWebServer() {
+	http.HandleFunc("/", handleIndex)
+	http.HandleFunc("/alerts", gzipResponse(handleAlerts))
+	http.HandleFunc("/events", handleEvents)
+	http.HandleFunc("/filters", handleFilters)
+	http.HandleFunc("/updateFilters", handleUpdateFilters)
+	http.HandleFunc("/telegram/webhook", handleTelegramWebhook)
+	http.HandleFunc("/wazers", handleWazers)
+	http.HandleFunc("/feed", gzipResponse(handleFeed))
+	http.HandleFunc("/stats", gzipResponse(handleStats))
+	http.HandleFunc("/version", handleVersion)
+	http.HandleFunc("/schema/", handleSchema)
+	http.HandleFunc("/debug/alerts/", handleDebugAlert)
+	http.HandleFunc("/debug/dedup", handleDebugDedup)
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/admin/reset", handleAdminReset)
+	http.HandleFunc("/replay", handleReplay)
+	http.HandleFunc("/pause", handlePause(true))
+	http.HandleFunc("/resume", handlePause(false))
+	log.Fatal(http.ListenAndServe(cli.listenAddr, accessLog(http.DefaultServeMux)))
+}
+
+// statusRecorder guarda o status e o tamanho da resposta para o log de
+// acesso. Repassa Flush para que o /events continue funcionando.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.size += n
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// accessLog registra método, caminho, status, tamanho, duração e origem de
+// cada requisição, exceto nos caminhos de options.accessLogSkip.
+func accessLog(next http.Handler) http.Handler {
+	if !options.accessLog {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if options.accessLogSkip[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := clock.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		logger(fmt.Sprintf("http %s %s %d %dB %s %s", r.Method, r.URL.Path, rec.status, rec.size,
+			clock.Now().Sub(start).Round(time.Millisecond), r.RemoteAddr))
+	})
+}
+
+// gzipMinSize é o menor corpo comprimido; abaixo disso o gzip não compensa.
+const gzipMinSize = 1024
+
+// bufferedResponse segura o corpo para decidir, no fim, se vale comprimir.
+// Não serve para streaming, então não deve envolver o /events.
+type bufferedResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+// gzipResponse comprime a resposta de next quando o cliente aceita gzip e o
+// corpo tem ao menos gzipMinSize bytes.
+func gzipResponse(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next(w, r)
+			return
+		}
+
+		buffered := &bufferedResponse{ResponseWriter: w, status: http.StatusOK}
+		next(buffered, r)
+
+		if buffered.body.Len() < gzipMinSize {
+			w.WriteHeader(buffered.status)
+			w.Write(buffered.body.Bytes())
+			return
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+		w.WriteHeader(buffered.status)
+		gz := gzip.NewWriter(w)
+		gz.Write(buffered.body.Bytes())
+		if err := gz.Close(); err != nil {
+			logger(fmt.Sprintf("ERROR: can't compress %s: %v", r.URL.Path, err))
+		}
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// handleUpdateFilters substitui os filtros com POST. Com PUT ou PATCH, apenas
+// os campos presentes no corpo são alterados; os demais são mantidos.
+func handleUpdateFilters(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		replaceFilters(w, r)
+	case http.MethodPut, http.MethodPatch:
+		mergeFilters(w, r)
+	default:
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "Método não permitido")
+	}
+}
+
+// replaceFilters troca os filtros pelos do corpo, que precisa ser um objeto
+// completo e só com campos conhecidos. Os filtros em uso só mudam depois que
+// o corpo inteiro foi decodificado e validado.
+func replaceFilters(w http.ResponseWriter, r *http.Request) {
+	var newFilters Filters
+	if !decodeFiltersBody(w, r, &newFilters) {
+		return
+	}
+
+	if err := validateFilters(&newFilters); err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, "invalid_filters", err.Error())
+		return
+	}
+
+	filtersLock.Lock()
+	filters = &newFilters
+	saveFilters("filters.json", filters)
+	filtersLock.Unlock()
+
+	writeFilters(w, &newFilters)
+}
+
+func mergeFilters(w http.ResponseWriter, r *http.Request) {
+	var patch map[string]json.RawMessage
+	if !decodeFiltersBody(w, r, &patch) {
+		return
+	}
+
+	filtersLock.Lock()
+	defer filtersLock.Unlock()
+
+	// Aplica o patch sobre a representação JSON de uma cópia dos filtros
+	// atuais, assim os nomes dos campos seguem as tags json de Filters.
+	current, err := json.Marshal(filters)
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, "internal", "Erro ao codificar filtros")
+		return
+	}
+	var merged map[string]json.RawMessage
+	if err := json.Unmarshal(current, &merged); err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, "internal", "Erro ao codificar filtros")
+		return
+	}
+	for key, value := range patch {
+		if _, ok := merged[key]; !ok {
+			writeJSONError(w, r, http.StatusBadRequest, "unknown_filter", fmt.Sprintf("Filtro desconhecido: %s", key))
+			return
+		}
+		merged[key] = value
+	}
+
+	body, err := json.Marshal(merged)
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, "internal", "Erro ao codificar filtros")
+		return
+	}
+	var newFilters Filters
+	if err := json.Unmarshal(body, &newFilters); err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, "invalid_body", "Erro ao decodificar filtros")
+		return
+	}
+	if err := validateFilters(&newFilters); err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, "invalid_filters", err.Error())
+		return
+	}
+
+	filters = &newFilters
+	saveFilters("filters.json", filters)
+
+	writeFilters(w, &newFilters)
+}
+
+// decodeFiltersBody decodifica o corpo de /updateFilters em v, recusando
+// campos desconhecidos e qualquer coisa depois do objeto. Em caso de erro,
+// responde 400 e devolve false.
+func decodeFiltersBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil && dec.Decode(&struct{}{}) != io.EOF {
+		err = errors.New("dados após o objeto JSON")
+	}
+	if err == nil {
+		return true
+	}
+
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		writeJSONError(w, r, http.StatusBadRequest, "unknown_filter", fmt.Sprintf("Filtro desconhecido: %s", strings.Trim(field, `"`)))
+		return false
+	}
+	writeJSONError(w, r, http.StatusBadRequest, "invalid_body", "Erro ao decodificar filtros")
+	return false
+}
+
+// writeFilters responde com os filtros em vigor, para o cliente confirmar o
+// que foi aplicado.
+func writeFilters(w http.ResponseWriter, f *Filters) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f)
+}
+
+func validateFilters(f *Filters) error {
+	switch f.ReportSource {
+	case "", reportSourceOfficial, reportSourceCommunity:
+	default:
+		return fmt.Errorf("reportSource inválido, use official, community ou vazio")
+	}
+
+	if f.MinJamLevel < 0 || f.MinJamLevel > 5 {
+		return fmt.Errorf("minJamLevel inválido, use de 0 a 5")
+	}
+	if f.MinJamSpeedDrop < 0 {
+		return fmt.Errorf("minJamSpeedDrop inválido, use 0 ou mais")
+	}
+
+	// Um trecho vazio estaria contido em qualquer rua.
+	for name, parts := range map[string][]string{"streets": f.Streets, "excludeStreets": f.ExcludeStreets} {
+		for _, part := range parts {
+			if strings.TrimSpace(part) == "" {
+				return fmt.Errorf("%s inválido, não use trechos vazios", name)
+			}
+		}
+	}
+
+	f.windows = nil
+	if len(f.Windows) > 0 {
+		f.windows = make(map[string][]activeWindow)
+	}
+	for alertType, windows := range f.Windows {
+		for _, w := range windows {
+			parsed, err := parseActiveWindow(w)
+			if err != nil {
+				return fmt.Errorf("windows inválido para %s: %v", alertType, err)
+			}
+			f.windows[alertType] = append(f.windows[alertType], parsed)
+		}
+	}
+	return nil
+}
+
+func handleIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "Bem-vindo ao servidor de alertas do Waze\n\n")
+	fmt.Fprintf(w, "Para ver os alertas, acesse /alerts (?format=raw|rendered|both)\n")
+	fmt.Fprintf(w, "Para receber os alertas em tempo real, acesse /events\n")
+	fmt.Fprintf(w, "Para configurar os filtros, acesse /filters\n")
+	fmt.Fprintf(w, "Para ver os wazers conectados, acesse /wazers\n")
+	fmt.Fprintf(w, "Para ver alertas e wazers numa só resposta, acesse /feed\n")
+	fmt.Fprintf(w, "Para ver as estatísticas, acesse /stats\n")
+}
+
+// handleAlerts aceita ?format=raw|rendered|both (padrão both). A mensagem
+// renderizada é a mesma enviada ao Telegram e ao /events.
+func handleAlerts(w http.ResponseWriter, r *http.Request) {
+	format, ok := alertsFormat(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	alertsLock.Lock()
+	defer alertsLock.Unlock()
+
+	json.NewEncoder(w).Encode(alertEntries(alerts, format))
+}
+
+// alertsFormat lê ?format=raw|rendered|both (padrão both), respondendo 400
+// a um valor inválido.
+func alertsFormat(w http.ResponseWriter, r *http.Request) (string, bool) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "both"
+	}
+	if format != "raw" && format != "rendered" && format != "both" {
+		writeJSONError(w, r, http.StatusBadRequest, "invalid_parameter", "Formato inválido, use raw, rendered ou both")
+		return "", false
+	}
+	return format, true
+}
+
+// alertEntries monta a lista de alertas no formato de /alerts.
+func alertEntries(list []map[string]interface{}, format string) interface{} {
+	if format == "raw" {
+		return list
+	}
+
+	entries := make([]map[string]interface{}, 0, len(list))
+	for _, alert := range list {
+		entry := map[string]interface{}{"message": renderAlert(alert)}
+		if format == "both" {
+			entry["raw"] = alert
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// handleFeed junta numa resposta os alertas guardados (sem uuids repetidos,
+// ficando a versão mais recente), a última contagem de motoristas e o pico
+// do período do relatório. Aceita o mesmo ?format de /alerts.
+func handleFeed(w http.ResponseWriter, r *http.Request) {
+	format, ok := alertsFormat(w, r)
+	if !ok {
+		return
+	}
+
+	alertsLock.Lock()
+	seen := make(map[string]bool, len(alerts))
+	latest := make([]map[string]interface{}, 0, len(alerts))
+	for i := len(alerts) - 1; i >= 0; i-- {
+		alertID, _ := alerts[i]["uuid"].(string)
+		if alertID != "" && seen[alertID] {
+			continue
+		}
+		seen[alertID] = true
+		latest = append(latest, alerts[i])
+	}
+	slices.Reverse(latest)
+	entries := alertEntries(latest, format)
+	alertsLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"wazersOnline":   wazersOnline.Get(),
+		"maxWazersToday": dailyWazersPeak.Get(clock.Now()),
+		"alerts":         entries,
+	})
+}
+
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, r, http.StatusInternalServerError, "streaming_unsupported", "Streaming não suportado")
+		return
+	}
+
+	notify := r.Context().Done()
+	client := make(chan struct{}, 1)
+
+	// Um cliente que reconecta informa o último id recebido e continua dali.
+	var sent int
+	if lastID, err := strconv.Atoi(r.Header.Get("Last-Event-ID")); err == nil && lastID > 0 {
+		sent = lastID
+	}
+	// Os avisos de resolvido não têm id: só vão os posteriores à conexão.
+	alertsLock.Lock()
+	resolvedSent := lastResolvedID
+	alertsLock.Unlock()
+
+	clientsLock.Lock()
+	if options.maxClients > 0 && len(clients) >= options.maxClients {
+		clientsLock.Unlock()
+		writeJSONError(w, r, http.StatusServiceUnavailable, "too_many_clients", "Limite de clientes atingido")
+		return
+	}
+	clients[client] = struct{}{}
+	clientsLock.Unlock()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Envia os cabeçalhos já, para o cliente saber que foi aceito.
+	flusher.Flush()
+	// O que já está no buffer vai logo, sem esperar o próximo alerta.
+	client <- struct{}{}
+
+	defer func() {
+		clientsLock.Lock()
+		delete(clients, client)
+		clientsLock.Unlock()
+		close(client)
+	}()
+
+	for {
+		select {
+		case <-notify:
+			logger("Cliente desconectado")
+			return
+		case <-client:
+			logger("Enviando eventos para o cliente")
+			var err error
+			if sent, err = writeEvents(w, flusher, sent); err != nil {
+				logger(fmt.Sprintf("Cliente desconectado: %v", err))
+				return
+			}
+			if resolvedSent, err = writeResolvedEvents(w, flusher, resolvedSent); err != nil {
+				logger(fmt.Sprintf("Cliente desconectado: %v", err))
+				return
+			}
+		}
+	}
+}
+
+// writeResolvedEvents envia os avisos de resolvido posteriores a after, sem
+// "id:", para não mexer no Last-Event-ID dos alertas.
+func writeResolvedEvents(w http.ResponseWriter, flusher http.Flusher, after int) (int, error) {
+	alertsLock.Lock()
+	pending := append([]map[string]interface{}(nil), resolvedEvents...)
+	last := lastResolvedID
+	alertsLock.Unlock()
+
+	if missed := last - after; missed < len(pending) {
+		pending = pending[len(pending)-missed:]
+	}
+	for i, event := range pending {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return after + i, err
+		}
+		if _, err := fmt.Fprintf(w, "event: resolved\ndata: %s\n\n", data); err != nil {
+			return after + i, err
+		}
+		flusher.Flush()
+	}
+	return last, nil
+}
+
+// writeEvents envia os alertas com id maior que after e retorna o id do último
+// enviado; um erro indica que a conexão caiu sem que o contexto da requisição
+// tenha sido cancelado. Se after já saiu do buffer, um evento "gap" avisa
+// quantos alertas se perderam antes do que ainda está disponível.
+func writeEvents(w http.ResponseWriter, flusher http.Flusher, after int) (int, error) {
+	alertsLock.Lock()
+	pending := append([]map[string]interface{}(nil), alerts...)
+	last := lastEventID
+	alertsLock.Unlock()
+
+	// Um id maior que o último publicado vem de antes de um reinício: o
+	// cliente recebe o buffer inteiro.
+	if after > last {
+		after = 0
+	}
+	first := last - len(pending) + 1
+	if missed := first - after - 1; after > 0 && missed > 0 {
+		if _, err := fmt.Fprintf(w, "event: gap\ndata: {\"missed\": %d}\n\n", missed); err != nil {
+			return after, err
+		}
+		flusher.Flush()
+	}
+	if after >= first {
+		pending = pending[after-first+1:]
+	}
+
+	id := last - len(pending)
+	for _, alert := range pending {
+		id++
+		// Alertas já resolvidos não são reenviados a quem chega depois.
+		if alert["resolvedAt"] != nil {
+			continue
+		}
+		message := renderAlert(alert)
+		if message == "" {
+			continue
+		}
+		// Cada linha da mensagem precisa do seu próprio "data:".
+		var event strings.Builder
+		fmt.Fprintf(&event, "id: %d\n", id)
+		for _, line := range strings.Split(message, "\n") {
+			fmt.Fprintf(&event, "data: %s\n", line)
+		}
+		event.WriteString("\n")
+		if _, err := io.WriteString(w, event.String()); err != nil {
+			return id - 1, err
+		}
+		flusher.Flush()
+		logger("Evento enviado")
+	}
+	return last, nil
+}
+
+// connectedClients retorna quantos clientes estão conectados em /events.
+func connectedClients() int {
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+	return len(clients)
+}
+
+// handleWazers expõe o máximo acumulado desde o último relatório, sem
+// zerá-lo; apenas sendWazersReport reinicia a contagem.
+func handleWazers(w http.ResponseWriter, r *http.Request) {
+	lastWazersReportLock.Lock()
+	lastReport := lastWazersReport
+	lastWazersReportLock.Unlock()
+
+	since := clock.Now().Sub(lastReport)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"wazersOnline":           wazersOnline.Get(),
+		"maxWazersOnline":        maxWazersOnline.Get(),
+		"lastReport":             lastReport,
+		"sinceLastReport":        since.Round(time.Second).String(),
+		"sinceLastReportSeconds": int(since.Seconds()),
+	})
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"version":   version,
+		"gitCommit": gitCommit,
+		"buildTime": buildTime,
+		"goVersion": runtime.Version(),
+	})
+}
+
+// handleDebugAlert mostra um alerta publicado (da memória ou do arquivo de
+// alertas): o JSON original do Waze, a mensagem renderizada e como os
+// filtros e a entrega o tratam agora.
+func handleDebugAlert(w http.ResponseWriter, r *http.Request) {
+	alertID := strings.TrimPrefix(r.URL.Path, "/debug/alerts/")
+	if alertID == "" {
+		writeJSONError(w, r, http.StatusBadRequest, "missing_uuid", "Informe o uuid: /debug/alerts/<uuid>")
+		return
+	}
+
+	alert, source := findAlert(alertID)
+	if alert == nil {
+		writeJSONError(w, r, http.StatusNotFound, "not_found", "Alerta não encontrado")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"source":   source,
+		"alert":    alert,
+		"rendered": renderAlert(alert),
+		"matched":  explainAlert(alert),
+	})
+}
+
+// Motivos contados em suppressions.
+const (
+	suppressedMaxAge       = "maxAge"
+	suppressedDedup        = "dedup"
+	suppressedCrossSource  = "crossSource"
+	suppressedFilters      = "filters"
+	suppressedActiveWindow = "activeWindow"
+	suppressedSeverity     = "severity"
+	suppressedJamSize      = "jamSize"
+	suppressedChitChat     = "chitChat"
+	suppressedQueueFull    = "queueFull"
+)
+
+const debugDedupLimit = 20
+
+// handleDebugDedup mostra o conjunto de uuids processados, os mais recentes
+// (?limit=N, padrão 20) e quantos alertas cada barreira segurou na última
+// hora. Exige ADMIN_TOKEN, já que expõe os uuids.
+func handleDebugDedup(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	limit := debugDedupLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeJSONError(w, r, http.StatusBadRequest, "invalid_parameter", "Parâmetro limit inválido")
+			return
+		}
+		limit = n
+	}
+
+	type seenAlert struct {
+		UUID string    `json:"uuid"`
+		Seen time.Time `json:"seen"`
+	}
+	recent := []seenAlert{}
+	for alertID, seen := range processedAlerts.Timestamps() {
+		recent = append(recent, seenAlert{alertID, seen})
+	}
+	sort.Slice(recent, func(i, j int) bool {
+		if !recent[i].Seen.Equal(recent[j].Seen) {
+			return recent[i].Seen.After(recent[j].Seen)
+		}
+		return recent[i].UUID < recent[j].UUID
+	})
+	size := len(recent)
+	if len(recent) > limit {
+		recent = recent[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"processed":          size,
+		"window":             options.dedupWindow.String(),
+		"maxSize":            options.dedupMaxSize,
+		"recent":             recent,
+		"suppressedLastHour": suppressions.Counts(clock.Now().Add(-time.Hour)),
+	})
+}
+
+// findAlert procura o uuid entre os alertas publicados desde o início do
+// processo e, depois, no arquivo (archivePath), do dia mais recente ao mais
+// antigo.
+func findAlert(alertID string) (map[string]interface{}, string) {
+	alertsLock.Lock()
+	for i := len(alerts) - 1; i >= 0; i-- {
+		if alerts[i]["uuid"] == alertID {
+			alert := alerts[i]
+			alertsLock.Unlock()
+			return alert, "memory"
+		}
+	}
+	alertsLock.Unlock()
+
+	if archive == nil {
+		return nil, ""
+	}
+	alert, err := archive.Find(alertID)
+	if err != nil {
+		logger(fmt.Sprintf("ERROR: can't search archive: %v", err))
+	}
+	if alert == nil {
+		return nil, ""
+	}
+	return alert, "archive"
+}
+
+// explainAlert descreve cada decisão que renderAlert e notifyAlert tomariam
+// para o alerta com os filtros e a configuração atuais.
+func explainAlert(alert map[string]interface{}) map[string]interface{} {
+	alertType, _ := alert["type"].(string)
+
+	filtersLock.Lock()
+	filterName, typeEnabled := typeFilter(filters, alertType)
+	zone := zoneAllowed(filters.Zones, alert)
+	source := reportSourceAllowed(filters.ReportSource, alert)
+	street := streetAllowed(filters.Streets, filters.ExcludeStreets, alert)
+	jamThreshold := jamThresholdAllowed(filters, alert)
+	subtype := subtypeAllowed(filters, alert)
+	reporter := reporterAllowed(filters, alert)
+	filtersLock.Unlock()
+
+	handler := "handleAlert"
+	if alertType == "CHIT_CHAT" {
+		handler = "handleChitChat"
+	}
+
+	delivery := "immediate"
+	switch {
+	case options.digestInterval > 0 && !options.digestImmediate[alertType]:
+		delivery = "digest"
+	case clusterer != nil && options.clusterTypes[alertType]:
+		delivery = "cluster"
+	}
+
+	return map[string]interface{}{
+		"typeFilter":   map[string]interface{}{"name": filterName, "enabled": typeEnabled},
+		"zone":         zone,
+		"reportSource": source,
+		"street":       street,
+		"jamThreshold": jamThreshold,
+		"subtype":      subtype,
+		"reportBy":     reporter,
+		"severity":     map[string]interface{}{"score": alertSeverity(alert), "min": options.minSeverity},
+		"handler":      handler,
+		"activeWindow": withinActiveWindow(alertType, clock.Now()),
+		"delivery":     delivery,
+	}
+}
+
+// schemaTypes são os documentos servidos em /schema/<nome>.
+var schemaTypes = map[string]reflect.Type{
+	"filters": reflect.TypeOf(Filters{}),
+	"config":  reflect.TypeOf(Config{}),
+}
+
+// handleSchema serve o JSON Schema de filters.json (também aceito por
+// /updateFilters) e de config.json, gerado a partir das structs.
+func handleSchema(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/schema/")
+	t, ok := schemaTypes[name]
+	if !ok {
+		writeJSONError(w, r, http.StatusNotFound, "not_found", "Schema não encontrado, use /schema/filters ou /schema/config")
+		return
+	}
+
+	schema := jsonSchema(t)
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = t.Name()
+	w.Header().Set("Content-Type", "application/schema+json")
+	json.NewEncoder(w).Encode(schema)
+}
+
+// jsonSchema descreve t como o encoding/json o (de)codifica: usa as tags
+// json dos campos e a tag enum (valores separados por vírgula) quando houver.
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": []string{"array", "null"}, "items": jsonSchema(t.Elem())}
+	case reflect.Array:
+		return map[string]interface{}{
+			"type":     "array",
+			"items":    jsonSchema(t.Elem()),
+			"minItems": t.Len(),
+			"maxItems": t.Len(),
+		}
+	case reflect.Map:
+		return map[string]interface{}{"type": []string{"object", "null"}, "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			property := jsonSchema(field.Type)
+			if enum, ok := field.Tag.Lookup("enum"); ok {
+				property["enum"] = strings.Split(enum, ",")
+			}
+			properties[name] = property
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+	}
+	return map[string]interface{}{}
+}
+
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	now := clock.Now()
+	windows := make(map[string]map[string]int)
+	for _, window := range []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"1h", time.Hour},
+		{"24h", 24 * time.Hour},
+	} {
+		counts := alertStats.Counts(now.Add(-window.duration))
+		total := 0
+		for _, count := range counts {
+			total += count
+		}
+		counts["total"] = total
+		windows[window.name] = counts
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"generatedAt":      now,
+		"windows":          windows,
+		"peakWazersOnline": maxWazersOnline.Get(),
+		"wazersOnline":     wazersOnline.Get(),
+		"dbWrites":         db.Writes(),
+		"dryRunSent":       dryRunSent.Get(),
+		"breakers":         breakerStates(),
+		"alertsQueue": map[string]int{
+			"length":   len(alertsCh),
+			"capacity": cap(alertsCh),
+			"dropped":  droppedAlerts.Get(),
+		},
+		"sseClients": map[string]int{
+			"connected": connectedClients(),
+			"max":       options.maxClients,
+		},
+		"jamThresholds": map[string]interface{}{
+			"minLengthMeters": options.minJamLength,
+			"minDelaySeconds": options.minJamDelay,
+			"dropWithoutData": options.dropJamsWithoutData,
+		},
+	})
+}
+
+func breakerStates() map[string]string {
+	return map[string]string{
+		alertsBreaker.name:    alertsBreaker.State(),
+		broadcastBreaker.name: broadcastBreaker.State(),
+	}
+}
+
+// htmlRoutes são as páginas feitas para o navegador; nelas os erros seguem em
+// texto, a não ser que o cliente peça JSON no Accept.
+var htmlRoutes = map[string]bool{"/": true, "/filters": true}
+
+// apiError é o corpo de erro das rotas de API: error traz a mensagem e code
+// um identificador estável para quem consome a API.
+type apiError struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// writeJSONError responde com o status e {"error": message, "code": code}.
+// Nas páginas HTML, mantém o texto simples do http.Error.
+func writeJSONError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if htmlRoutes[r.URL.Path] && !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		http.Error(w, message, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{Error: message, Code: code})
+}
+
+// authorizeAdmin confere o token de administração e responde com o erro
+// quando ele não confere.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if adminToken == "" {
+		writeJSONError(w, r, http.StatusForbidden, "admin_disabled", "Administração desativada (defina ADMIN_TOKEN)")
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		logger(fmt.Sprintf("admin: acesso negado a %s de %s", r.URL.Path, r.RemoteAddr))
+		writeJSONError(w, r, http.StatusUnauthorized, "unauthorized", "Não autorizado")
+		return false
+	}
+	return true
+}
+
+// handleAdminReset limpa os uuids processados (what=processed), o pico de
+// motoristas (what=wazers) ou ambos (what=all) e grava o estado no db.json.
+func handleAdminReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "Método não permitido")
+		return
+	}
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	what := r.URL.Query().Get("what")
+	if what != "processed" && what != "wazers" && what != "all" {
+		writeJSONError(w, r, http.StatusBadRequest, "invalid_parameter", "Parâmetro what inválido (use processed, wazers ou all)")
+		return
+	}
+
+	cleared := make(map[string]int)
+	if what == "processed" || what == "all" {
+		cleared["processedAlerts"] = processedAlerts.Clear()
+		db.SetProcessedAlerts(processedAlerts)
+	}
+	if what == "wazers" || what == "all" {
+		cleared["maxWazersOnline"] = maxWazersOnline.GetAndReset()
+		db.SetMaxWazersOnline(maxWazersOnline)
+	}
+
+	logger(fmt.Sprintf("admin: reset %s por %s (%s): %v", what, r.RemoteAddr, r.UserAgent(), cleared))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"cleared": cleared})
+}
+
+// notificationsPaused suspende o envio aos destinos externos (Telegram,
+// Discord, webhook); os alertas continuam sendo processados, guardados e
+// transmitidos em /events.
+var notificationsPaused atomic.Bool
+
+// handlePause atende POST /pause (paused = true) e POST /resume, com o mesmo
+// token dos endpoints /admin/.
+func handlePause(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSONError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "Método não permitido")
+			return
+		}
+		if !authorizeAdmin(w, r) {
+			return
+		}
+
+		if notificationsPaused.Swap(paused) != paused {
+			state := "retomadas"
+			if paused {
+				state = "pausadas"
+			}
+			logger(fmt.Sprintf("admin: notificações %s por %s (%s)", state, r.RemoteAddr, r.UserAgent()))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"paused": paused})
+	}
+}
+
+// replayBusy impede dois replays simultâneos.
+var replayBusy = make(chan struct{}, 1)
+
+// handleReplay reenvia os alertas publicados desde ?since=<RFC3339>,
+// sem passar pela deduplicação, janelas ou resumo. Com ?notifier=<nome>,
+// envia só a esse destino (ex.: um canal recém-criado). O envio segue em
+// segundo plano, um alerta a cada replayInterval.
+func handleReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "Método não permitido")
+		return
+	}
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	since, err := time.Parse(time.RFC3339, r.URL.Query().Get("since"))
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, "invalid_parameter", "Parâmetro since inválido (use RFC3339, ex.: 2024-03-11T08:00:00-03:00)")
+		return
+	}
+
+	targets := notifiers
+	if name := r.URL.Query().Get("notifier"); name != "" {
+		targets = nil
+		for _, notifier := range notifiers {
+			if notifier.Name() == name {
+				targets = append(targets, notifier)
+			}
+		}
+		if len(targets) == 0 {
+			writeJSONError(w, r, http.StatusBadRequest, "unknown_notifier", fmt.Sprintf("Destino %q não está ativo", name))
+			return
+		}
+	}
+
+	var replay []map[string]interface{}
+	alertsLock.Lock()
+	for _, alert := range alerts {
+		pubMillis, _ := alert["pubMillis"].(float64)
+		if pubMillis >= float64(since.UnixMilli()) {
+			replay = append(replay, alert)
+		}
+	}
+	alertsLock.Unlock()
+
+	select {
+	case replayBusy <- struct{}{}:
+	default:
+		writeJSONError(w, r, http.StatusConflict, "replay_in_progress", "Já existe um replay em andamento")
+		return
+	}
+
+	logger(fmt.Sprintf("admin: replay de %d alertas desde %s por %s", len(replay), since.Format(time.RFC3339), r.RemoteAddr))
+	go func() {
+		defer func() { <-replayBusy }()
+		runReplay(targets, replay, options.replayInterval)
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int{"replaying": len(replay)})
+}
+
+// runReplay envia os alertas aos destinos, esperando interval entre eles.
+func runReplay(targets []Notifier, replay []map[string]interface{}, interval time.Duration) {
+	for i, alert := range replay {
+		if i > 0 {
+			<-clock.After(interval)
+		}
+		if message := renderAlert(alert); message != "" {
+			deliverAlert(targets, alert, message)
+		}
+	}
+	logger(fmt.Sprintf("admin: replay concluído (%d alertas)", len(replay)))
+}
+
+// handleHealthz responde "degraded" enquanto algum circuito do Waze não
+// estiver fechado ou o broker MQTT estiver fora do ar; o servidor em si
+// continua saudável.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	states := breakerStates()
+	status := "ok"
+	for _, state := range states {
+		if state != breakerClosed {
+			status = "degraded"
+		}
+	}
+
+	health := map[string]interface{}{
+		"breakers": states,
+		"paused":   notificationsPaused.Load(),
+	}
+	for _, notifier := range notifiers {
+		if mqtt, ok := notifier.(*MQTTNotifier); ok {
+			health["mqtt"] = mqtt.Connected()
+			if !mqtt.Connected() {
+				status = "degraded"
+			}
+		}
+	}
+	health["status"] = status
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(health)
+}
+
+func handleFilters(w http.ResponseWriter, r *http.Request) {
+	html := `
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<title>Configurar Filtros</title>
+	</head>
+	<body>
+		<h1>Configurar Filtros</h1>
+		<form id="filterForm">
+			<label><input type="checkbox" name="chitChat"> Comentário</label><br>
+			<label><input type="checkbox" name="police"> Polícia</label><br>
+			<label><input type="checkbox" name="jam"> Congestionamento</label><br>
+			<label><input type="checkbox" name="accident"> Acidente</label><br>
+			<label><input type="checkbox" name="unknown"> Outros</label><br>
+			<label>Origem
+				<select name="reportSource">
+					<option value="">Todas</option>
+					<option value="official">Oficial (prefeitura)</option>
+					<option value="community">Comunidade</option>
+				</select>
+			</label><br>
+			<label>Nível mínimo de congestionamento (0 a 5) <input type="number" name="minJamLevel" min="0" max="5" value="0"></label><br>
+			<label>Queda mínima de velocidade (km/h) <input type="number" name="minJamSpeedDrop" min="0" value="0"></label><br>
+			<button type="submit">Salvar</button>
+		</form>
+		<script>
+			// Preenche com os filtros atuais e envia todos os campos do
+			// formulário num PATCH, para não apagar os que ele não mostra
+			// (janelas, zonas, ruas, subtipos, autores).
+			const form = document.getElementById('filterForm');
+			const current = {{filters}};
+			for (const input of form.elements) {
+				if (!(input.name in current)) {
+					continue;
+				}
+				if (input.type === 'checkbox') {
+					input.checked = current[input.name];
+				} else {
+					input.value = current[input.name];
+				}
+			}
+			form.addEventListener('submit', function(event) {
+				event.preventDefault();
+				const filters = {};
+				for (const input of this.elements) {
+					if (!input.name) {
+						continue;
+					}
+					if (input.type === 'checkbox') {
+						filters[input.name] = input.checked;
+					} else if (input.type === 'number') {
+						filters[input.name] = Number(input.value);
+					} else {
+						filters[input.name] = input.value;
+					}
+				}
+				fetch('/updateFilters', {
+					method: 'PATCH',
+					headers: {
+						'Content-Type': 'application/json',
+					},
+					body: JSON.stringify(filters),
+				}).then((response) => {
+					if (!response.ok) {
+						return response.json().then((body) => { throw new Error(body.error); });
+					}
+					alert('Filtros atualizados com sucesso');
+				}).catch((error) => {
+					alert(error.message || 'Erro ao atualizar filtros');
+					console.error(error);
+				});
+			});
+		</script>
+	</body>
+	</html>
+	`
+	// json.Marshal escapa <, > e &, então o objeto pode ir direto no script.
+	filtersLock.Lock()
+	current, err := json.Marshal(filters)
+	filtersLock.Unlock()
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, "internal", "Erro ao codificar filtros")
+		return
+	}
+	fmt.Fprint(w, strings.Replace(html, "{{filters}}", string(current), 1))
+}
+
+// renderAlert formata o alerta de acordo com seu tipo, retornando "" quando
+// o tipo está desabilitado nos filtros.
+func renderAlert(alert map[string]interface{}) string {
+	message := formatAlert(alert)
+	if message == "" {
+		return ""
+	}
+
+	if engagement := alertEngagement(alert); engagement != "" {
+		message += "\n" + engagement
+	}
+	if age, ok := alertAge(alert); ok {
+		message += "\n⏱️ " + formatAge(age)
+	}
+	if reannounce, _ := alert["reannounce"].(bool); reannounce {
+		message = tr("alert.stillActive") + "\n" + message
+	}
+	return message
+}
+
+// alertEngagement resume as confirmações (nThumbsUp), os comentários
+// (nComments e o mais recente) e o nível de quem reportou (reportRating);
+// cada linha só aparece quando o campo vem no alerta.
+func alertEngagement(alert map[string]interface{}) string {
+	var lines []string
+
+	if thumbs, ok := alert["nThumbsUp"].(float64); ok && thumbs > 0 {
+		label := tr("alert.confirmations")
+		if thumbs == 1 {
+			label = tr("alert.confirmation")
+		}
+		lines = append(lines, fmt.Sprintf("👍 %d %s", int(thumbs), label))
+	}
+
+	count := ""
+	if n, ok := alert["nComments"].(float64); ok && n > 0 {
+		label := tr("alert.comments")
+		if n == 1 {
+			label = tr("alert.comment")
+		}
+		count = fmt.Sprintf("%d %s", int(n), label)
+	}
+	switch comment := latestComment(alert); {
+	case comment != "" && count != "":
+		lines = append(lines, fmt.Sprintf("💬 \"%s\" (%s)", comment, count))
+	case comment != "":
+		lines = append(lines, fmt.Sprintf("💬 \"%s\"", comment))
+	case count != "":
+		lines = append(lines, "💬 "+count)
+	}
+
+	if rating, ok := alert["reportRating"].(float64); ok && rating > 0 {
+		lines = append(lines, tr("alert.reporterRank", int(rating)))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// latestComment retorna o texto do comentário com maior reportMillis (ou o
+// último da lista, se não houver horário).
+func latestComment(alert map[string]interface{}) string {
+	comments, ok := alert["comments"].([]interface{})
+	if !ok {
+		return ""
+	}
+
+	var latest string
+	var latestMillis float64 = -1
+	for _, raw := range comments {
+		comment, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		text, _ := comment["text"].(string)
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		millis, _ := comment["reportMillis"].(float64)
+		if millis >= latestMillis {
+			latest, latestMillis = text, millis
+		}
+	}
+	return latest
+}
+
+func formatAlert(alert map[string]interface{}) string {
+	filtersLock.Lock()
+	defer filtersLock.Unlock()
+
+	if !zoneAllowed(filters.Zones, alert) || !reportSourceAllowed(filters.ReportSource, alert) ||
+		!streetAllowed(filters.Streets, filters.ExcludeStreets, alert) || !jamThresholdAllowed(filters, alert) {
+		return ""
+	}
+
+	alertType, _ := alert["type"].(string)
+	if _, enabled := typeFilter(filters, alertType); !enabled {
+		return ""
+	}
+	if !subtypeAllowed(filters, alert) || !reporterAllowed(filters, alert) {
+		return ""
+	}
+	if alertType == "CHIT_CHAT" {
+		return handleChitChat(alert)
+	}
+	return handleAlert(alert)
+}
+
+// subtypeAllowed aplica Subtypes e ExcludeSubtypes, sem diferenciar
+// maiúsculas. Os subtipos do Waze começam pelo tipo ("HAZARD_..."), e é por
+// esse prefixo que Subtypes sabe quais tipos restringe.
+func subtypeAllowed(f *Filters, alert map[string]interface{}) bool {
+	subtype, _ := alert["subtype"].(string)
+	if subtype == "" {
+		return true
+	}
+	for _, excluded := range f.ExcludeSubtypes {
+		if strings.EqualFold(subtype, excluded) {
+			return false
+		}
+	}
+
+	alertType, _ := alert["type"].(string)
+	restricted := false
+	for _, included := range f.Subtypes {
+		if strings.EqualFold(subtype, included) {
+			return true
+		}
+		if len(included) > len(alertType) && strings.EqualFold(included[:len(alertType)+1], alertType+"_") {
+			restricted = true
+		}
+	}
+	return !restricted
+}
+
+// reporterAllowed aplica ExcludeReportBy e ReportByWhitelist ao autor do
+// alerta. Os congestionamentos da lista "jams" (consumeJams) são calculados
+// pelo Waze, não relatados, e por isso nunca caem por esses filtros.
+func reporterAllowed(f *Filters, alert map[string]interface{}) bool {
+	if source, _ := alert["source"].(string); source == "jams" {
+		return true
+	}
+	reporter, _ := alert["reportBy"].(string)
+	reporter = strings.TrimSpace(reporter)
+	if reporter == "" {
+		return len(f.ReportByWhitelist) == 0
+	}
+	listed := func(names []string) bool {
+		for _, name := range names {
+			if strings.EqualFold(reporter, strings.TrimSpace(name)) {
+				return true
+			}
+		}
+		return false
+	}
+	if listed(f.ExcludeReportBy) {
+		return false
+	}
+	return len(f.ReportByWhitelist) == 0 || listed(f.ReportByWhitelist)
+}
+
+// typeFilter retorna o filtro (pelo nome no filters.json) que decide se o
+// tipo é enviado e se ele está ligado.
+func typeFilter(f *Filters, alertType string) (string, bool) {
+	switch alertType {
+	case "CHIT_CHAT":
+		return "chitChat", f.ChitChat
+	case "POLICE", "POLICEMAN":
+		return "police", f.Police
+	case "JAM":
+		return "jam", f.Jam
+	case "ACCIDENT":
+		return "accident", f.Accident
+	}
+	return "unknown", f.Unknown
+}
+
+// alertAge calcula a idade do alerta a partir de pubMillis. Valores ausentes
+// ou inválidos resultam em ok == false.
+func alertAge(alert map[string]interface{}) (time.Duration, bool) {
+	pubMillis, ok := alert["pubMillis"].(float64)
+	if !ok || pubMillis <= 0 {
+		return 0, false
+	}
+
+	age := clock.Now().Sub(time.UnixMilli(int64(pubMillis)))
+	if age < 0 {
+		return 0, false
+	}
+	return age, true
+}
+
+func formatAge(age time.Duration) string {
+	switch {
+	case age < time.Minute:
+		return tr("age.now")
+	case age < time.Hour:
+		return tr("age.minutes", int(age.Minutes()))
+	default:
+		return tr("age.hours", int(age.Hours()), int(age.Minutes())%60)
+	}
+}
+
+const (
+	reportSourceOfficial  = "official"
+	reportSourceCommunity = "community"
+)
+
+// officialReportField é o campo do alerta que indica um reporte oficial.
+// O Waze o envia como string ("true"/"false"), às vezes como booleano;
+// ajuste aqui se o feed mudar.
+const officialReportField = "reportByMunicipalityUser"
+
+func isOfficialReport(alert map[string]interface{}) bool {
+	switch v := alert[officialReportField].(type) {
+	case bool:
+		return v
+	case string:
+		return strings.EqualFold(v, "true")
+	}
+	return false
+}
+
+func reportSourceAllowed(source string, alert map[string]interface{}) bool {
+	switch source {
+	case reportSourceOfficial:
+		return isOfficialReport(alert)
+	case reportSourceCommunity:
+		return !isOfficialReport(alert)
+	}
+	return true
+}
+
+// jamLevel lê o nível do congestionamento (0 livre a 5 parado), de level
+// ou, nos JAM da lista de alertas, do subtipo.
+func jamLevel(alert map[string]interface{}) (float64, bool) {
+	if level, ok := alert["level"].(float64); ok {
+		return level, true
+	}
+	subtype, _ := alert["subtype"].(string)
+	if level, known := jamSubtypeLevels[subtype]; known {
+		return float64(level), true
+	}
+	return 0, false
+}
+
+// defaultSeverityScores é a pontuação base (0–100) por subtipo ou, quando o
+// subtipo não está na tabela, por tipo; os demais ficam com defaultSeverity.
+var defaultSeverityScores = map[string]int{
+	"ACCIDENT":                   70,
+	"ACCIDENT_MINOR":             60,
+	"ACCIDENT_MAJOR":             90,
+	"ROAD_CLOSED":                60,
+	"HAZARD":                     40,
+	"HAZARD_ON_ROAD_OBJECT":      50,
+	"HAZARD_ON_ROAD_CAR_STOPPED": 50,
+	"HAZARD_WEATHER_FLOOD":       70,
+	"JAM":                        20,
+	"POLICE":                     20,
+	"CHIT_CHAT":                  5,
+}
+
+const defaultSeverity = 30
+
+// alertSeverity pontua o alerta de 0 a 100: a base da tabela, mais 10 por
+// nível nos congestionamentos, ponderada pela confiabilidade do Waze
+// (reliability, de 0 a 10), que mantém de metade a toda a pontuação.
+func alertSeverity(alert map[string]interface{}) int {
+	alertType, _ := alert["type"].(string)
+	subtype, _ := alert["subtype"].(string)
+
+	score, ok := options.severityScores[subtype]
+	if subtype == "" || !ok {
+		if score, ok = options.severityScores[alertType]; !ok {
+			score = defaultSeverity
+		}
+	}
+	if alertType == "JAM" {
+		if level, ok := jamLevel(alert); ok {
+			score += int(level) * 10
+		}
+	}
+	if reliability, ok := alert["reliability"].(float64); ok {
+		reliability = math.Max(0, math.Min(reliability, 10))
+		score = int(math.Round(float64(score) * (0.5 + reliability/20)))
+	}
+	return max(0, min(score, 100))
+}
+
+// jamSubtypeLevels traduz os subtipos de JAM da lista de alertas, que não
+// trazem level, para a escala de nível da lista de congestionamentos.
+var jamSubtypeLevels = map[string]int{
+	"JAM_LIGHT_TRAFFIC":       1,
+	"JAM_MODERATE_TRAFFIC":    2,
+	"JAM_HEAVY_TRAFFIC":       3,
+	"JAM_STAND_STILL_TRAFFIC": 4,
+}
+
+// jamThresholdAllowed aplica minJamLevel e minJamSpeedDrop aos JAM. O nível
+// vem de level (lista "jams") ou do subtipo; a queda de velocidade só existe
+// nos convertidos por jamAlerts (speedDropKMH).
+func jamThresholdAllowed(f *Filters, alert map[string]interface{}) bool {
+	if alertType, _ := alert["type"].(string); alertType != "JAM" {
+		return true
+	}
+
+	if f.MinJamLevel > 0 {
+		if level, ok := jamLevel(alert); ok && level < float64(f.MinJamLevel) {
+			return false
+		}
+	}
+	if f.MinJamSpeedDrop > 0 {
+		if drop, ok := alert["speedDropKMH"].(float64); ok && drop < f.MinJamSpeedDrop {
+			return false
+		}
+	}
+	return true
+}
+
+// streetAllowed aplica os filtros de rua ao nome em street ou, na falta
+// dele, em location.name.
+func streetAllowed(include, exclude []string, alert map[string]interface{}) bool {
+	street, _ := alert["street"].(string)
+	if street == "" {
+		location, _ := alert["location"].(map[string]interface{})
+		street, _ = location["name"].(string)
+	}
+	if street == "" {
+		return true
+	}
+
+	// Trechos vazios, que validateFilters já recusa, são ignorados: estariam
+	// contidos em qualquer rua.
+	street = foldText(street)
+	for _, part := range exclude {
+		if part := foldText(part); part != "" && strings.Contains(street, part) {
+			return false
+		}
+	}
+	if len(include) == 0 {
+		return true
+	}
+	for _, part := range include {
+		if part := foldText(part); part != "" && strings.Contains(street, part) {
+			return true
+		}
+	}
+	return false
+}
+
+var accentReplacer = strings.NewReplacer(
+	"á", "a", "à", "a", "â", "a", "ã", "a", "ä", "a",
+	"é", "e", "è", "e", "ê", "e", "ë", "e",
+	"í", "i", "ì", "i", "î", "i", "ï", "i",
+	"ó", "o", "ò", "o", "ô", "o", "õ", "o", "ö", "o",
+	"ú", "u", "ù", "u", "û", "u", "ü", "u",
+	"ç", "c", "ñ", "n",
+)
+
+// foldText normaliza o texto para comparação: minúsculas e sem acentos,
+// inclusive os escritos como marcas combinantes (forma NFD).
+func foldText(text string) string {
+	text = accentReplacer.Replace(strings.ToLower(strings.TrimSpace(text)))
+	return strings.Map(func(r rune) rune {
+		if r >= 0x300 && r <= 0x36f {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+func zoneAllowed(zones []string, alert map[string]interface{}) bool {
+	if len(zones) == 0 {
+		return true
+	}
+	zone, _ := alert["zone"].(string)
+	for _, allowed := range zones {
+		if zone == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func handleChitChat(alert map[string]interface{}) string {
+	reportBy := alert["reportBy"].(string)
+	location := alert["location"].(string)
+	zone, _ := alert["zone"].(string)
+
+	display, _ := alertDisplay(alert)
+
+	return fmt.Sprintf("[%s] %s", localTime(clock.Now()).Format("15:04:05"), tr("alert.chitChat", reportBy, display.Banner, location, zone))
+}
+
+func handleAlert(alert map[string]interface{}) string {
+	info := formatAlertData(alert)
+	header := alertHeader(alert)
+	if summary := jamSummary(alert); summary != "" {
+		header += "\n" + summary
+	}
+	if info == "" {
+		return fmt.Sprintf("[%s] %s", localTime(clock.Now()).Format("15:04:05"), header)
+	}
+	return fmt.Sprintf("[%s] %s\n```%s```", localTime(clock.Now()).Format("15:04:05"), header, info)
+}
+
+const defaultLang = "pt"
+
+// messageCatalogs guarda, por idioma, os textos enviados aos destinos. Os
+// valores são formatos do fmt; cada tradução deve manter os mesmos verbos na
+// mesma ordem.
+var messageCatalogs = map[string]map[string]string{
+	"pt": {
+		"alert.stillActive":          "🔁 Ainda ativo",
+		"alert.confirmation":         "confirmação",
+		"alert.confirmations":        "confirmações",
+		"alert.comment":              "comentário",
+		"alert.comments":             "comentários",
+		"alert.reporterRank":         "🏅 reportado por wazer nível %d",
+		"alert.unknownType":          "🤖 Tipo de notificação desconhecida",
+		"alert.chitChat":             "📢 %s deixou um comentário no mapa %s\nAnálise 🗺️: %s\nZona: %s",
+		"age.now":                    "agora",
+		"age.minutes":                "há %d min",
+		"age.hours":                  "há %dh%02d",
+		"jam.delay":                  "⏳ %.0f min de atraso em %.0f m",
+		"allClear.JAM":               "Congestionamento normalizado",
+		"allClear.ACCIDENT":          "Acidente liberado",
+		"allClear.other":             "%s encerrado",
+		"allClear.message":           "✅ %s na %s",
+		"chitChat.muted":             "🗣️ %s está muito ativo no mapa; novos comentários serão omitidos por %s",
+		"wazers.report":              "%d wazers conectados 🚙 🚕 🚚",
+		"wazers.window":              "🕐 %s–%s",
+		"wazers.peakAt":              ", pico às %s",
+		"wazers.up":                  "↑ +%d em relação ao período anterior (%d)",
+		"wazers.down":                "↓ -%d em relação ao período anterior (%d)",
+		"wazers.same":                "= igual ao período anterior (%d)",
+		"wazers.speed":               "🏎️ velocidade média %.0f km/h nos congestionamentos",
+		"wazers.threshold":           "🚗 mais de %d wazers online agora",
+		"digest.header":              "📋 Resumo dos últimos %s: %d alertas",
+		"cluster.header":             "📢 %d %s na %s %s",
+		"street.unknown":             "local desconhecido",
+		"discord.location":           "Local",
+		"discord.map":                "Mapa",
+		"telegram.ackButton":         "👁 visto",
+		"telegram.ackAnswer":         "Alerta marcado como visto (%d)",
+		"telegram.started":           "✅ Chat registrado: os alertas serão enviados aqui. Envie /stop para parar.",
+		"telegram.startedConfigured": "✅ Chat registrado, mas este bot usa os chats do TELEGRAM_CHAT_ID; os alertas só virão aqui se eles forem removidos.",
+		"telegram.stopped":           "Chat removido: os alertas não serão mais enviados aqui.",
+		"anomaly":                    "⚠️ atividade incomum: %d %s %s (o normal seria ~%.0f)",
+		"check.message":              "🔧 Mensagem de teste do Informa-Waze",
+		"lifecycle.started":          "🟢 Informa-Waze %s iniciado (commit %s)",
+		"lifecycle.stopping":         "🔴 Informa-Waze %s encerrando (commit %s)",
+		"period.lastHour":            "na última hora",
+		"period.last":                "nos últimos %s",
+	},
+	"en": {
+		"alert.stillActive":          "🔁 Still active",
+		"alert.confirmation":         "confirmation",
+		"alert.confirmations":        "confirmations",
+		"alert.comment":              "comment",
+		"alert.comments":             "comments",
+		"alert.reporterRank":         "🏅 reported by a level %d wazer",
+		"alert.unknownType":          "🤖 Unknown notification type",
+		"alert.chitChat":             "📢 %s left a comment on the map %s\nAnalysis 🗺️: %s\nZone: %s",
+		"age.now":                    "just now",
+		"age.minutes":                "%d min ago",
+		"age.hours":                  "%dh%02d ago",
+		"jam.delay":                  "⏳ %.0f min delay over %.0f m",
+		"allClear.JAM":               "Traffic back to normal",
+		"allClear.ACCIDENT":          "Accident cleared",
+		"allClear.other":             "%s ended",
+		"allClear.message":           "✅ %s on %s",
+		"chitChat.muted":             "🗣️ %s is very active on the map; new comments will be hidden for %s",
+		"wazers.report":              "%d wazers online 🚙 🚕 🚚",
+		"wazers.window":              "🕐 %s–%s",
+		"wazers.peakAt":              ", peak at %s",
+		"wazers.up":                  "↑ +%d compared to the previous period (%d)",
+		"wazers.down":                "↓ -%d compared to the previous period (%d)",
+		"wazers.same":                "= same as the previous period (%d)",
+		"wazers.speed":               "🏎️ average speed %.0f km/h in jams",
+		"wazers.threshold":           "🚗 more than %d wazers online right now",
+		"digest.header":              "📋 Summary of the last %s: %d alerts",
+		"cluster.header":             "📢 %d %s on %s %s",
+		"street.unknown":             "unknown location",
+		"discord.location":           "Location",
+		"discord.map":                "Map",
+		"telegram.ackButton":         "👁 seen",
+		"telegram.ackAnswer":         "Alert marked as seen (%d)",
+		"telegram.started":           "✅ Chat registered: alerts will be sent here. Send /stop to stop.",
+		"telegram.startedConfigured": "✅ Chat registered, but this bot uses the chats from TELEGRAM_CHAT_ID; alerts will only come here once those are removed.",
+		"telegram.stopped":           "Chat removed: alerts will no longer be sent here.",
+		"anomaly":                    "⚠️ unusual activity: %d %s %s (usually ~%.0f)",
+		"check.message":              "🔧 Informa-Waze test message",
+		"lifecycle.started":          "🟢 Informa-Waze %s started (commit %s)",
+		"lifecycle.stopping":         "🔴 Informa-Waze %s shutting down (commit %s)",
+		"period.lastHour":            "in the last hour",
+		"period.last":                "in the last %s",
+	},
+}
+
+// lookupMessage procura key no idioma configurado e, se faltar, em
+// português.
+func lookupMessage(key string) (string, bool) {
+	if message, ok := messageCatalogs[options.lang][key]; ok {
+		return message, true
+	}
+	message, ok := messageCatalogs[defaultLang][key]
+	return message, ok
+}
+
+// tr formata a mensagem key no idioma configurado. Chaves inexistentes
+// retornam a própria chave, para que o erro apareça na mensagem.
+func tr(key string, args ...interface{}) string {
+	format, ok := lookupMessage(key)
+	if !ok {
+		logger(fmt.Sprintf("WARNING: mensagem sem tradução: %s", key))
+		return key
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// AlertDisplay define como um tipo ou subtipo de alerta aparece: Label e
+// Banner no cabeçalho do alerta, Emoji e Plural no resumo e no Discord.
+type AlertDisplay struct {
+	Emoji  string `json:"emoji"`
+	Label  string `json:"label"`
+	Plural string `json:"plural"`
+	Banner string `json:"banner"`
+}
+
+var defaultAlertDisplays = map[string]AlertDisplay{
+	"CHIT_CHAT": {Emoji: "💭", Label: "Comentário", Plural: "Comentários", Banner: "💭"},
+	"POLICE":    {Emoji: "🚓", Label: "Polícia", Plural: "Polícia", Banner: "🚔"},
+	"POLICEMAN": {Emoji: "🚓", Label: "Polícia", Plural: "Polícia", Banner: "🚔"},
+	"JAM":       {Emoji: "🚗", Label: "Congestionamento", Plural: "Congestionamentos", Banner: "🚗🚕🚙"},
+	"ACCIDENT":  {Emoji: "💥", Label: "Acidente", Plural: "Acidentes", Banner: "🚙💥🚕"},
+}
+
+// knownAlertTypes são os tipos e subtipos publicados pelo Waze, aceitos
+// como chave de alertDisplays.
+var knownAlertTypes = []string{
+	"ACCIDENT", "ACCIDENT_MINOR", "ACCIDENT_MAJOR",
+	"JAM", "JAM_LIGHT_TRAFFIC", "JAM_MODERATE_TRAFFIC",
+	"JAM_HEAVY_TRAFFIC", "JAM_STAND_STILL_TRAFFIC",
+	"POLICE", "POLICEMAN", "POLICE_VISIBLE", "POLICE_HIDING",
+	"ROAD_CLOSED", "ROAD_CLOSED_HAZARD", "ROAD_CLOSED_CONSTRUCTION",
+	"ROAD_CLOSED_EVENT",
+	"HAZARD", "WEATHERHAZARD", "CONSTRUCTION", "MISC", "CHIT_CHAT",
+	"HAZARD_ON_ROAD", "HAZARD_ON_ROAD_OBJECT", "HAZARD_ON_ROAD_POT_HOLE",
+	"HAZARD_ON_ROAD_ROAD_KILL", "HAZARD_ON_ROAD_CAR_STOPPED",
+	"HAZARD_ON_ROAD_CONSTRUCTION", "HAZARD_ON_ROAD_LANE_CLOSED",
+	"HAZARD_ON_ROAD_OIL", "HAZARD_ON_ROAD_ICE",
+	"HAZARD_ON_ROAD_TRAFFIC_LIGHT_FAULT", "HAZARD_ON_ROAD_EMERGENCY_VEHICLE",
+	"HAZARD_ON_SHOULDER", "HAZARD_ON_SHOULDER_CAR_STOPPED",
+	"HAZARD_ON_SHOULDER_ANIMALS", "HAZARD_ON_SHOULDER_MISSING_SIGN",
+	"HAZARD_WEATHER", "HAZARD_WEATHER_FOG", "HAZARD_WEATHER_HAIL",
+	"HAZARD_WEATHER_HEAVY_RAIN", "HAZARD_WEATHER_HEAVY_SNOW",
+	"HAZARD_WEATHER_FLOOD", "HAZARD_WEATHER_MONSOON",
+	"HAZARD_WEATHER_TORNADO", "HAZARD_WEATHER_HEAT_WAVE",
+	"HAZARD_WEATHER_HURRICANE", "HAZARD_WEATHER_FREEZING_RAIN",
+}
+
+// localizedAlertDisplays traduz os nomes de defaultAlertDisplays; os emojis
+// são os mesmos em todos os idiomas.
+var localizedAlertDisplays = map[string]map[string]AlertDisplay{
+	"en": {
+		"CHIT_CHAT": {Label: "Comment", Plural: "Comments"},
+		"POLICE":    {Label: "Police", Plural: "Police"},
+		"POLICEMAN": {Label: "Police", Plural: "Police"},
+		"JAM":       {Label: "Traffic jam", Plural: "Traffic jams"},
+		"ACCIDENT":  {Label: "Accident", Plural: "Accidents"},
+	},
+}
+
+// merge sobrepõe os campos preenchidos de other.
+func (d AlertDisplay) merge(other AlertDisplay) AlertDisplay {
+	for _, field := range []struct{ dest, value *string }{
+		{&d.Emoji, &other.Emoji},
+		{&d.Label, &other.Label},
+		{&d.Plural, &other.Plural},
+		{&d.Banner, &other.Banner},
+	} {
+		if *field.value != "" {
+			*field.dest = *field.value
+		}
+	}
+	return d
+}
+
+// buildAlertDisplays aplica a tradução do idioma e as personalizações sobre
+// os padrões.
+func buildAlertDisplays(lang string, overrides map[string]AlertDisplay) map[string]AlertDisplay {
+	displays := make(map[string]AlertDisplay, len(defaultAlertDisplays)+len(overrides))
+	for alertType, display := range defaultAlertDisplays {
+		displays[alertType] = display.merge(localizedAlertDisplays[lang][alertType])
+	}
+	for alertType, display := range overrides {
+		displays[alertType] = displays[alertType].merge(display)
+	}
+	return displays
+}
+
+// alertDisplay procura a aparência do tipo e a completa com a do subtipo,
+// se houver. ok é false quando nenhum dos dois está configurado.
+func alertDisplay(alert map[string]interface{}) (AlertDisplay, bool) {
+	alertType, _ := alert["type"].(string)
+	subtype, _ := alert["subtype"].(string)
+
+	display, ok := options.alertDisplays[alertType]
+	if sub, found := options.alertDisplays[subtype]; subtype != "" && found {
+		display, ok = display.merge(sub), true
+	}
+	return display, ok
+}
+
+func alertHeader(alert map[string]interface{}) string {
+	display, ok := alertDisplay(alert)
+	if !ok {
+		return tr("alert.unknownType")
+	}
+	return strings.TrimSpace("📢 " + display.Label + " " + display.Banner)
+}
+
+// alertTitle é o título usado no resumo e no Discord.
+func alertTitle(alert map[string]interface{}) string {
+	display, ok := alertDisplay(alert)
+	if !ok {
+		alertType, _ := alert["type"].(string)
+		return "🤖 " + alertType
+	}
+	return strings.TrimSpace(display.Emoji + " " + display.Plural)
+}
+
+// Clock abstrai o relógio para que a lógica dependente de tempo possa ser
+// testada com um relógio falso.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTimer(d time.Duration) Timer         { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (r realTimer) C() <-chan time.Time { return r.t.C }
+func (r realTimer) Stop() bool          { return r.t.Stop() }
+
+var clock Clock = realClock{}
+
+// scheduledJobs associa os nomes usados em schedules aos jobs.
+var scheduledJobs = map[string]func(){
+	"updates":      getUpdates,
+	"wazers":       countWazers,
+	"wazersReport": sendWazersReport,
+}
+
+// scheduleJob executa job conforme schedules[name]. Quando a configuração é
+// recarregada, a próxima execução é recalculada com a nova expressão.
+func scheduleJob(name string, job func()) {
+	defer wg.Done()
+
+	runSchedule(clock, liveConfig, name, job, stopJobs)
+}
+
+// runSchedule é o laço de scheduleJob, com relógio e configuração explícitos
+// para que os testes controlem o tempo. As expressões valem no fuso de
+// options.timezone. Retorna quando stop é fechado.
+func runSchedule(clk Clock, holder *ConfigHolder, name string, job func(), stop <-chan struct{}) {
+	for {
+		live, changed := holder.Watch()
+		schedule, err := parseCron(live.Schedules[name])
+		if err != nil {
+			logger(fmt.Sprintf("ERROR: agenda de %s inválida: %v", name, err))
+			select {
+			case <-changed:
+				continue
+			case <-stop:
+				return
+			}
+		}
+
+		now := localTime(clk.Now())
+		timer := clk.NewTimer(schedule.Next(now).Sub(now))
+		select {
+		case <-timer.C():
+			job()
+		case <-changed:
+			timer.Stop()
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// cronSchedule é uma expressão cron de 5 campos (minuto, hora, dia, mês,
+// dia da semana) ou de 6, com os segundos na frente. Cada campo vira uma
+// máscara de bits com os valores aceitos. O parser é próprio porque o
+// robfig/cron, listado no go.mod, não está vendorizado e o build não baixa
+// dependências.
+type cronSchedule struct {
+	second, minute, hour, dom, month, dow uint64
+	// Como no cron tradicional, se dia e dia da semana forem restritos,
+	// basta um dos dois coincidir. Um campo que começa com "*" (inclusive
+	// "*/2") não conta como restrito, também como no cron.
+	domAny, dowAny bool
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("expressão cron %q deve ter 5 ou 6 campos", expr)
+	}
+
+	limits := [6][2]int{{0, 59}, {0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var masks [6]uint64
+	for i, field := range fields {
+		mask, err := parseCronField(field, limits[i][0], limits[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("expressão cron %q: %v", expr, err)
+		}
+		masks[i] = mask
+	}
+	// 0 e 7 são domingo.
+	if masks[5]&(1<<7) != 0 {
+		masks[5] |= 1
+	}
+
+	return &cronSchedule{
+		second: masks[0],
+		minute: masks[1],
+		hour:   masks[2],
+		dom:    masks[3],
+		month:  masks[4],
+		dow:    masks[5],
+		domAny: strings.HasPrefix(fields[3], "*"),
+		dowAny: strings.HasPrefix(fields[5], "*"),
+	}, nil
+}
+
+// parseCronField aceita "*", números, intervalos "a-b", passos "/n" e listas
+// separadas por vírgula.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var mask uint64
+	for _, part := range strings.Split(field, ",") {
+		valueRange, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("passo inválido em %q", part)
+			}
+			valueRange, step = part[:i], n
+		}
+
+		lo, hi := min, max
+		if valueRange != "*" {
+			bounds := strings.SplitN(valueRange, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("valor inválido em %q", part)
+			}
+			switch {
+			case len(bounds) == 2:
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("valor inválido em %q", part)
+				}
+			case step == 1:
+				hi = lo
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q fora do intervalo %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			mask |= 1 << uint(v)
+		}
+	}
+	return mask, nil
+}
+
+func (s *cronSchedule) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next devolve o primeiro instante depois de t aceito pela expressão, ou o
+// tempo zero se não houver nenhum nos próximos cinco anos (ex.: 31 de
+// fevereiro). Horas e minutos avançam em tempo absoluto, então as mudanças
+// de horário de verão não fazem a busca voltar no tempo: um horário que não
+// existe no dia da mudança é pulado, e um que se repete é executado nas duas
+// vezes.
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Second).Add(time.Second)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Add(time.Hour - time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute - time.Duration(t.Second())*time.Second)
+		case s.second&(1<<uint(t.Second())) == 0:
+			t = t.Add(time.Second)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// newHTTPClient cria o cliente usado nas requisições ao Waze. Um proxyURL
+// explícito tem prioridade sobre HTTP_PROXY/HTTPS_PROXY do ambiente.
+func newHTTPClient(proxyURL string) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	return &http.Client{Transport: transport}, nil
+}
+
+func logProxy(proxyURL, targetURL string) {
+	if proxyURL != "" {
+		logger(fmt.Sprintf("proxy (config): %s", redactURL(proxyURL)))
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodGet, targetURL, nil)
+	if err != nil {
+		return
+	}
+	u, err := http.ProxyFromEnvironment(req)
+	if err != nil || u == nil {
+		logger("proxy: nenhum")
+		return
+	}
+	logger(fmt.Sprintf("proxy (ambiente): %s", redactURL(u.String())))
+}
+
+// redactURL esconde a senha de URLs com credenciais antes de logar.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
+// newWazeRequest monta um GET aos feeds do Waze com o User-Agent e os
+// cabeçalhos de identificação configurados.
+func newWazeRequest(ctx context.Context, targetURL string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range options.requestHeaders {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("User-Agent", wazeUserAgent())
+	return req, nil
+}
+
+func wazeUserAgent() string {
+	if options.userAgent != "" {
+		return options.userAgent
+	}
+	return "InformaWaze/" + version
+}
+
+// validators guarda ETag/Last-Modified da última resposta de cada URL.
+type validators struct {
+	etag         string
+	lastModified string
+}
+
+var (
+	urlValidators     = make(map[string]validators)
+	urlValidatorsLock sync.Mutex
+)
+
+// conditionalGet envia If-None-Match/If-Modified-Since com os validadores
+// da resposta anterior à mesma URL. Quem chama deve tratar o 304.
+func conditionalGet(targetURL string) (*http.Response, error) {
+	req, err := newWazeRequest(context.Background(), targetURL)
+	if err != nil {
+		return nil, err
+	}
+
+	urlValidatorsLock.Lock()
+	v := urlValidators[targetURL]
+	urlValidatorsLock.Unlock()
+
+	if v.etag != "" {
+		req.Header.Set("If-None-Match", v.etag)
+	}
+	if v.lastModified != "" {
+		req.Header.Set("If-Modified-Since", v.lastModified)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		urlValidatorsLock.Lock()
+		urlValidators[targetURL] = validators{
+			etag:         resp.Header.Get("ETag"),
+			lastModified: resp.Header.Get("Last-Modified"),
+		}
+		urlValidatorsLock.Unlock()
+	}
+	return resp, nil
+}
+
+// jsonContentTypes são os Content-Type aceitos dos feeds do Waze. text/plain
+// e a ausência do cabeçalho são tolerados porque alguns proxies os trocam.
+var jsonContentTypes = map[string]bool{
+	"":                       true,
+	"application/json":       true,
+	"application/javascript": true,
+	"text/javascript":        true,
+	"text/json":              true,
+	"text/plain":             true,
+}
+
+// responseSnippetSize é quanto do corpo entra no log de uma resposta
+// inesperada.
+const responseSnippetSize = 200
+
+// checkJSONResponse confere status e Content-Type antes da decodificação.
+// Páginas de erro ou de limite de requisições (geralmente HTML) viram um
+// erro com o início do corpo, para que sejam tratadas como falha de consulta.
+func checkJSONResponse(resp *http.Response) error {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 && jsonContentTypes[mediaType] {
+		return nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, responseSnippetSize))
+	snippet := strings.Join(strings.Fields(string(body)), " ")
+	return fmt.Errorf("resposta inesperada: %s, Content-Type %q: %q", resp.Status, resp.Header.Get("Content-Type"), snippet)
+}
+
+// forgetValidators descarta os validadores de uma resposta que não pôde ser
+// usada, para que a próxima requisição traga o corpo completo.
+func forgetValidators(targetURL string) {
+	urlValidatorsLock.Lock()
+	delete(urlValidators, targetURL)
+	urlValidatorsLock.Unlock()
+}
+
+func getUpdates() {
+	logger("getting updates")
+
+	// Verifica se os dados estão no cache
+	if data, found := c.Get("wazeData"); found {
+		processAlerts(data.([]interface{}))
+		return
+	}
+
+	live := liveConfig.Get()
+	url, err := addBoundsToURL(live.AreaBounds, live.RequestURL)
+	if err != nil {
+		logger("ERROR: invalid request URL")
+		return
+	}
+
+	// Quem chega com uma consulta à mesma URL em andamento espera por ela;
+	// só quem a fez processa os alertas, para não enfileirá-los duas vezes.
+	items, leader := updatesFlight.Do(url, func() interface{} {
+		return fetchUpdates(url)
+	})
+	if !leader {
+		logger("consulta ao Waze já em andamento, aproveitando o resultado")
+		return
+	}
+	// Sem lista (304 ou falha) não há o que processar: um feed vazio faria
+	// todos os alertas ativos parecerem resolvidos.
+	if items, ok := items.([]interface{}); ok && items != nil {
+		processAlerts(items)
+	}
+}
+
+// updatesFlight junta as consultas simultâneas de getUpdates.
+var updatesFlight flightGroup
+
+// fetchUpdates consulta o feed de alertas e guarda a lista no cache. Devolve
+// nil se a consulta falhou ou se nada mudou (304).
+func fetchUpdates(url string) []interface{} {
+	if !alertsBreaker.Allow() {
+		return nil
+	}
+
+	resp, err := conditionalGet(url)
+	if err != nil {
+		alertsBreaker.Failure()
+		logger("ERROR: can't get updates")
+		return nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		alertsBreaker.Success()
+		logger("alertas sem alterações (304)")
+		return nil
+	}
+
+	if err := checkJSONResponse(resp); err != nil {
+		alertsBreaker.Failure()
+		forgetValidators(url)
+		logger(fmt.Sprintf("ERROR: can't get updates: %v", err))
+		return nil
+	}
+
+	var data map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		alertsBreaker.Failure()
+		forgetValidators(url)
+		logger("ERROR: can't decode response")
+		return nil
+	}
+
+	// Uma resposta fora do formato esperado também conta como falha. Sem a
+	// chave "alerts", o feed pode trazer só congestionamentos, que valem
+	// quando consumeJams está ligado.
+	items, ok := data["alerts"].([]interface{})
+	if _, found := data["alerts"]; !found && options.consumeJams {
+		items, ok = []interface{}{}, true
+	}
+	if !ok {
+		alertsBreaker.Failure()
+		forgetValidators(url)
+		if _, found := data["alerts"]; !found {
+			logger("ERROR: 'alerts' key not found in data")
+		} else {
+			logger("ERROR: 'alerts' is not a list")
+		}
+		return nil
+	}
+	alertsBreaker.Success()
+
+	if options.consumeJams {
+		// A fonte preferida vem primeiro, para ser a notificada quando o
+		// mesmo congestionamento aparece nas duas.
+		if options.jamDedup == jamSourceJams {
+			items = append(jamAlerts(data["jams"]), items...)
+		} else {
+			items = append(items, jamAlerts(data["jams"])...)
+		}
+	}
+
+	// Adiciona os dados ao cache
+	c.Set("wazeData", items, options.cacheTTL)
+	return items
+}
+
+// flightGroup junta chamadas simultâneas com a mesma chave numa só
+// execução, como o singleflight de golang.org/x/sync.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done  chan struct{}
+	value interface{}
+}
+
+// Do executa fn, a menos que já haja uma execução com a mesma chave em
+// andamento; nesse caso espera por ela e devolve o mesmo valor. leader
+// indica se esta chamada foi a que executou fn.
+func (g *flightGroup) Do(key string, fn func() interface{}) (value interface{}, leader bool) {
+	g.mu.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-call.done
+		return call.value, false
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+	call.value = fn()
+	return call.value, true
+}
+
+// jamAlerts converte os itens de "jams" em alertas JAM, para que passem pelos
+// mesmos filtros, deduplicação e destinos dos demais. A lista pode faltar.
+func jamAlerts(raw interface{}) []interface{} {
+	jams, _ := raw.([]interface{})
+	converted := make([]interface{}, 0, len(jams))
+	for _, item := range jams {
+		jam, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		id, ok := jam["uuid"]
+		if !ok {
+			id, ok = jam["id"]
+		}
+		if !ok {
+			continue
+		}
+
+		alert := map[string]interface{}{
+			// O prefixo evita colisão com os uuids da lista de alertas.
+			"uuid":   fmt.Sprintf("jam-%v", id),
+			"type":   "JAM",
+			"source": "jams",
+		}
+		for _, key := range []string{"street", "city", "pubMillis", "level", "speedKMH"} {
+			if value, ok := jam[key]; ok {
+				alert[key] = value
+			}
+		}
+		// delay é -1 em vias bloqueadas.
+		if delay, ok := jam["delay"].(float64); ok && delay >= 0 {
+			alert["delayMinutes"] = math.Round(delay / 60)
+			alert["delaySeconds"] = delay
+		}
+		if length, ok := jam["length"].(float64); ok {
+			alert["lengthMeters"] = length
+		}
+		if line, ok := jam["line"].([]interface{}); ok && len(line) > 0 {
+			alert["location"] = line[0]
+		}
+		if drop, ok := jamSpeedDrop(jam); ok {
+			alert["speedDropKMH"] = drop
+		}
+		converted = append(converted, alert)
+	}
+	return converted
+}
+
+// jamSpeedDrop estima quantos km/h o congestionamento tira da via. O feed
+// não traz a velocidade normal, mas ela sai da extensão, da velocidade atual e
+// do atraso: sem o atraso, o trecho levaria length/speed - delay segundos.
+func jamSpeedDrop(jam map[string]interface{}) (float64, bool) {
+	speed, okSpeed := jam["speedKMH"].(float64)
+	length, okLength := jam["length"].(float64)
+	delay, okDelay := jam["delay"].(float64)
+	if !okSpeed || !okLength || !okDelay || speed <= 0 || length <= 0 || delay < 0 {
+		return 0, false
+	}
+
+	current := length / (speed / 3.6)
+	free := current - delay
+	if free <= 0 {
+		return 0, false
+	}
+	return math.Round(length/free*3.6 - speed), true
+}
+
+// jamSummary resume atraso e extensão dos alertas vindos de "jams".
+func jamSummary(alert map[string]interface{}) string {
+	delay, hasDelay := alert["delayMinutes"].(float64)
+	length, hasLength := alert["lengthMeters"].(float64)
+	switch {
+	case hasDelay && hasLength:
+		return tr("jam.delay", delay, length)
+	case hasLength:
+		return fmt.Sprintf("⏳ %.0f m", length)
+	}
+	return ""
+}
+
+func processAlerts(alerts []interface{}) {
+	logger("processando alertas")
+
+	current := make(map[string]bool, len(alerts))
+	processed := 0
+	markProcessed := func(alertID string) {
+		processedAlerts.Add(alertID)
+		processed++
+	}
+
+	for _, alert := range alerts {
+		alertData, _ := alert.(map[string]interface{})
+		alertID, ok := alertKey(alertData)
+		if !ok {
+			logger(fmt.Sprintf("WARNING: alerta sem %s, ignorado", strings.Join(options.dedupKeys, ", ")))
+			continue
+		}
+		// O resto do código (/feed, /debug/alerts, logs) identifica o
+		// alerta pelo uuid.
+		if uuid, _ := alertData["uuid"].(string); uuid == "" {
+			alertData["uuid"] = alertID
+		}
+		current[alertID] = true
+		if !processedAlerts.Has(alertID) {
+			if age, ok := alertAge(alertData); ok && age > options.maxAlertAge {
+				logger(fmt.Sprintf("descartando alerta antigo %s (%s)", alertID, formatAge(age)))
+				suppressions.Record(suppressedMaxAge, clock.Now())
+				markProcessed(alertID)
+				continue
+			}
+			// Não é marcado como processado: se o congestionamento crescer,
+			// ele é notificado numa próxima consulta. Até lá, o log e a
+			// contagem só o registram na primeira.
+			if !jamSizeAllowed(alertData) {
+				if firstSmallJam(alertID) {
+					logger(fmt.Sprintf("ignorando congestionamento pequeno %s", alertID))
+					suppressions.Record(suppressedJamSize, clock.Now())
+				}
+				continue
+			}
+			if !allowChitChat(alertData) {
+				suppressions.Record(suppressedChitChat, clock.Now())
+				markProcessed(alertID)
+				continue
+			}
+			if isDuplicateAlert(alertData) {
+				logger(fmt.Sprintf("descartando alerta repetido %s", alertID))
+				suppressions.Record(suppressedDedup, clock.Now())
+				markProcessed(alertID)
+				continue
+			}
+			alertData["zone"] = alertZone(alertData)
+			alertData["severity"] = alertSeverity(alertData)
+			if isCrossSourceJam(alertData) {
+				logger(fmt.Sprintf("descartando congestionamento %s, já notificado pela outra fonte", alertID))
+				suppressions.Record(suppressedCrossSource, clock.Now())
+				markProcessed(alertID)
+				continue
+			}
+			if !enqueueAlert(alertData) {
+				continue
+			}
+			markProcessed(alertID)
+			trackActiveAlert(alertID, alertData)
+			recordAnnouncement(alertID, alertData)
+		} else {
+			refreshAnnouncement(alertID, alertData)
+		}
+	}
+
+	// Grava os uuids novos para não reenviá-los após um reinício; com
+	// dedupSaveInterval, a gravação fica para runProcessedSave.
+	if processed > 0 {
+		if options.dedupSaveInterval > 0 {
+			processedDirty.Store(true)
+		} else {
+			saveProcessedAlerts()
+		}
+	}
+
+	resolveAlerts(current)
+	forgetAnnouncements(current)
+	forgetSmallJams(current)
+}
+
+// firstSmallJam marca o congestionamento como barrado pelo tamanho e diz se
+// é a primeira vez.
+func firstSmallJam(alertID string) bool {
+	smallJamsLock.Lock()
+	defer smallJamsLock.Unlock()
+
+	if smallJams[alertID] {
+		return false
+	}
+	smallJams[alertID] = true
+	return true
+}
+
+func forgetSmallJams(current map[string]bool) {
+	smallJamsLock.Lock()
+	defer smallJamsLock.Unlock()
+
+	for alertID := range smallJams {
+		if !current[alertID] {
+			delete(smallJams, alertID)
+		}
+	}
+}
+
+// announcement é o alerta anunciado, quando foi anunciado pela última vez e
+// quantas vezes já foi repetido.
+type announcement struct {
+	alert   map[string]interface{}
+	last    time.Time
+	repeats int
+}
+
+func recordAnnouncement(alertID string, alert map[string]interface{}) {
+	alertType, _ := alert["type"].(string)
+	if _, ok := options.reannounceInterval[alertType]; !ok {
+		return
+	}
+
+	announcementsLock.Lock()
+	announcements[alertID] = &announcement{alert: alert, last: clock.Now()}
+	announcementsLock.Unlock()
+}
+
+// refreshAnnouncement troca o alerta guardado pela versão mais recente do
+// feed, para que a repetição mostre os dados atuais.
+func refreshAnnouncement(alertID string, alert map[string]interface{}) {
+	announcementsLock.Lock()
+	defer announcementsLock.Unlock()
+
+	if a, ok := announcements[alertID]; ok {
+		a.alert = alert
+	}
+}
+
+// dueReannouncements devolve os alertas anunciados que devem ser repetidos
+// agora e registra a repetição de cada um.
+func dueReannouncements() []map[string]interface{} {
+	announcementsLock.Lock()
+	defer announcementsLock.Unlock()
+
+	var due []map[string]interface{}
+	for _, a := range announcements {
+		alertType, _ := a.alert["type"].(string)
+		interval := options.reannounceInterval[alertType]
+		if a.repeats >= options.reannounceMax || clock.Now().Sub(a.last) < interval {
+			continue
+		}
+		a.last = clock.Now()
+		a.repeats++
+		due = append(due, a.alert)
+	}
+	return due
+}
+
+// runReannouncements repete os alertas ainda ativos no seu próprio ritmo:
+// com o feed sem mudanças (304), processAlerts não roda, e a repetição não
+// pode depender dele. A repetição segue pela fila como os alertas novos,
+// para chegar também a /events, ao buffer e ao arquivo.
+func runReannouncements(interval time.Duration) {
+	for {
+		<-clock.After(interval)
+		reannounce()
+	}
+}
+
+func reannounce() {
+	for _, alert := range dueReannouncements() {
+		enqueueAlert(reannouncement(alert))
+	}
+}
+
+func forgetAnnouncements(current map[string]bool) {
+	announcementsLock.Lock()
+	defer announcementsLock.Unlock()
+
+	for alertID := range announcements {
+		if !current[alertID] {
+			delete(announcements, alertID)
+		}
+	}
+}
+
+// reannouncement copia o alerta marcando-o como repetição, sem alterar o
+// mapa que fica no cache.
+func reannouncement(alert map[string]interface{}) map[string]interface{} {
+	repeated := make(map[string]interface{}, len(alert)+2)
+	for key, value := range alert {
+		repeated[key] = value
+	}
+	repeated["zone"] = alertZone(alert)
+	repeated["reannounce"] = true
+	return repeated
+}
+
+// trackActiveAlert guarda os alertas anunciados que ainda estão no feed,
+// separado de processedAlerts, que lembra tudo o que já foi visto.
+func trackActiveAlert(alertID string, alert map[string]interface{}) {
+	activeAlertsLock.Lock()
+	activeAlerts[alertID] = alert
+	activeAlertsLock.Unlock()
+}
+
+// resolveAlerts publica em /events os alertas ativos que sumiram do feed.
+// Os tipos de allClearTypes também recebem uma mensagem, no máximo uma por
+// tipo e rua a cada allClearThrottle.
+func resolveAlerts(current map[string]bool) {
+	var resolved []map[string]interface{}
+
+	activeAlertsLock.Lock()
+	for alertID, alert := range activeAlerts {
+		if !current[alertID] {
+			resolved = append(resolved, alert)
+			delete(activeAlerts, alertID)
+		}
+	}
+	activeAlertsLock.Unlock()
+
+	for _, alert := range resolved {
+		publishResolved(alert)
+		alertType, _ := alert["type"].(string)
+		if !options.allClearTypes[alertType] {
+			continue
+		}
+		street := alertStreet(alert)
+		if c.Add("clear:"+alertType+"|"+street, struct{}{}, options.allClearThrottle) != nil {
+			continue
+		}
+
+		label, ok := lookupMessage("allClear." + alertType)
+		if !ok {
+			label = tr("allClear.other", alertType)
+		}
+		enqueueMessage(tr("allClear.message", label, street))
+	}
+}
+
+// defaultDedupKeys é a ordem padrão de dedupKeys.
+var defaultDedupKeys = []string{"uuid", "id", "fingerprint"}
+
+// alertKey devolve o identificador do alerta pelo primeiro campo de
+// dedupKeys que ele tiver; ok é false se nenhum servir.
+func alertKey(alert map[string]interface{}) (string, bool) {
+	if alert == nil {
+		return "", false
+	}
+	for _, field := range options.dedupKeys {
+		if field == "fingerprint" {
+			if alertType, _ := alert["type"].(string); alertType != "" {
+				return alertFingerprint(alert), true
+			}
+			continue
+		}
+		switch value := alert[field].(type) {
+		case string:
+			if value != "" {
+				return value, true
+			}
+		case float64:
+			return strconv.FormatFloat(value, 'f', -1, 64), true
+		}
+	}
+	return "", false
+}
+
+// alertFingerprint identifica a ocorrência independente do uuid: mesmo tipo,
+// subtipo e rua, com coordenadas arredondadas (coordinatePrecision) para o
+// trecho da via.
+func alertFingerprint(alert map[string]interface{}) string {
+	alertType, _ := alert["type"].(string)
+	subtype, _ := alert["subtype"].(string)
+	street, _ := alert["street"].(string)
+
+	var x, y float64
+	if location, ok := alert["location"].(map[string]interface{}); ok {
+		x, _ = location["x"].(float64)
+		y, _ = location["y"].(float64)
+	}
+
+	return fmt.Sprintf("%s|%s|%s|%s|%s", alertType, subtype, street, formatCoord(x), formatCoord(y))
+}
+
+// enqueueAlert entrega o alerta sem bloquear a consulta ao Waze. Com a fila
+// cheia, o alerta é descartado; como não fica marcado como processado nem
+// como repetido, ele é tentado de novo na próxima consulta.
+func enqueueAlert(alert map[string]interface{}) bool {
+	select {
+	case alertsCh <- alert:
+		return true
+	default:
+		droppedAlerts.Inc()
+		suppressions.Record(suppressedQueueFull, clock.Now())
+		// A repetição não passou por isDuplicateAlert; a impressão digital
+		// ainda é do anúncio original.
+		if reannounce, _ := alert["reannounce"].(bool); !reannounce {
+			c.Delete("dedup:" + alertFingerprint(alert))
+		}
+		logger(fmt.Sprintf("WARNING: fila de alertas cheia (%d), descartando %s", cap(alertsCh), alert["uuid"]))
+		return false
+	}
+}
+
+// isDuplicateAlert suprime alertas com a mesma impressão digital dentro da
+// janela configurada para o tipo. Tipos sem janela nunca são suprimidos.
+func isDuplicateAlert(alert map[string]interface{}) bool {
+	alertType, _ := alert["type"].(string)
+	ttl, ok := options.dedupTTL[alertType]
+	if !ok || ttl <= 0 {
+		return false
+	}
+
+	return c.Add("dedup:"+alertFingerprint(alert), struct{}{}, ttl) != nil
+}
+
+const (
+	jamSourceJams   = "jams"
+	jamSourceAlerts = "alerts"
+	// jamDedupTTL é por quanto tempo um congestionamento notificado bloqueia
+	// o mesmo trecho vindo da outra fonte.
+	jamDedupTTL = 30 * time.Minute
+)
+
+// isCrossSourceJam diz se um JAM já foi notificado pela outra fonte ("alerts"
+// ou "jams"). Repetições da mesma fonte ficam com isDuplicateAlert.
+func isCrossSourceJam(alert map[string]interface{}) bool {
+	if alertType, _ := alert["type"].(string); alertType != "JAM" || !options.consumeJams || options.jamDedup == "off" {
+		return false
+	}
+	key, ok := jamDedupKey(alert)
+	if !ok {
+		return false
+	}
+
+	source, _ := alert["source"].(string)
+	if source == "" {
+		source = jamSourceAlerts
+	}
+	if previous, found := c.Get(key); found && previous.(string) != source {
+		return true
+	}
+	// Só um JAM que vai ser anunciado bloqueia a outra fonte: se os filtros
+	// descartam esta versão, a da outra lista ainda pode passar.
+	if wouldNotify(alert) {
+		c.Set(key, source, jamDedupTTL)
+	}
+	return false
+}
+
+// wouldNotify diz se notifyAlert anunciaria o alerta (na hora, no resumo ou
+// num grupo), sem enviá-lo.
+func wouldNotify(alert map[string]interface{}) bool {
+	if renderAlert(alert) == "" || alertSeverity(alert) < options.minSeverity {
+		return false
+	}
+	alertType, _ := alert["type"].(string)
+	return withinActiveWindow(alertType, clock.Now())
+}
+
+// jamSizeAllowed aplica minJamLengthMeters e minJamDelaySeconds aos JAM.
+// Sem o dado correspondente, decide dropJamsWithoutData.
+func jamSizeAllowed(alert map[string]interface{}) bool {
+	if alertType, _ := alert["type"].(string); alertType != "JAM" {
+		return true
+	}
+	if level, _ := alert["level"].(float64); level >= 5 {
+		return true
+	}
+
+	for _, threshold := range []struct {
+		field string
+		min   float64
+	}{
+		{"lengthMeters", options.minJamLength},
+		{"delaySeconds", options.minJamDelay},
+	} {
+		if threshold.min <= 0 {
+			continue
+		}
+		value, ok := alert[threshold.field].(float64)
+		if !ok {
+			if options.dropJamsWithoutData {
+				return false
+			}
+			continue
+		}
+		if value < threshold.min {
+			return false
+		}
+	}
+	return true
+}
+
+// jamDedupKey agrupa congestionamentos pela rua normalizada e pelo quadrado
+// de options.jamDedupBucket metros em que caem.
+func jamDedupKey(alert map[string]interface{}) (string, bool) {
+	street, _ := alert["street"].(string)
+	location, ok := alert["location"].(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	x, okX := location["x"].(float64)
+	y, okY := location["y"].(float64)
+	if !okX || !okY {
+		return "", false
+	}
+
+	const metersPerDegree = 111320.0
+	size := options.jamDedupBucket
+	row := math.Floor(y * metersPerDegree / size)
+	col := math.Floor(x * metersPerDegree * math.Cos(y*math.Pi/180) / size)
+	return fmt.Sprintf("jamdedup:%s|%.0f|%.0f", foldText(street), row, col), true
+}
+
+// allowChitChat aplica o limite de comentários por usuário (reportBy).
+func allowChitChat(alert map[string]interface{}) bool {
+	if alertType, _ := alert["type"].(string); alertType != "CHIT_CHAT" || chitChatThrottle == nil {
+		return true
+	}
+
+	reportBy, _ := alert["reportBy"].(string)
+	allowed, firstSuppressed := chitChatThrottle.Allow(reportBy)
+	if !allowed {
+		logger(fmt.Sprintf("suprimindo comentário de %s", reportBy))
+		if firstSuppressed && options.chitChatNote {
+			sendMessage(tr("chitChat.muted", reportBy, options.chitChatWindow))
+		}
+	}
+	return allowed
+}
+
+func alertZone(alert map[string]interface{}) string {
+	location, ok := alert["location"].(map[string]interface{})
+	if !ok {
+		return zoneOutside
+	}
+	x, okX := location["x"].(float64)
+	y, okY := location["y"].(float64)
+	if !okX || !okY {
+		return zoneOutside
+	}
+	return zoneFor(options.zones, x, y)
+}
+
+func countWazers() {
+	logger("contando motoristas")
+
+	var usersOnJams []interface{}
+
+	// Verifica se os dados estão no cache
+	if data, found := c.Get("broadcastData"); found {
+		usersOnJams = data.([]interface{})
+	} else {
+		list, ok := fetchUsersOnJams(liveConfig.Get().BroadcastFeedURL)
+		if !ok {
+			return
+		}
+		usersOnJams = list
+		c.Set("broadcastData", usersOnJams, options.broadcastCacheTTL)
+	}
+
+	actualWazersOnline := 0
+	for _, item := range usersOnJams {
+		jam, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		wazersCount, _ := jam["wazersCount"].(float64)
+		actualWazersOnline += int(wazersCount)
+		if speed, ok := jamSpeedKMH(jam); ok {
+			jamSpeeds.Add(speed)
+		}
+	}
+
+	wazersOnline.Set(actualWazersOnline)
+	checkWazersThresholds(actualWazersOnline)
+	if maxWazersOnline.SetIfGreater(actualWazersOnline) {
+		now := clock.Now()
+		lastWazersReportLock.Lock()
+		maxWazersOnlineAt = now
+		lastWazersReportLock.Unlock()
+		db.SetWazersPeak(actualWazersOnline, now)
+	}
+	if dailyWazersPeak.Record(actualWazersOnline, clock.Now()) {
+		db.SetDailyWazersPeak(dailyWazersPeak)
+	}
+}
+
+// lastUsersOnJams guarda a última lista decodificada de cada feed de
+// broadcast, reaproveitada quando o Waze responde 304.
+var (
+	lastUsersOnJams     = make(map[string][]interface{})
+	lastUsersOnJamsLock sync.Mutex
+)
+
+// fetchUsersOnJams consulta o feed de broadcast. Num 304, devolve a lista da
+// resposta anterior, para a contagem continuar com o feed parado.
+func fetchUsersOnJams(feedURL string) ([]interface{}, bool) {
+	if !broadcastBreaker.Allow() {
+		return nil, false
+	}
+
+	resp, err := conditionalGet(feedURL)
+	if err != nil {
+		broadcastBreaker.Failure()
+		logger("ERROR: can't count wazers")
+		return nil, false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		broadcastBreaker.Success()
+		lastUsersOnJamsLock.Lock()
+		defer lastUsersOnJamsLock.Unlock()
+		list, found := lastUsersOnJams[feedURL]
+		return list, found
+	}
+
+	if err := checkJSONResponse(resp); err != nil {
+		broadcastBreaker.Failure()
+		forgetValidators(feedURL)
+		logger(fmt.Sprintf("ERROR: can't count wazers: %v", err))
+		return nil, false
+	}
+
+	var data map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		broadcastBreaker.Failure()
+		forgetValidators(feedURL)
+		logger("ERROR: can't decode response")
+		return nil, false
+	}
+
+	list, ok := data["usersOnJams"].([]interface{})
+	if !ok {
+		broadcastBreaker.Failure()
+		forgetValidators(feedURL)
+		if _, found := data["usersOnJams"]; !found {
+			logger("ERROR: 'usersOnJams' key not found in data")
+		} else {
+			logger("ERROR: 'usersOnJams' is not a list")
+		}
+		return nil, false
+	}
+	broadcastBreaker.Success()
+
+	lastUsersOnJamsLock.Lock()
+	lastUsersOnJams[feedURL] = list
+	lastUsersOnJamsLock.Unlock()
+	return list, true
+}
+
+// wazersThresholdRearm é a fração do limite abaixo da qual a contagem
+// precisa cair para o aviso valer de novo, evitando repetições quando ela
+// oscila em torno do limite.
+const wazersThresholdRearm = 0.9
+
+// checkWazersThresholds avisa quando count passa do maior limite ainda não
+// avisado.
+func checkWazersThresholds(count int) {
+	crossed := 0
+	for _, threshold := range options.wazersThresholds {
+		if count > threshold && threshold > crossed {
+			crossed = threshold
+		}
+	}
+
+	level := wazersThresholdLevel.Get()
+	switch {
+	case crossed > level:
+		wazersThresholdLevel.Set(crossed)
+		sendMessage(tr("wazers.threshold", crossed))
+	case level > 0 && float64(count) <= float64(level)*wazersThresholdRearm:
+		wazersThresholdLevel.Set(crossed)
+	}
+}
+
+func sendWazersReport() {
+	maxWazers := maxWazersOnline.GetAndReset()
+	if maxWazers > 0 {
+		now := clock.Now()
+		lastWazersReportLock.Lock()
+		from, peakAt, previous := lastWazersReport, maxWazersOnlineAt, previousWazersPeak
+		lastWazersReport, previousWazersPeak = now, maxWazers
+		lastWazersReportLock.Unlock()
+
+		speed, hasSpeed := jamSpeeds.GetAndReset()
+		sendMessage(formatWazersReport(maxWazers, previous, from, now, peakAt, speed, hasSpeed))
+		db.SetWazersReport(now, maxWazers)
+	}
+}
+
+// formatWazersReport monta o relatório com o período, o horário do pico
+// (quando conhecido), a velocidade média nos congestionamentos (quando o feed
+// a trouxe) e a comparação com o pico do relatório anterior.
+func formatWazersReport(peak, previous int, from, to, peakAt time.Time, speed float64, hasSpeed bool) string {
+	lines := []string{tr("wazers.report", peak)}
+
+	window := tr("wazers.window", localTime(from).Format("15:04"), localTime(to).Format("15:04"))
+	if !peakAt.IsZero() && !peakAt.Before(from) {
+		window += tr("wazers.peakAt", localTime(peakAt).Format("15:04"))
+	}
+	lines = append(lines, window)
+	if hasSpeed {
+		lines = append(lines, tr("wazers.speed", speed))
+	}
+
+	switch diff := peak - previous; {
+	case previous == 0:
+	case diff > 0:
+		lines = append(lines, tr("wazers.up", diff, previous))
+	case diff < 0:
+		lines = append(lines, tr("wazers.down", -diff, previous))
+	default:
+		lines = append(lines, tr("wazers.same", previous))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// jamSpeedKMH lê a velocidade de uma entrada de usersOnJams, que pode vir em
+// km/h (speedKMH) ou em m/s (speed), ou faltar.
+func jamSpeedKMH(jam map[string]interface{}) (float64, bool) {
+	if speed, ok := jam["speedKMH"].(float64); ok && speed >= 0 {
+		return speed, true
+	}
+	if speed, ok := jam["speed"].(float64); ok && speed >= 0 {
+		return speed * 3.6, true
+	}
+	return 0, false
+}
+
+// addBoundsToURL adiciona os limites da área à query de sourceURL. As chaves
+// saem em ordem alfabética, então a URL é estável entre chamadas.
+func addBoundsToURL(bounds map[string]float64, sourceURL string) (string, error) {
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	for key, val := range bounds {
+		query.Set(key, formatCoord(val))
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// localTime converte t para o fuso de options.timezone, usado em todos os
+// horários das mensagens.
+func localTime(t time.Time) time.Time {
+	return t.In(options.timezone)
+}
+
+// formatCoord arredonda a coordenada para options.coordinatePrecision casas
+// decimais. Com 4 casas a resolução é de ~11 m; com 3, ~110 m.
+func formatCoord(val float64) string {
+	return strconv.FormatFloat(val, 'f', options.coordinatePrecision, 64)
+}
+
+// sendMessage registra o texto na saída do log (o arquivo de -log-file, se
+// houver) e o envia aos notificadores.
+func sendMessage(text string) {
+	fmt.Fprintln(logOutput, text)
+	if notificationsPaused.Load() {
+		return
+	}
+
+	branded := brandMessage(text, "")
+	for _, notifier := range notifiers {
+		if err := notifier.SendText(branded); err != nil {
+			logger(fmt.Sprintf("ERROR: can't send %s message: %v", notifier.Name(), err))
+		}
+	}
+}
+
+// notifyAlert envia o alerta renderizado a todos os notificadores ativos,
+// ou o guarda para o próximo resumo quando o tipo não é imediato.
+func notifyAlert(alert map[string]interface{}) {
+	message := renderAlert(alert)
+	if message == "" {
+		// O log mostra o código exato, para quem quiser listá-lo nos filtros.
+		filtersLock.Lock()
+		subtypeDropped := !subtypeAllowed(filters, alert)
+		reporterDropped := !reporterAllowed(filters, alert)
+		filtersLock.Unlock()
+		if subtypeDropped {
+			logger(fmt.Sprintf("alerta %s descartado pelo filtro de subtipos: %s", alert["uuid"], alert["subtype"]))
+		}
+		if reporterDropped {
+			reporter, _ := alert["reportBy"].(string)
+			if reporter == "" {
+				reporter = "sem reportBy"
+			}
+			logger(fmt.Sprintf("alerta %s descartado pelo filtro de autores: %s", alert["uuid"], reporter))
+		}
+		suppressions.Record(suppressedFilters, clock.Now())
+		return
+	}
+	if severity := alertSeverity(alert); severity < options.minSeverity {
+		logger(fmt.Sprintf("alerta %s com severidade %d, abaixo de %d, não enviado", alert["uuid"], severity, options.minSeverity))
+		suppressions.Record(suppressedSeverity, clock.Now())
+		return
+	}
+	if len(notifiers) == 0 {
+		return
+	}
+
+	alertType, _ := alert["type"].(string)
+	if !withinActiveWindow(alertType, clock.Now()) {
+		logger(fmt.Sprintf("alerta %s fora da janela ativa de %s, não enviado", alert["uuid"], alertType))
+		suppressions.Record(suppressedActiveWindow, clock.Now())
+		return
+	}
+
+	if options.digestInterval > 0 && !options.digestImmediate[alertType] {
+		digestLock.Lock()
+		digest = append(digest, alert)
+		digestLock.Unlock()
+		return
+	}
+
+	if clusterer != nil && options.clusterTypes[alertType] && clusterer.Add(alert) {
+		return
+	}
+
+	sendAlert(alert, message)
+}
+
+// sendAlert entrega a mensagem de um alerta (ou de um grupo) a todos os
+// destinos.
+func sendAlert(alert map[string]interface{}, message string) {
+	deliverAlert(notifiers, alert, message)
+}
+
+func deliverAlert(targets []Notifier, alert map[string]interface{}, message string) {
+	if notificationsPaused.Load() {
+		logger(fmt.Sprintf("notificações pausadas, alerta %s não enviado", alert["uuid"]))
+		return
+	}
+
+	zone, _ := alert["zone"].(string)
+	message = brandMessage(message, zone)
+	for _, notifier := range targets {
+		if err := notifier.SendAlert(alert, message); err != nil {
+			logger(fmt.Sprintf("ERROR: can't send %s alert: %v", notifier.Name(), err))
+		}
+	}
+}
+
+// Notifier é um destino das mensagens do bot.
+type Notifier interface {
+	Name() string
+	// SendAlert envia um alerta; message é o texto já renderizado.
+	SendAlert(alert map[string]interface{}, message string) error
+	// SendText envia mensagens avulsas, como relatórios e resumos.
+	SendText(text string) error
+}
+
+const (
+	notifierTelegram = "telegram"
+	notifierDiscord  = "discord"
+	notifierWebhook  = "webhook"
+	notifierMatrix   = "matrix"
+	notifierMQTT     = "mqtt"
+)
+
+// buildNotifiers cria os notificadores listados em options.notifiers.
+func buildNotifiers() []Notifier {
+	var built []Notifier
+	for _, name := range options.notifiers {
+		switch name {
+		case notifierTelegram:
+			built = append(built, TelegramNotifier{})
+		case notifierDiscord:
+			built = append(built, &DiscordNotifier{webhookURL: options.discordWebhookURL})
+		case notifierWebhook:
+			built = append(built, &WebhookNotifier{
+				url:     options.webhookURL,
+				secret:  options.webhookSecret,
+				timeout: options.webhookTimeout,
+			})
+		case notifierMatrix:
+			built = append(built, &MatrixNotifier{
+				homeserver: options.matrixHomeserver,
+				roomID:     options.matrixRoomID,
+				token:      matrixAccessToken,
+				timeout:    options.webhookTimeout,
+			})
+		case notifierMQTT:
+			mqtt := &MQTTNotifier{
+				broker:   options.mqttBroker,
+				topic:    options.mqttTopic,
+				qos:      byte(options.mqttQoS),
+				retain:   options.mqttRetain,
+				clientID: options.mqttClientID,
+				username: options.mqttUsername,
+				password: mqttPassword,
+				timeout:  options.webhookTimeout,
+			}
+			mqtt.start()
+			built = append(built, mqtt)
+		}
+	}
+	return built
+}
+
+// TelegramNotifier envia ao chat da rota do tipo, com o botão "visto" que
+// permite aos inscritos confirmar que viram a ocorrência.
+type TelegramNotifier struct{}
+
+func (TelegramNotifier) Name() string { return notifierTelegram }
+
+// chatReplier é implementado pelos notificadores que respondem num chat
+// específico, como o Telegram aos comandos /start e /stop.
+type chatReplier interface {
+	Reply(chatID, text string) error
+}
+
+// Reply responde no chat de onde veio o comando.
+func (TelegramNotifier) Reply(chatID, text string) error {
+	return sendTelegramMessage(TelegramRoute{ChatID: chatID}, text, nil)
+}
+
+func (TelegramNotifier) SendAlert(alert map[string]interface{}, message string) error {
+	alertType, _ := alert["type"].(string)
+
+	var markup interface{}
+	if alertID, ok := alert["uuid"].(string); ok {
+		markup = ackKeyboard(alertID)
+	}
+
+	routes := telegramRoutesFor(alertType)
+	photo := ""
+	if options.staticMapTypes[alertType] {
+		photo = staticMapLink(alert)
+	}
+	if photo == "" || len([]rune(message)) > telegramMaxCaption {
+		return sendTelegramMessages(routes, message, markup)
+	}
+
+	// Se o Telegram não conseguir baixar a imagem, o chat recebe o texto.
+	var errs []error
+	for _, route := range routes {
+		err := sendTelegramPhoto(route, photo, message, markup)
+		if err != nil {
+			logger(fmt.Sprintf("WARNING: can't send map photo to chat %s, sending text: %v", route.ChatID, err))
+			err = sendTelegramMessage(route, message, markup)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("chat %s: %w", route.ChatID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (TelegramNotifier) SendText(text string) error {
+	return sendTelegramMessages(defaultTelegramRoutes(), text, nil)
+}
+
+const (
+	discordMaxDescription = 4096
+	discordMaxContent     = 2000
+	discordMaxAttempts    = 3
+)
+
+// DiscordNotifier publica em um webhook do Discord usando embeds.
+type DiscordNotifier struct {
+	webhookURL string
+}
+
+func (d *DiscordNotifier) Name() string { return notifierDiscord }
+
+func (d *DiscordNotifier) SendAlert(alert map[string]interface{}, message string) error {
+	embed := map[string]interface{}{
+		"title":       alertTitle(alert),
+		"description": truncate(message, discordMaxDescription),
+	}
+
+	fields := []map[string]interface{}{
+		{"name": tr("discord.location"), "value": alertStreet(alert), "inline": true},
+	}
+	if link := wazeMapLink(alert); link != "" {
+		embed["url"] = link
+		fields = append(fields, map[string]interface{}{"name": tr("discord.map"), "value": link, "inline": true})
+	}
+	embed["fields"] = fields
+
+	return d.post(map[string]interface{}{"embeds": []interface{}{embed}})
+}
+
+func (d *DiscordNotifier) SendText(text string) error {
+	return d.post(map[string]interface{}{"content": truncate(text, discordMaxContent)})
+}
+
+// post envia o payload, aguardando retry_after quando o Discord responde 429.
+func (d *DiscordNotifier) post(payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := httpClient.Post(d.webhookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode != http.StatusTooManyRequests {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				return fmt.Errorf("discord: %s", resp.Status)
+			}
+			return nil
+		}
+
+		var limit struct {
+			RetryAfter float64 `json:"retry_after"`
+		}
+		json.NewDecoder(resp.Body).Decode(&limit)
+		resp.Body.Close()
+
+		if attempt >= discordMaxAttempts {
+			return fmt.Errorf("discord: limite de requisições excedido após %d tentativas", attempt)
+		}
+		wait := time.Duration(limit.RetryAfter * float64(time.Second))
+		if wait <= 0 {
+			wait = time.Second
+		}
+		logger(fmt.Sprintf("discord: limite de requisições, aguardando %s", wait))
+		<-clock.After(wait)
+	}
+}
+
+const webhookMaxAttempts = 3
+
+// WebhookNotifier envia os alertas em JSON para uma URL qualquer. Com um
+// secret, o corpo é assinado em X-Signature: sha256=<hmac hex>.
+type WebhookNotifier struct {
+	url     string
+	secret  string
+	timeout time.Duration
+}
+
+func (n *WebhookNotifier) Name() string { return notifierWebhook }
+
+func (n *WebhookNotifier) SendAlert(alert map[string]interface{}, message string) error {
+	return n.post(map[string]interface{}{"alert": alert, "message": message})
+}
+
+func (n *WebhookNotifier) SendText(text string) error {
+	return n.post(map[string]interface{}{"message": text})
+}
+
+func (n *WebhookNotifier) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(n.secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (n *WebhookNotifier) post(payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return sendWithRetry(func() (bool, error) { return n.send(body) })
+}
+
+// sendWithRetry tenta até webhookMaxAttempts vezes enquanto send pedir nova
+// tentativa (erros de rede, 429 e 5xx), com espera crescente entre elas.
+func sendWithRetry(send func() (retry bool, err error)) error {
+	var lastErr error
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		if attempt > 1 {
+			<-clock.After(time.Duration(attempt-1) * time.Second)
+		}
+
+		retry, err := send()
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !retry {
+			break
+		}
+	}
+	return lastErr
+}
+
+// retryableStatus separa as respostas que valem nova tentativa (429 e 5xx)
+// das demais falhas.
+func retryableStatus(name string, resp *http.Response) (retry bool, err error) {
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		return true, fmt.Errorf("%s: %s", name, resp.Status)
+	case resp.StatusCode >= 300:
+		return false, fmt.Errorf("%s: %s", name, resp.Status)
+	}
+	return false, nil
+}
+
+func (n *WebhookNotifier) send(body []byte) (retry bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.secret != "" {
+		req.Header.Set("X-Signature", n.sign(body))
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	return retryableStatus("webhook", resp)
+}
+
+func matrixEnabled() bool {
+	return options.matrixHomeserver != "" && options.matrixRoomID != "" && matrixAccessToken != ""
+}
+
+// MatrixNotifier publica mensagens m.text numa sala do Matrix, com uma versão
+// em HTML (formatted_body) para os clientes que a exibem.
+type MatrixNotifier struct {
+	homeserver string
+	roomID     string
+	token      string
+	timeout    time.Duration
+}
+
+func (m *MatrixNotifier) Name() string { return notifierMatrix }
+
+func (m *MatrixNotifier) SendAlert(alert map[string]interface{}, message string) error {
+	formatted := "<b>" + html.EscapeString(alertTitle(alert)) + "</b><br>" + matrixHTML(message)
+	if link := wazeMapLink(alert); link != "" {
+		formatted += fmt.Sprintf(`<br><a href="%s">%s</a>`, html.EscapeString(link), html.EscapeString(tr("discord.map")))
+	}
+	return m.send(message, formatted)
+}
+
+func (m *MatrixNotifier) SendText(text string) error {
+	return m.send(text, matrixHTML(text))
+}
+
+// matrixTxnCounter torna únicos os ids de transação de um mesmo instante.
+var matrixTxnCounter atomic.Int64
+
+// send usa o mesmo id de transação em todas as tentativas, então o servidor
+// descarta uma repetição de uma mensagem que já tinha chegado.
+func (m *MatrixNotifier) send(text, formatted string) error {
+	body, err := json.Marshal(map[string]string{
+		"msgtype":        "m.text",
+		"body":           text,
+		"format":         "org.matrix.custom.html",
+		"formatted_body": formatted,
+	})
+	if err != nil {
+		return err
+	}
+
+	txnID := fmt.Sprintf("informawaze-%d-%d", clock.Now().UnixNano(), matrixTxnCounter.Add(1))
+	endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+		m.homeserver, url.PathEscape(m.roomID), url.PathEscape(txnID))
+
+	return sendWithRetry(func() (bool, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+m.token)
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return true, err
+		}
+		resp.Body.Close()
+		return retryableStatus("matrix", resp)
+	})
+}
+
+// matrixHTML converte o texto das mensagens em HTML: os blocos ``` viram
+// <pre><code> e as demais quebras de linha, <br>.
+func matrixHTML(text string) string {
+	var sb strings.Builder
+	for i, part := range strings.Split(text, "```") {
+		part = html.EscapeString(part)
+		if i%2 == 1 {
+			sb.WriteString("<pre><code>" + part + "</code></pre>")
+			continue
+		}
+		sb.WriteString(strings.ReplaceAll(part, "\n", "<br>"))
+	}
+	return sb.String()
+}
+
+const (
+	mqttDefaultPort = "1883"
+	mqttKeepAlive   = 60 * time.Second
+	mqttQueueSize   = 100
+	mqttMaxBackoff  = time.Minute
+	// mqttDrainTimeout limita quanto Close espera para publicar a fila.
+	mqttDrainTimeout = 5 * time.Second
+)
+
+// Tipos de pacote do MQTT 3.1.1 usados pelo notificador (byte de cabeçalho
+// sem as flags).
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttPuback     = 0x40
+	mqttPingreq    = 0xC0
+	mqttPingresp   = 0xD0
+	mqttDisconnect = 0xE0
+)
+
+func mqttEnabled() bool {
+	return options.mqttBroker != ""
+}
+
+// mqttAddress aceita "host", "host:porta" e os prefixos tcp:// e mqtt://.
+func mqttAddress(broker string) string {
+	if broker == "" {
+		return ""
+	}
+	for _, prefix := range []string{"tcp://", "mqtt://"} {
+		broker = strings.TrimPrefix(broker, prefix)
+	}
+	if _, _, err := net.SplitHostPort(broker); err != nil {
+		broker = net.JoinHostPort(broker, mqttDefaultPort)
+	}
+	return broker
+}
+
+// MQTTNotifier publica os alertas em JSON num broker MQTT. SendAlert só põe
+// a mensagem na fila; uma goroutine própria mantém a conexão e publica, então
+// um broker fora do ar não segura o pipeline. Com a fila cheia, as mensagens
+// novas são descartadas.
+type MQTTNotifier struct {
+	broker   string
+	topic    string
+	qos      byte
+	retain   bool
+	clientID string
+	username string
+	password string
+	timeout  time.Duration
+
+	queue    chan mqttMessage
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	conn     net.Conn
+	packetID uint16
+	// online é lido pelo /healthz, fora da goroutine de run.
+	online atomic.Bool
+}
+
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	// id é o packet id do QoS 1, mantido no reenvio; dup marca o reenvio.
+	id  uint16
+	dup bool
+}
+
+func (m *MQTTNotifier) Name() string { return notifierMQTT }
+
+func (m *MQTTNotifier) SendAlert(alert map[string]interface{}, message string) error {
+	alertType, _ := alert["type"].(string)
+	zone, _ := alert["zone"].(string)
+	return m.enqueue(alertType, zone, map[string]interface{}{"alert": alert, "message": message})
+}
+
+// SendText publica relatórios e resumos no tópico com {type} = "text".
+func (m *MQTTNotifier) SendText(text string) error {
+	return m.enqueue("text", "", map[string]interface{}{"message": text})
+}
+
+// Connected informa se há conexão aberta com o broker.
+func (m *MQTTNotifier) Connected() bool {
+	return m.online.Load()
+}
+
+func (m *MQTTNotifier) enqueue(topicType, region string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	msg := mqttMessage{topic: mqttTopic(m.topic, topicType, region), payload: body}
+	select {
+	case m.queue <- msg:
+		return nil
+	default:
+		return fmt.Errorf("mqtt: fila cheia, mensagem para %s descartada", msg.topic)
+	}
+}
+
+// mqttTopic preenche o modelo do tópico. Sem zona (mensagens de texto ou
+// alertas sem localização), {region} vira "all"; barras e curingas no nome
+// da zona viram "-" para não criar níveis extras no tópico.
+func mqttTopic(template, alertType, region string) string {
+	if region == "" {
+		region = "all"
+	}
+	region = strings.NewReplacer("/", "-", "+", "-", "#", "-").Replace(region)
+	return strings.NewReplacer("{type}", alertType, "{region}", region).Replace(template)
+}
+
+func (m *MQTTNotifier) start() {
+	m.queue = make(chan mqttMessage, mqttQueueSize)
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go m.run()
+}
+
+// Close publica o que ainda estiver na fila, por até mqttDrainTimeout, e
+// encerra a conexão com um DISCONNECT. Com o broker fora do ar, a fila é
+// perdida.
+func (m *MQTTNotifier) Close() error {
+	m.stopOnce.Do(func() { close(m.stop) })
+	<-m.done
+	return nil
+}
+
+// run conecta ao broker e publica a fila em ordem. Quando a conexão cai, a
+// mensagem em andamento é reenviada (com DUP, no QoS 1) depois da
+// reconexão. Tanto a falha ao conectar quanto a falha ao publicar esperam
+// de 1s até mqttMaxBackoff antes de tentar de novo, para um broker que aceita
+// o CONNECT e derruba o PUBLISH não virar um laço. Sem mensagens, um PINGREQ
+// a cada meio keep-alive mantém a conexão e detecta quedas.
+func (m *MQTTNotifier) run() {
+	defer close(m.done)
+
+	var pending *mqttMessage
+	backoff := time.Second
+	// retry espera o backoff; devolve false se Close foi chamado nesse meio
+	// tempo, descartando o que não foi publicado.
+	retry := func() bool {
+		select {
+		case <-clock.After(backoff):
+			backoff = min(backoff*2, mqttMaxBackoff)
+			return true
+		case <-m.stop:
+			lost := len(m.queue)
+			if pending != nil {
+				lost++
+			}
+			if lost > 0 {
+				logger(fmt.Sprintf("WARNING: mqtt: sem conexão ao encerrar, %d mensagens descartadas", lost))
+			}
+			return false
+		}
+	}
+	for {
+		if m.conn == nil {
+			if err := m.connect(); err != nil {
+				logger(fmt.Sprintf("WARNING: mqtt: can't connect to %s, retrying in %s: %v", m.broker, backoff, err))
+				if !retry() {
+					return
+				}
+				continue
+			}
+		}
+
+		if pending == nil {
+			select {
+			case msg := <-m.queue:
+				pending = &msg
+			case <-clock.After(mqttKeepAlive / 2):
+				if err := m.ping(); err != nil {
+					m.disconnect(err)
+				} else {
+					backoff = time.Second
+				}
+				continue
+			case <-m.stop:
+				m.drain()
+				return
+			}
+		}
+
+		if err := m.publish(pending); err != nil {
+			pending.dup = true
+			m.disconnect(err)
+			logger(fmt.Sprintf("WARNING: mqtt: can't publish to %s, retrying in %s", m.broker, backoff))
+			if !retry() {
+				return
+			}
+			continue
+		}
+		pending = nil
+		backoff = time.Second
+	}
+}
+
+// drain publica o que está na fila até mqttDrainTimeout e desconecta.
+func (m *MQTTNotifier) drain() {
+	deadline := time.Now().Add(mqttDrainTimeout)
+	for len(m.queue) > 0 && time.Now().Before(deadline) {
+		msg := <-m.queue
+		if err := m.publish(&msg); err != nil {
+			logger(fmt.Sprintf("WARNING: mqtt: can't publish to %s while closing: %v", m.broker, err))
+			break
+		}
+	}
+	if lost := len(m.queue); lost > 0 {
+		logger(fmt.Sprintf("WARNING: mqtt: %d mensagens na fila descartadas ao encerrar", lost))
+	}
+	m.write([]byte{mqttDisconnect, 0})
+	m.closeConn()
+}
+
+func (m *MQTTNotifier) connect() error {
+	conn, err := net.DialTimeout("tcp", m.broker, m.timeout)
+	if err != nil {
+		return err
+	}
+	m.conn = conn
+
+	// Clean session: o bot só publica, não há assinaturas a preservar.
+	flags := byte(0x02)
+	payload := mqttString(m.clientID)
+	if m.username != "" {
+		flags |= 0x80
+		payload = append(payload, mqttString(m.username)...)
+		if m.password != "" {
+			flags |= 0x40
+			payload = append(payload, mqttString(m.password)...)
+		}
+	}
+	keepAlive := uint16(mqttKeepAlive / time.Second)
+	header := append(mqttString("MQTT"), 4, flags, byte(keepAlive>>8), byte(keepAlive))
+
+	if err := m.write(mqttPacket(mqttConnect, append(header, payload...))); err != nil {
+		m.closeConn()
+		return err
+	}
+	packetType, body, err := mqttRead(conn, m.timeout)
+	if err != nil {
+		m.closeConn()
+		return err
+	}
+	if packetType != mqttConnack || len(body) != 2 {
+		m.closeConn()
+		return fmt.Errorf("resposta inesperada ao CONNECT: 0x%02x", packetType)
+	}
+	if body[1] != 0 {
+		m.closeConn()
+		return fmt.Errorf("conexão recusada pelo broker (código %d)", body[1])
+	}
+	m.online.Store(true)
+	logger("mqtt: conectado a " + m.broker)
+	return nil
+}
+
+func (m *MQTTNotifier) publish(msg *mqttMessage) error {
+	header := byte(mqttPublish) | m.qos<<1
+	if m.retain {
+		header |= 0x01
+	}
+	body := mqttString(msg.topic)
+	if m.qos > 0 {
+		if msg.dup {
+			header |= 0x08
+		}
+		if msg.id == 0 {
+			m.packetID++
+			if m.packetID == 0 {
+				m.packetID = 1
+			}
+			msg.id = m.packetID
+		}
+		body = append(body, byte(msg.id>>8), byte(msg.id))
+	}
+	body = append(body, msg.payload...)
+
+	if err := m.write(mqttPacket(header, body)); err != nil {
+		return err
+	}
+	if m.qos == 0 {
+		return nil
+	}
+
+	packetType, ack, err := mqttRead(m.conn, m.timeout)
+	if err != nil {
+		return err
+	}
+	if packetType != mqttPuback || len(ack) != 2 || uint16(ack[0])<<8|uint16(ack[1]) != msg.id {
+		return fmt.Errorf("PUBACK inesperado: 0x%02x %v", packetType, ack)
+	}
+	return nil
+}
+
+func (m *MQTTNotifier) ping() error {
+	if err := m.write([]byte{mqttPingreq, 0}); err != nil {
+		return err
+	}
+	packetType, _, err := mqttRead(m.conn, m.timeout)
+	if err != nil {
+		return err
+	}
+	if packetType != mqttPingresp {
+		return fmt.Errorf("resposta inesperada ao PINGREQ: 0x%02x", packetType)
+	}
+	return nil
+}
+
+func (m *MQTTNotifier) write(packet []byte) error {
+	m.conn.SetWriteDeadline(time.Now().Add(m.timeout))
+	_, err := m.conn.Write(packet)
+	return err
+}
+
+func (m *MQTTNotifier) disconnect(err error) {
+	logger(fmt.Sprintf("WARNING: mqtt: lost connection to %s: %v", m.broker, err))
+	m.closeConn()
+}
+
+func (m *MQTTNotifier) closeConn() {
+	m.online.Store(false)
+	m.conn.Close()
+	m.conn = nil
+}
+
+// mqttString codifica uma string do MQTT: tamanho em 2 bytes e o conteúdo.
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+// mqttPacket monta o pacote com o "remaining length" em base 128.
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// mqttRead lê um pacote e devolve o byte de cabeçalho (tipo e flags) e o
+// corpo. As respostas que o notificador espera não têm flags.
+func mqttRead(conn net.Conn, timeout time.Duration) (byte, []byte, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	var b [1]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return 0, nil, err
+	}
+	header := b[0]
+
+	length, shift := 0, 0
+	for {
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return 0, nil, err
+		}
+		length |= int(b[0]&0x7F) << shift
+		if b[0]&0x80 == 0 {
+			break
+		}
+		shift += 7
+		if shift > 21 {
+			return 0, nil, fmt.Errorf("mqtt: remaining length inválido")
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// wazeMapLink aponta para a posição do alerta no mapa do Waze.
+func wazeMapLink(alert map[string]interface{}) string {
+	location, ok := alert["location"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	x, okX := location["x"].(float64)
+	y, okY := location["y"].(float64)
+	if !okX || !okY {
+		return ""
+	}
+	return fmt.Sprintf("https://www.waze.com/ul?ll=%s%%2C%s&navigate=no", formatCoord(y), formatCoord(x))
+}
+
+// staticMapLink monta a URL da imagem do mapa a partir de staticMapUrl. Sem
+// coordenadas, ou se o modelo pede {key} e não há chave, devolve "".
+func staticMapLink(alert map[string]interface{}) string {
+	if options.staticMapURL == "" {
+		return ""
+	}
+	if strings.Contains(options.staticMapURL, "{key}") && staticMapKey == "" {
+		return ""
+	}
+	location, ok := alert["location"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	x, okX := location["x"].(float64)
+	y, okY := location["y"].(float64)
+	if !okX || !okY {
+		return ""
+	}
+	return strings.NewReplacer(
+		"{lat}", formatCoord(y),
+		"{lon}", formatCoord(x),
+		"{key}", url.QueryEscape(staticMapKey),
+	).Replace(options.staticMapURL)
+}
+
+func truncate(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return string(runes[:limit-1]) + "…"
+}
+
+func runDigest(interval time.Duration) {
+	for {
+		<-clock.After(interval)
+		flushDigest(interval)
+	}
+}
+
+// flushDigest envia o resumo dos alertas acumulados, se houver algum.
+func flushDigest(interval time.Duration) {
+	digestLock.Lock()
+	pending := digest
+	digest = nil
+	digestLock.Unlock()
+
+	if len(pending) > 0 {
+		sendMessage(formatDigest(pending, interval))
+	}
+}
+
+// formatDigest agrupa os alertas por tipo, com a contagem de cada um e as
+// ruas mais citadas.
+func formatDigest(pending []map[string]interface{}, interval time.Duration) string {
+	const topLocations = 3
+
+	byType := make(map[string][]map[string]interface{})
+	for _, alert := range pending {
+		alertType, _ := alert["type"].(string)
+		byType[alertType] = append(byType[alertType], alert)
+	}
+
+	types := make([]string, 0, len(byType))
+	for alertType := range byType {
+		types = append(types, alertType)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if len(byType[types[i]]) != len(byType[types[j]]) {
+			return len(byType[types[i]]) > len(byType[types[j]])
+		}
+		return types[i] < types[j]
+	})
+
+	var sb strings.Builder
+	sb.WriteString(tr("digest.header", interval, len(pending)) + "\n")
+
+	for _, alertType := range types {
+		label := alertTitle(map[string]interface{}{"type": alertType})
+		sb.WriteString(fmt.Sprintf("\n%s: %d\n", label, len(byType[alertType])))
+
+		locations := make(map[string]int)
+		for _, alert := range byType[alertType] {
+			locations[alertStreet(alert)]++
+		}
+		names := make([]string, 0, len(locations))
+		for name := range locations {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			if locations[names[i]] != locations[names[j]] {
+				return locations[names[i]] > locations[names[j]]
+			}
+			return names[i] < names[j]
+		})
+		if len(names) > topLocations {
+			names = names[:topLocations]
+		}
+		for _, name := range names {
+			sb.WriteString(fmt.Sprintf("  • %s (%d)\n", name, locations[name]))
+		}
+	}
+
+	return sb.String()
+}
+
+func alertStreet(alert map[string]interface{}) string {
+	if street, ok := alert["street"].(string); ok && street != "" {
+		return street
+	}
+	if city, ok := alert["city"].(string); ok && city != "" {
+		return city
+	}
+	return tr("street.unknown")
+}
+
+const (
+	telegramAPIURL = "https://api.telegram.org/bot%s/%s"
+	// telegramMaxCaption é o limite da legenda de fotos; textos maiores vão
+	// como mensagem comum.
+	telegramMaxCaption = 1024
+	ackPrefix          = "ack:"
+)
+
+type telegramUser struct {
+	ID        int64  `json:"id"`
+	Username  string `json:"username"`
+	FirstName string `json:"first_name"`
+}
+
+type telegramCallbackQuery struct {
+	ID   string       `json:"id"`
+	From telegramUser `json:"from"`
+	Data string       `json:"data"`
+}
+
+type telegramChat struct {
+	ID int64 `json:"id"`
+}
+
+type telegramMessage struct {
+	Chat telegramChat `json:"chat"`
+	From telegramUser `json:"from"`
+	Text string       `json:"text"`
+}
+
+type telegramUpdate struct {
+	UpdateID      int64                  `json:"update_id"`
+	Message       *telegramMessage       `json:"message"`
+	CallbackQuery *telegramCallbackQuery `json:"callback_query"`
+}
+
+// telegramEnabled só exige o token: sem chats configurados, os alertas vão
+// para os chats registrados com /start.
+func telegramEnabled() bool {
+	return telegramBotToken != ""
+}
+
+// splitList separa uma lista por vírgulas, ignorando itens vazios.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func ackKeyboard(alertID string) map[string]interface{} {
+	return map[string]interface{}{
+		"inline_keyboard": [][]map[string]string{
+			{{"text": tr("telegram.ackButton"), "callback_data": ackPrefix + alertID}},
+		},
+	}
+}
+
+// TelegramRoute é o destino de um tipo de alerta; ThreadID seleciona o
+// tópico em grupos com fórum.
+type TelegramRoute struct {
+	ChatID   string `json:"chatId"`
+	ThreadID int64  `json:"threadId"`
+}
+
+// defaultTelegramRoutes envia a todos os chats padrão: os configurados ou,
+// na falta deles, os registrados com /start.
+func defaultTelegramRoutes() []TelegramRoute {
+	chatIDs := telegramChatIDs
+	if len(chatIDs) == 0 {
+		chatIDs = telegramChats.Slice()
+		sort.Strings(chatIDs)
+	}
+	routes := make([]TelegramRoute, len(chatIDs))
+	for i, chatID := range chatIDs {
+		routes[i] = TelegramRoute{ChatID: chatID}
+	}
+	return routes
+}
+
+// telegramRoutesFor retorna o destino configurado para o tipo, ou os chats
+// padrão para tipos sem rota.
+func telegramRoutesFor(alertType string) []TelegramRoute {
+	route, ok := options.telegramRoutes[alertType]
+	if !ok || route.ChatID == "" {
+		return defaultTelegramRoutes()
+	}
+	return []TelegramRoute{route}
+}
+
+// sendTelegramMessages envia a todas as rotas, mesmo que alguma falhe, e
+// retorna os erros juntos.
+func sendTelegramMessages(routes []TelegramRoute, text string, replyMarkup interface{}) error {
+	var errs []error
+	for _, route := range routes {
+		if err := sendTelegramMessage(route, text, replyMarkup); err != nil {
+			errs = append(errs, fmt.Errorf("chat %s: %w", route.ChatID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func sendTelegramMessage(route TelegramRoute, text string, replyMarkup interface{}) error {
+	payload := map[string]interface{}{
+		"chat_id": route.ChatID,
+		"text":    text,
+	}
+	if route.ThreadID != 0 {
+		payload["message_thread_id"] = route.ThreadID
+	}
+	if replyMarkup != nil {
+		payload["reply_markup"] = replyMarkup
+	}
+	return telegramCall("sendMessage", payload)
+}
+
+// sendTelegramPhoto envia a imagem pela URL; o Telegram a baixa do provedor.
+func sendTelegramPhoto(route TelegramRoute, photoURL, caption string, replyMarkup interface{}) error {
+	payload := map[string]interface{}{
+		"chat_id": route.ChatID,
+		"photo":   photoURL,
+		"caption": caption,
+	}
+	if route.ThreadID != 0 {
+		payload["message_thread_id"] = route.ThreadID
+	}
+	if replyMarkup != nil {
+		payload["reply_markup"] = replyMarkup
+	}
+	return telegramCall("sendPhoto", payload)
+}
+
+func telegramCall(method string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf(telegramAPIURL, telegramBotToken, method)
+	resp, err := httpClient.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// Os erros do net/http citam a URL, que contém o token.
+		if telegramBotToken != "" {
+			err = errors.New(strings.ReplaceAll(err.Error(), telegramBotToken, redactSecret(telegramBotToken)))
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if !result.OK {
+		return fmt.Errorf("telegram %s: %s", method, result.Description)
+	}
+	return nil
+}
+
+func handleTelegramWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "Método não permitido")
+		return
+	}
+
+	if telegramWebhookSecret != "" && r.Header.Get("X-Telegram-Bot-Api-Secret-Token") != telegramWebhookSecret {
+		writeJSONError(w, r, http.StatusUnauthorized, "unauthorized", "Não autorizado")
+		return
+	}
+
+	var update telegramUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, "invalid_body", "Erro ao decodificar atualização")
+		return
+	}
+
+	if update.Message != nil {
+		handleTelegramCommand(update.Message)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Telegram só precisa de um 200; outros tipos de atualização são ignorados.
+	query := update.CallbackQuery
+	if query == nil || !strings.HasPrefix(query.Data, ackPrefix) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	alertID := strings.TrimPrefix(query.Data, ackPrefix)
+	user := query.From.Username
+	if user == "" {
+		user = fmt.Sprintf("%s (%d)", query.From.FirstName, query.From.ID)
+	}
+	total := db.AddAcknowledgement(alertID, user)
+
+	answer := map[string]interface{}{
+		"callback_query_id": query.ID,
+		"text":              tr("telegram.ackAnswer", total),
+	}
+	if err := telegramCall("answerCallbackQuery", answer); err != nil {
+		logger(fmt.Sprintf("ERROR: can't answer callback query: %v", err))
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleTelegramCommand registra (/start) ou remove (/stop) o chat da
+// mensagem na lista de destinos; outras mensagens são ignoradas.
+func handleTelegramCommand(message *telegramMessage) {
+	fields := strings.Fields(message.Text)
+	if len(fields) == 0 {
+		return
+	}
+	// Em grupos, o comando pode vir como /start@NomeDoBot.
+	command, _, _ := strings.Cut(fields[0], "@")
+	chatID := strconv.FormatInt(message.Chat.ID, 10)
+
+	var reply string
+	switch command {
+	case "/start":
+		telegramChats.Add(chatID)
+		reply = tr("telegram.started")
+		logger(fmt.Sprintf("chat %s registrado via /start", chatID))
+	case "/stop":
+		telegramChats.Remove(chatID)
+		reply = tr("telegram.stopped")
+		logger(fmt.Sprintf("chat %s removido via /stop", chatID))
+	default:
+		return
+	}
+	db.SetTelegramChats(telegramChats)
+
+	if len(telegramChatIDs) > 0 && command == "/start" {
+		reply = tr("telegram.startedConfigured")
+	}
+	// A resposta passa pelos notificadores, como as demais mensagens: nada
+	// sai com as notificações pausadas, e no dry-run ela só é registrada.
+	if notificationsPaused.Load() {
+		return
+	}
+	for _, notifier := range notifiers {
+		if replier, ok := notifier.(chatReplier); ok {
+			if err := replier.Reply(chatID, reply); err != nil {
+				logger(fmt.Sprintf("ERROR: can't answer %s: %v", command, err))
+			}
+		}
+	}
+}
+
+func logger(msg string) {
+	if !logLevelAllows(msg) {
+		return
+	}
+	t := clock.Now()
+	fmt.Fprintf(logOutput, "[%02d:%02d:%02d] %s\n", t.Hour(), t.Minute(), t.Second(), msg)
+}
+
+// logOutput é a saída de logger: a padrão ou o arquivo de -log-file.
+var logOutput io.Writer = os.Stdout
+
+// RotatingFile é um io.Writer que grava em path e, quando a próxima escrita
+// passaria de maxSize bytes, renomeia o arquivo para path.1 (e os
+// anteriores para path.2, path.3...), mantendo até maxBackups cópias.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		// Se a rotação falhar, o log segue no arquivo atual e a próxima
+		// escrita tenta de novo. O erro vai para a saída de erro, já que o
+		// logger escreve aqui.
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: can't rotate log file: %v\n", err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate descarta a cópia mais antiga, desloca as demais e começa um
+// arquivo novo. Sem backups, o arquivo atual é esvaziado. O arquivo aberto
+// só é trocado depois que o novo abriu, então uma falha no meio do caminho
+// nunca deixa o log sem destino.
+func (r *RotatingFile) rotate() error {
+	if r.maxBackups == 0 {
+		if err := r.file.Truncate(0); err != nil {
+			return err
+		}
+		r.size = 0
+		return nil
+	}
+	for i := r.maxBackups; i > 1; i-- {
+		from := fmt.Sprintf("%s.%d", r.path, i-1)
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", r.path, i)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return err
+	}
+
+	previous := r.file
+	if err := r.open(); err != nil {
+		// Continua escrevendo no arquivo antigo, agora com o nome .1.
+		return err
+	}
+	previous.Close()
+	return nil
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+// defaultAlertFields são os campos mostrados nas mensagens quando alertFields
+// não está no config.json.
+var defaultAlertFields = []string{"type", "subtype", "severity", "street", "city", "reportBy", "pubMillis", "location", "uuid"}
+
+// internalAlertFields são acrescentados pelo bot e ficam de fora do "*".
+var internalAlertFields = map[string]bool{
+	"zone": true, "source": true, "reannounce": true, "delaySeconds": true, "speedDropKMH": true,
+}
+
+// formatAlertData lista os campos de options.alertFields presentes no alerta,
+// sempre na mesma ordem. Campos ausentes ou vazios são omitidos.
+func formatAlertData(alert map[string]interface{}) string {
+	var sb strings.Builder
+
+	listed := make(map[string]bool)
+	var keys []string
+	for _, key := range options.alertFields {
+		if key == "*" {
+			var rest []string
+			for other := range alert {
+				if !internalAlertFields[other] && !slices.Contains(options.alertFields, other) {
+					rest = append(rest, other)
+				}
+			}
+			sort.Strings(rest)
+			keys = append(keys, rest...)
+			continue
+		}
+		if !listed[key] {
+			listed[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	for _, key := range keys {
+		val, ok := alert[key]
+		if !ok || val == nil || val == "" {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("%s: %s\n", key, formatAlertValue(key, val)))
+	}
+
+	return sb.String()
+}
+
+// formatAlertValue mostra coordenadas como "lat, lon", pubMillis como
+// horário e números inteiros sem notação científica.
+func formatAlertValue(key string, val interface{}) string {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		x, okX := v["x"].(float64)
+		y, okY := v["y"].(float64)
+		if okX && okY {
+			return formatCoord(y) + ", " + formatCoord(x)
+		}
+	case float64:
+		if key == "pubMillis" {
+			return localTime(time.UnixMilli(int64(v))).Format("02/01 15:04:05")
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(val)
+}
+
+type Database struct {
+	filename string
+	data     map[string]interface{}
+	// writes conta as gravações bem-sucedidas, mostradas em /stats.
+	writes int
+	mu     sync.Mutex
+}
+
+func NewDatabase(filename string) *Database {
+	return &Database{filename: filename, data: make(map[string]interface{})}
+}
+
+func (db *Database) load() {
+	file, err := os.Open(db.filename)
+	if err != nil {
+		log.Println("ERROR: can't open database file")
+		return
+	}
+	defer file.Close()
+
+	err = json.NewDecoder(file).Decode(&db.data)
+	if err != nil {
+		log.Println("ERROR: can't decode database file")
+		return
+	}
+}
+
+// save grava o db com writeJSONAtomic, então uma falha no meio da escrita
+// preserva o último db válido.
+func (db *Database) save() {
+	if err := writeJSONAtomic(db.filename, &db.data); err != nil {
+		log.Printf("ERROR: can't save database file: %v", err)
+		return
+	}
+	db.writes++
+}
+
+func (db *Database) Writes() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.writes
+}
+
+// writeJSONAtomic grava v em um arquivo temporário no mesmo diretório e o
+// renomeia sobre filename; quem lê nunca vê um arquivo pela metade.
+func writeJSONAtomic(filename string, v interface{}) error {
+	file, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("can't create file: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	if err := json.NewEncoder(file).Encode(v); err != nil {
+		file.Close()
+		return fmt.Errorf("can't encode file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("can't sync file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("can't close file: %w", err)
+	}
+	if err := os.Rename(file.Name(), filename); err != nil {
+		return fmt.Errorf("can't replace file: %w", err)
+	}
+
+	if dir, err := os.Open(filepath.Dir(filename)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+func (db *Database) GetProcessedAlerts() *Set {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.load()
+
+	// Entradas antigas, sem instante salvo, contam como vistas agora.
+	seen := make(map[string]time.Time)
+	now := clock.Now()
+	switch alerts := db.data["processedAlerts"].(type) {
+	case []string:
+		for _, alertID := range alerts {
+			seen[alertID] = now
+		}
+	case []interface{}:
+		for _, alertID := range alerts {
+			if id, ok := alertID.(string); ok {
+				seen[id] = now
+			}
+		}
+	}
+
+	switch times := db.data["processedAlertsSeen"].(type) {
+	case map[string]int64:
+		for alertID, millis := range times {
+			seen[alertID] = time.UnixMilli(millis)
+		}
+	case map[string]interface{}:
+		for alertID, millis := range times {
+			if ms, ok := millis.(float64); ok {
+				seen[alertID] = time.UnixMilli(int64(ms))
+			}
+		}
+	}
+
+	// A ordem LRU salva vale sobre a dos instantes, que não registram os
+	// acessos feitos com Has.
+	set := NewTimedSet(seen, 0)
+	switch order := db.data["processedAlertsOrder"].(type) {
+	case []string:
+		set.restoreOrder(order)
+	case []interface{}:
+		ids := make([]string, 0, len(order))
+		for _, alertID := range order {
+			if id, ok := alertID.(string); ok {
+				ids = append(ids, id)
+			}
+		}
+		set.restoreOrder(ids)
+	}
+	return set
+}
+
+func (db *Database) GetMaxWazersOnline() *Counter {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.load()
+	return NewCounter(dbInt(db.data["maxWazersOnline"]))
+}
+
+// GetWazersHistory retorna quando o pico atual foi atingido, o último
+// relatório (ou agora, se nunca houve um) e o pico daquele relatório.
+func (db *Database) GetWazersHistory() (peakAt, lastReport time.Time, previousPeak int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.load()
+	if millis := dbInt(db.data["maxWazersOnlineAt"]); millis > 0 {
+		peakAt = time.UnixMilli(int64(millis))
+	}
+	lastReport = clock.Now()
+	if millis := dbInt(db.data["lastWazersReport"]); millis > 0 {
+		lastReport = time.UnixMilli(int64(millis))
+	}
+	return peakAt, lastReport, dbInt(db.data["previousWazersPeak"])
+}
+
+// SetWazersPeak grava um novo pico, para que sobreviva a um reinício antes
+// do relatório.
+func (db *Database) SetWazersPeak(count int, at time.Time) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.data["maxWazersOnline"] = count
+	db.data["maxWazersOnlineAt"] = at.UnixMilli()
+	db.save()
+}
+
+// GetDailyWazersPeak restaura o pico do dia; se o dia salvo já passou, o
+// pico lido vale zero.
+func (db *Database) GetDailyWazersPeak() *DailyPeak {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.load()
+	day, _ := db.data["dailyWazersPeakDay"].(string)
+	return &DailyPeak{day: day, count: dbInt(db.data["dailyWazersPeak"])}
+}
+
+func (db *Database) SetDailyWazersPeak(peak *DailyPeak) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	day, count := peak.snapshot()
+	db.data["dailyWazersPeakDay"] = day
+	db.data["dailyWazersPeak"] = count
+	db.save()
+}
+
+// SetWazersReport registra um relatório enviado e zera o pico corrente.
+func (db *Database) SetWazersReport(at time.Time, peak int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.data["maxWazersOnline"] = 0
+	delete(db.data, "maxWazersOnlineAt")
+	db.data["lastWazersReport"] = at.UnixMilli()
+	db.data["previousWazersPeak"] = peak
+	db.save()
+}
+
+// dbInt lê um número do db.json, que volta como float64 depois de
+// decodificado.
+func dbInt(value interface{}) int {
+	switch n := value.(type) {
+	case int:
+		return n
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	}
+	return 0
+}
+
+func (db *Database) SetProcessedAlerts(alerts *Set) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	timestamps := alerts.Timestamps()
+	seen := make(map[string]int64, len(timestamps))
+	for alertID, t := range timestamps {
+		seen[alertID] = t.UnixMilli()
+	}
+
+	db.data["processedAlerts"] = alerts.Slice()
+	db.data["processedAlertsSeen"] = seen
+	db.data["processedAlertsOrder"] = alerts.Order()
+	db.save()
+}
+
+// AddAcknowledgement registra que user viu o alerta e retorna quantos
+// usuários já o confirmaram.
+func (db *Database) AddAcknowledgement(alertID, user string) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	acks, ok := db.data["acknowledgements"].(map[string]interface{})
+	if !ok {
+		acks = make(map[string]interface{})
+	}
+
+	users, _ := acks[alertID].([]interface{})
+	for _, u := range users {
+		if u == user {
+			return len(users)
+		}
+	}
+
+	users = append(users, user)
+	acks[alertID] = users
+	db.data["acknowledgements"] = acks
+	db.save()
+	return len(users)
+}
+
+// GetGeocodedArea devolve o retângulo que geocodeArea guardou para a chave,
+// ou nil. Ao contrário dos outros Get, não relê o db.json: é chamado a cada
+// recarga da configuração, e o arquivo já foi lido na inicialização.
+func (db *Database) GetGeocodedArea(key string) map[string]float64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	areas, _ := db.data["geocodedAreas"].(map[string]interface{})
+	switch area := areas[key].(type) {
+	case map[string]float64:
+		return area
+	case map[string]interface{}:
+		bounds := make(map[string]float64, len(area))
+		for side, value := range area {
+			if number, ok := value.(float64); ok {
+				bounds[side] = number
+			}
+		}
+		return bounds
+	}
+	return nil
+}
+
+// SetGeocodedArea guarda o retângulo de uma área e grava o db.json.
+func (db *Database) SetGeocodedArea(key string, bounds map[string]float64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	areas, _ := db.data["geocodedAreas"].(map[string]interface{})
+	if areas == nil {
+		areas = make(map[string]interface{})
+		db.data["geocodedAreas"] = areas
+	}
+	areas[key] = bounds
+	db.save()
+}
+
+// GetTelegramChats retorna os chats registrados com /start.
+func (db *Database) GetTelegramChats() *Set {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.load()
+	var chats []string
+	switch ids := db.data["telegramChats"].(type) {
+	case []string:
+		chats = ids
+	case []interface{}:
+		for _, id := range ids {
+			if chatID, ok := id.(string); ok {
+				chats = append(chats, chatID)
+			}
+		}
+	}
+	return NewSet(chats)
+}
+
+func (db *Database) SetTelegramChats(chats *Set) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.data["telegramChats"] = chats.Slice()
+	db.save()
+}
+
+func (db *Database) SetMaxWazersOnline(count *Counter) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.data["maxWazersOnline"] = count.Get()
+	db.save()
+}
+
+// Set guarda quando cada item foi visto. Com uma janela (window) definida,
+// itens mais antigos que ela são tratados como ausentes; com capacity > 0,
+// os itens usados há mais tempo são descartados quando o limite é excedido.
+type Set struct {
+	data     map[string]*list.Element
+	order    *list.List // mais recente na frente
+	window   time.Duration
+	capacity int
+	mu       sync.Mutex
+}
+
+type setEntry struct {
+	item string
+	seen time.Time
+}
+
+func NewSet(items []string) *Set {
+	set := &Set{data: make(map[string]*list.Element), order: list.New()}
+	set.AddAll(items)
+	return set
+}
+
+// NewTimedSet restaura um conjunto com os instantes salvos no db.json.
+func NewTimedSet(items map[string]time.Time, window time.Duration) *Set {
+	set := &Set{data: make(map[string]*list.Element, len(items)), order: list.New(), window: window}
+
+	// Insere do mais antigo para o mais recente, preservando a ordem LRU.
+	entries := make([]setEntry, 0, len(items))
+	for item, seen := range items {
+		entries = append(entries, setEntry{item: item, seen: seen})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seen.Before(entries[j].seen) })
+	for _, entry := range entries {
+		set.put(entry.item, entry.seen)
+	}
+	return set
+}
+
+// restoreOrder traz os itens de order para a frente, do primeiro ao último,
+// que fica como o usado mais recentemente. Itens ausentes são ignorados.
+func (s *Set) restoreOrder(order []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, item := range order {
+		if element, ok := s.data[item]; ok {
+			s.order.MoveToFront(element)
+		}
+	}
+}
+
+func (s *Set) SetWindow(window time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.window = window
+}
+
+// SetCapacity limita o número de itens; 0 desativa o limite.
+func (s *Set) SetCapacity(capacity int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.capacity = capacity
+	s.evict()
+}
+
+func (s *Set) expired(seen, now time.Time) bool {
+	return s.window > 0 && now.Sub(seen) > s.window
+}
+
+// put insere ou atualiza item na frente da lista. Deve ser chamado com o
+// lock obtido.
+func (s *Set) put(item string, seen time.Time) {
+	if element, ok := s.data[item]; ok {
+		element.Value.(*setEntry).seen = seen
+		s.order.MoveToFront(element)
+		return
+	}
+	s.data[item] = s.order.PushFront(&setEntry{item: item, seen: seen})
+	s.evict()
+}
+
+func (s *Set) evict() {
+	for s.capacity > 0 && s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.data, oldest.Value.(*setEntry).item)
+	}
+}
+
+func (s *Set) Add(item string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.put(item, clock.Now())
+}
+
+func (s *Set) Remove(item string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if element, ok := s.data[item]; ok {
+		s.order.Remove(element)
+		delete(s.data, item)
+	}
+}
+
+// Clear remove todos os itens e retorna quantos havia.
+func (s *Set) Clear() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cleared := s.order.Len()
+	s.data = make(map[string]*list.Element)
+	s.order.Init()
+	return cleared
+}
+
+// Expire remove os itens vencidos pela janela e devolve quantos saíram.
+func (s *Set) Expire() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := clock.Now()
+	expired := 0
+	for item, element := range s.data {
+		if s.expired(element.Value.(*setEntry).seen, now) {
+			s.order.Remove(element)
+			delete(s.data, item)
+			expired++
+		}
+	}
+	return expired
+}
+
+// Has também conta como acesso para a ordem LRU.
+func (s *Set) Has(item string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, ok := s.data[item]
+	if !ok || s.expired(element.Value.(*setEntry).seen, clock.Now()) {
+		return false
+	}
+	s.order.MoveToFront(element)
+	return true
+}
+
+func (s *Set) AddAll(items []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := clock.Now()
+	for _, item := range items {
+		s.put(item, now)
+	}
+}
+
+func (s *Set) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.order.Len()
+}
+
+// Slice retorna os itens ordenados; um conjunto vazio resulta em []string{},
+// nunca nil, para serializar como [] em JSON.
+func (s *Set) Slice() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := clock.Now()
+	items := make([]string, 0, len(s.data))
+	for item, element := range s.data {
+		if !s.expired(element.Value.(*setEntry).seen, now) {
+			items = append(items, item)
+		}
+	}
+	sort.Strings(items)
+	return items
+}
+
+// Order retorna os itens ainda válidos do usado há mais tempo ao mais
+// recente, a ordem que restoreOrder espera.
+func (s *Set) Order() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := clock.Now()
+	items := make([]string, 0, len(s.data))
+	for element := s.order.Back(); element != nil; element = element.Prev() {
+		if entry := element.Value.(*setEntry); !s.expired(entry.seen, now) {
+			items = append(items, entry.item)
+		}
+	}
+	return items
+}
+
+// Timestamps retorna uma cópia dos itens ainda válidos com o instante em que
+// foram vistos.
+func (s *Set) Timestamps() map[string]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := clock.Now()
+	items := make(map[string]time.Time, len(s.data))
+	for item, element := range s.data {
+		if seen := element.Value.(*setEntry).seen; !s.expired(seen, now) {
+			items[item] = seen
+		}
+	}
+	return items
+}
+
+// Union, Intersect e Diff trabalham sobre uma cópia de other, então nunca
+// seguram os dois locks ao mesmo tempo.
+func (s *Set) Union(other *Set) *Set {
+	result := NewSet(s.Slice())
+	result.AddAll(other.Slice())
+	return result
+}
+
+func (s *Set) Intersect(other *Set) *Set {
+	own := s.Timestamps()
+	result := NewSet(nil)
+	for _, item := range other.Slice() {
+		if _, ok := own[item]; ok {
+			result.Add(item)
+		}
+	}
+	return result
+}
+
+func (s *Set) Diff(other *Set) *Set {
+	result := NewSet(s.Slice())
+	for _, item := range other.Slice() {
+		result.Remove(item)
+	}
+	return result
+}
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// CircuitBreaker suspende as chamadas a um endpoint após threshold falhas
+// seguidas. Passado o cooldown, uma única chamada de teste (half-open)
+// decide se o circuito fecha ou volta a abrir.
+type CircuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	state     string
+	openedAt  time.Time
+	probing   bool
+	mu        sync.Mutex
+}
+
+func NewCircuitBreaker(name string, threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{name: name, threshold: threshold, cooldown: cooldown, state: breakerClosed}
+}
+
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if clock.Now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		logger(fmt.Sprintf("circuito %s meio-aberto, testando recuperação", b.name))
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerClosed {
+		logger(fmt.Sprintf("circuito %s fechado", b.name))
+	}
+	b.state = breakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *CircuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.state = breakerOpen
+		b.openedAt = clock.Now()
+		logger(fmt.Sprintf("circuito %s aberto após %d falhas, aguardando %s", b.name, b.failures, b.cooldown))
+	}
+}
+
+func (b *CircuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+// Archive grava cada alerta processado como uma linha JSON em
+// alerts-AAAA-MM-DD.jsonl, trocando de arquivo quando o dia muda.
+type Archive struct {
+	dir    string
+	day    string
+	file   *os.File
+	writer *bufio.Writer
+	mu     sync.Mutex
+}
+
+func NewArchive(dir string) *Archive {
+	return &Archive{dir: dir}
+}
+
+func (a *Archive) Write(alert map[string]interface{}) error {
+	line, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if day := clock.Now().Format("2006-01-02"); day != a.day || a.file == nil {
+		if err := a.rotate(day); err != nil {
+			return err
+		}
+	}
+
+	if _, err := a.writer.Write(line); err != nil {
+		return err
+	}
+	return a.writer.WriteByte('\n')
+}
+
+// rotate fecha o arquivo do dia anterior (gravando o buffer) e abre o novo.
+func (a *Archive) rotate(day string) error {
+	if err := a.closeFile(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(a.dir, 0o755); err != nil {
+		return err
+	}
+	filename := filepath.Join(a.dir, fmt.Sprintf("alerts-%s.jsonl", day))
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	a.day = day
+	a.file = file
+	a.writer = bufio.NewWriter(file)
+	return nil
+}
+
+func (a *Archive) closeFile() error {
+	if a.file == nil {
+		return nil
+	}
+	if err := a.writer.Flush(); err != nil {
+		a.file.Close()
+		return err
+	}
+	err := a.file.Close()
+	a.file = nil
+	a.writer = nil
+	return err
+}
+
+func (a *Archive) Flush() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.writer == nil {
+		return nil
+	}
+	return a.writer.Flush()
+}
+
+// Find procura o alerta nos arquivos do diretório, começando pelo dia mais
+// recente. Retorna nil se não houver nenhum com o uuid.
+func (a *Archive) Find(alertID string) (map[string]interface{}, error) {
+	if err := a.Flush(); err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(a.dir, "alerts-*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(files)))
+
+	for _, filename := range files {
+		alert, err := findInArchiveFile(filename, alertID)
+		if err != nil || alert != nil {
+			return alert, err
+		}
+	}
+	return nil, nil
+}
+
+// findInArchiveFile retorna a última ocorrência do uuid no arquivo.
+func findInArchiveFile(filename, alertID string) (map[string]interface{}, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var found map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		// Evita decodificar linhas que não podem ser o alerta.
+		if !bytes.Contains(scanner.Bytes(), []byte(alertID)) {
+			continue
+		}
+		var alert map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &alert); err != nil {
+			continue
+		}
+		if alert["uuid"] == alertID {
+			found = alert
+		}
+	}
+	return found, scanner.Err()
+}
+
+func (a *Archive) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.closeFile()
+}
+
+// savedAlerts é o formato do alertsFile: os alertas e o id de /events do
+// último deles, para que os ids continuem de onde pararam depois de um
+// reinício.
+type savedAlerts struct {
+	LastEventID int                      `json:"lastEventId"`
+	Alerts      []map[string]interface{} `json:"alerts"`
+}
+
+// loadAlerts lê os alertas gravados por saveAlerts, mantendo só os que ainda
+// passam por maxAlertAge e os últimos storedAlerts, e o id de /events do
+// último alerta gravado. Um arquivo ausente não é erro: é a primeira
+// execução. Arquivos antigos, só com a lista, continuam sendo lidos.
+func loadAlerts(filename string) ([]map[string]interface{}, int) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("ERROR: can't read alerts file: %v", err)
+		}
+		return nil, 0
+	}
+
+	var saved savedAlerts
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		err = json.Unmarshal(data, &saved.Alerts)
+	} else {
+		err = json.Unmarshal(data, &saved)
+	}
+	if err != nil {
+		log.Printf("ERROR: can't decode alerts file: %v", err)
+		return nil, 0
+	}
+
+	var restored []map[string]interface{}
+	for _, alert := range saved.Alerts {
+		if age, ok := alertAge(alert); ok && age > options.maxAlertAge {
+			continue
+		}
+		restored = append(restored, alert)
+	}
+	if excess := len(restored) - options.storedAlerts; options.storedAlerts > 0 && excess > 0 {
+		restored = restored[excess:]
+	}
+	return restored, max(saved.LastEventID, len(restored))
+}
+
+func saveAlerts(filename string) error {
+	alertsLock.Lock()
+	snapshot := savedAlerts{LastEventID: lastEventID, Alerts: append([]map[string]interface{}{}, alerts...)}
+	alertsLock.Unlock()
+	return writeJSONAtomic(filename, snapshot)
+}
+
+// runAlertsSave grava os alertas em memória a cada interval, se algum foi
+// publicado desde a última gravação.
+func runAlertsSave(filename string, interval time.Duration) {
+	alertsLock.Lock()
+	saved := lastEventID
+	alertsLock.Unlock()
+
+	for {
+		<-clock.After(interval)
+		alertsLock.Lock()
+		version := lastEventID
+		alertsLock.Unlock()
+		if version == saved {
+			continue
+		}
+		if err := saveAlerts(filename); err != nil {
+			logger(fmt.Sprintf("ERROR: can't save alerts: %v", err))
+			continue
+		}
+		saved = version
+	}
+}
 
-	defer func() {
-		clientsLock.Lock()
-		delete(clients, client)
-		clientsLock.Unlock()
-		close(client)
-	}()
+// processedDirty marca que processedAlerts mudou desde a última gravação.
+var processedDirty atomic.Bool
+
+// saveProcessedAlerts descarta os uuids vencidos pela dedupWindow, na
+// memória e no arquivo, e grava o restante no db.json.
+func saveProcessedAlerts() {
+	if expired := processedAlerts.Expire(); expired > 0 {
+		logger(fmt.Sprintf("%d uuids processados vencidos descartados", expired))
+	}
+	db.SetProcessedAlerts(processedAlerts)
+}
 
+// runCacheCleanup remove do cache os itens vencidos a cada intervalo, até
+// stop ser fechado.
+func runCacheCleanup(interval time.Duration, stop <-chan struct{}) {
 	for {
 		select {
-		case <-notify:
-			logger("Cliente desconectado")
+		case <-clock.After(interval):
+			c.DeleteExpired()
+		case <-stop:
 			return
-		case <-client:
-			logger("Enviando eventos para o cliente")
-			alertsLock.Lock()
-			for _, alert := range alerts {
-				eventType := alert["type"].(string)
-				var message string
-
-				switch eventType {
-				case "CHIT_CHAT":
-					if filters.ChitChat {
-						message = handleChitChat(alert)
-					}
-				case "POLICE", "POLICEMAN":
-					if filters.Police {
-						message = handlePoliceAlert(alert)
-					}
-				case "JAM":
-					if filters.Jam {
-						message = handleJamAlert(alert)
-					}
-				case "ACCIDENT":
-					if filters.Accident {
-						message = handleAccidentAlert(alert)
-					}
-				default:
-					if filters.Unknown {
-						message = handleUnknownAlert(alert)
-					}
-				}
-
-				if message != "" {
-					fmt.Fprintf(w, "data: %s\n\n", message)
-					w.(http.Flusher).Flush()
-					logger("Evento enviado")
-				}
-			}
-			alertsLock.Unlock()
 		}
 	}
 }
 
-func handleFilters(w http.ResponseWriter, r *http.Request) {
-	html := `
-	<!DOCTYPE html>
-	<html>
-	<head>
-		<title>Configurar Filtros</title>
-	</head>
-	<body>
-		<h1>Configurar Filtros</h1>
-		<form id="filterForm">
-			<label><input type="checkbox" name="chit_chat"> Comnetário</label><br>
-			<label><input type="checkbox" name="police"> Polícia</label><br>
-			<label><input type="checkbox" name="jam"> Congestionamento</label><br>
-			<label><input type="checkbox" name="accident"> Acidente</label><br>
-			<label><input type="checkbox" name="unknown"> Outros</label><br>
-			<button type="submit">Salvar</button>
-		</form>
-		<script>
-			document.getElementById('filterForm').addEventListener('submit', function(event) {
-				event.preventDefault();
-				const formData = new FormData(this);
-				const filters = {};
-				for (const [name, value] of formData.entries()) {
-					filters[name] = value === 'on';
-				}
-				fetch('/updateFilters', {
-					method: 'POST',
-					headers: {
-						'Content-Type': 'application/json',
-					},
-					body: JSON.stringify(filters),
-				}).then(() => {
-					alert('Filtros atualizados com sucesso');
-				}).catch((error) => {
-					alert('Erro ao atualizar filtros');
-					console.error(error);
-				});
-			});
-		</script>
-	</body>
-	</html>
-	`
-	fmt.Fprintf(w, html)
+// runProcessedSave grava os uuids processados a cada interval, se algum
+// ciclo os alterou, juntando as mudanças de vários ciclos numa só escrita.
+func runProcessedSave(interval time.Duration) {
+	for {
+		<-clock.After(interval)
+		if processedDirty.Swap(false) {
+			saveProcessedAlerts()
+		}
+	}
 }
 
-func handleChitChat(alert map[string]interface{}) string {
-	reportBy := alert["reportBy"].(string)
-	location := alert["location"].(string)
-
-	return fmt.Sprintf("[%s] 📢 %s deixou um comentário no mapa 💭\nAnálise 🗺️: %s", time.Now().Format("15:04:05"), reportBy, location)
+func runArchiveFlush(archive *Archive, interval time.Duration) {
+	for {
+		<-clock.After(interval)
+		if err := archive.Flush(); err != nil {
+			logger(fmt.Sprintf("ERROR: can't flush archive: %v", err))
+		}
+	}
 }
 
-func handlePoliceAlert(alert map[string]interface{}) string {
-	info := formatAlertData(alert)
-	return fmt.Sprintf("[%s] 📢 Polícia &#128660;\n```%s```", time.Now().Format("15:04:05"), info)
+// Clusterer junta alertas do mesmo tipo próximos entre si. Cada grupo é
+// aberto pelo primeiro alerta, que serve de referência para a distância, e
+// é enviado quando sua janela termina.
+type Clusterer struct {
+	radius   float64
+	window   time.Duration
+	clusters []*alertCluster
+	mu       sync.Mutex
 }
 
-func handleJamAlert(alert map[string]interface{}) string {
-	info := formatAlertData(alert)
-	return fmt.Sprintf("[%s] 📢 Congestionamento 🚗🚕🚙\n```%s```", time.Now().Format("15:04:05"), info)
+type alertCluster struct {
+	alertType string
+	x, y      float64
+	opened    time.Time
+	alerts    []map[string]interface{}
 }
 
-func handleAccidentAlert(alert map[string]interface{}) string {
-	info := formatAlertData(alert)
-	return fmt.Sprintf("[%s] 📢 Acidente 🚙💥🚕\n```%s```", time.Now().Format("15:04:05"), info)
+func NewClusterer(radius float64, window time.Duration) *Clusterer {
+	return &Clusterer{radius: radius, window: window}
 }
 
-func handleUnknownAlert(alert map[string]interface{}) string {
-	info := formatAlertData(alert)
-	return fmt.Sprintf("[%s] 🤖 Tipo de notificação desconhecida\n```%s```", time.Now().Format("15:04:05"), info)
-}
+// Add coloca o alerta num grupo e retorna false se ele não tiver localização,
+// caso em que deve ser enviado na hora.
+func (cl *Clusterer) Add(alert map[string]interface{}) bool {
+	location, _ := alert["location"].(map[string]interface{})
+	x, okX := location["x"].(float64)
+	y, okY := location["y"].(float64)
+	if !okX || !okY {
+		return false
+	}
+	alertType, _ := alert["type"].(string)
 
-func scheduleJob(cron string, job func()) {
-	defer wg.Done()
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
 
-	for {
-		now := time.Now()
-		next := now.Add(1 * time.Minute)
-		next = time.Date(next.Year(), next.Month(), next.Day(), next.Hour(), next.Minute(), 0, 0, next.Location())
+	for _, cluster := range cl.clusters {
+		if cluster.alertType == alertType && distanceMeters(cluster.x, cluster.y, x, y) <= cl.radius {
+			cluster.alerts = append(cluster.alerts, alert)
+			return true
+		}
+	}
+	cl.clusters = append(cl.clusters, &alertCluster{
+		alertType: alertType,
+		x:         x,
+		y:         y,
+		opened:    clock.Now(),
+		alerts:    []map[string]interface{}{alert},
+	})
+	return true
+}
 
-		timer := time.NewTimer(next.Sub(now))
-		<-timer.C
+// Due remove e retorna os grupos cuja janela já terminou.
+func (cl *Clusterer) Due() []*alertCluster {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
 
-		job()
+	now := clock.Now()
+	var due []*alertCluster
+	open := cl.clusters[:0]
+	for _, cluster := range cl.clusters {
+		if now.Sub(cluster.opened) >= cl.window {
+			due = append(due, cluster)
+		} else {
+			open = append(open, cluster)
+		}
 	}
+	cl.clusters = open
+	return due
 }
 
-func getUpdates() {
-	logger("getting updates")
+// Flush remove e retorna todos os grupos abertos, vencidos ou não.
+func (cl *Clusterer) Flush() []*alertCluster {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
 
-	// Verifica se os dados estão no cache
-	if data, found := c.Get("wazeData"); found {
-		processAlerts(data.([]interface{}))
-		return
+	clusters := cl.clusters
+	cl.clusters = nil
+	return clusters
+}
+
+// runClusterFlush envia os grupos vencidos, verificando algumas vezes por
+// janela.
+func runClusterFlush(cl *Clusterer) {
+	interval := cl.window / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for {
+		<-clock.After(interval)
+		sendClusters(cl.Due())
 	}
+}
 
-	url := addBoundsToURL(options.areaBounds, options.requestURL)
+// sendClusters envia cada grupo: um alerta sozinho sai como alerta comum.
+func sendClusters(clusters []*alertCluster) {
+	for _, cluster := range clusters {
+		if len(cluster.alerts) == 1 {
+			sendAlert(cluster.alerts[0], renderAlert(cluster.alerts[0]))
+			continue
+		}
+		sendAlert(cluster.alerts[0], formatCluster(cluster.alerts))
+	}
+}
 
-	resp, err := http.Get(url)
-	if err != nil {
-		logger("ERROR: can't get updates")
-		return
+// formatCluster resume um grupo, ex.: "3 congestionamentos na SC-401",
+// seguido das ruas envolvidas.
+func formatCluster(alerts []map[string]interface{}) string {
+	display, _ := alertDisplay(alerts[0])
+	label := display.Plural
+	if label == "" {
+		label, _ = alerts[0]["type"].(string)
 	}
-	defer resp.Body.Close()
 
-	var data map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-		logger("ERROR: can't decode response")
-		return
+	counts := make(map[string]int)
+	for _, alert := range alerts {
+		counts[alertStreet(alert)]++
 	}
+	streets := make([]string, 0, len(counts))
+	for street := range counts {
+		streets = append(streets, street)
+	}
+	sort.Slice(streets, func(i, j int) bool {
+		if counts[streets[i]] != counts[streets[j]] {
+			return counts[streets[i]] > counts[streets[j]]
+		}
+		return streets[i] < streets[j]
+	})
 
-	if _, ok := data["alerts"]; !ok {
-		logger("ERROR: 'alerts' key not found in data")
-		return
+	header := strings.TrimSpace(tr("cluster.header", len(alerts), strings.ToLower(label), streets[0], display.Banner))
+	locations := make([]string, len(streets))
+	for i, street := range streets {
+		locations[i] = fmt.Sprintf("%s (%d)", street, counts[street])
 	}
+	return fmt.Sprintf("[%s] %s\n📍 %s", localTime(clock.Now()).Format("15:04:05"), header, strings.Join(locations, ", "))
+}
 
-	// Adiciona os dados ao cache
-	c.Set("wazeData", data["alerts"].([]interface{}), cache.DefaultExpiration)
+// distanceMeters é a distância pela fórmula de haversine entre dois pontos
+// em longitude (x) e latitude (y).
+func distanceMeters(x1, y1, x2, y2 float64) float64 {
+	const earthRadius = 6371000
 
-	processAlerts(data["alerts"].([]interface{}))
+	lat1, lat2 := y1*math.Pi/180, y2*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (x2 - x1) * math.Pi / 180
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
 }
 
-func processAlerts(alerts []interface{}) {
-	logger("processando alertas")
+// ChatThrottle limita quantos comentários cada usuário pode emitir dentro
+// de uma janela deslizante.
+type ChatThrottle struct {
+	limit      int
+	window     time.Duration
+	seen       map[string][]time.Time
+	suppressed map[string]bool
+	mu         sync.Mutex
+}
 
-	for _, alert := range alerts {
-		alertData := alert.(map[string]interface{})
-		alertID := alertData["uuid"].(string)
-		if !processedAlerts.Has(alertID) {
-			alertsCh <- alertData
-			processedAlerts.Add(alertID)
-		}
+func NewChatThrottle(limit int, window time.Duration) *ChatThrottle {
+	return &ChatThrottle{
+		limit:      limit,
+		window:     window,
+		seen:       make(map[string][]time.Time),
+		suppressed: make(map[string]bool),
 	}
 }
 
-func countWazers() {
-	logger("contando motoristas")
+// Allow registra um comentário de user. firstSuppressed é verdadeiro apenas
+// no primeiro comentário suprimido desde que o usuário excedeu o limite.
+func (t *ChatThrottle) Allow(user string) (allowed, firstSuppressed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	resp, err := http.Get(options.broadcastFeedURL)
-	if err != nil {
-		logger("ERROR: can't count wazers")
-		return
+	now := clock.Now()
+	recent := t.recent(user, now)
+	if len(recent) >= t.limit {
+		t.seen[user] = recent
+		firstSuppressed = !t.suppressed[user]
+		t.suppressed[user] = true
+		return false, firstSuppressed
 	}
-	defer resp.Body.Close()
 
-	var data map[string]interface{}
-	err = json.NewDecoder(resp.Body).Decode(&data)
-	if err != nil {
-		logger("ERROR: can't decode response")
-		return
-	}
+	t.seen[user] = append(recent, now)
+	delete(t.suppressed, user)
+	return true, false
+}
 
-	usersOnJams := data["usersOnJams"].([]interface{})
-	actualWazersOnline := 0
-	for _, jam := range usersOnJams {
-		wazersCount := jam.(map[string]interface{})["wazersCount"].(float64)
-		actualWazersOnline += int(wazersCount)
+func (t *ChatThrottle) recent(user string, now time.Time) []time.Time {
+	times := t.seen[user]
+	kept := times[:0]
+	for _, seen := range times {
+		if now.Sub(seen) < t.window {
+			kept = append(kept, seen)
+		}
 	}
+	return kept
+}
+
+// Cleanup remove os usuários sem comentários dentro da janela.
+func (t *ChatThrottle) Cleanup() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	if actualWazersOnline > maxWazersOnline.Get() {
-		maxWazersOnline.Set(actualWazersOnline)
+	now := clock.Now()
+	for user := range t.seen {
+		if recent := t.recent(user, now); len(recent) > 0 {
+			t.seen[user] = recent
+		} else {
+			delete(t.seen, user)
+			delete(t.suppressed, user)
+		}
 	}
 }
 
-func sendWazersReport() {
-	maxWazers := maxWazersOnline.Get()
-	if maxWazers > 0 {
-		message := fmt.Sprintf("%d wazers conectados 🚙 🚕 🚚", maxWazers)
-		sendMessage(message)
-		maxWazersOnline.Set(0)
+func runChatThrottleCleanup(throttle *ChatThrottle, interval time.Duration) {
+	for {
+		<-clock.After(interval)
+		throttle.Cleanup()
 	}
 }
 
-func addBoundsToURL(bounds map[string]float64, sourceURL string) string {
-	var sb strings.Builder
-	sb.WriteString(sourceURL)
+// statsRetention é por quanto tempo alertStats guarda as contagens.
+const statsRetention = 24 * time.Hour
 
-	for key, val := range bounds {
-		sb.WriteString(fmt.Sprintf("&%s=%.4f", key, val))
-	}
+// StatsCounter conta alertas por tipo em buckets de um minuto, descartando
+// os buckets mais antigos que retention.
+type StatsCounter struct {
+	buckets   map[int64]map[string]int
+	retention time.Duration
+	mu        sync.Mutex
+}
 
-	return sb.String()
+func NewStatsCounter(retention time.Duration) *StatsCounter {
+	return &StatsCounter{buckets: make(map[int64]map[string]int), retention: retention}
 }
 
-func sendMessage(text string) {
-	fmt.Println(text)
+func (s *StatsCounter) Record(alertType string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket := at.Truncate(time.Minute).Unix()
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = make(map[string]int)
+	}
+	s.buckets[bucket][alertType]++
+
+	oldest := at.Add(-s.retention).Truncate(time.Minute).Unix()
+	for b := range s.buckets {
+		if b < oldest {
+			delete(s.buckets, b)
+		}
+	}
 }
 
-func logger(msg string) {
-	t := time.Now()
-	fmt.Printf("[%02d:%02d:%02d] %s\n", t.Hour(), t.Minute(), t.Second(), msg)
+// Counts soma os buckets a partir de since (com resolução de um minuto).
+func (s *StatsCounter) Counts(since time.Time) map[string]int {
+	return s.CountsBetween(since, time.Time{})
 }
 
-func formatAlertData(alert map[string]interface{}) string {
-	var sb strings.Builder
+// CountsBetween soma os buckets de from até antes de to; to zero não limita.
+func (s *StatsCounter) CountsBetween(from, to time.Time) map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	for key, val := range alert {
-		sb.WriteString(fmt.Sprintf("%s: %v\n", key, val))
+	first := from.Truncate(time.Minute).Unix()
+	last := to.Truncate(time.Minute).Unix()
+	counts := make(map[string]int)
+	for b, types := range s.buckets {
+		if b < first || (!to.IsZero() && b >= last) {
+			continue
+		}
+		for alertType, count := range types {
+			counts[alertType] += count
+		}
 	}
-
-	return sb.String()
+	return counts
 }
 
-type Database struct {
-	filename string
-	data     map[string]interface{}
+// AnomalyDetector compara os alertas da última janela com a média de um
+// período mais longo (baseline) e aponta picos fora do normal.
+type AnomalyDetector struct {
+	stats    *StatsCounter
+	window   time.Duration
+	baseline time.Duration
+	factor   float64
+	minCount int
+	// started evita avisos enquanto as contagens, que ficam só em memória,
+	// ainda não cobrem o baseline.
+	started  time.Time
+	lastSent map[string]time.Time
 	mu       sync.Mutex
 }
 
-func NewDatabase(filename string) *Database {
-	return &Database{filename: filename, data: make(map[string]interface{})}
+func NewAnomalyDetector(stats *StatsCounter, window, baseline time.Duration, factor float64, minCount int) *AnomalyDetector {
+	return &AnomalyDetector{
+		stats:    stats,
+		window:   window,
+		baseline: baseline,
+		factor:   factor,
+		minCount: minCount,
+		started:  clock.Now(),
+		lastSent: make(map[string]time.Time),
+	}
 }
 
-func (db *Database) load() {
-	file, err := os.Open(db.filename)
-	if err != nil {
-		log.Println("ERROR: can't open database file")
-		return
+// Check diz se o tipo está em pico em now, com a contagem da janela e o
+// esperado para ela. Um aviso é registrado e só volta após uma janela.
+func (d *AnomalyDetector) Check(alertType string, now time.Time) (int, float64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.Sub(d.started) < d.baseline {
+		return 0, 0, false
+	}
+	if last, ok := d.lastSent[alertType]; ok && now.Sub(last) < d.window {
+		return 0, 0, false
 	}
-	defer file.Close()
 
-	err = json.NewDecoder(file).Decode(&db.data)
-	if err != nil {
-		log.Println("ERROR: can't decode database file")
-		return
+	windowStart := now.Add(-d.window)
+	count := d.stats.Counts(windowStart)[alertType]
+	previous := d.stats.CountsBetween(now.Add(-d.baseline), windowStart)[alertType]
+	expected := float64(previous) * float64(d.window) / float64(d.baseline-d.window)
+	if count < d.minCount || float64(count) <= d.factor*expected {
+		return count, expected, false
 	}
+
+	d.lastSent[alertType] = now
+	return count, expected, true
 }
 
-func (db *Database) save() {
-	file, err := os.Create(db.filename)
-	if err != nil {
-		log.Println("ERROR: can't create database file")
-		return
+func formatAnomaly(alertType string, count int, expected float64, window time.Duration) string {
+	display, ok := alertDisplay(map[string]interface{}{"type": alertType})
+	label := strings.ToLower(display.Plural)
+	if !ok || label == "" {
+		label = alertType
 	}
-	defer file.Close()
 
-	err = json.NewEncoder(file).Encode(&db.data)
-	if err != nil {
-		log.Println("ERROR: can't encode database file")
-		return
+	period := tr("period.lastHour")
+	if window != time.Hour {
+		period = tr("period.last", shortDuration(window))
 	}
+	return tr("anomaly", count, label, period, expected)
 }
 
-func (db *Database) GetProcessedAlerts() *Set {
-	db.load()
-	alerts, ok := db.data["processedAlerts"].([]string)
-	if !ok {
-		alerts = []string{}
+// shortDuration omite as unidades zeradas do fim: 1h em vez de 1h0m0s.
+func shortDuration(d time.Duration) string {
+	text := d.String()
+	if strings.HasSuffix(text, "m0s") {
+		text = strings.TrimSuffix(text, "0s")
 	}
-	return NewSet(alerts)
-}
-
-func (db *Database) GetMaxWazersOnline() *Counter {
-	db.load()
-	count, ok := db.data["maxWazersOnline"].(int)
-	if !ok {
-		count = 0
+	if strings.HasSuffix(text, "h0m") {
+		text = strings.TrimSuffix(text, "0m")
 	}
-	return NewCounter(count)
+	return text
 }
 
-func (db *Database) SetProcessedAlerts(alerts *Set) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	db.data["processedAlerts"] = alerts.Slice()
-	db.save()
+// Average acumula valores para uma média, como a velocidade nos
+// congestionamentos entre dois relatórios.
+type Average struct {
+	sum   float64
+	count int
+	mu    sync.Mutex
 }
 
-func (db *Database) SetMaxWazersOnline(count *Counter) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+func (a *Average) Add(value float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-	db.data["maxWazersOnline"] = count.Get()
-	db.save()
+	a.sum += value
+	a.count++
 }
 
-type Set struct {
-	data map[string]struct{}
-	mu   sync.Mutex
-}
+// GetAndReset retorna a média e recomeça; ok é false se nada foi somado.
+func (a *Average) GetAndReset() (average float64, ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-func NewSet(items []string) *Set {
-	set := &Set{data: make(map[string]struct{})}
-	for _, item := range items {
-		set.Add(item)
+	if a.count == 0 {
+		return 0, false
 	}
-	return set
+	average = a.sum / float64(a.count)
+	a.sum, a.count = 0, 0
+	return average, true
 }
 
-func (s *Set) Add(item string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	s.data[item] = struct{}{}
+type Counter struct {
+	count int
+	mu    sync.Mutex
 }
 
-func (s *Set) Remove(item string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// DailyPeak guarda o maior valor do dia corrente, no fuso de timezone; na
+// virada do dia, volta a contar do zero.
+type DailyPeak struct {
+	day   string // AAAA-MM-DD
+	count int
+	mu    sync.Mutex
+}
 
-	delete(s.data, item)
+func peakDay(t time.Time) string {
+	return localTime(t).Format("2006-01-02")
 }
 
-func (s *Set) Has(item string) bool {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// Record registra n visto em now e informa se o pico do dia mudou.
+func (p *DailyPeak) Record(n int, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	_, ok := s.data[item]
-	return ok
+	if day := peakDay(now); day != p.day {
+		p.day, p.count = day, n
+		return true
+	}
+	if n <= p.count {
+		return false
+	}
+	p.count = n
+	return true
 }
 
-func (s *Set) Slice() []string {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// Get retorna o pico do dia de now; zero se nada foi registrado nele.
+func (p *DailyPeak) Get(now time.Time) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	var items []string
-	for item := range s.data {
-		items = append(items, item)
+	if peakDay(now) != p.day {
+		return 0
 	}
-	return items
+	return p.count
 }
 
-type Counter struct {
-	count int
-	mu    sync.Mutex
+func (p *DailyPeak) snapshot() (string, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.day, p.count
 }
 
 func NewCounter(count int) *Counter {
@@ -570,3 +7904,38 @@ func (c *Counter) Set(count int) {
 
 	c.count = count
 }
+
+func (c *Counter) Add(delta int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.count += delta
+	return c.count
+}
+
+// GetAndReset lê e zera o contador em uma única operação.
+func (c *Counter) GetAndReset() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count := c.count
+	c.count = 0
+	return count
+}
+
+func (c *Counter) Inc() int {
+	return c.Add(1)
+}
+
+// SetIfGreater atualiza o contador apenas se n for maior que o valor atual,
+// informando se houve atualização.
+func (c *Counter) SetIfGreater(n int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if n <= c.count {
+		return false
+	}
+	c.count = n
+	return true
+}
@@ -0,0 +1,3587 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// fakeClock é um Clock controlado pelo teste: o tempo só avança em Advance.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock    *fakeClock
+	deadline time.Time
+	ch       chan time.Time
+	stopped  bool
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+func (f *fakeClock) NewTimer(d time.Duration) Timer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	timer := &fakeTimer{clock: f, deadline: f.now.Add(d), ch: make(chan time.Time, 1)}
+	f.timers = append(f.timers, timer)
+	return timer
+}
+
+// Advance move o relógio e dispara os timers vencidos.
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = f.now.Add(d)
+	pending := f.timers[:0]
+	for _, timer := range f.timers {
+		if timer.stopped {
+			continue
+		}
+		if !timer.deadline.After(f.now) {
+			timer.ch <- f.now
+			continue
+		}
+		pending = append(pending, timer)
+	}
+	f.timers = pending
+}
+
+// AdvanceToNextTimer leva o relógio até o timer ativo mais próximo, que
+// dispara, e retorna o novo horário.
+func (f *fakeClock) AdvanceToNextTimer() time.Time {
+	f.mu.Lock()
+	var next time.Time
+	for _, timer := range f.timers {
+		if !timer.stopped && (next.IsZero() || timer.deadline.Before(next)) {
+			next = timer.deadline
+		}
+	}
+	d := next.Sub(f.now)
+	f.mu.Unlock()
+
+	f.Advance(d)
+	return f.Now()
+}
+
+// waitForTimers espera até haver n timers ativos, criados por outra goroutine.
+func (f *fakeClock) waitForTimers(t *testing.T, n int) {
+	t.Helper()
+	f.waitFor(t, fmt.Sprintf("%d timers", n), func(active []*fakeTimer) bool { return len(active) >= n })
+}
+
+// waitForDeadline espera até haver um timer ativo vencendo em deadline.
+func (f *fakeClock) waitForDeadline(t *testing.T, deadline time.Time) {
+	t.Helper()
+	f.waitFor(t, "a timer at "+deadline.String(), func(active []*fakeTimer) bool {
+		for _, timer := range active {
+			if timer.deadline.Equal(deadline) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (f *fakeClock) waitFor(t *testing.T, what string, ready func(active []*fakeTimer) bool) {
+	t.Helper()
+	limit := time.Now().Add(time.Second)
+	for time.Now().Before(limit) {
+		f.mu.Lock()
+		var active []*fakeTimer
+		for _, timer := range f.timers {
+			if !timer.stopped {
+				active = append(active, timer)
+			}
+		}
+		ok := ready(active)
+		f.mu.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.ch }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	wasActive := !t.stopped
+	t.stopped = true
+	return wasActive
+}
+
+// instantClock dispara After imediatamente, para testes que não devem
+// esperar de verdade.
+type instantClock struct{ realClock }
+
+func (instantClock) After(time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- time.Now()
+	return ch
+}
+
+// withClock troca o relógio global durante o teste.
+func withClock(t *testing.T, c Clock) {
+	t.Helper()
+	previous := clock
+	clock = c
+	t.Cleanup(func() { clock = previous })
+}
+
+func TestPointInPolygon(t *testing.T) {
+	square := [][2]float64{{0, 0}, {4, 0}, {4, 4}, {0, 4}}
+	// Formato de "U": a reentrância entre x=1 e x=3 acima de y=1 fica fora.
+	concave := [][2]float64{{0, 0}, {4, 0}, {4, 4}, {3, 4}, {3, 1}, {1, 1}, {1, 4}, {0, 4}}
+
+	tests := []struct {
+		name    string
+		polygon [][2]float64
+		x, y    float64
+		want    bool
+	}{
+		{"square inside", square, 2, 2, true},
+		{"square outside", square, 5, 2, false},
+		{"square bottom edge", square, 2, 0, true},
+		{"square right edge", square, 4, 3, true},
+		{"square vertex", square, 4, 4, true},
+		{"square edge extension", square, 5, 0, false},
+		{"concave left arm", concave, 0.5, 3, true},
+		{"concave right arm", concave, 3.5, 3, true},
+		{"concave base", concave, 2, 0.5, true},
+		{"concave notch", concave, 2, 3, false},
+		{"concave notch edge", concave, 2, 1, true},
+		{"concave inner wall", concave, 3, 2, true},
+		{"degenerate", [][2]float64{{0, 0}, {1, 1}}, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pointInPolygon(tt.polygon, tt.x, tt.y); got != tt.want {
+				t.Errorf("pointInPolygon(%v, %v) = %v, want %v", tt.x, tt.y, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestZoneFor(t *testing.T) {
+	zones := []Zone{
+		{Name: "centro", Polygon: [][2]float64{{0, 0}, {2, 0}, {2, 2}, {0, 2}}},
+		{Name: "norte", Bounds: map[string]float64{"left": 0, "right": 2, "top": 4, "bottom": 2}},
+	}
+
+	tests := []struct {
+		x, y float64
+		want string
+	}{
+		{1, 1, "centro"},
+		{1, 3, "norte"},
+		{1, 2, "centro"},
+		{5, 5, zoneOutside},
+	}
+
+	for _, tt := range tests {
+		if got := zoneFor(zones, tt.x, tt.y); got != tt.want {
+			t.Errorf("zoneFor(%v, %v) = %q, want %q", tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+func TestAlertAge(t *testing.T) {
+	now := time.Date(2024, 1, 2, 8, 0, 0, 0, time.UTC)
+	withClock(t, newFakeClock(now))
+
+	tests := []struct {
+		name      string
+		pubMillis interface{}
+		wantAge   time.Duration
+		wantOK    bool
+	}{
+		{"recent", float64(now.Add(-5 * time.Minute).UnixMilli()), 5 * time.Minute, true},
+		{"missing", nil, 0, false},
+		{"garbage", "ontem", 0, false},
+		{"future", float64(now.Add(time.Hour).UnixMilli()), 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alert := map[string]interface{}{}
+			if tt.pubMillis != nil {
+				alert["pubMillis"] = tt.pubMillis
+			}
+			age, ok := alertAge(alert)
+			if age != tt.wantAge || ok != tt.wantOK {
+				t.Errorf("alertAge() = %v, %v, want %v, %v", age, ok, tt.wantAge, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestFakeClockTimer(t *testing.T) {
+	fake := newFakeClock(time.Date(2024, 1, 2, 8, 0, 0, 0, time.UTC))
+
+	timer := fake.NewTimer(time.Minute)
+	fake.Advance(30 * time.Second)
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired before its deadline")
+	default:
+	}
+
+	fake.Advance(30 * time.Second)
+	select {
+	case <-timer.C():
+	default:
+		t.Fatal("timer did not fire at its deadline")
+	}
+}
+
+func TestDatabaseSaveKeepsPreviousFileOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db.json")
+
+	db := NewDatabase(path)
+	db.data["maxWazersOnline"] = 5
+	db.save()
+
+	// Um valor que não pode ser codificado interrompe a escrita no meio.
+	db.data["broken"] = make(chan int)
+	db.save()
+
+	reloaded := NewDatabase(path)
+	reloaded.load()
+	if got := reloaded.data["maxWazersOnline"]; got != float64(5) {
+		t.Fatalf("maxWazersOnline = %v, want 5", got)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+}
+
+func TestDatabaseLoad(t *testing.T) {
+	fake := newFakeClock(time.Date(2024, 3, 11, 8, 0, 0, 0, time.UTC))
+	withClock(t, fake)
+	seen := fake.Now().Add(-10 * time.Minute)
+
+	tests := []struct {
+		name      string
+		content   *string
+		processed []string
+		peak      int
+		chats     int
+	}{
+		{name: "missing file", content: nil},
+		{name: "empty file", content: ptr("")},
+		{name: "corrupted file", content: ptr(`{"maxWazersOnline": 7, "processedAlerts": [`)},
+		{name: "wrong types", content: ptr(`{"maxWazersOnline": "sete", "processedAlerts": "a", "telegramChats": [1, "42"]}`), chats: 1},
+		{name: "legacy list", content: ptr(`{"maxWazersOnline": 7, "processedAlerts": ["a", "b"]}`), processed: []string{"a", "b"}, peak: 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db.json")
+			if tt.content != nil {
+				if err := os.WriteFile(path, []byte(*tt.content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			db := NewDatabase(path)
+
+			processed := db.GetProcessedAlerts()
+			if got := processed.Slice(); !reflect.DeepEqual(got, append([]string{}, tt.processed...)) {
+				t.Errorf("processed = %v, want %v", got, tt.processed)
+			}
+			if got := db.GetMaxWazersOnline().Get(); got != tt.peak {
+				t.Errorf("peak = %d, want %d", got, tt.peak)
+			}
+			if got := db.GetTelegramChats().Len(); got != tt.chats {
+				t.Errorf("chats = %d, want %d", got, tt.chats)
+			}
+
+			// Depois de gravado, o arquivo volta igual, mesmo partindo de um
+			// arquivo vazio ou corrompido.
+			processed.Add("novo")
+			db.SetProcessedAlerts(processed)
+			db.SetMaxWazersOnline(NewCounter(12))
+			db.SetWazersPeak(12, seen)
+			db.SetTelegramChats(NewSet([]string{"-100"}))
+
+			reloaded := NewDatabase(path)
+			want := append(append([]string{}, tt.processed...), "novo")
+			sort.Strings(want)
+			if got := reloaded.GetProcessedAlerts().Slice(); !reflect.DeepEqual(got, want) {
+				t.Errorf("reloaded processed = %v, want %v", got, want)
+			}
+			if got := reloaded.GetProcessedAlerts().Timestamps()["novo"]; !got.Equal(fake.Now()) {
+				t.Errorf("reloaded timestamp = %v, want %v", got, fake.Now())
+			}
+			if got := reloaded.GetMaxWazersOnline().Get(); got != 12 {
+				t.Errorf("reloaded peak = %d, want 12", got)
+			}
+			if peakAt, _, _ := reloaded.GetWazersHistory(); !peakAt.Equal(seen) {
+				t.Errorf("reloaded peakAt = %v, want %v", peakAt, seen)
+			}
+			if chats := reloaded.GetTelegramChats(); chats.Len() != 1 || !chats.Has("-100") {
+				t.Errorf("reloaded chats = %v", chats.Slice())
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+// inTempDir roda o teste em um diretório temporário, já que alguns handlers
+// gravam arquivos (filters.json) no diretório atual.
+func inTempDir(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// TestConcurrentStateAccess exercita alerts, filtros e cache ao mesmo tempo;
+// serve principalmente para rodar com go test -race.
+func TestConcurrentStateAccess(t *testing.T) {
+	inTempDir(t)
+
+	filtersLock.Lock()
+	filters = &Filters{Jam: true}
+	filtersLock.Unlock()
+
+	alert := map[string]interface{}{"uuid": "a1", "type": "JAM", "street": "SC-401"}
+	c.Set("wazeData", []interface{}{alert}, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			publishAlert(alert)
+		}()
+		go func() {
+			defer wg.Done()
+			renderAlert(alert)
+		}()
+		go func() {
+			defer wg.Done()
+			handleAlerts(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/alerts", nil))
+		}()
+		go func() {
+			defer wg.Done()
+			body := strings.NewReader(`{"jam": true, "accident": true}`)
+			handleUpdateFilters(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/updateFilters", body))
+		}()
+	}
+	wg.Wait()
+
+	if _, found := c.Get("wazeData"); !found {
+		t.Error("cache entry missing")
+	}
+}
+
+func TestSetWindow(t *testing.T) {
+	fake := newFakeClock(time.Date(2024, 1, 2, 8, 0, 0, 0, time.UTC))
+	withClock(t, fake)
+
+	set := NewTimedSet(map[string]time.Time{"old": fake.Now().Add(-2 * time.Hour)}, time.Hour)
+	set.Add("new")
+
+	if set.Has("old") {
+		t.Error("entry older than the window should be absent")
+	}
+	if !set.Has("new") {
+		t.Error("fresh entry should be present")
+	}
+
+	fake.Advance(61 * time.Minute)
+	if set.Has("new") {
+		t.Error("entry should expire once the window passes")
+	}
+	if got := set.Slice(); len(got) != 0 {
+		t.Errorf("Slice() = %v, want empty", got)
+	}
+}
+
+// roundTripFunc permite injetar um transporte no httpClient.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func withHTTPClient(t *testing.T, transport http.RoundTripper) {
+	t.Helper()
+	previous := httpClient
+	httpClient = &http.Client{Transport: transport}
+	t.Cleanup(func() { httpClient = previous })
+}
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	fake := newFakeClock(time.Date(2024, 1, 2, 8, 0, 0, 0, time.UTC))
+	withClock(t, fake)
+
+	calls := 0
+	failing := true
+	withHTTPClient(t, roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		calls++
+		if failing {
+			return nil, errors.New("connection refused")
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"alerts": []}`)),
+		}, nil
+	}))
+
+	previous := alertsBreaker
+	alertsBreaker = NewCircuitBreaker("alerts", 3, time.Minute)
+	t.Cleanup(func() {
+		alertsBreaker = previous
+		c.Delete("wazeData")
+	})
+	c.Delete("wazeData")
+
+	for i := 0; i < 5; i++ {
+		getUpdates()
+	}
+	if calls != 3 {
+		t.Errorf("calls = %d, want 3 before the circuit opens", calls)
+	}
+	if got := alertsBreaker.State(); got != breakerOpen {
+		t.Fatalf("state = %q, want %q", got, breakerOpen)
+	}
+
+	// Passado o cooldown, a chamada de teste falha e o circuito reabre.
+	fake.Advance(time.Minute)
+	getUpdates()
+	if calls != 4 || alertsBreaker.State() != breakerOpen {
+		t.Fatalf("calls = %d, state = %q after failed probe", calls, alertsBreaker.State())
+	}
+
+	failing = false
+	fake.Advance(time.Minute)
+	getUpdates()
+	if got := alertsBreaker.State(); got != breakerClosed {
+		t.Errorf("state = %q, want %q after successful probe", got, breakerClosed)
+	}
+}
+
+func TestArchiveRotatesAtMidnight(t *testing.T) {
+	fake := newFakeClock(time.Date(2024, 1, 2, 23, 59, 0, 0, time.Local))
+	withClock(t, fake)
+
+	dir := t.TempDir()
+	archive := NewArchive(dir)
+	if err := archive.Write(map[string]interface{}{"uuid": "a1"}); err != nil {
+		t.Fatal(err)
+	}
+	fake.Advance(2 * time.Minute)
+	if err := archive.Write(map[string]interface{}{"uuid": "a2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for file, want := range map[string]string{
+		"alerts-2024-01-02.jsonl": `{"uuid":"a1"}` + "\n",
+		"alerts-2024-01-03.jsonl": `{"uuid":"a2"}` + "\n",
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", file, got, want)
+		}
+	}
+}
+
+func TestAddBoundsToURL(t *testing.T) {
+	bounds := map[string]float64{"top": -27.5, "bottom": -27.8, "left": -48.6, "right": -48.3}
+	want := "?bottom=-27.8000&left=-48.6000&right=-48.3000&top=-27.5000"
+
+	tests := []struct {
+		name    string
+		baseURL string
+		want    string
+	}{
+		{"with query", "https://example.com/feed?format=JSON", "https://example.com/feed?bottom=-27.8000&format=JSON&left=-48.6000&right=-48.3000&top=-27.5000"},
+		{"without query", "https://example.com/feed", "https://example.com/feed" + want},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 5; i++ {
+				got, err := addBoundsToURL(bounds, tt.baseURL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != tt.want {
+					t.Fatalf("addBoundsToURL() = %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSetCapacityEvictsLeastRecentlyUsed(t *testing.T) {
+	fake := newFakeClock(time.Date(2024, 1, 2, 8, 0, 0, 0, time.UTC))
+	withClock(t, fake)
+
+	set := NewSet(nil)
+	set.SetCapacity(3)
+	for _, item := range []string{"a", "b", "c"} {
+		set.Add(item)
+		fake.Advance(time.Second)
+	}
+
+	// Acessar "a" o torna o mais recente; "b" passa a ser o mais antigo.
+	if !set.Has("a") {
+		t.Fatal("a should be present")
+	}
+	set.Add("d")
+
+	if set.Has("b") {
+		t.Error("b should have been evicted")
+	}
+	for _, item := range []string{"a", "c", "d"} {
+		if !set.Has(item) {
+			t.Errorf("%s should still be present after eviction", item)
+		}
+	}
+	if got := set.Len(); got != 3 {
+		t.Errorf("Len() = %d, want 3", got)
+	}
+
+	set.Add("e")
+	if set.Has("a") {
+		t.Error("a should be evicted once it is the least recently used")
+	}
+}
+
+func TestNewTimedSetRestoresLRUOrder(t *testing.T) {
+	base := time.Date(2024, 1, 2, 8, 0, 0, 0, time.UTC)
+	withClock(t, newFakeClock(base))
+
+	set := NewTimedSet(map[string]time.Time{
+		"new": base.Add(-time.Minute),
+		"old": base.Add(-time.Hour),
+		"mid": base.Add(-10 * time.Minute),
+	}, 0)
+	set.SetCapacity(2)
+
+	if got := set.Slice(); len(got) != 2 || got[0] != "mid" || got[1] != "new" {
+		t.Errorf("Slice() = %v, want [mid new]", got)
+	}
+}
+
+func TestProcessedAlertsKeepLRUOrderAcrossRestart(t *testing.T) {
+	fake := newFakeClock(time.Date(2024, 1, 2, 8, 0, 0, 0, time.UTC))
+	withClock(t, fake)
+	path := filepath.Join(t.TempDir(), "db.json")
+
+	set := NewSet(nil)
+	for _, item := range []string{"a", "b", "c"} {
+		set.Add(item)
+		fake.Advance(time.Minute)
+	}
+	// Has renova "a" sem mudar o instante em que foi visto.
+	set.Has("a")
+	NewDatabase(path).SetProcessedAlerts(set)
+
+	restored := NewDatabase(path).GetProcessedAlerts()
+	if got, want := restored.Order(), []string{"b", "c", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Order() = %v, want %v", got, want)
+	}
+	restored.SetCapacity(2)
+	if got := restored.Slice(); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Errorf("Slice() after eviction = %v, want [a c]", got)
+	}
+}
+
+// TestCounterGetAndResetKeepsPeak intercala SetIfGreater e GetAndReset; rode
+// com -race. O pico final deve ser lido exatamente uma vez.
+func TestCounterGetAndResetKeepsPeak(t *testing.T) {
+	const peak = 10000
+	counter := NewCounter(0)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= peak; i++ {
+			counter.SetIfGreater(i)
+		}
+	}()
+
+	var reports []int
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		if n := counter.GetAndReset(); n > 0 {
+			reports = append(reports, n)
+		}
+	}
+
+	seen := 0
+	for i, n := range reports {
+		if i > 0 && n <= reports[i-1] {
+			t.Fatalf("report %d = %d is not greater than previous %d", i, n, reports[i-1])
+		}
+		if n == peak {
+			seen++
+		}
+	}
+	if seen != 1 {
+		t.Errorf("peak reported %d times, want exactly once (reports: %d)", seen, len(reports))
+	}
+}
+
+func TestSetOperations(t *testing.T) {
+	tests := []struct {
+		name    string
+		initial []string
+		apply   func(s *Set)
+		want    []string
+	}{
+		{"nil input", nil, func(*Set) {}, []string{}},
+		{"duplicates collapse", []string{"b", "a", "b", "a"}, func(*Set) {}, []string{"a", "b"}},
+		{"add twice", nil, func(s *Set) { s.Add("x"); s.Add("x") }, []string{"x"}},
+		{"remove twice", []string{"x", "y"}, func(s *Set) { s.Remove("x"); s.Remove("x") }, []string{"y"}},
+		{"remove missing", []string{"x"}, func(s *Set) { s.Remove("nada") }, []string{"x"}},
+		{"add all with duplicates", []string{"a"}, func(s *Set) { s.AddAll([]string{"a", "c", "c"}) }, []string{"a", "c"}},
+		{"add all nil", []string{"a"}, func(s *Set) { s.AddAll(nil) }, []string{"a"}},
+		{"clear", []string{"a", "b"}, func(s *Set) { s.Clear() }, []string{}},
+	}
+	for _, tt := range tests {
+		set := NewSet(tt.initial)
+		tt.apply(set)
+
+		got := set.Slice()
+		if got == nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Slice() = %#v, want %#v", tt.name, got, tt.want)
+		}
+		if set.Len() != len(tt.want) {
+			t.Errorf("%s: Len() = %d, want %d", tt.name, set.Len(), len(tt.want))
+		}
+		for _, item := range tt.want {
+			if !set.Has(item) {
+				t.Errorf("%s: Has(%q) = false", tt.name, item)
+			}
+		}
+		if set.Has("nada") {
+			t.Errorf("%s: Has(missing) = true", tt.name)
+		}
+	}
+
+	a, b := NewSet([]string{"1", "2", "3"}), NewSet([]string{"2", "3", "4"})
+	for name, got := range map[string]*Set{"union": a.Union(b), "intersect": a.Intersect(b), "diff": a.Diff(b)} {
+		want := map[string][]string{"union": {"1", "2", "3", "4"}, "intersect": {"2", "3"}, "diff": {"1"}}[name]
+		if !reflect.DeepEqual(got.Slice(), want) {
+			t.Errorf("%s = %v, want %v", name, got.Slice(), want)
+		}
+	}
+	if !reflect.DeepEqual(a.Slice(), []string{"1", "2", "3"}) {
+		t.Errorf("operations changed the receiver: %v", a.Slice())
+	}
+}
+
+func TestCounterOperations(t *testing.T) {
+	tests := []struct {
+		name  string
+		start int
+		apply func(c *Counter) int
+		ret   int
+		want  int
+	}{
+		{"get", 7, func(c *Counter) int { return c.Get() }, 7, 7},
+		{"set", 7, func(c *Counter) int { c.Set(3); return 0 }, 0, 3},
+		{"add", 7, func(c *Counter) int { return c.Add(5) }, 12, 12},
+		{"add negative", 7, func(c *Counter) int { return c.Add(-10) }, -3, -3},
+		{"inc", 7, func(c *Counter) int { return c.Inc() }, 8, 8},
+		{"get and reset", 7, func(c *Counter) int { return c.GetAndReset() }, 7, 0},
+		{"set if greater", 7, func(c *Counter) int { return boolInt(c.SetIfGreater(9)) }, 1, 9},
+		{"set if equal", 7, func(c *Counter) int { return boolInt(c.SetIfGreater(7)) }, 0, 7},
+		{"set if smaller", 7, func(c *Counter) int { return boolInt(c.SetIfGreater(2)) }, 0, 7},
+	}
+	for _, tt := range tests {
+		counter := NewCounter(tt.start)
+		if ret := tt.apply(counter); ret != tt.ret {
+			t.Errorf("%s: returned %d, want %d", tt.name, ret, tt.ret)
+		}
+		if got := counter.Get(); got != tt.want {
+			t.Errorf("%s: Get() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// TestSetAndCounterConcurrency só prova algo com go test -race: várias
+// goroutines mexem nos mesmos Set e Counter ao mesmo tempo.
+func TestSetAndCounterConcurrency(t *testing.T) {
+	const workers, rounds = 16, 200
+
+	set := NewSet(nil)
+	set.SetCapacity(workers * rounds / 2)
+	counter := NewCounter(0)
+	peak := NewCounter(0)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				item := fmt.Sprintf("%d-%d", w, i)
+				set.Add(item)
+				set.Has(item)
+				set.AddAll([]string{item, "comum"})
+				if i%3 == 0 {
+					set.Remove(item)
+				}
+				set.Slice()
+				set.Timestamps()
+				set.Len()
+
+				counter.Inc()
+				counter.Add(2)
+				counter.Get()
+				peak.SetIfGreater(w*rounds + i)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if got := counter.Get(); got != workers*rounds*3 {
+		t.Errorf("counter = %d, want %d", got, workers*rounds*3)
+	}
+	if got := peak.GetAndReset(); got != workers*rounds-1 {
+		t.Errorf("peak = %d, want %d", got, workers*rounds-1)
+	}
+	if set.Len() > workers*rounds/2 {
+		t.Errorf("set grew past its capacity: %d", set.Len())
+	}
+	for _, item := range set.Slice() {
+		if !set.Has(item) {
+			t.Fatalf("Slice returned %q but Has is false", item)
+		}
+	}
+}
+
+// O formulário de /filters precisa usar os mesmos nomes das tags json de
+// Filters (/updateFilters recusa campos desconhecidos) e não pode apagar os
+// filtros que não mostra.
+func TestFiltersForm(t *testing.T) {
+	inTempDir(t)
+	previous := filters
+	t.Cleanup(func() { filters = previous })
+	filters = &Filters{Police: true, Streets: []string{"SC-401"}, ExcludeReportBy: []string{"meu_usuario"}}
+
+	page := httptest.NewRecorder()
+	handleFilters(page, httptest.NewRequest(http.MethodGet, "/filters", nil))
+	if !strings.Contains(page.Body.String(), `"streets":["SC-401"]`) {
+		t.Error("form not prefilled with the current filters")
+	}
+	names := regexp.MustCompile(`name="(\w+)"`).FindAllStringSubmatch(page.Body.String(), -1)
+	if len(names) == 0 {
+		t.Fatal("no form fields found")
+	}
+
+	body := map[string]interface{}{}
+	for _, match := range names {
+		switch name := match[1]; name {
+		case "reportSource":
+			body[name] = ""
+		case "minJamLevel", "minJamSpeedDrop":
+			body[name] = 0
+		default:
+			body[name] = true
+		}
+	}
+	encoded, _ := json.Marshal(body)
+	rec := httptest.NewRecorder()
+	handleUpdateFilters(rec, httptest.NewRequest(http.MethodPatch, "/updateFilters", bytes.NewReader(encoded)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("form fields %s: status %d: %s", encoded, rec.Code, rec.Body.String())
+	}
+	if !filters.Jam || !reflect.DeepEqual(filters.Streets, []string{"SC-401"}) || !reflect.DeepEqual(filters.ExcludeReportBy, []string{"meu_usuario"}) {
+		t.Errorf("filters after form save = %+v", filters)
+	}
+}
+
+func TestMergeFilters(t *testing.T) {
+	inTempDir(t)
+
+	filtersLock.Lock()
+	filters = &Filters{Police: true, Jam: true, Zones: []string{"centro"}}
+	filtersLock.Unlock()
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		status int
+		want   Filters
+	}{
+		{"patch one flag", http.MethodPatch, `{"jam": false}`, http.StatusOK,
+			Filters{Police: true, Zones: []string{"centro"}}},
+		{"put keeps others", http.MethodPut, `{"accident": true, "reportSource": "official"}`, http.StatusOK,
+			Filters{Police: true, Accident: true, Zones: []string{"centro"}, ReportSource: "official"}},
+		{"unknown field", http.MethodPatch, `{"bogus": true}`, http.StatusBadRequest,
+			Filters{Police: true, Accident: true, Zones: []string{"centro"}, ReportSource: "official"}},
+		{"invalid value", http.MethodPatch, `{"reportSource": "x"}`, http.StatusBadRequest,
+			Filters{Police: true, Accident: true, Zones: []string{"centro"}, ReportSource: "official"}},
+		{"patch subtypes", http.MethodPatch, `{"excludeSubtypes": ["HAZARD_ON_ROAD_CAR_STOPPED"]}`, http.StatusOK,
+			Filters{Police: true, Accident: true, Zones: []string{"centro"}, ReportSource: "official", ExcludeSubtypes: []string{"HAZARD_ON_ROAD_CAR_STOPPED"}}},
+		{"patch reporters", http.MethodPatch, `{"excludeReportBy": ["meu_usuario"]}`, http.StatusOK,
+			Filters{Police: true, Accident: true, Zones: []string{"centro"}, ReportSource: "official", ExcludeSubtypes: []string{"HAZARD_ON_ROAD_CAR_STOPPED"}, ExcludeReportBy: []string{"meu_usuario"}}},
+		{"blank street", http.MethodPatch, `{"excludeStreets": ["Beira-Mar", " "]}`, http.StatusBadRequest,
+			Filters{Police: true, Accident: true, Zones: []string{"centro"}, ReportSource: "official", ExcludeSubtypes: []string{"HAZARD_ON_ROAD_CAR_STOPPED"}, ExcludeReportBy: []string{"meu_usuario"}}},
+		// POST substitui tudo, mas só com um corpo válido por inteiro.
+		{"post unknown field", http.MethodPost, `{"police": true, "bogus": true}`, http.StatusBadRequest,
+			Filters{Police: true, Accident: true, Zones: []string{"centro"}, ReportSource: "official", ExcludeSubtypes: []string{"HAZARD_ON_ROAD_CAR_STOPPED"}, ExcludeReportBy: []string{"meu_usuario"}}},
+		{"post truncated", http.MethodPost, `{"police": false, "jam": tr`, http.StatusBadRequest,
+			Filters{Police: true, Accident: true, Zones: []string{"centro"}, ReportSource: "official", ExcludeSubtypes: []string{"HAZARD_ON_ROAD_CAR_STOPPED"}, ExcludeReportBy: []string{"meu_usuario"}}},
+		{"post wrong type", http.MethodPost, `{"police": false, "minJamLevel": "alto"}`, http.StatusBadRequest,
+			Filters{Police: true, Accident: true, Zones: []string{"centro"}, ReportSource: "official", ExcludeSubtypes: []string{"HAZARD_ON_ROAD_CAR_STOPPED"}, ExcludeReportBy: []string{"meu_usuario"}}},
+		{"post trailing data", http.MethodPost, `{"jam": true} {"police": false}`, http.StatusBadRequest,
+			Filters{Police: true, Accident: true, Zones: []string{"centro"}, ReportSource: "official", ExcludeSubtypes: []string{"HAZARD_ON_ROAD_CAR_STOPPED"}, ExcludeReportBy: []string{"meu_usuario"}}},
+		{"post replaces", http.MethodPost, `{"jam": true, "minJamLevel": 2}`, http.StatusOK,
+			Filters{Jam: true, MinJamLevel: 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handleUpdateFilters(rec, httptest.NewRequest(tt.method, "/updateFilters", strings.NewReader(tt.body)))
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+
+			filtersLock.Lock()
+			got := *filters
+			filtersLock.Unlock()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filters = %+v, want %+v", got, tt.want)
+			}
+
+			// A resposta traz os filtros em vigor.
+			if rec.Code == http.StatusOK {
+				var echoed Filters
+				if err := json.Unmarshal(rec.Body.Bytes(), &echoed); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(echoed, tt.want) {
+					t.Errorf("response = %+v, want %+v", echoed, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSubtypeAllowed(t *testing.T) {
+	f := &Filters{
+		Subtypes:        []string{"HAZARD_WEATHER_FLOOD", "hazard_on_road_pot_hole"},
+		ExcludeSubtypes: []string{"ACCIDENT_MINOR"},
+	}
+	tests := []struct {
+		alertType, subtype string
+		want               bool
+	}{
+		{"HAZARD", "HAZARD_WEATHER_FLOOD", true},
+		{"HAZARD", "HAZARD_ON_ROAD_POT_HOLE", true},
+		{"HAZARD", "HAZARD_ON_ROAD_CAR_STOPPED", false},
+		{"HAZARD", "", true},
+		// Subtypes não cita nenhum subtipo de acidente: só o excluído cai.
+		{"ACCIDENT", "ACCIDENT_MAJOR", true},
+		{"ACCIDENT", "accident_minor", false},
+		{"JAM", "JAM_HEAVY_TRAFFIC", true},
+	}
+	for _, tt := range tests {
+		alert := map[string]interface{}{"type": tt.alertType, "subtype": tt.subtype}
+		if got := subtypeAllowed(f, alert); got != tt.want {
+			t.Errorf("subtypeAllowed(%s, %q) = %t, want %t", tt.alertType, tt.subtype, got, tt.want)
+		}
+	}
+}
+
+func TestReportSourceAllowed(t *testing.T) {
+	official := map[string]interface{}{"type": "HAZARD", officialReportField: true}
+	officialText := map[string]interface{}{"type": "HAZARD", officialReportField: "TRUE"}
+	community := map[string]interface{}{"type": "HAZARD", officialReportField: false}
+	unmarked := map[string]interface{}{"type": "HAZARD"}
+
+	tests := []struct {
+		source string
+		alert  map[string]interface{}
+		want   bool
+	}{
+		{"", official, true},
+		{"", community, true},
+		{reportSourceOfficial, official, true},
+		{reportSourceOfficial, officialText, true},
+		{reportSourceOfficial, community, false},
+		{reportSourceOfficial, unmarked, false},
+		{reportSourceCommunity, official, false},
+		{reportSourceCommunity, community, true},
+		{reportSourceCommunity, unmarked, true},
+	}
+	for _, tt := range tests {
+		if got := reportSourceAllowed(tt.source, tt.alert); got != tt.want {
+			t.Errorf("reportSourceAllowed(%q, %v) = %t, want %t", tt.source, tt.alert, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		source string
+		valid  bool
+	}{
+		{"", true},
+		{reportSourceOfficial, true},
+		{reportSourceCommunity, true},
+		{"Official", false},
+		{"todas", false},
+	} {
+		err := validateFilters(&Filters{ReportSource: tt.source})
+		if (err == nil) != tt.valid {
+			t.Errorf("validateFilters(reportSource %q) = %v, want valid %t", tt.source, err, tt.valid)
+		}
+	}
+}
+
+func TestReporterAllowed(t *testing.T) {
+	f := &Filters{ExcludeReportBy: []string{"Meu_Usuario", " bot-transito "}}
+	tests := []struct {
+		alert map[string]interface{}
+		want  bool
+	}{
+		{map[string]interface{}{"type": "ACCIDENT", "reportBy": "meu_usuario"}, false},
+		{map[string]interface{}{"type": "CHIT_CHAT", "reportBy": "BOT-TRANSITO"}, false},
+		{map[string]interface{}{"type": "JAM", "reportBy": "outra_pessoa"}, true},
+		{map[string]interface{}{"type": "JAM"}, true},
+	}
+	for _, tt := range tests {
+		if got := reporterAllowed(f, tt.alert); got != tt.want {
+			t.Errorf("reporterAllowed(%v) = %t, want %t", tt.alert, got, tt.want)
+		}
+	}
+
+	// Com a lista de confiança, só os listados passam, e a exclusão ainda vale.
+	f.ReportByWhitelist = []string{"vizinho_1", "Meu_Usuario"}
+	tests = []struct {
+		alert map[string]interface{}
+		want  bool
+	}{
+		{map[string]interface{}{"type": "ACCIDENT", "reportBy": "VIZINHO_1"}, true},
+		{map[string]interface{}{"type": "ACCIDENT", "reportBy": "outra_pessoa"}, false},
+		{map[string]interface{}{"type": "ACCIDENT", "reportBy": "meu_usuario"}, false},
+		{map[string]interface{}{"type": "ACCIDENT"}, false},
+		{map[string]interface{}{"type": "ACCIDENT", "reportBy": "  "}, false},
+		// Os congestionamentos de "jams" não são relatos e não têm reportBy.
+		{jamAlerts([]interface{}{map[string]interface{}{"uuid": 1234.0, "street": "SC-401"}})[0].(map[string]interface{}), true},
+		{map[string]interface{}{"type": "JAM"}, false},
+	}
+	for _, tt := range tests {
+		if got := reporterAllowed(f, tt.alert); got != tt.want {
+			t.Errorf("whitelist: reporterAllowed(%v) = %t, want %t", tt.alert, got, tt.want)
+		}
+	}
+}
+
+func TestDiscordNotifierRetriesAfterRateLimit(t *testing.T) {
+	withClock(t, instantClock{})
+
+	var requests int
+	var payload map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"retry_after": 0.5}`))
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	notifier := &DiscordNotifier{webhookURL: server.URL}
+	alert := map[string]interface{}{
+		"type":     "ACCIDENT",
+		"street":   "SC-401",
+		"location": map[string]interface{}{"x": -48.5, "y": -27.6},
+	}
+	if err := notifier.SendAlert(alert, "detalhes"); err != nil {
+		t.Fatal(err)
+	}
+
+	if requests != 2 {
+		t.Errorf("requests = %d, want 2", requests)
+	}
+	embeds, _ := payload["embeds"].([]interface{})
+	if len(embeds) != 1 {
+		t.Fatalf("embeds = %v", payload["embeds"])
+	}
+	embed := embeds[0].(map[string]interface{})
+	if embed["title"] != "💥 Acidentes" || embed["description"] != "detalhes" {
+		t.Errorf("embed = %v", embed)
+	}
+}
+
+func TestWebhookNotifierSignsBodyAndRetries(t *testing.T) {
+	withClock(t, instantClock{})
+
+	var requests int
+	var body []byte
+	var signature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ = io.ReadAll(r.Body)
+		signature = r.Header.Get("X-Signature")
+	}))
+	defer server.Close()
+
+	notifier := &WebhookNotifier{url: server.URL, secret: "segredo", timeout: time.Second}
+	if err := notifier.SendAlert(map[string]interface{}{"type": "JAM"}, "detalhes"); err != nil {
+		t.Fatal(err)
+	}
+
+	if requests != 2 {
+		t.Errorf("requests = %d, want 2", requests)
+	}
+	mac := hmac.New(sha256.New, []byte("segredo"))
+	mac.Write(body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); signature != want {
+		t.Errorf("X-Signature = %q, want %q", signature, want)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil || payload["message"] != "detalhes" {
+		t.Errorf("payload = %s (%v)", body, err)
+	}
+}
+
+func TestMQTTNotifier(t *testing.T) {
+	for broker, want := range map[string]string{"tcp://broker:1884": "broker:1884", "mqtt://broker": "broker:1883", "10.0.0.5": "10.0.0.5:1883", "": ""} {
+		if got := mqttAddress(broker); got != want {
+			t.Errorf("mqttAddress(%q) = %q, want %q", broker, got, want)
+		}
+	}
+
+	for _, tc := range []struct{ template, region, want string }{
+		{"waze/{region}/{type}", "Centro", "waze/Centro/ACCIDENT"},
+		{"waze/{region}/{type}", "", "waze/all/ACCIDENT"},
+		{"waze/{region}/{type}", "Norte/Sul #1", "waze/Norte-Sul -1/ACCIDENT"},
+		{"waze/alerts/{type}", "Centro", "waze/alerts/ACCIDENT"},
+	} {
+		if got := mqttTopic(tc.template, "ACCIDENT", tc.region); got != tc.want {
+			t.Errorf("mqttTopic(%q, %q) = %q, want %q", tc.template, tc.region, got, tc.want)
+		}
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	notifier := &MQTTNotifier{
+		broker: ln.Addr().String(), topic: "waze/alerts/{type}", qos: 1, retain: true,
+		clientID: "teste", username: "bot", password: "segredo", timeout: 2 * time.Second,
+	}
+	notifier.start()
+	defer notifier.Close()
+
+	read := func(conn net.Conn) (byte, []byte) {
+		t.Helper()
+		header, body, err := mqttRead(conn, 2*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return header, body
+	}
+	accept := func() net.Conn {
+		t.Helper()
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, body := read(conn)
+		if header != mqttConnect || !bytes.Contains(body, []byte("teste")) || !bytes.HasSuffix(body, append(mqttString("bot"), mqttString("segredo")...)) {
+			t.Fatalf("CONNECT = 0x%02x %q", header, body)
+		}
+		conn.Write([]byte{mqttConnack, 2, 0, 0})
+		return conn
+	}
+	// readPublish devolve o tópico, o id do pacote e o payload; dup guarda a
+	// flag DUP do último PUBLISH.
+	var dup bool
+	readPublish := func(conn net.Conn) (string, uint16, []byte) {
+		t.Helper()
+		header, body := read(conn)
+		if header&^0x08 != mqttPublish|1<<1|1 {
+			t.Fatalf("PUBLISH header = 0x%02x", header)
+		}
+		dup = header&0x08 != 0
+		topicLen := int(body[0])<<8 | int(body[1])
+		topic := string(body[2 : 2+topicLen])
+		id := uint16(body[2+topicLen])<<8 | uint16(body[3+topicLen])
+		return topic, id, body[4+topicLen:]
+	}
+
+	if notifier.Connected() {
+		t.Error("connected before the broker accepted")
+	}
+	conn := accept()
+	alert := map[string]interface{}{"type": "ACCIDENT", "uuid": "a1"}
+	if err := notifier.SendAlert(alert, "Acidente"); err != nil {
+		t.Fatal(err)
+	}
+	topic, firstID, _ := readPublish(conn)
+	if topic != "waze/alerts/ACCIDENT" || dup {
+		t.Errorf("topic = %q, dup %t", topic, dup)
+	}
+	if !notifier.Connected() {
+		t.Error("not connected after CONNACK")
+	}
+
+	// O broker cai antes do PUBACK: a mensagem volta depois da reconexão.
+	conn.Close()
+	conn = accept()
+	defer conn.Close()
+	topic, id, payload := readPublish(conn)
+	if !dup || id != firstID {
+		t.Errorf("resent with dup %t and id %d, want DUP and id %d", dup, id, firstID)
+	}
+	var got struct {
+		Alert   map[string]interface{} `json:"alert"`
+		Message string                 `json:"message"`
+	}
+	if err := json.Unmarshal(payload, &got); err != nil {
+		t.Fatal(err)
+	}
+	if topic != "waze/alerts/ACCIDENT" || got.Message != "Acidente" || got.Alert["uuid"] != "a1" {
+		t.Errorf("republished %q: %s", topic, payload)
+	}
+	conn.Write([]byte{mqttPuback, 2, byte(id >> 8), byte(id)})
+
+	if err := notifier.SendText("Resumo"); err != nil {
+		t.Fatal(err)
+	}
+	topic, id, payload = readPublish(conn)
+	if topic != "waze/alerts/text" || string(payload) != `{"message":"Resumo"}` || dup {
+		t.Errorf("text published to %q: %s", topic, payload)
+	}
+	conn.Write([]byte{mqttPuback, 2, byte(id >> 8), byte(id)})
+
+	notifier.Close()
+	if header, _ := read(conn); header != mqttDisconnect {
+		t.Errorf("expected DISCONNECT on close, got 0x%02x", header)
+	}
+	if notifier.Connected() {
+		t.Error("still connected after Close")
+	}
+}
+
+func TestMQTTNotifierDrainsOnClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// O broker confirma cada PUBLISH e devolve os payloads ao receber o
+	// DISCONNECT.
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var payloads []string
+		for {
+			header, body, err := mqttRead(conn, 2*time.Second)
+			if err != nil {
+				break
+			}
+			switch header &^ 0x0F {
+			case mqttConnect:
+				conn.Write([]byte{mqttConnack, 2, 0, 0})
+			case mqttPublish:
+				topicLen := int(body[0])<<8 | int(body[1])
+				id := body[2+topicLen : 4+topicLen]
+				payloads = append(payloads, string(body[4+topicLen:]))
+				conn.Write([]byte{mqttPuback, 2, id[0], id[1]})
+			}
+			if header == mqttDisconnect {
+				break
+			}
+		}
+		received <- payloads
+	}()
+
+	notifier := &MQTTNotifier{broker: ln.Addr().String(), topic: "waze/{type}", qos: 1, clientID: "teste", timeout: 2 * time.Second}
+	notifier.queue = make(chan mqttMessage, mqttQueueSize)
+	notifier.stop = make(chan struct{})
+	notifier.done = make(chan struct{})
+	for _, text := range []string{"um", "dois", "três"} {
+		if err := notifier.SendText(text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Encerrado antes de começar: tudo o que está na fila ainda sai.
+	go notifier.run()
+	notifier.Close()
+
+	select {
+	case payloads := <-received:
+		want := []string{`{"message":"um"}`, `{"message":"dois"}`, `{"message":"três"}`}
+		if !reflect.DeepEqual(payloads, want) {
+			t.Errorf("published = %q, want %q", payloads, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("broker never got DISCONNECT")
+	}
+}
+
+func TestMQTTNotifierBacksOffWhenPublishFails(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// O broker aceita o CONNECT e derruba a conexão a cada PUBLISH.
+	var connects atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			connects.Add(1)
+			go func() {
+				defer conn.Close()
+				for {
+					header, _, err := mqttRead(conn, 2*time.Second)
+					if err != nil || header&^0x0F == mqttPublish {
+						return
+					}
+					if header == mqttConnect {
+						conn.Write([]byte{mqttConnack, 2, 0, 0})
+					}
+				}
+			}()
+		}
+	}()
+
+	notifier := &MQTTNotifier{broker: ln.Addr().String(), topic: "waze/{type}", qos: 1, clientID: "teste", timeout: 2 * time.Second}
+	notifier.start()
+	if err := notifier.SendText("sempre falha"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if n := connects.Load(); n != 1 {
+		t.Errorf("connects = %d in 500ms, want 1 before the backoff", n)
+	}
+
+	// Close não fica preso esperando a mensagem sair.
+	closed := make(chan struct{})
+	go func() {
+		notifier.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked while the publish kept failing")
+	}
+}
+
+func TestMatrixNotifier(t *testing.T) {
+	withClock(t, instantClock{})
+
+	var paths, auths []string
+	var body map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			t.Errorf("method = %s", r.Method)
+		}
+		paths = append(paths, r.URL.EscapedPath())
+		auths = append(auths, r.Header.Get("Authorization"))
+		if len(paths) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		fmt.Fprint(w, `{"event_id": "$1"}`)
+	}))
+	defer server.Close()
+
+	notifier := &MatrixNotifier{homeserver: server.URL, roomID: "!sala:exemplo.org", token: "tok", timeout: time.Second}
+	alert := map[string]interface{}{"type": "ACCIDENT", "location": map[string]interface{}{"x": -48.5, "y": -27.6}}
+	if err := notifier.SendAlert(alert, "Acidente <BR-101>\n```street: BR-101\n```"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A nova tentativa reaproveita o id de transação.
+	if len(paths) != 2 || paths[0] != paths[1] || !strings.HasPrefix(paths[0], "/_matrix/client/v3/rooms/%21sala:exemplo.org/send/m.room.message/informawaze-") {
+		t.Errorf("paths = %q", paths)
+	}
+	if auths[1] != "Bearer tok" {
+		t.Errorf("Authorization = %q", auths[1])
+	}
+	if body["msgtype"] != "m.text" || body["format"] != "org.matrix.custom.html" || body["body"] != "Acidente <BR-101>\n```street: BR-101\n```" {
+		t.Errorf("body = %v", body)
+	}
+	for _, want := range []string{"<b>", "Acidente &lt;BR-101&gt;<br><pre><code>street: BR-101\n</code></pre>", `<a href="https://www.waze.com/ul?ll=-27.6000%2C-48.5000&amp;navigate=no">`} {
+		if !strings.Contains(body["formatted_body"], want) {
+			t.Errorf("formatted_body = %q, missing %q", body["formatted_body"], want)
+		}
+	}
+}
+
+func TestWebhookNotifierDoesNotRetryClientErrors(t *testing.T) {
+	withClock(t, instantClock{})
+
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	notifier := &WebhookNotifier{url: server.URL, timeout: time.Second}
+	if err := notifier.SendText("oi"); err == nil {
+		t.Error("expected error")
+	}
+	if requests != 1 {
+		t.Errorf("requests = %d, want 1", requests)
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	loc := time.FixedZone("BRT", -3*60*60)
+	from := time.Date(2024, 3, 15, 10, 7, 12, 0, loc)
+
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"*/30 * * * * *", time.Date(2024, 3, 15, 10, 7, 30, 0, loc)},
+		{"*/20 * * * * *", time.Date(2024, 3, 15, 10, 7, 20, 0, loc)},
+		{"0 * * * *", time.Date(2024, 3, 15, 11, 0, 0, 0, loc)},
+		{"30 6-9,17 * * 1-5", time.Date(2024, 3, 15, 17, 30, 0, 0, loc)},
+		{"0 8 * * 0", time.Date(2024, 3, 17, 8, 0, 0, 0, loc)},
+		{"0 8 * * 7", time.Date(2024, 3, 17, 8, 0, 0, 0, loc)},
+		{"0 0 1 * *", time.Date(2024, 4, 1, 0, 0, 0, 0, loc)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, loc)},
+		// Dia e dia da semana restritos: basta um dos dois.
+		{"0 0 17 * 1", time.Date(2024, 3, 17, 0, 0, 0, 0, loc)},
+		// "*/2" não restringe no sentido do cron: os dois precisam valer.
+		{"0 0 */2 * 1", time.Date(2024, 3, 25, 0, 0, 0, 0, loc)},
+	}
+	for _, tt := range tests {
+		schedule, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tt.expr, err)
+		}
+		if got := schedule.Next(from); !got.Equal(tt.want) {
+			t.Errorf("Next(%q) = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) should fail", expr)
+		}
+	}
+}
+
+func TestReloadConfigKeepsPreviousOnInvalid(t *testing.T) {
+	inTempDir(t)
+	previous := liveConfig.Get()
+	t.Cleanup(func() { liveConfig.Set(previous) })
+	liveConfig.Set(defaultLiveConfig())
+
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile("config.json", []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, changed := liveConfig.Watch()
+	write(`{"requestUrl": "https://example.com/feed", "schedules": {"updates": "*/10 * * * * *"}}`)
+	reloadConfig("config.json")
+
+	select {
+	case <-changed:
+	default:
+		t.Error("reload did not notify watchers")
+	}
+	live := liveConfig.Get()
+	if live.RequestURL != "https://example.com/feed" || live.Schedules["updates"] != "*/10 * * * * *" {
+		t.Errorf("live config = %+v", live)
+	}
+	if live.Schedules["wazers"] != defaultLiveConfig().Schedules["wazers"] {
+		t.Errorf("unset schedule should keep its default, got %q", live.Schedules["wazers"])
+	}
+
+	for _, content := range []string{
+		`{"requestUrl": "nada"}`,
+		`{"areaBounds": {"left": 1, "right": 0, "top": 1, "bottom": 0}}`,
+		`{"schedules": {"updates": "todo minuto"}}`,
+		`{"requestUrl": `,
+	} {
+		write(content)
+		reloadConfig("config.json")
+		if liveConfig.Get() != live {
+			t.Errorf("invalid config %s replaced the previous one", content)
+		}
+	}
+}
+
+func TestReloadFiltersKeepsPreviousOnInvalid(t *testing.T) {
+	inTempDir(t)
+	previous := filters
+	t.Cleanup(func() { filters = previous })
+	filters = &Filters{Jam: true}
+
+	for _, content := range []string{
+		`{"jam": true, "minJamLevel": 9}`,
+		`{"jam": `,
+	} {
+		if err := os.WriteFile("filters.json", []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		reloadFilters("filters.json")
+		if !filters.Jam || filters.MinJamLevel != 0 {
+			t.Errorf("invalid filters %s replaced the previous ones: %+v", content, filters)
+		}
+	}
+
+	if err := os.WriteFile("filters.json", []byte(`{"jam": true, "accident": true, "minJamLevel": 3}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloadFilters("filters.json")
+	if !filters.Accident || filters.MinJamLevel != 3 {
+		t.Errorf("filters = %+v", filters)
+	}
+}
+
+func TestActiveWindowContains(t *testing.T) {
+	at := func(day, hour, minute int) time.Time {
+		// 2024-03-11 é uma segunda-feira.
+		return time.Date(2024, 3, 11+day, hour, minute, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		window ActiveWindow
+		t      time.Time
+		want   bool
+	}{
+		{ActiveWindow{From: "06:00", To: "10:00"}, at(0, 6, 0), true},
+		{ActiveWindow{From: "06:00", To: "10:00"}, at(0, 10, 0), false},
+		{ActiveWindow{From: "06:00", To: "10:00"}, at(0, 5, 59), false},
+		{ActiveWindow{From: "22:00", To: "02:00"}, at(0, 23, 30), true},
+		{ActiveWindow{From: "22:00", To: "02:00"}, at(1, 1, 30), true},
+		{ActiveWindow{From: "22:00", To: "02:00"}, at(1, 12, 0), false},
+		{ActiveWindow{From: "06:00", To: "10:00", Weekdays: []string{"seg"}}, at(0, 7, 0), true},
+		{ActiveWindow{From: "06:00", To: "10:00", Weekdays: []string{"mon"}}, at(1, 7, 0), false},
+		// A madrugada de sábado pertence à janela de sexta.
+		{ActiveWindow{From: "22:00", To: "02:00", Weekdays: []string{"sex"}}, at(5, 1, 0), true},
+		{ActiveWindow{From: "22:00", To: "02:00", Weekdays: []string{"sex"}}, at(5, 23, 0), false},
+		{ActiveWindow{From: "00:00", To: "00:00", Weekdays: []string{"dom"}}, at(6, 15, 0), true},
+	}
+	for _, tt := range tests {
+		w, err := parseActiveWindow(tt.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.contains(tt.t); got != tt.want {
+			t.Errorf("%+v contains %s = %t, want %t", tt.window, tt.t.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+
+	for _, w := range []ActiveWindow{{From: "6h", To: "10:00"}, {From: "06:00", To: "10:00", Weekdays: []string{"feriado"}}} {
+		if _, err := parseActiveWindow(w); err == nil {
+			t.Errorf("parseActiveWindow(%+v) should fail", w)
+		}
+	}
+}
+
+func TestFilterWindowsFromUpdateFilters(t *testing.T) {
+	inTempDir(t)
+	previous := filters
+	t.Cleanup(func() { filters = previous })
+	filters = &Filters{Police: true}
+
+	patch := func(body string) int {
+		rec := httptest.NewRecorder()
+		handleUpdateFilters(rec, httptest.NewRequest(http.MethodPatch, "/updateFilters", strings.NewReader(body)))
+		return rec.Code
+	}
+
+	if code := patch(`{"windows": {"POLICE": [{"from": "7h", "to": "09:00"}]}}`); code != http.StatusBadRequest {
+		t.Errorf("invalid window: status %d", code)
+	}
+	if code := patch(`{"windows": {"POLICE": [
+		{"from": "07:00", "to": "09:00", "weekdays": ["seg", "ter", "qua", "qui", "sex"]},
+		{"from": "17:00", "to": "19:00", "weekdays": ["seg", "ter", "qua", "qui", "sex"]}
+	]}}`); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+
+	// 2024-03-11 é uma segunda-feira.
+	monday := func(hour int) time.Time { return time.Date(2024, 3, 11, hour, 30, 0, 0, time.Local) }
+	for _, tt := range []struct {
+		alertType string
+		t         time.Time
+		want      bool
+	}{
+		{"POLICE", monday(8), true},
+		{"POLICE", monday(12), false},
+		{"POLICE", monday(18), true},
+		{"POLICE", monday(8).AddDate(0, 0, 5), false},
+		{"JAM", monday(12), true},
+	} {
+		if got := withinActiveWindow(tt.alertType, tt.t); got != tt.want {
+			t.Errorf("withinActiveWindow(%s, %s) = %t, want %t", tt.alertType, tt.t.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+
+	// As janelas são gravadas e voltam ao recarregar o arquivo.
+	saved, err := readFilters("filters.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.windows["POLICE"]) != 2 {
+		t.Errorf("windows after reload = %v", saved.windows)
+	}
+}
+
+func TestReannouncementIsBounded(t *testing.T) {
+	fake := newFakeClock(time.Date(2024, 3, 11, 8, 0, 0, 0, time.Local))
+	withClock(t, fake)
+	previousInterval, previousMax := options.reannounceInterval, options.reannounceMax
+	t.Cleanup(func() {
+		options.reannounceInterval, options.reannounceMax = previousInterval, previousMax
+	})
+	options.reannounceInterval = map[string]time.Duration{"ROAD_CLOSED": 30 * time.Minute}
+	options.reannounceMax = 2
+
+	closure := map[string]interface{}{"uuid": "a", "type": "ROAD_CLOSED"}
+	jam := map[string]interface{}{"uuid": "b", "type": "JAM"}
+	recordAnnouncement("a", closure)
+	recordAnnouncement("b", jam)
+
+	var repeats int
+	for i := 0; i < 5; i++ {
+		for _, alert := range dueReannouncements() {
+			if alert["uuid"] != "a" {
+				t.Errorf("%v has no reannounceInterval and must not repeat", alert["type"])
+			}
+			repeats++
+		}
+		fake.Advance(20 * time.Minute)
+	}
+	// Em 100 minutos, a cada 30, caberiam três repetições; o limite é 2.
+	if repeats != 2 {
+		t.Errorf("repeats = %d, want 2", repeats)
+	}
+
+	forgetAnnouncements(map[string]bool{})
+	announcementsLock.Lock()
+	remaining := len(announcements)
+	announcementsLock.Unlock()
+	if remaining != 0 {
+		t.Errorf("announcements left after the alert vanished: %d", remaining)
+	}
+}
+
+func TestProcessAlertsDropsWhenQueueIsFull(t *testing.T) {
+	inTempDir(t)
+	previous, previousProcessed := alertsCh, processedAlerts
+	t.Cleanup(func() { alertsCh, processedAlerts = previous, previousProcessed })
+	alertsCh = make(chan map[string]interface{}, 1)
+	processedAlerts = NewSet(nil)
+	dropped := droppedAlerts.Get()
+
+	feed := []interface{}{
+		map[string]interface{}{"uuid": "queue-a", "type": "JAM"},
+		map[string]interface{}{"uuid": "queue-b", "type": "JAM"},
+	}
+	processAlerts(feed)
+
+	if got := droppedAlerts.Get() - dropped; got != 1 {
+		t.Errorf("dropped = %d, want 1", got)
+	}
+	if !processedAlerts.Has("queue-a") || processedAlerts.Has("queue-b") {
+		t.Error("only the queued alert should be marked as processed")
+	}
+
+	<-alertsCh
+	processAlerts(feed)
+	if alert := <-alertsCh; alert["uuid"] != "queue-b" {
+		t.Errorf("retried alert = %v, want queue-b", alert["uuid"])
+	}
+}
+
+func TestAlertKey(t *testing.T) {
+	inTempDir(t)
+	previousOptions, previousCh, previousProcessed := options, alertsCh, processedAlerts
+	t.Cleanup(func() { options, alertsCh, processedAlerts = previousOptions, previousCh, previousProcessed })
+
+	located := map[string]interface{}{"type": "JAM", "street": "SC-401", "location": map[string]interface{}{"x": -48.5, "y": -27.6}}
+	for _, tc := range []struct {
+		name  string
+		keys  []string
+		alert map[string]interface{}
+		want  string
+		ok    bool
+	}{
+		{"uuid", defaultDedupKeys, map[string]interface{}{"uuid": "u-1", "id": "i-1"}, "u-1", true},
+		{"id fallback", defaultDedupKeys, map[string]interface{}{"id": "i-1"}, "i-1", true},
+		{"numeric id", defaultDedupKeys, map[string]interface{}{"uuid": "", "id": float64(123)}, "123", true},
+		{"fingerprint fallback", defaultDedupKeys, located, alertFingerprint(located), true},
+		{"id first", []string{"id", "uuid"}, map[string]interface{}{"uuid": "u-1", "id": "i-1"}, "i-1", true},
+		{"no key", []string{"uuid", "id"}, located, "", false},
+		{"not a map", defaultDedupKeys, nil, "", false},
+	} {
+		options.dedupKeys = tc.keys
+		if got, ok := alertKey(tc.alert); got != tc.want || ok != tc.ok {
+			t.Errorf("%s: alertKey = %q, %v, want %q, %v", tc.name, got, ok, tc.want, tc.ok)
+		}
+	}
+
+	// Alertas sem chave são ignorados, sem derrubar o processo.
+	options.dedupKeys = []string{"uuid", "id"}
+	alertsCh = make(chan map[string]interface{}, 10)
+	processedAlerts = NewSet(nil)
+	processAlerts([]interface{}{
+		map[string]interface{}{"type": "JAM"},
+		"inesperado",
+		map[string]interface{}{"id": "i-2", "type": "JAM"},
+	})
+	if len(alertsCh) != 1 {
+		t.Fatalf("queued %d alerts, want 1", len(alertsCh))
+	}
+	if alert := <-alertsCh; alert["uuid"] != "i-2" || !processedAlerts.Has("i-2") {
+		t.Errorf("queued alert = %v", alert)
+	}
+}
+
+func TestDedupSaveIntervalCoalescesWrites(t *testing.T) {
+	inTempDir(t)
+	fake := newFakeClock(time.Date(2024, 3, 11, 8, 0, 0, 0, time.UTC))
+	withClock(t, fake)
+	previousOptions := options
+	previousCh, previousProcessed, previousDB := alertsCh, processedAlerts, db
+	t.Cleanup(func() {
+		options = previousOptions
+		alertsCh, processedAlerts, db = previousCh, previousProcessed, previousDB
+		processedDirty.Store(false)
+	})
+	options.dedupSaveInterval = 30 * time.Second
+	alertsCh = make(chan map[string]interface{}, 10)
+	db = NewDatabase("db.json")
+	processedAlerts = NewTimedSet(nil, time.Hour)
+	processedAlerts.Add("antigo")
+	fake.Advance(2 * time.Hour)
+
+	processAlerts([]interface{}{map[string]interface{}{"uuid": "ciclo-1", "type": "JAM"}})
+	processAlerts([]interface{}{map[string]interface{}{"uuid": "ciclo-2", "type": "JAM"}})
+	if got := db.Writes(); got != 0 {
+		t.Fatalf("writes before the interval = %d, want 0", got)
+	}
+
+	start := fake.Now()
+	go runProcessedSave(options.dedupSaveInterval)
+	fake.waitForDeadline(t, start.Add(30*time.Second))
+	fake.Advance(30 * time.Second)
+	fake.waitForDeadline(t, start.Add(time.Minute))
+	if got := db.Writes(); got != 1 {
+		t.Errorf("writes after the interval = %d, want 1", got)
+	}
+
+	data, err := os.ReadFile("db.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "ciclo-2") || strings.Contains(string(data), "antigo") {
+		t.Errorf("db.json = %s, want ciclo-2 without the expired uuid", data)
+	}
+	if processedAlerts.Has("antigo") || processedAlerts.Len() != 2 {
+		t.Errorf("processedAlerts = %v", processedAlerts.Slice())
+	}
+
+	// Sem uuids novos, o intervalo seguinte não grava.
+	fake.Advance(30 * time.Second)
+	fake.waitForDeadline(t, start.Add(90*time.Second))
+	if got := db.Writes(); got != 1 {
+		t.Errorf("writes without changes = %d, want 1", got)
+	}
+}
+
+func TestAdminReset(t *testing.T) {
+	inTempDir(t)
+	previous := adminToken
+	t.Cleanup(func() { adminToken = previous })
+	adminToken = "segredo"
+
+	processedAlerts.Add("reset-a")
+	maxWazersOnline.SetIfGreater(42)
+
+	reset := func(what, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/reset?what="+what, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handleAdminReset(rec, req)
+		return rec
+	}
+
+	if rec := reset("all", "errado"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token: status %d", rec.Code)
+	}
+	if rec := reset("tudo", "segredo"); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid what: status %d", rec.Code)
+	}
+
+	rec := reset("all", "segredo")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var body struct {
+		Cleared map[string]int `json:"cleared"`
+	}
+	json.NewDecoder(rec.Body).Decode(&body)
+	if body.Cleared["processedAlerts"] < 1 || body.Cleared["maxWazersOnline"] < 42 {
+		t.Errorf("cleared = %v", body.Cleared)
+	}
+	if processedAlerts.Len() != 0 || maxWazersOnline.Get() != 0 {
+		t.Error("state was not cleared")
+	}
+
+	saved := NewDatabase("db.json")
+	if saved.GetProcessedAlerts().Len() != 0 || saved.GetMaxWazersOnline().Get() != 0 {
+		t.Error("cleared state was not persisted")
+	}
+}
+
+func TestAdminReplay(t *testing.T) {
+	withClock(t, instantClock{})
+	previousToken, previousNotifiers, previousFilters := adminToken, notifiers, filters
+	t.Cleanup(func() {
+		adminToken, notifiers, filters = previousToken, previousNotifiers, previousFilters
+		alertsLock.Lock()
+		alerts = nil
+		alertsLock.Unlock()
+	})
+	adminToken = "segredo"
+	filters = &Filters{Jam: true, Accident: true}
+	recorder := &recordingNotifier{}
+	notifiers = []Notifier{recorder, dryRunNotifier{}}
+
+	since := time.Date(2024, 3, 11, 8, 0, 0, 0, time.UTC)
+	alertsLock.Lock()
+	alerts = []map[string]interface{}{
+		{"uuid": "antigo", "type": "JAM", "street": "SC-401", "pubMillis": float64(since.Add(-time.Minute).UnixMilli())},
+		{"uuid": "novo-1", "type": "JAM", "street": "SC-401", "pubMillis": float64(since.UnixMilli())},
+		{"uuid": "novo-2", "type": "ACCIDENT", "street": "BR-101", "pubMillis": float64(since.Add(time.Minute).UnixMilli())},
+	}
+	alertsLock.Unlock()
+
+	replay := func(query, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/replay?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handleReplay(rec, req)
+		return rec
+	}
+
+	if rec := replay("since=2024-03-11T08:00:00Z", "errado"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token: status %d", rec.Code)
+	}
+	if rec := replay("since=ontem", "segredo"); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid since: status %d", rec.Code)
+	}
+	if rec := replay("since=2024-03-11T08:00:00Z&notifier=discord", "segredo"); rec.Code != http.StatusBadRequest {
+		t.Errorf("inactive notifier: status %d", rec.Code)
+	}
+
+	rec := replay("since=2024-03-11T05:00:00-03:00&notifier=recording", "segredo")
+	if rec.Code != http.StatusAccepted || !strings.Contains(rec.Body.String(), `"replaying":2`) {
+		t.Fatalf("replay: status %d, body %s", rec.Code, rec.Body.String())
+	}
+
+	// O replay termina quando libera a vaga.
+	replayBusy <- struct{}{}
+	<-replayBusy
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if len(recorder.alerts) != 2 || !strings.Contains(recorder.alerts[0], "SC-401") || !strings.Contains(recorder.alerts[1], "BR-101") {
+		t.Errorf("replayed = %q", recorder.alerts)
+	}
+}
+
+func TestAlertDisplayFallsBackFromSubtypeToType(t *testing.T) {
+	previous := options.alertDisplays
+	t.Cleanup(func() { options.alertDisplays = previous })
+	options.alertDisplays = buildAlertDisplays(defaultLang, map[string]AlertDisplay{
+		"ACCIDENT_MAJOR": {Label: "Acidente grave"},
+		"JAM":            {Banner: "🐢"},
+		"ROAD_CLOSED":    {Emoji: "⛔", Label: "Via interditada", Plural: "Vias interditadas"},
+	})
+
+	tests := []struct {
+		alert  map[string]interface{}
+		header string
+		title  string
+	}{
+		{map[string]interface{}{"type": "ACCIDENT", "subtype": "ACCIDENT_MAJOR"}, "📢 Acidente grave 🚙💥🚕", "💥 Acidentes"},
+		{map[string]interface{}{"type": "ACCIDENT", "subtype": "ACCIDENT_MINOR"}, "📢 Acidente 🚙💥🚕", "💥 Acidentes"},
+		{map[string]interface{}{"type": "JAM"}, "📢 Congestionamento 🐢", "🚗 Congestionamentos"},
+		{map[string]interface{}{"type": "ROAD_CLOSED"}, "📢 Via interditada", "⛔ Vias interditadas"},
+		{map[string]interface{}{"type": "HAZARD"}, "🤖 Tipo de notificação desconhecida", "🤖 HAZARD"},
+	}
+	for _, tt := range tests {
+		if got := alertHeader(tt.alert); got != tt.header {
+			t.Errorf("alertHeader(%v) = %q, want %q", tt.alert, got, tt.header)
+		}
+		if got := alertTitle(tt.alert); got != tt.title {
+			t.Errorf("alertTitle(%v) = %q, want %q", tt.alert, got, tt.title)
+		}
+	}
+
+	if err := validateConfig(); err != nil {
+		t.Errorf("known types rejected: %v", err)
+	}
+	options.alertDisplays = buildAlertDisplays(defaultLang, map[string]AlertDisplay{"ACIDENTE": {Label: "Batida"}})
+	if err := validateConfig(); err == nil || !strings.Contains(err.Error(), "alertDisplays.ACIDENTE") {
+		t.Errorf("unknown type: validateConfig = %v", err)
+	}
+}
+
+func TestGzipResponse(t *testing.T) {
+	big := strings.Repeat(`{"type": "JAM"},`, 200)
+	handler := gzipResponse(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("small") != "" {
+			w.Write([]byte(`[]`))
+			return
+		}
+		w.Write([]byte(big))
+	})
+
+	get := func(target, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	rec := get("/alerts", "deflate, gzip")
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("large response not compressed: %v", rec.Header())
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(gz); string(body) != big {
+		t.Error("decompressed body differs")
+	}
+
+	for _, tt := range []struct{ target, acceptEncoding string }{
+		{"/alerts?small=1", "gzip"},
+		{"/alerts", ""},
+		{"/alerts", "gzip;q=0"},
+	} {
+		rec := get(tt.target, tt.acceptEncoding)
+		if rec.Header().Get("Content-Encoding") != "" || rec.Body.Len() == 0 {
+			t.Errorf("%s with %q: encoding %q, %d bytes", tt.target, tt.acceptEncoding,
+				rec.Header().Get("Content-Encoding"), rec.Body.Len())
+		}
+	}
+}
+
+func TestBrandMessage(t *testing.T) {
+	previousPrefix, previousSuffix, previousZones := options.messagePrefix, options.messageSuffix, options.zones
+	t.Cleanup(func() {
+		options.messagePrefix, options.messageSuffix, options.zones = previousPrefix, previousSuffix, previousZones
+	})
+	options.messagePrefix = "🚨 Trânsito Floripa |"
+	options.messageSuffix = "@transitofloripa"
+	options.zones = []Zone{
+		{Name: "Centro", MessagePrefix: "🚨 Centro |"},
+		{Name: "Norte"},
+	}
+
+	tests := []struct {
+		zone string
+		want string
+	}{
+		{"", "🚨 Trânsito Floripa | alerta\n@transitofloripa"},
+		{"Centro", "🚨 Centro | alerta\n@transitofloripa"},
+		{"Norte", "🚨 Trânsito Floripa | alerta\n@transitofloripa"},
+	}
+	for _, tt := range tests {
+		if got := brandMessage("alerta", tt.zone); got != tt.want {
+			t.Errorf("brandMessage(%q) = %q, want %q", tt.zone, got, tt.want)
+		}
+	}
+
+	options.messagePrefix, options.messageSuffix = "", ""
+	if got := brandMessage("alerta", "Norte"); got != "alerta" {
+		t.Errorf("without branding got %q", got)
+	}
+}
+
+func TestPublishAlertDoesNotBlockOnSlowClients(t *testing.T) {
+	previousFilters, previousAlerts, previousLast := filters, alerts, lastEventID
+	t.Cleanup(func() {
+		filters = previousFilters
+		alertsLock.Lock()
+		alerts, lastEventID = previousAlerts, previousLast
+		alertsLock.Unlock()
+	})
+	filters = &Filters{}
+
+	slow := make(chan struct{}, 1)
+	clientsLock.Lock()
+	clients[slow] = struct{}{}
+	clientsLock.Unlock()
+	t.Cleanup(func() {
+		clientsLock.Lock()
+		delete(clients, slow)
+		clientsLock.Unlock()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			publishAlert(map[string]interface{}{"uuid": fmt.Sprintf("slow-%d", i), "type": "HAZARD"})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publishAlert blocked on a client that is not reading")
+	}
+	if len(slow) != 1 {
+		t.Errorf("pending wake-ups = %d, want 1", len(slow))
+	}
+}
+
+func TestEventsResumeFromLastEventID(t *testing.T) {
+	previousAlerts, previousLast, previousFilters := alerts, lastEventID, filters
+	t.Cleanup(func() {
+		alertsLock.Lock()
+		alerts, lastEventID = previousAlerts, previousLast
+		alertsLock.Unlock()
+		filters = previousFilters
+	})
+	filters = &Filters{Jam: true}
+
+	// O buffer guarda só os alertas 8 a 10.
+	alertsLock.Lock()
+	alerts = nil
+	for _, street := range []string{"SC-401", "BR-101", "Beira-Mar"} {
+		alerts = append(alerts, map[string]interface{}{"uuid": street, "type": "JAM", "street": street})
+	}
+	lastEventID = 10
+	alertsLock.Unlock()
+
+	ids := func(body string) []string {
+		var got []string
+		for _, line := range strings.Split(body, "\n") {
+			if strings.HasPrefix(line, "id: ") {
+				got = append(got, strings.TrimPrefix(line, "id: "))
+			}
+		}
+		return got
+	}
+
+	for _, tc := range []struct {
+		after, last int
+		want        []string
+		gap         string
+	}{
+		{after: 9, last: 10, want: []string{"10"}},
+		{after: 10, last: 10},
+		{after: 0, last: 10, want: []string{"8", "9", "10"}},
+		{after: 5, last: 10, want: []string{"8", "9", "10"}, gap: "event: gap\ndata: {\"missed\": 2}\n\n"},
+		// Um id de antes de um reinício recebe o buffer inteiro.
+		{after: 50, last: 10, want: []string{"8", "9", "10"}},
+	} {
+		rec := httptest.NewRecorder()
+		last, err := writeEvents(rec, rec, tc.after)
+		body := rec.Body.String()
+		if err != nil || last != tc.last || !reflect.DeepEqual(ids(body), tc.want) {
+			t.Errorf("after %d: last %d, ids %v, err %v", tc.after, last, ids(body), err)
+		}
+		if tc.gap != "" && !strings.HasPrefix(body, tc.gap) {
+			t.Errorf("after %d: no gap event in %q", tc.after, body)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+			if line != "" && !strings.HasPrefix(line, "id: ") && !strings.HasPrefix(line, "data: ") && !strings.HasPrefix(line, "event: ") {
+				t.Errorf("after %d: line without a field: %q", tc.after, line)
+			}
+		}
+	}
+
+	// O cabeçalho Last-Event-ID chega ao handler.
+	server := httptest.NewServer(http.HandlerFunc(handleEvents))
+	t.Cleanup(server.Close)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	req.Header.Set("Last-Event-ID", "9")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "id: 10\n" {
+		t.Errorf("first line = %q, %v", line, err)
+	}
+}
+
+func TestEventsRejectsClientsOverLimit(t *testing.T) {
+	previous, previousAlerts := options.maxClients, alerts
+	t.Cleanup(func() {
+		options.maxClients = previous
+		alertsLock.Lock()
+		alerts = previousAlerts
+		alertsLock.Unlock()
+	})
+	options.maxClients = 1
+	alertsLock.Lock()
+	alerts = nil
+	alertsLock.Unlock()
+
+	server := httptest.NewServer(http.HandlerFunc(handleEvents))
+	t.Cleanup(server.Close)
+
+	waitClients := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for connectedClients() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("connected clients = %d, want %d", connectedClients(), want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	first, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Body.Close()
+	if first.StatusCode != http.StatusOK {
+		t.Fatalf("first client status = %d", first.StatusCode)
+	}
+	waitClients(1)
+
+	second, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.Body.Close()
+	if second.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("second client status = %d, want 503", second.StatusCode)
+	}
+
+	rec := httptest.NewRecorder()
+	handleStats(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var stats struct {
+		SSEClients map[string]int `json:"sseClients"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &stats)
+	if stats.SSEClients["connected"] != 1 || stats.SSEClients["max"] != 1 {
+		t.Errorf("sseClients = %v", stats.SSEClients)
+	}
+
+	// Derrubar a conexão libera a vaga.
+	cancel()
+	waitClients(0)
+}
+
+func TestParseFlags(t *testing.T) {
+	previous := cli
+	t.Cleanup(func() { cli = previous })
+	t.Setenv("LISTEN_ADDR", ":8080")
+	t.Setenv("LOG_LEVEL", "warn")
+	t.Setenv("AREA_BOUNDS", "-49,-48,-27,-28")
+
+	err := parseFlags([]string{"-config", "outro.json", "-log-level", "error", "-dry-run", "-updates-schedule", "0 * * * * *"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cli.listenAddr != ":8080" || cli.configFile != "outro.json" || cli.logLevel != "error" || !cli.dryRun {
+		t.Errorf("cli = %+v", cli)
+	}
+
+	live := buildLiveConfig(&Config{Schedules: map[string]string{"updates": "*/5 * * * * *", "wazers": "*/5 * * * * *"}})
+	if live.Schedules["updates"] != "0 * * * * *" || live.Schedules["wazers"] != "*/5 * * * * *" {
+		t.Errorf("schedules = %v", live.Schedules)
+	}
+	if live.AreaBounds["left"] != -49 || live.AreaBounds["bottom"] != -28 {
+		t.Errorf("bounds = %v", live.AreaBounds)
+	}
+
+	if logLevelAllows("processando alertas") || !logLevelAllows("ERROR: falhou") {
+		t.Error("log level error should only allow ERROR messages")
+	}
+
+	if err := parseFlags([]string{"-min-severity", "60"}); err != nil || cli.minSeverity != 60 {
+		t.Errorf("-min-severity: cli.minSeverity = %d, err %v", cli.minSeverity, err)
+	}
+
+	t.Setenv("LOG_MAX_BACKUPS", "5")
+	if err := parseFlags([]string{"-log-file", "informa.log", "-log-max-size", "50"}); err != nil || cli.logFile != "informa.log" || cli.logMaxSize != 50 || cli.logMaxBackups != 5 {
+		t.Errorf("log file flags: cli = %+v, err %v", cli, err)
+	}
+
+	for _, args := range [][]string{{"-log-level", "verbose"}, {"-bounds", "1,2,3"}, {"-wazers-schedule", "sempre"}, {"-min-severity", "101"},
+		{"-log-max-size", "0"}, {"-log-max-backups", "-1"}} {
+		if err := parseFlags(args); err == nil {
+			t.Errorf("parseFlags(%q) should fail", args)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "informa.log")
+	file, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"linha-1\n", "linha-2\n", "linha-3\n", "linha-4\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cada linha passa do limite junto com a anterior: a mais antiga é
+	// descartada ao passar de duas cópias.
+	for name, want := range map[string]string{"informa.log": "linha-4\n", "informa.log.1": "linha-3\n", "informa.log.2": "linha-2\n"} {
+		data, err := os.ReadFile(filepath.Join(filepath.Dir(path), name))
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", name, data, err, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 should not exist: %v", path, err)
+	}
+
+	// Reabrir continua do tamanho atual do arquivo.
+	file, err = OpenRotatingFile(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("x\n"))
+	file.Write([]byte("linha-5\n"))
+	file.Close()
+	if data, _ := os.ReadFile(path); string(data) != "linha-5\n" {
+		t.Errorf("without backups, log = %q", data)
+	}
+
+	// Se a rotação falha (aqui, um diretório no lugar do .1), o log continua
+	// no arquivo atual e a rotação volta a ser tentada na escrita seguinte.
+	path = filepath.Join(t.TempDir(), "informa.log")
+	if err := os.MkdirAll(filepath.Join(path+".1", "ocupado"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	file, err = OpenRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for _, line := range []string{"linha-1\n", "linha-2\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatalf("write after failed rotation: %v", err)
+		}
+	}
+	if data, _ := os.ReadFile(path); string(data) != "linha-1\nlinha-2\n" {
+		t.Errorf("after failed rotation, log = %q", data)
+	}
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("linha-3\n"))
+	if data, _ := os.ReadFile(path); string(data) != "linha-3\n" {
+		t.Errorf("after recovery, log = %q", data)
+	}
+	if data, _ := os.ReadFile(path + ".1"); string(data) != "linha-1\nlinha-2\n" {
+		t.Errorf("after recovery, backup = %q", data)
+	}
+}
+
+func TestGeocodeArea(t *testing.T) {
+	inTempDir(t)
+	previousDB := db
+	t.Cleanup(func() { db = previousDB })
+	db = NewDatabase("db.json")
+
+	var queries []string
+	withHTTPClient(t, roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		queries = append(queries, r.URL.String())
+		body := `[{"boundingbox": ["-27.8472", "-27.3800", "-48.6130", "-48.3580"]}]`
+		if r.URL.Query().Get("q") == "Lugar Nenhum" {
+			body = `[]`
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+		}, nil
+	}))
+
+	explicit := map[string]float64{"left": -49, "right": -48, "top": -27, "bottom": -28}
+	live := buildLiveConfig(&Config{AreaName: "Florianópolis, SC", AreaBounds: explicit})
+	want := map[string]float64{"left": -48.6130, "right": -48.3580, "top": -27.3800, "bottom": -27.8472}
+	if !reflect.DeepEqual(live.AreaBounds, want) {
+		t.Errorf("AreaBounds = %v, want %v", live.AreaBounds, want)
+	}
+	if len(queries) != 1 || !strings.Contains(queries[0], "q=Florian%C3%B3polis%2C+SC") {
+		t.Fatalf("queries = %q", queries)
+	}
+
+	// A recarga e o reinício usam o retângulo guardado no db.json, lido
+	// uma vez na inicialização.
+	db = NewDatabase("db.json")
+	db.load()
+	if live := buildLiveConfig(&Config{AreaName: "florianópolis, sc"}); !reflect.DeepEqual(live.AreaBounds, want) || len(queries) != 1 {
+		t.Errorf("cached AreaBounds = %v after %d queries", live.AreaBounds, len(queries))
+	}
+
+	// Outra geocoderUrl não aproveita o que veio da anterior.
+	buildLiveConfig(&Config{AreaName: "Florianópolis, SC", GeocoderURL: "https://geo.example/search?format=json&q={query}"})
+	if len(queries) != 2 || !strings.HasPrefix(queries[1], "https://geo.example/") {
+		t.Errorf("queries after changing geocoderUrl = %q", queries)
+	}
+
+	// O que está em memória vale mais que o arquivo, que não é relido.
+	if err := os.WriteFile("db.json", []byte(`{}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if live := buildLiveConfig(&Config{AreaName: "Florianópolis, SC"}); !reflect.DeepEqual(live.AreaBounds, want) || len(queries) != 2 {
+		t.Errorf("AreaBounds after db.json changed = %v after %d queries", live.AreaBounds, len(queries))
+	}
+
+	// Sem resultado, vale areaBounds.
+	if live := buildLiveConfig(&Config{AreaName: "Lugar Nenhum", AreaBounds: explicit}); !reflect.DeepEqual(live.AreaBounds, explicit) {
+		t.Errorf("fallback AreaBounds = %v", live.AreaBounds)
+	}
+
+	// Na inicialização, a consulta já sai pelo proxy e com o User-Agent do
+	// config.json.
+	var proxied []*http.Request
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `[{"boundingbox": ["-27.8472", "-27.3800", "-48.6130", "-48.3580"]}]`)
+	}))
+	defer proxy.Close()
+	previousOptions, previousLive := options, liveConfig.Get()
+	t.Cleanup(func() { options = previousOptions; liveConfig.Set(previousLive) })
+	withHTTPClient(t, http.DefaultTransport)
+	applyConfig(&Config{
+		AreaName: "Joinville, SC", GeocoderURL: "http://geo.invalid/search?format=json&q={query}",
+		ProxyURL: proxy.URL, UserAgent: "InformaWaze-teste/1.0",
+	})
+	if len(proxied) != 1 {
+		t.Fatalf("geocoder requests through proxy = %d, want 1", len(proxied))
+	}
+	if proxied[0].Host != "geo.invalid" || proxied[0].UserAgent() != "InformaWaze-teste/1.0" {
+		t.Errorf("proxied request to %q with User-Agent %q", proxied[0].Host, proxied[0].UserAgent())
+	}
+	if !reflect.DeepEqual(liveConfig.Get().AreaBounds, want) {
+		t.Errorf("AreaBounds from applyConfig = %v", liveConfig.Get().AreaBounds)
+	}
+
+	opencage := `{"results": [{"bounds": {"northeast": {"lat": -27.38, "lng": -48.358}, "southwest": {"lat": -27.85, "lng": -48.613}}}]}`
+	bounds, err := parseGeocoderBounds("opencage", strings.NewReader(opencage))
+	if err != nil || bounds["left"] != -48.613 || bounds["top"] != -27.38 {
+		t.Errorf("opencage bounds = %v, err %v", bounds, err)
+	}
+}
+
+func TestRunScheduleFiresAtExpectedInstants(t *testing.T) {
+	mustLoad := func(name string) *time.Location {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return loc
+	}
+	newYork := mustLoad("America/New_York")
+	saoPaulo := mustLoad("America/Sao_Paulo")
+	utc := time.UTC
+
+	tests := []struct {
+		name  string
+		expr  string
+		start time.Time
+		want  []time.Time
+	}{
+		{
+			name:  "a cada 30 segundos",
+			expr:  "*/30 * * * * *",
+			start: time.Date(2024, 3, 11, 8, 0, 10, 0, utc),
+			want: []time.Time{
+				time.Date(2024, 3, 11, 8, 0, 30, 0, utc),
+				time.Date(2024, 3, 11, 8, 1, 0, 0, utc),
+				time.Date(2024, 3, 11, 8, 1, 30, 0, utc),
+			},
+		},
+		{
+			name:  "dias úteis pula o fim de semana",
+			expr:  "0 8 * * 1-5",
+			start: time.Date(2024, 3, 15, 9, 0, 0, 0, utc), // sexta
+			want: []time.Time{
+				time.Date(2024, 3, 18, 8, 0, 0, 0, utc),
+				time.Date(2024, 3, 19, 8, 0, 0, 0, utc),
+			},
+		},
+		{
+			name:  "virada de mês e ano bissexto",
+			expr:  "0 0 29 2 *",
+			start: time.Date(2023, 3, 1, 0, 0, 0, 0, utc),
+			want: []time.Time{
+				time.Date(2024, 2, 29, 0, 0, 0, 0, utc),
+				time.Date(2028, 2, 29, 0, 0, 0, 0, utc),
+			},
+		},
+		{
+			// Go não representa segundos bissextos: 23:59:59 é seguido de 00:00:00.
+			name:  "perto do segundo bissexto de 2016",
+			expr:  "*/20 * * * * *",
+			start: time.Date(2016, 12, 31, 23, 59, 41, 0, utc),
+			want: []time.Time{
+				time.Date(2017, 1, 1, 0, 0, 0, 0, utc),
+				time.Date(2017, 1, 1, 0, 0, 20, 0, utc),
+			},
+		},
+		{
+			name:  "a cada hora atravessando o início do horário de verão",
+			expr:  "0 * * * *",
+			start: time.Date(2024, 3, 10, 0, 30, 0, 0, newYork),
+			want: []time.Time{
+				time.Date(2024, 3, 10, 1, 0, 0, 0, newYork),
+				time.Date(2024, 3, 10, 3, 0, 0, 0, newYork), // 02:00 não existe
+				time.Date(2024, 3, 10, 4, 0, 0, 0, newYork),
+			},
+		},
+		{
+			name:  "a cada hora atravessando o fim do horário de verão",
+			expr:  "0 * * * *",
+			start: time.Date(2024, 11, 3, 0, 30, 0, 0, newYork),
+			want: []time.Time{
+				time.Date(2024, 11, 3, 1, 0, 0, 0, newYork),                // 01:00 EDT
+				time.Date(2024, 11, 3, 1, 0, 0, 0, newYork).Add(time.Hour), // 01:00 EST
+				time.Date(2024, 11, 3, 2, 0, 0, 0, newYork),
+			},
+		},
+		{
+			name:  "horário inexistente no dia da mudança é pulado",
+			expr:  "30 2 * * *",
+			start: time.Date(2024, 3, 9, 12, 0, 0, 0, newYork),
+			want: []time.Time{
+				time.Date(2024, 3, 11, 2, 30, 0, 0, newYork),
+			},
+		},
+		{
+			// Em 2018 o horário de verão começou à meia-noite de 4/11.
+			name:  "meia-noite inexistente em São Paulo",
+			expr:  "0 0 * * *",
+			start: time.Date(2018, 11, 3, 12, 0, 0, 0, saoPaulo),
+			want: []time.Time{
+				time.Date(2018, 11, 5, 0, 0, 0, 0, saoPaulo),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := options.timezone
+			t.Cleanup(func() { options.timezone = previous })
+			options.timezone = tt.start.Location()
+
+			fake := newFakeClock(tt.start)
+			live := defaultLiveConfig()
+			live.Schedules["updates"] = tt.expr
+			holder := NewConfigHolder(live)
+
+			fired := make(chan time.Time)
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				runSchedule(fake, holder, "updates", func() { fired <- fake.Now() }, stop)
+				close(done)
+			}()
+			defer func() {
+				close(stop)
+				<-done
+			}()
+
+			for _, want := range tt.want {
+				fake.waitForTimers(t, 1)
+				fake.AdvanceToNextTimer()
+				if got := <-fired; !got.Equal(want) {
+					t.Fatalf("fired at %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTimezoneForWindowsAndSchedules(t *testing.T) {
+	saoPaulo, err := time.LoadLocation("America/Sao_Paulo")
+	if err != nil {
+		t.Skip(err)
+	}
+	// O relógio do servidor em UTC, com timezone America/Sao_Paulo no
+	// config.json.
+	previousOptions, previousFilters := options, filters
+	t.Cleanup(func() { options, filters = previousOptions, previousFilters })
+	options.timezone = saoPaulo
+	filters = &Filters{Police: true}
+
+	window, err := parseActiveWindow(ActiveWindow{From: "07:00", To: "09:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	options.activeWindows = map[string][]activeWindow{"POLICE": {window}}
+	for _, tt := range []struct {
+		t    time.Time
+		want bool
+	}{
+		{time.Date(2024, 3, 11, 11, 30, 0, 0, time.UTC), true}, // 08:30 em São Paulo
+		{time.Date(2024, 3, 11, 8, 30, 0, 0, time.UTC), false}, // 05:30 em São Paulo
+	} {
+		if got := withinActiveWindow("POLICE", tt.t); got != tt.want {
+			t.Errorf("withinActiveWindow(POLICE, %s UTC) = %t, want %t", tt.t.Format("15:04"), got, tt.want)
+		}
+	}
+
+	fake := newFakeClock(time.Date(2024, 3, 11, 8, 0, 0, 0, time.UTC))
+	live := defaultLiveConfig()
+	live.Schedules["updates"] = "0 8 * * *"
+	holder := NewConfigHolder(live)
+
+	fired := make(chan time.Time)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		runSchedule(fake, holder, "updates", func() { fired <- fake.Now() }, stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	fake.waitForTimers(t, 1)
+	fake.AdvanceToNextTimer()
+	if got, want := <-fired, time.Date(2024, 3, 11, 11, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("fired at %v, want %v (08:00 in São Paulo)", got, want)
+	}
+}
+
+func TestRunCacheCleanupStops(t *testing.T) {
+	fake := newFakeClock(time.Date(2024, 3, 11, 8, 0, 0, 0, time.UTC))
+	withClock(t, fake)
+	previous := c
+	t.Cleanup(func() { c = previous })
+	c = cache.New(time.Minute, 0)
+	c.Set("vencido", 1, time.Nanosecond)
+	c.Set("valido", 1, time.Hour)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		runCacheCleanup(10*time.Minute, stop)
+		close(done)
+	}()
+
+	fake.waitForTimers(t, 1)
+	fake.AdvanceToNextTimer()
+	// A limpeza roda e agenda a próxima.
+	fake.waitForTimers(t, 1)
+	if got := c.ItemCount(); got != 1 {
+		t.Errorf("items after cleanup = %d, want 1", got)
+	}
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("runCacheCleanup did not stop")
+	}
+}
+
+func TestRunScheduleReplansOnReload(t *testing.T) {
+	fake := newFakeClock(time.Date(2024, 3, 11, 8, 0, 0, 0, time.UTC))
+	live := defaultLiveConfig()
+	live.Schedules["updates"] = "0 * * * *"
+	holder := NewConfigHolder(live)
+
+	fired := make(chan time.Time)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		runSchedule(fake, holder, "updates", func() { fired <- fake.Now() }, stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	fake.waitForTimers(t, 1)
+	reloaded := defaultLiveConfig()
+	reloaded.Schedules["updates"] = "*/10 * * * *"
+	holder.Set(reloaded)
+
+	// O timer da hora cheia é cancelado e um novo, de 10 minutos, é criado.
+	fake.waitForDeadline(t, time.Date(2024, 3, 11, 8, 10, 0, 0, time.UTC))
+	fake.AdvanceToNextTimer()
+	if got, want := <-fired, time.Date(2024, 3, 11, 8, 10, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("fired at %v, want %v", got, want)
+	}
+}
+
+func TestClustererGroupsNearbyAlertsOfSameType(t *testing.T) {
+	fake := newFakeClock(time.Date(2024, 3, 11, 8, 0, 0, 0, time.Local))
+	withClock(t, fake)
+
+	jam := func(street string, x, y float64) map[string]interface{} {
+		return map[string]interface{}{
+			"type":     "JAM",
+			"street":   street,
+			"location": map[string]interface{}{"x": x, "y": y},
+		}
+	}
+
+	cl := NewClusterer(500, 2*time.Minute)
+	cl.Add(jam("Av. Beira-Mar", -48.5500, -27.5900))
+	cl.Add(jam("Av. Beira-Mar", -48.5520, -27.5910))
+	cl.Add(jam("Rua Bocaiúva", -48.5490, -27.5920))
+	// A 10 km dali: abre outro grupo.
+	cl.Add(jam("SC-401", -48.5000, -27.5100))
+	// Mesmo ponto, mas outro tipo.
+	cl.Add(map[string]interface{}{"type": "ACCIDENT", "location": map[string]interface{}{"x": -48.55, "y": -27.59}})
+	if cl.Add(map[string]interface{}{"type": "JAM"}) {
+		t.Error("alert without location should not be clustered")
+	}
+
+	fake.Advance(time.Minute)
+	if due := cl.Due(); len(due) != 0 {
+		t.Fatalf("%d clusters due before the window ended", len(due))
+	}
+	fake.Advance(time.Minute)
+	due := cl.Due()
+	if len(due) != 3 {
+		t.Fatalf("clusters = %d, want 3", len(due))
+	}
+	if len(due[0].alerts) != 3 || len(due[1].alerts) != 1 || len(due[2].alerts) != 1 {
+		t.Errorf("cluster sizes = %d, %d, %d", len(due[0].alerts), len(due[1].alerts), len(due[2].alerts))
+	}
+
+	want := "[08:02:00] 📢 3 congestionamentos na Av. Beira-Mar 🚗🚕🚙\n📍 Av. Beira-Mar (2), Rua Bocaiúva (1)"
+	if got := formatCluster(due[0].alerts); got != want {
+		t.Errorf("formatCluster = %q, want %q", got, want)
+	}
+	if due := cl.Due(); len(due) != 0 {
+		t.Errorf("clusters sent twice: %d", len(due))
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	inTempDir(t)
+	previousFilters := filters
+	t.Cleanup(func() { filters = previousFilters })
+	filters = &Filters{}
+
+	decode := func(rec *httptest.ResponseRecorder) apiError {
+		t.Helper()
+		if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		var body apiError
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("body %q: %v", rec.Body.String(), err)
+		}
+		return body
+	}
+
+	rec := httptest.NewRecorder()
+	handleAlerts(rec, httptest.NewRequest(http.MethodGet, "/alerts?format=xml", nil))
+	if body := decode(rec); rec.Code != http.StatusBadRequest || body.Code != "invalid_parameter" || body.Error == "" {
+		t.Errorf("/alerts: %d %+v", rec.Code, body)
+	}
+
+	rec = httptest.NewRecorder()
+	handleUpdateFilters(rec, httptest.NewRequest(http.MethodPatch, "/updateFilters", strings.NewReader(`{"bicicleta": true}`)))
+	if body := decode(rec); rec.Code != http.StatusBadRequest || body.Code != "unknown_filter" || body.Error != "Filtro desconhecido: bicicleta" {
+		t.Errorf("/updateFilters: %d %+v", rec.Code, body)
+	}
+
+	rec = httptest.NewRecorder()
+	handleUpdateFilters(rec, httptest.NewRequest(http.MethodGet, "/updateFilters", nil))
+	if body := decode(rec); rec.Code != http.StatusMethodNotAllowed || body.Code != "method_not_allowed" {
+		t.Errorf("GET /updateFilters: %d %+v", rec.Code, body)
+	}
+
+	// As páginas HTML seguem em texto, a não ser que o cliente peça JSON.
+	rec = httptest.NewRecorder()
+	writeJSONError(rec, httptest.NewRequest(http.MethodGet, "/filters", nil), http.StatusBadRequest, "invalid_body", "Erro")
+	if rec.Body.String() != "Erro\n" {
+		t.Errorf("HTML route body = %q", rec.Body.String())
+	}
+	req := httptest.NewRequest(http.MethodGet, "/filters", nil)
+	req.Header.Set("Accept", "application/json")
+	rec = httptest.NewRecorder()
+	writeJSONError(rec, req, http.StatusBadRequest, "invalid_body", "Erro")
+	if body := decode(rec); body.Code != "invalid_body" {
+		t.Errorf("HTML route with Accept: %+v", body)
+	}
+}
+
+func TestSchemaMatchesStructs(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleSchema(rec, httptest.NewRequest(http.MethodGet, "/schema/config", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	var schema struct {
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	// Toda chave do config.json de exemplo precisa estar no schema; caso
+	// contrário a struct e o arquivo divergiram.
+	data, err := os.ReadFile("config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sample map[string]json.RawMessage
+	if err := json.Unmarshal(data, &sample); err != nil {
+		t.Fatal(err)
+	}
+	for key := range sample {
+		if _, ok := schema.Properties[key]; !ok {
+			t.Errorf("config.json key %q missing from schema", key)
+		}
+	}
+
+	filtersSchema := jsonSchema(reflect.TypeOf(Filters{}))
+	properties := filtersSchema["properties"].(map[string]interface{})
+	exported := 0
+	for _, field := range reflect.VisibleFields(reflect.TypeOf(Filters{})) {
+		if field.IsExported() {
+			exported++
+		}
+	}
+	if len(properties) != exported {
+		t.Errorf("filters schema has %d properties, want %d", len(properties), exported)
+	}
+	zones := properties["zones"].(map[string]interface{})
+	if zones["items"].(map[string]interface{})["type"] != "string" {
+		t.Errorf("zones = %v", zones)
+	}
+	// O enum precisa aceitar exatamente o que validateFilters aceita.
+	for _, value := range properties["reportSource"].(map[string]interface{})["enum"].([]string) {
+		if err := validateFilters(&Filters{ReportSource: value}); err != nil {
+			t.Errorf("enum value %q rejected: %v", value, err)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	handleSchema(rec, httptest.NewRequest(http.MethodGet, "/schema/outro", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown schema status = %d", rec.Code)
+	}
+}
+
+func TestMessageCatalogs(t *testing.T) {
+	verbs := regexp.MustCompile(`%[-+# 0-9.]*[a-zA-Z]`)
+	for lang, catalog := range messageCatalogs {
+		for key, format := range catalog {
+			base, ok := messageCatalogs[defaultLang][key]
+			if !ok {
+				t.Errorf("%s: key %q missing from %s", lang, key, defaultLang)
+				continue
+			}
+			if got, want := verbs.FindAllString(format, -1), verbs.FindAllString(base, -1); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s.%s verbs = %v, want %v", lang, key, got, want)
+			}
+		}
+	}
+
+	previous := options.lang
+	previousDisplays := options.alertDisplays
+	t.Cleanup(func() { options.lang, options.alertDisplays = previous, previousDisplays })
+	options.lang = "en"
+	options.alertDisplays = buildAlertDisplays("en", nil)
+
+	if got := formatAge(90 * time.Minute); got != "1h30 ago" {
+		t.Errorf("formatAge = %q", got)
+	}
+	if got := alertHeader(map[string]interface{}{"type": "JAM"}); got != "📢 Traffic jam 🚗🚕🚙" {
+		t.Errorf("alertHeader = %q", got)
+	}
+
+	// Chaves sem tradução caem para o português.
+	delete(messageCatalogs["en"], "street.unknown")
+	t.Cleanup(func() { messageCatalogs["en"]["street.unknown"] = "unknown location" })
+	if got := alertStreet(map[string]interface{}{}); got != "local desconhecido" {
+		t.Errorf("fallback = %q", got)
+	}
+}
+
+func TestWazersReport(t *testing.T) {
+	at := func(hour, minute int) time.Time { return time.Date(2024, 3, 11, hour, minute, 0, 0, time.Local) }
+
+	tests := []struct {
+		peak, previous int
+		peakAt         time.Time
+		speed          float64
+		hasSpeed       bool
+		want           string
+	}{
+		{12, 0, time.Time{}, 0, false, "12 wazers conectados 🚙 🚕 🚚\n🕐 08:00–09:00"},
+		{12, 9, at(8, 37), 0, false, "12 wazers conectados 🚙 🚕 🚚\n🕐 08:00–09:00, pico às 08:37\n↑ +3 em relação ao período anterior (9)"},
+		{7, 9, at(8, 5), 0, false, "7 wazers conectados 🚙 🚕 🚚\n🕐 08:00–09:00, pico às 08:05\n↓ -2 em relação ao período anterior (9)"},
+		// Pico anterior ao período (ex.: restaurado de outra janela) não é citado.
+		{9, 9, at(7, 50), 0, false, "9 wazers conectados 🚙 🚕 🚚\n🕐 08:00–09:00\n= igual ao período anterior (9)"},
+		{12, 0, time.Time{}, 17.4, true, "12 wazers conectados 🚙 🚕 🚚\n🕐 08:00–09:00\n🏎️ velocidade média 17 km/h nos congestionamentos"},
+	}
+	for _, tt := range tests {
+		if got := formatWazersReport(tt.peak, tt.previous, at(8, 0), at(9, 0), tt.peakAt, tt.speed, tt.hasSpeed); got != tt.want {
+			t.Errorf("formatWazersReport(%d, %d) = %q, want %q", tt.peak, tt.previous, got, tt.want)
+		}
+	}
+}
+
+func TestWazersThresholds(t *testing.T) {
+	previousOptions, previousNotifiers, previousLevel := options, notifiers, wazersThresholdLevel
+	t.Cleanup(func() { options, notifiers, wazersThresholdLevel = previousOptions, previousNotifiers, previousLevel })
+	notifier := &recordingNotifier{}
+	notifiers = []Notifier{notifier}
+	wazersThresholdLevel = NewCounter(0)
+	options.wazersThresholds = []int{200, 100}
+
+	steps := []struct {
+		count int
+		want  string
+	}{
+		{90, ""},
+		{120, "🚗 mais de 100 wazers online agora"},
+		{130, ""},
+		// Só volta a avisar depois de cair abaixo de 90% do limite.
+		{95, ""},
+		{110, ""},
+		{85, ""},
+		{110, "🚗 mais de 100 wazers online agora"},
+		{250, "🚗 mais de 200 wazers online agora"},
+		{170, ""},
+		{210, "🚗 mais de 200 wazers online agora"},
+	}
+	for i, step := range steps {
+		notifier.texts = nil
+		checkWazersThresholds(step.count)
+		got := strings.Join(notifier.texts, "\n")
+		if got != step.want {
+			t.Errorf("step %d (%d wazers): sent %q, want %q", i, step.count, got, step.want)
+		}
+	}
+}
+
+func TestWazersHistorySurvivesRestart(t *testing.T) {
+	inTempDir(t)
+	withClock(t, newFakeClock(time.Date(2024, 3, 11, 9, 0, 0, 0, time.Local)))
+
+	peakAt := time.Date(2024, 3, 11, 8, 37, 0, 0, time.Local)
+	NewDatabase("db.json").SetWazersPeak(15, peakAt)
+
+	restarted := NewDatabase("db.json")
+	if got := restarted.GetMaxWazersOnline().Get(); got != 15 {
+		t.Errorf("peak after restart = %d, want 15", got)
+	}
+	gotPeakAt, lastReport, previous := restarted.GetWazersHistory()
+	if !gotPeakAt.Equal(peakAt) || !lastReport.Equal(clock.Now()) || previous != 0 {
+		t.Errorf("history = %s, %s, %d", gotPeakAt, lastReport, previous)
+	}
+
+	restarted.SetWazersReport(clock.Now(), 15)
+	restarted = NewDatabase("db.json")
+	if got := restarted.GetMaxWazersOnline().Get(); got != 0 {
+		t.Errorf("peak after report = %d, want 0", got)
+	}
+	gotPeakAt, lastReport, previous = restarted.GetWazersHistory()
+	if !gotPeakAt.IsZero() || !lastReport.Equal(clock.Now()) || previous != 15 {
+		t.Errorf("history after report = %s, %s, %d", gotPeakAt, lastReport, previous)
+	}
+}
+
+func TestDebugAlert(t *testing.T) {
+	inTempDir(t)
+	previousFilters, previousArchive := filters, archive
+	t.Cleanup(func() {
+		filters, archive = previousFilters, previousArchive
+		alertsLock.Lock()
+		alerts = nil
+		alertsLock.Unlock()
+	})
+	filters = &Filters{Jam: true, Zones: []string{"centro"}}
+	archive = NewArchive("arquivo")
+
+	old := map[string]interface{}{"uuid": "arquivado", "type": "ACCIDENT", "street": "BR-101"}
+	if err := archive.Write(old); err != nil {
+		t.Fatal(err)
+	}
+	alertsLock.Lock()
+	alerts = []map[string]interface{}{{"uuid": "na-memoria", "type": "JAM", "street": "SC-401", "zone": "centro"}}
+	alertsLock.Unlock()
+
+	debug := func(alertID string) (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		handleDebugAlert(rec, httptest.NewRequest(http.MethodGet, "/debug/alerts/"+alertID, nil))
+		var body map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body
+	}
+
+	code, body := debug("na-memoria")
+	if code != http.StatusOK || body["source"] != "memory" {
+		t.Fatalf("status %d, body %v", code, body)
+	}
+	if rendered, _ := body["rendered"].(string); !strings.Contains(rendered, "SC-401") {
+		t.Errorf("rendered = %q", rendered)
+	}
+	matched := body["matched"].(map[string]interface{})
+	if matched["zone"] != true || matched["handler"] != "handleAlert" || matched["delivery"] != "immediate" {
+		t.Errorf("matched = %v", matched)
+	}
+
+	code, body = debug("arquivado")
+	if code != http.StatusOK || body["source"] != "archive" {
+		t.Fatalf("status %d, body %v", code, body)
+	}
+	// Acidentes estão desligados e o alerta não tem zona: nada seria enviado.
+	matched = body["matched"].(map[string]interface{})
+	if body["rendered"] != "" || matched["zone"] != false {
+		t.Errorf("rendered = %q, matched = %v", body["rendered"], matched)
+	}
+	if filter := matched["typeFilter"].(map[string]interface{}); filter["name"] != "accident" || filter["enabled"] != false {
+		t.Errorf("typeFilter = %v", filter)
+	}
+
+	if code, _ := debug("sumiu"); code != http.StatusNotFound {
+		t.Errorf("unknown uuid: status %d", code)
+	}
+}
+
+func TestFillBuildInfo(t *testing.T) {
+	previousCommit, previousTime := gitCommit, buildTime
+	t.Cleanup(func() { gitCommit, buildTime = previousCommit, previousTime })
+
+	settings := []debug.BuildSetting{
+		{Key: "vcs.revision", Value: "a95ad02c1f9e8b7d"},
+		{Key: "vcs.time", Value: "2024-03-11T08:00:00Z"},
+		{Key: "vcs.modified", Value: "true"},
+	}
+
+	gitCommit, buildTime = "unknown", "unknown"
+	fillBuildInfo(settings)
+	if gitCommit != "a95ad02-dirty" || buildTime != "2024-03-11T08:00:00Z" {
+		t.Errorf("from VCS: commit %q, build %q", gitCommit, buildTime)
+	}
+
+	// Valores passados por -ldflags têm prioridade.
+	gitCommit, buildTime = "1234567", "2024-01-01T00:00:00Z"
+	fillBuildInfo(settings)
+	if gitCommit != "1234567" || buildTime != "2024-01-01T00:00:00Z" {
+		t.Errorf("with ldflags: commit %q, build %q", gitCommit, buildTime)
+	}
+
+	rec := httptest.NewRecorder()
+	handleVersion(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if !strings.Contains(rec.Body.String(), `"goVersion":"`+runtime.Version()+`"`) {
+		t.Errorf("/version = %s", rec.Body.String())
+	}
+}
+
+func TestTelegramConfigFromFile(t *testing.T) {
+	previousOptions, previousLive := options, liveConfig.Get()
+	previousToken, previousChats := telegramBotToken, telegramChatIDs
+	t.Cleanup(func() {
+		options = previousOptions
+		liveConfig.Set(previousLive)
+		telegramBotToken, telegramChatIDs = previousToken, previousChats
+	})
+	t.Setenv("TELEGRAM_BOT_TOKEN", "")
+	t.Setenv("TELEGRAM_CHAT_ID", "")
+	telegramBotToken, telegramChatIDs = "", nil
+	// applyConfig troca o httpClient.
+	withHTTPClient(t, http.DefaultTransport)
+
+	applyConfig(&Config{TelegramBotToken: "123:segredo-do-bot", TelegramChatIDs: []string{"-100", "-200"}})
+	if err := validateConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if len(options.notifiers) != 1 || options.notifiers[0] != notifierTelegram {
+		t.Errorf("notifiers = %v", options.notifiers)
+	}
+
+	var chats []string
+	withHTTPClient(t, roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		chats = append(chats, payload["chat_id"].(string))
+		if payload["chat_id"] == "-200" {
+			return nil, errors.New("conexão recusada")
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"ok": true}`))}, nil
+	}))
+
+	err := TelegramNotifier{}.SendText("oi")
+	if !reflect.DeepEqual(chats, []string{"-100", "-200"}) {
+		t.Errorf("chats = %v", chats)
+	}
+	// O erro do chat que falhou não pode expor o token.
+	if err == nil || strings.Contains(err.Error(), "segredo-do-bot") || !strings.Contains(err.Error(), "chat -200") {
+		t.Errorf("err = %v", err)
+	}
+
+	// O ambiente tem prioridade sobre o arquivo.
+	t.Setenv("TELEGRAM_BOT_TOKEN", "456:do-ambiente")
+	t.Setenv("TELEGRAM_CHAT_ID", "-300, -400")
+	telegramBotToken, telegramChatIDs = "456:do-ambiente", splitList("-300, -400")
+	applyConfig(&Config{TelegramBotToken: "123:segredo-do-bot", TelegramChatIDs: []string{"-100"}})
+	if telegramBotToken != "456:do-ambiente" || !reflect.DeepEqual(telegramChatIDs, []string{"-300", "-400"}) {
+		t.Errorf("token %q, chats %v", telegramBotToken, telegramChatIDs)
+	}
+}
+
+func TestTelegramStaticMapPhoto(t *testing.T) {
+	previousOptions := options
+	previousToken, previousChats, previousKey := telegramBotToken, telegramChatIDs, staticMapKey
+	t.Cleanup(func() {
+		options = previousOptions
+		telegramBotToken, telegramChatIDs, staticMapKey = previousToken, previousChats, previousKey
+	})
+	telegramBotToken, telegramChatIDs = "123:abc", []string{"-100"}
+	options.telegramRoutes = nil
+	options.staticMapURL = "https://mapas.exemplo/static?center={lat},{lon}&key={key}"
+	options.staticMapTypes = map[string]bool{"ACCIDENT": true}
+
+	type call struct {
+		method  string
+		payload map[string]interface{}
+	}
+	var calls []call
+	photoFails := false
+	withHTTPClient(t, roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		calls = append(calls, call{method, payload})
+		body := `{"ok": true}`
+		if method == "sendPhoto" && photoFails {
+			body = `{"ok": false, "description": "Bad Request: failed to get HTTP URL content"}`
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}, nil
+	}))
+
+	located := map[string]interface{}{"type": "ACCIDENT", "location": map[string]interface{}{"x": -48.5, "y": -27.6}}
+	tests := []struct {
+		name    string
+		key     string
+		alert   map[string]interface{}
+		message string
+		fails   bool
+		want    []string
+	}{
+		{"photo", "k&1", located, "Acidente", false, []string{"sendPhoto"}},
+		{"type without map", "k&1", map[string]interface{}{"type": "JAM", "location": located["location"]}, "Congestionamento", false, []string{"sendMessage"}},
+		{"no coordinates", "k&1", map[string]interface{}{"type": "ACCIDENT"}, "Acidente", false, []string{"sendMessage"}},
+		{"no key", "", located, "Acidente", false, []string{"sendMessage"}},
+		{"caption too long", "k&1", located, strings.Repeat("a", telegramMaxCaption+1), false, []string{"sendMessage"}},
+		{"provider fails", "k&1", located, "Acidente", true, []string{"sendPhoto", "sendMessage"}},
+	}
+	for _, tt := range tests {
+		calls, photoFails, staticMapKey = nil, tt.fails, tt.key
+		if err := (TelegramNotifier{}).SendAlert(tt.alert, tt.message); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		var methods []string
+		for _, c := range calls {
+			methods = append(methods, c.method)
+		}
+		if !reflect.DeepEqual(methods, tt.want) {
+			t.Errorf("%s: methods = %v, want %v", tt.name, methods, tt.want)
+		}
+	}
+
+	calls, photoFails, staticMapKey = nil, false, "k&1"
+	(TelegramNotifier{}).SendAlert(located, "Acidente")
+	payload := calls[0].payload
+	if payload["photo"] != "https://mapas.exemplo/static?center=-27.6000,-48.5000&key=k%261" || payload["caption"] != "Acidente" || payload["chat_id"] != "-100" {
+		t.Errorf("sendPhoto payload = %v", payload)
+	}
+}
+
+func TestTelegramStartRegistersChat(t *testing.T) {
+	inTempDir(t)
+	previousToken, previousChats := telegramBotToken, telegramChatIDs
+	previousDB, previousRegistered, previousNotifiers := db, telegramChats, notifiers
+	t.Cleanup(func() {
+		telegramBotToken, telegramChatIDs = previousToken, previousChats
+		db, telegramChats, notifiers = previousDB, previousRegistered, previousNotifiers
+		notificationsPaused.Store(false)
+	})
+	telegramBotToken, telegramChatIDs = "123:abc", nil
+	db = NewDatabase("db.json")
+	telegramChats = NewSet(nil)
+	notifiers = []Notifier{TelegramNotifier{}}
+
+	var sent []map[string]interface{}
+	withHTTPClient(t, roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		sent = append(sent, payload)
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"ok": true}`))}, nil
+	}))
+
+	post := func(chatID int64, text string) {
+		body := fmt.Sprintf(`{"update_id": 1, "message": {"chat": {"id": %d}, "text": %q}}`, chatID, text)
+		rec := httptest.NewRecorder()
+		handleTelegramWebhook(rec, httptest.NewRequest(http.MethodPost, "/telegram/webhook", strings.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", text, rec.Code)
+		}
+	}
+	post(-100, "/start")
+	post(42, "/start@InformaWazeBot")
+	post(7, "olá")
+
+	if len(sent) != 2 || sent[0]["chat_id"] != "-100" || sent[0]["text"] != tr("telegram.started") {
+		t.Fatalf("replies = %v", sent)
+	}
+	if got := NewDatabase("db.json").GetTelegramChats(); got.Len() != 2 || !got.Has("42") {
+		t.Errorf("persisted chats = %v", got.Slice())
+	}
+
+	// Sem chats configurados, os alertas vão para todos os registrados.
+	sent = nil
+	if err := (TelegramNotifier{}).SendText("oi"); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 2 || sent[0]["chat_id"] != "-100" || sent[1]["chat_id"] != "42" {
+		t.Errorf("sent = %v", sent)
+	}
+
+	post(42, "/stop")
+	telegramChatIDs = []string{"-300"}
+	sent = nil
+	TelegramNotifier{}.SendText("oi")
+	if len(sent) != 1 || sent[0]["chat_id"] != "-300" {
+		t.Errorf("configured chats should win: %v", sent)
+	}
+	if telegramChats.Has("42") || NewDatabase("db.json").GetTelegramChats().Has("42") {
+		t.Error("/stop did not remove the chat")
+	}
+
+	// Pausado ou em dry-run, o comando vale, mas a resposta não sai.
+	sent = nil
+	notificationsPaused.Store(true)
+	post(42, "/start")
+	notificationsPaused.Store(false)
+	notifiers = []Notifier{dryRunNotifier{}}
+	before := dryRunSent.Get()
+	post(43, "/start")
+	if len(sent) != 0 || dryRunSent.Get()-before != 1 {
+		t.Errorf("replies while paused or in dry-run = %v, dryRunSent +%d", sent, dryRunSent.Get()-before)
+	}
+	if !telegramChats.Has("42") || !telegramChats.Has("43") {
+		t.Errorf("chats = %v", telegramChats.Slice())
+	}
+}
+
+func TestAlertsSurviveRestart(t *testing.T) {
+	inTempDir(t)
+	now := time.Date(2024, 3, 11, 8, 0, 0, 0, time.Local)
+	withClock(t, newFakeClock(now))
+	previousOptions, previousAlerts, previousEventID := options, alerts, lastEventID
+	t.Cleanup(func() {
+		options = previousOptions
+		alertsLock.Lock()
+		alerts, lastEventID = previousAlerts, previousEventID
+		alertsLock.Unlock()
+	})
+	options.maxAlertAge, options.storedAlerts = 30*time.Minute, 2
+
+	published := func(uuid string, age time.Duration) map[string]interface{} {
+		return map[string]interface{}{"uuid": uuid, "type": "JAM", "pubMillis": float64(now.Add(-age).UnixMilli())}
+	}
+	alertsLock.Lock()
+	alerts = []map[string]interface{}{
+		published("velho", 2*time.Hour),
+		published("a", 20*time.Minute),
+		published("b", 10*time.Minute),
+		published("c", time.Minute),
+	}
+	lastEventID = 57
+	alertsLock.Unlock()
+
+	if err := saveAlerts("alerts.json"); err != nil {
+		t.Fatal(err)
+	}
+	if leftovers, _ := filepath.Glob("alerts.json.tmp-*"); len(leftovers) > 0 {
+		t.Errorf("temporary files left behind: %v", leftovers)
+	}
+
+	// O velho passou de maxAlertAge e, dos restantes, ficam os 2 últimos.
+	// Os ids de /events continuam de onde pararam.
+	restored, lastID := loadAlerts("alerts.json")
+	var uuids []string
+	for _, alert := range restored {
+		uuids = append(uuids, alert["uuid"].(string))
+	}
+	if !reflect.DeepEqual(uuids, []string{"b", "c"}) || lastID != 57 {
+		t.Errorf("restored = %v, last id %d", uuids, lastID)
+	}
+
+	// O formato antigo, só com a lista, numera a partir do buffer.
+	if err := os.WriteFile("antigo.json", []byte(`[{"uuid": "a"}, {"uuid": "b"}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if restored, lastID := loadAlerts("antigo.json"); len(restored) != 2 || lastID != 2 {
+		t.Errorf("old format: %v, last id %d", restored, lastID)
+	}
+
+	if restored, lastID := loadAlerts("nao-existe.json"); restored != nil || lastID != 0 {
+		t.Errorf("missing file = %v, last id %d", restored, lastID)
+	}
+}
+
+func TestAnomalyDetector(t *testing.T) {
+	start := time.Date(2024, 3, 11, 0, 0, 0, 0, time.Local)
+	fake := newFakeClock(start)
+	withClock(t, fake)
+
+	stats := NewStatsCounter(statsRetention)
+	detector := NewAnomalyDetector(stats, time.Hour, 24*time.Hour, 3, 3)
+
+	// Um acidente por hora durante o baseline: o esperado é ~1 por hora.
+	for hour := 0; hour < 23; hour++ {
+		stats.Record("ACCIDENT", start.Add(time.Duration(hour)*time.Hour+30*time.Minute))
+	}
+	if _, _, ok := detector.Check("ACCIDENT", start.Add(23*time.Hour)); ok {
+		t.Error("fired before the baseline was covered")
+	}
+
+	now := start.Add(24*time.Hour + 10*time.Minute)
+	fake.Advance(now.Sub(start))
+	for i := 0; i < 3; i++ {
+		stats.Record("ACCIDENT", now)
+	}
+	if count, _, ok := detector.Check("ACCIDENT", now); ok {
+		t.Errorf("fired with %d alerts, below 3x the baseline", count)
+	}
+
+	stats.Record("ACCIDENT", now)
+	count, expected, ok := detector.Check("ACCIDENT", now)
+	if !ok || count != 4 || expected < 0.9 || expected > 1.1 {
+		t.Fatalf("Check = %d, %.2f, %t", count, expected, ok)
+	}
+	if got, want := formatAnomaly("ACCIDENT", count, expected, time.Hour), "⚠️ atividade incomum: 4 acidentes na última hora (o normal seria ~1)"; got != want {
+		t.Errorf("formatAnomaly = %q, want %q", got, want)
+	}
+
+	// No máximo um aviso por janela.
+	stats.Record("ACCIDENT", now.Add(30*time.Minute))
+	if _, _, ok := detector.Check("ACCIDENT", now.Add(30*time.Minute)); ok {
+		t.Error("fired twice in the same window")
+	}
+	// Poucos alertas de um tipo sem histórico não bastam.
+	stats.Record("POLICE", now)
+	if _, _, ok := detector.Check("POLICE", now); ok {
+		t.Error("fired below anomalyMinCount")
+	}
+
+	if got := shortDuration(90 * time.Minute); got != "1h30m" {
+		t.Errorf("shortDuration = %q", got)
+	}
+}
+
+func TestStreetAllowed(t *testing.T) {
+	street := func(name string) map[string]interface{} {
+		return map[string]interface{}{"street": name}
+	}
+
+	tests := []struct {
+		name             string
+		include, exclude []string
+		alert            map[string]interface{}
+		want             bool
+	}{
+		{"no filters", nil, nil, street("SC-401"), true},
+		{"include matches", []string{"sc-401", "br-101"}, nil, street("Rod. SC-401"), true},
+		{"include misses", []string{"sc-401"}, nil, street("Av. Beira-Mar Norte"), false},
+		{"accents and case", []string{"JOAO PAULO"}, nil, street("Rua João Paulo"), true},
+		{"accented filter", []string{"joão"}, nil, street("RUA JOAO PAULO"), true},
+		// "ã" escrito como "a" + til combinante (U+0303).
+		{"decomposed accents", []string{"joão"}, nil, street("Rua João Paulo"), true},
+		{"exclude wins", []string{"avenida"}, []string{"Beira-Mar"}, street("Avenida Beira-Mar"), false},
+		{"location name", nil, []string{"trindade"}, map[string]interface{}{"location": map[string]interface{}{"name": "Trindade"}}, false},
+		{"no street passes", []string{"sc-401"}, nil, map[string]interface{}{"type": "JAM"}, true},
+		{"blank exclude ignored", nil, []string{"", "  "}, street("SC-401"), true},
+		{"blank include ignored", []string{" ", "br-101"}, nil, street("SC-401"), false},
+	}
+	for _, tt := range tests {
+		if got := streetAllowed(tt.include, tt.exclude, tt.alert); got != tt.want {
+			t.Errorf("%s: streetAllowed = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAlertSeverity(t *testing.T) {
+	previousOptions := options
+	t.Cleanup(func() { options = previousOptions })
+	options.severityScores = map[string]int{"ACCIDENT": 70, "ACCIDENT_MAJOR": 90, "JAM": 20}
+
+	tests := []struct {
+		alert map[string]interface{}
+		want  int
+	}{
+		{map[string]interface{}{"type": "ACCIDENT"}, 70},
+		{map[string]interface{}{"type": "ACCIDENT", "subtype": "ACCIDENT_MAJOR"}, 90},
+		// Subtipo fora da tabela usa o tipo; tipo fora da tabela, o padrão.
+		{map[string]interface{}{"type": "ACCIDENT", "subtype": "ACCIDENT_OTHER"}, 70},
+		{map[string]interface{}{"type": "CONSTRUCTION"}, defaultSeverity},
+		{map[string]interface{}{"type": "JAM", "level": 4.0}, 60},
+		{map[string]interface{}{"type": "JAM", "subtype": "JAM_HEAVY_TRAFFIC"}, 50},
+		{map[string]interface{}{"type": "JAM"}, 20},
+		{map[string]interface{}{"type": "ACCIDENT", "subtype": "ACCIDENT_MAJOR", "reliability": 10.0}, 90},
+		{map[string]interface{}{"type": "ACCIDENT", "subtype": "ACCIDENT_MAJOR", "reliability": 5.0}, 68},
+		{map[string]interface{}{"type": "ACCIDENT", "reliability": 0.0}, 35},
+		{map[string]interface{}{"type": "JAM", "level": 5.0, "reliability": 20.0}, 70},
+	}
+	for _, tt := range tests {
+		if got := alertSeverity(tt.alert); got != tt.want {
+			t.Errorf("alertSeverity(%v) = %d, want %d", tt.alert, got, tt.want)
+		}
+	}
+
+	options.severityScores = map[string]int{"JAM": 95}
+	if got := alertSeverity(map[string]interface{}{"type": "JAM", "level": 5.0}); got != 100 {
+		t.Errorf("severity should be capped at 100, got %d", got)
+	}
+}
+
+func TestMinSeverityGate(t *testing.T) {
+	previousOptions, previousNotifiers, previousFilters := options, notifiers, filters
+	t.Cleanup(func() { options, notifiers, filters = previousOptions, previousNotifiers, previousFilters })
+	notifier := &recordingNotifier{}
+	notifiers = []Notifier{notifier}
+	filters = &Filters{Jam: true, Accident: true}
+	options.severityScores = defaultSeverityScores
+	options.minSeverity = 50
+
+	notifyAlert(map[string]interface{}{"uuid": "leve", "type": "JAM", "subtype": "JAM_LIGHT_TRAFFIC", "street": "SC-401"})
+	notifyAlert(map[string]interface{}{"uuid": "grave", "type": "ACCIDENT", "subtype": "ACCIDENT_MAJOR", "street": "BR-101"})
+	if len(notifier.alerts) != 1 || !strings.Contains(notifier.alerts[0], "grave") {
+		t.Errorf("alerts = %q", notifier.alerts)
+	}
+}
+
+func TestDryRunCountsWouldHaveSent(t *testing.T) {
+	previousOptions, previousNotifiers, previousFilters := options, notifiers, filters
+	t.Cleanup(func() { options, notifiers, filters = previousOptions, previousNotifiers, previousFilters })
+	withHTTPClient(t, http.DefaultTransport)
+	applyConfig(&Config{DryRun: true})
+	if !options.dryRun {
+		t.Error("dryRun from config.json was not applied")
+	}
+	notifiers = []Notifier{dryRunNotifier{}}
+	filters = &Filters{Accident: true}
+	before := dryRunSent.Get()
+	// Com -log-file, o que seria enviado vai para o arquivo.
+	var logged bytes.Buffer
+	previousOutput := logOutput
+	t.Cleanup(func() { logOutput = previousOutput })
+	logOutput = &logged
+
+	notifyAlert(map[string]interface{}{"uuid": "acidente", "type": "ACCIDENT", "street": "BR-101"})
+	notifyAlert(map[string]interface{}{"uuid": "filtrado", "type": "JAM", "street": "SC-401"})
+	sendMessage("relatório")
+	if got := dryRunSent.Get() - before; got != 2 {
+		t.Errorf("dryRunSent = %d, want 2", got)
+	}
+	if !strings.Contains(logged.String(), "[DRY-RUN] alerta:") || !strings.Contains(logged.String(), "relatório\n") {
+		t.Errorf("log = %q", logged.String())
+	}
+}
+
+func TestTimezoneFormatting(t *testing.T) {
+	previousOptions := options
+	t.Cleanup(func() { options = previousOptions })
+	withHTTPClient(t, http.DefaultTransport)
+
+	// O servidor em UTC, monitorando uma região em -03:00.
+	now := time.Date(2024, 3, 11, 11, 0, 0, 0, time.UTC)
+	withClock(t, newFakeClock(now))
+	applyConfig(&Config{Timezone: "America/Sao_Paulo"})
+
+	alert := map[string]interface{}{"type": "ACCIDENT", "street": "BR-101", "pubMillis": float64(now.Add(-5 * time.Minute).UnixMilli())}
+	if message := handleAlert(alert); !strings.HasPrefix(message, "[08:00:00]") || !strings.Contains(message, "pubMillis: 11/03 07:55:00") {
+		t.Errorf("handleAlert = %q", message)
+	}
+	report := formatWazersReport(3, 0, now.Add(-time.Hour), now, now.Add(-20*time.Minute), 0, false)
+	if !strings.Contains(report, "🕐 07:00–08:00, pico às 07:40") {
+		t.Errorf("formatWazersReport = %q", report)
+	}
+
+	// Sem timezone, vale o fuso do servidor.
+	options = previousOptions
+	applyConfig(&Config{})
+	if options.timezone != time.Local {
+		t.Errorf("default timezone = %v, want Local", options.timezone)
+	}
+}
+
+func TestAlertEngagement(t *testing.T) {
+	comments := []interface{}{
+		map[string]interface{}{"text": "pista bloqueada", "reportMillis": 2.0},
+		map[string]interface{}{"text": "ainda lá", "reportMillis": 1.0},
+	}
+	tests := []struct {
+		alert map[string]interface{}
+		want  string
+	}{
+		{map[string]interface{}{}, ""},
+		{map[string]interface{}{"nThumbsUp": 12.0}, "👍 12 confirmações"},
+		{map[string]interface{}{"nThumbsUp": 1.0, "nComments": 1.0}, "👍 1 confirmação\n💬 1 comentário"},
+		{map[string]interface{}{"nComments": 2.0, "comments": comments}, "💬 \"pista bloqueada\" (2 comentários)"},
+		{map[string]interface{}{"comments": comments}, "💬 \"pista bloqueada\""},
+		{map[string]interface{}{"reportRating": 4.0}, "🏅 reportado por wazer nível 4"},
+		// Campos zerados ou com tipo inesperado são omitidos.
+		{map[string]interface{}{"nThumbsUp": 0.0, "nComments": "3", "reportRating": 0.0}, ""},
+		// Sem comentário com texto, só a contagem aparece.
+		{map[string]interface{}{"nThumbsUp": 3.0, "nComments": 2.0, "comments": []interface{}{}}, "👍 3 confirmações\n💬 2 comentários"},
+		{map[string]interface{}{"nComments": 1.0, "comments": []interface{}{map[string]interface{}{"text": "  "}}}, "💬 1 comentário"},
+		{map[string]interface{}{"comments": []interface{}{}}, ""},
+		{map[string]interface{}{"comments": nil}, ""},
+	}
+	for _, tt := range tests {
+		if got := alertEngagement(tt.alert); got != tt.want {
+			t.Errorf("alertEngagement(%v) = %q, want %q", tt.alert, got, tt.want)
+		}
+	}
+}
+
+func TestLatestComment(t *testing.T) {
+	tests := []struct {
+		name     string
+		comments interface{}
+		want     string
+	}{
+		{"missing", nil, ""},
+		{"wrong type", "pista bloqueada", ""},
+		{"empty", []interface{}{}, ""},
+		{"blank and missing text", []interface{}{
+			map[string]interface{}{"text": " ", "reportMillis": 5.0},
+			map[string]interface{}{"reportMillis": 6.0},
+			"não é um comentário",
+		}, ""},
+		{"newest wins", []interface{}{
+			map[string]interface{}{"text": "mais novo", "reportMillis": 9.0},
+			map[string]interface{}{"text": "mais antigo", "reportMillis": 3.0},
+		}, "mais novo"},
+		{"blank newest skipped", []interface{}{
+			map[string]interface{}{"text": "com texto", "reportMillis": 3.0},
+			map[string]interface{}{"text": "", "reportMillis": 9.0},
+		}, "com texto"},
+		{"no times keeps the last", []interface{}{
+			map[string]interface{}{"text": "primeiro"},
+			map[string]interface{}{"text": " último "},
+		}, "último"},
+	}
+	for _, tt := range tests {
+		alert := map[string]interface{}{}
+		if tt.comments != nil {
+			alert["comments"] = tt.comments
+		}
+		if got := latestComment(alert); got != tt.want {
+			t.Errorf("%s: latestComment = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFormatAlertData(t *testing.T) {
+	withClock(t, newFakeClock(time.Date(2024, 3, 11, 8, 0, 0, 0, time.Local)))
+	previous := options.alertFields
+	t.Cleanup(func() { options.alertFields = previous })
+
+	alert := map[string]interface{}{
+		"uuid":        "abc",
+		"type":        "ACCIDENT",
+		"subtype":     "",
+		"street":      "BR-101",
+		"pubMillis":   float64(time.Date(2024, 3, 11, 7, 55, 0, 0, time.Local).UnixMilli()),
+		"location":    map[string]interface{}{"x": -48.55, "y": -27.6},
+		"nThumbsUp":   3.0,
+		"zone":        "Centro",
+		"reliability": 7.0,
+	}
+
+	options.alertFields = defaultAlertFields
+	want := "type: ACCIDENT\nstreet: BR-101\npubMillis: 11/03 07:55:00\nlocation: -27.6000, -48.5500\nuuid: abc\n"
+	for i := 0; i < 5; i++ {
+		if got := formatAlertData(alert); got != want {
+			t.Fatalf("default fields = %q, want %q", got, want)
+		}
+	}
+
+	// "*" acrescenta o resto em ordem alfabética, sem os campos internos.
+	options.alertFields = []string{"street", "*", "uuid"}
+	if got := formatAlertData(alert); got != "street: BR-101\nlocation: -27.6000, -48.5500\nnThumbsUp: 3\npubMillis: 11/03 07:55:00\nreliability: 7\ntype: ACCIDENT\nuuid: abc\n" {
+		t.Errorf("wildcard = %q", got)
+	}
+
+	options.alertFields = []string{}
+	if got := handleAlert(alert); strings.Contains(got, "```") {
+		t.Errorf("empty field list still renders a code block: %q", got)
+	}
+}
+
+func TestJamThresholdAllowed(t *testing.T) {
+	// Atraso de 250 s em 850 m a 8,5 km/h: sem ele, o trecho seria feito a
+	// ~28 km/h, uma queda de 19 km/h.
+	converted := jamAlerts([]interface{}{map[string]interface{}{
+		"uuid": 1.0, "level": 3.0, "speedKMH": 8.5, "length": 850.0, "delay": 250.0,
+	}})[0].(map[string]interface{})
+	if drop := converted["speedDropKMH"]; drop != 19.0 {
+		t.Fatalf("speedDropKMH = %v, want 19", drop)
+	}
+
+	tests := []struct {
+		name    string
+		filters Filters
+		alert   map[string]interface{}
+		want    bool
+	}{
+		{"no thresholds", Filters{}, map[string]interface{}{"type": "JAM", "level": 1.0}, true},
+		{"level below", Filters{MinJamLevel: 4}, converted, false},
+		{"level reached", Filters{MinJamLevel: 3}, converted, true},
+		{"subtype level", Filters{MinJamLevel: 3}, map[string]interface{}{"type": "JAM", "subtype": "JAM_MODERATE_TRAFFIC"}, false},
+		{"unknown level passes", Filters{MinJamLevel: 3}, map[string]interface{}{"type": "JAM"}, true},
+		{"speed drop below", Filters{MinJamSpeedDrop: 20}, converted, false},
+		{"speed drop reached", Filters{MinJamSpeedDrop: 15}, converted, true},
+		{"other types pass", Filters{MinJamLevel: 5}, map[string]interface{}{"type": "ACCIDENT", "level": 1.0}, true},
+	}
+	for _, tt := range tests {
+		if got := jamThresholdAllowed(&tt.filters, tt.alert); got != tt.want {
+			t.Errorf("%s: jamThresholdAllowed = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+
+	// filters.json antigos, sem os campos, continuam carregando sem limite.
+	inTempDir(t)
+	os.WriteFile("filters.json", []byte(`{"jam": true}`), 0o644)
+	loaded, err := readFilters("filters.json")
+	if err != nil || loaded.MinJamLevel != 0 || loaded.MinJamSpeedDrop != 0 {
+		t.Errorf("old filters = %+v, %v", loaded, err)
+	}
+	if err := validateFilters(&Filters{MinJamLevel: 6}); err == nil {
+		t.Error("minJamLevel 6 accepted")
+	}
+}